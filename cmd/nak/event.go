@@ -13,6 +13,7 @@ import (
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip13"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nson"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/relay"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
@@ -60,6 +61,10 @@ example:
 			Name:  "nson",
 			Usage: "encode the event using NSON",
 		},
+		&cli.IntFlag{
+			Name:  "pow",
+			Usage: "NIP-13 difficulty to mine the event ID to, in leading zero bits, before signing",
+		},
 		&cli.IntFlag{
 			Name:        "kind",
 			Aliases:     []string{"k"},
@@ -210,6 +215,17 @@ example:
 				mustRehashAndResign = true
 			}
 
+			if difficulty := c.Int("pow"); difficulty > 0 {
+				if evt.PubKey, err = keys.GetPublicKey(sec); err != nil {
+					return fmt.Errorf("error getting public key: %w", err)
+				}
+				log.I.F("mining proof of work of difficulty %d...", difficulty)
+				if err = nip13.Generate(c.Context, evt, difficulty); err != nil {
+					return fmt.Errorf("error generating proof of work: %w", err)
+				}
+				mustRehashAndResign = true
+			}
+
 			if evt.Sig == "" || mustRehashAndResign {
 				if err := evt.Sign(sec); err != nil {
 					return fmt.Errorf("error signing with provided key: %w", err)
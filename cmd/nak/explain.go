@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip86"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip98"
+	"github.com/urfave/cli/v2"
+)
+
+var explain = &cli.Command{
+	Name:  "explain",
+	Usage: "shows how a relay or a local badger store would query the events for a filter",
+	Description: `reads filters from stdin, one per line, and prints the plan of the query for
+each: the index that is read, how many ranges of it, an estimate of the number
+of entries and the other indexes that were considered.
+
+with --db the plan is made by a local badger event store, otherwise it is
+requested from the relay with the "explain" management call, which has to be
+signed with the key of the relay operator.
+
+example usage:
+        nak req -k 1 -a <pubkey> --bare | nak explain --sec <nsec> wss://relay.example.com
+        echo '{"kinds":[1],"#t":["nostr"]}' | nak explain --db ./events`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "db",
+			Usage: "path of a local badger event store to explain the query for",
+		},
+		&cli.StringFlag{
+			Name:        "sec",
+			Usage:       "secret key of the relay operator to sign the management call, as hex or nsec",
+			DefaultText: "the key '1'",
+			Value:       "0000000000000000000000000000000000000000000000000000000000000001",
+		},
+		&cli.BoolFlag{
+			Name:  "prompt-sec",
+			Usage: "prompt the user to paste a hex or nsec with which to sign the management call",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the plan as JSON",
+		},
+	},
+	ArgsUsage: "[relay]",
+	Action: func(c *cli.Context) (err error) {
+		var explainFilter func(f *filter.T) (*eventstore.Plan, error)
+		if path := c.String("db"); path != "" {
+			if c.Args().Len() != 0 {
+				return errors.New("explain needs a relay or --db, not both")
+			}
+			db := &badger.BadgerBackend{Path: path, Log: log}
+			if err = db.Init(); err != nil {
+				return fmt.Errorf("unable to open %s: %w", path, err)
+			}
+			defer db.Close()
+			explainFilter = func(f *filter.T) (*eventstore.Plan, error) {
+				return db.Explain(c.Context, f)
+			}
+		} else {
+			if c.Args().Len() != 1 {
+				return errors.New("explain needs one relay")
+			}
+			var sec string
+			if sec, err = gatherSecretKeyFromArguments(c); err != nil {
+				return
+			}
+			url := managementURL(c.Args().First())
+			explainFilter = func(f *filter.T) (*eventstore.Plan, error) {
+				return explainRemote(c.Context, url, sec, f)
+			}
+		}
+		for stdinFilter := range getStdinLinesOrBlank() {
+			f := &filter.T{}
+			if stdinFilter != "" {
+				if err = json.Unmarshal([]byte(stdinFilter), f); err != nil {
+					lineProcessingError(c, "invalid filter '%s' received from stdin: %s", stdinFilter, err)
+					continue
+				}
+			}
+			var plan *eventstore.Plan
+			if plan, err = explainFilter(f); err != nil {
+				lineProcessingError(c, "failed to explain '%s': %s", f, err)
+				continue
+			}
+			if c.Bool("json") {
+				var b []byte
+				if b, err = json.Marshal(plan); err != nil {
+					return
+				}
+				fmt.Println(string(b))
+			} else {
+				fmt.Printf("%s\n%s", f, plan)
+			}
+		}
+		exitIfLineProcessingError(c)
+		return nil
+	},
+}
+
+// managementURL returns the http URL of a relay given by its websocket URL.
+func managementURL(url string) string {
+	if strings.HasPrefix(url, "ws://") {
+		return "http://" + strings.TrimPrefix(url, "ws://")
+	} else if strings.HasPrefix(url, "wss://") {
+		return "https://" + strings.TrimPrefix(url, "wss://")
+	}
+	return url
+}
+
+// explainRemote makes the explain management call for a filter, signed with
+// NIP-98 by sec.
+func explainRemote(c context.T, url, sec string, f *filter.T) (
+	plan *eventstore.Plan, err error) {
+
+	var params []byte
+	if params, err = json.Marshal(f); err != nil {
+		return
+	}
+	var body []byte
+	if body, err = json.Marshal(nip86.Request{Method: nip86.Explain,
+		Params: []json.RawMessage{params}}); err != nil {
+		return
+	}
+	pk, _ := keys.GetPublicKey(sec)
+	auth := nip98.CreateUnsignedAuthEvent(pk, url, http.MethodPost, body)
+	if err = auth.Sign(sec); err != nil {
+		return
+	}
+	var header string
+	if header, err = nip98.Header(auth); err != nil {
+		return
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(c, http.MethodPost, url,
+		bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", nip86.ContentType)
+	req.Header.Set("Authorization", header)
+	var res *http.Response
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	var b []byte
+	if b, err = io.ReadAll(res.Body); err != nil {
+		return
+	}
+	var resp struct {
+		Result *eventstore.Plan `json:"result"`
+		Error  string           `json:"error"`
+	}
+	if err = json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %s", url, b)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	if resp.Result == nil {
+		return nil, fmt.Errorf("no plan in the response from %s", url)
+	}
+	return resp.Result, nil
+}
@@ -21,6 +21,9 @@ var app = &cli.App{
 		verify,
 		getRelayInfo,
 		bunker,
+		syncCmd,
+		explain,
+		serve,
 	},
 	Flags: []cli.Flag{
 		&cli.BoolFlag{
@@ -33,7 +33,13 @@ example:
 it can also take a filter from stdin, optionally modify it with flags and send it to specific relays (or just print it).
 
 example:
-		echo '{"kinds": [1], "#t": ["test"]}' | nak req -l 5 -k 4549 --tag t=spam wss://nostr-pub.wellorder.net`,
+		echo '{"kinds": [1], "#t": ["test"]}' | nak req -l 5 -k 4549 --tag t=spam wss://nostr-pub.wellorder.net
+
+with --paginate it keeps querying the relays for older events until they have no more, so it gets more
+than the relays return for one query. the limit is then the size of each page.
+
+example:
+		nak req -k 1 -a 3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d --paginate wss://nos.lol > history.jsonl`,
 	Flags: []cli.Flag{
 		&cli.StringSliceFlag{
 			Name:     "author",
@@ -102,6 +108,10 @@ example:
 			Usage:       "keep the subscription open, printing all events as they are returned",
 			DefaultText: "false, will close on EOSE",
 		},
+		&cli.BoolFlag{
+			Name:  "paginate",
+			Usage: "keep querying for older events until the relays have no more, printing all of them",
+		},
 		&cli.BoolFlag{
 			Name:  "bare",
 			Usage: "when printing the filter, print just the filter, not enveloped in a [\"REQ\", ...] array",
@@ -123,6 +133,9 @@ example:
 	},
 	ArgsUsage: "[getRelayInfo...]",
 	Action: func(c *cli.Context) error {
+		if c.Bool("paginate") && c.Bool("stream") {
+			return fmt.Errorf("--paginate and --stream can't be used together")
+		}
 		var p *pool.Simple
 		relayUrls := c.Args().Slice()
 		if len(relayUrls) > 0 {
@@ -232,7 +245,11 @@ example:
 				f.Limit = limit
 			}
 
-			if len(relayUrls) > 0 {
+			if len(relayUrls) > 0 && c.Bool("paginate") {
+				for ie := range p.PaginateMany(c.Context, relayUrls, f) {
+					fmt.Println(ie.Event)
+				}
+			} else if len(relayUrls) > 0 {
 				fn := p.SubManyEose
 				if c.Bool("stream") {
 					fn = p.SubMany
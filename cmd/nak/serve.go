@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/cmd/replicatrd/replicatr"
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/memory"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+	"github.com/urfave/cli/v2"
+)
+
+var serve = &cli.Command{
+	Name:  "serve",
+	Usage: "starts a relay that keeps its events in memory, for testing",
+	Description: `the events are gone when the relay stops, which it does on interrupt.
+
+example usage:
+        nak serve --port 10547
+        nak event -c hello ws://localhost:10547`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "host",
+			Usage: "address to listen on",
+			Value: "localhost",
+		},
+		&cli.IntFlag{
+			Name:  "port",
+			Usage: "port to listen on",
+			Value: 10547,
+		},
+		&cli.IntFlag{
+			Name:  "max-events",
+			Usage: "most events to keep, the least recently used are evicted first, zero is no limit",
+		},
+	},
+	Action: func(c *cli.Context) (err error) {
+		db := &memory.Store{MaxEvents: c.Int("max-events")}
+		if err = db.Init(); err != nil {
+			return
+		}
+		rl := replicatr.NewRelay(log, &nip11.Info{Name: "nak serve"})
+		rl.Info.AddNIPs(1, 9, 11, 40, 45, 50)
+		rl.StoreEvent = append(rl.StoreEvent, db.SaveEvent)
+		rl.ReplaceEvent = append(rl.ReplaceEvent, db.ReplaceEvent)
+		rl.QueryEvents = append(rl.QueryEvents, db.QueryEvents)
+		rl.CountEvents = append(rl.CountEvents, db.CountEvents)
+		rl.DeleteEvent = append(rl.DeleteEvent, db.DeleteEvent)
+		rl.OnShutdown = append(rl.OnShutdown, func(c context.T) { db.Close() })
+		sc, stop := signal.NotifyContext(c.Context, os.Interrupt,
+			syscall.SIGTERM)
+		defer stop()
+		started := make(chan bool)
+		serveErr := make(chan error, 1)
+		go func() { serveErr <- rl.Start(c.String("host"), c.Int("port"), started) }()
+		select {
+		case err = <-serveErr:
+			return
+		case <-started:
+		}
+		log.I.F("relay running at ws://%s", rl.Addr)
+		select {
+		case err = <-serveErr:
+		case <-sc.Done():
+		}
+		sd, cancel := context.Timeout(context.Bg(), 5*time.Second)
+		defer cancel()
+		rl.Shutdown(sd)
+		return
+	},
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/relay"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/urfave/cli/v2"
+)
+
+// syncBatchSize is the number of events fetched or published at a time.
+const syncBatchSize = 500
+
+var syncCmd = &cli.Command{
+	Name:  "sync",
+	Usage: "reconciles a local event store with a relay using negentropy (NIP-77)",
+	Description: `finds the events that only the local badger store or only the relay has, with
+bandwidth proportional to the difference, and downloads the missing events into
+the store. with --upload the events the relay is missing are published to it.
+
+example usage:
+        nak sync --db ./events --kind 1 --since 1700000000 wss://relay.example.com`,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "db",
+			Usage:    "path of the local badger event store",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "upload",
+			Usage: "publish the events the relay doesn't have to it",
+		},
+		&cli.StringSliceFlag{
+			Name:     "author",
+			Aliases:  []string{"a"},
+			Usage:    "only sync events from these authors (pubkey as hex)",
+			Category: CategoryFilterAttributes,
+		},
+		&cli.IntSliceFlag{
+			Name:     "kind",
+			Aliases:  []string{"k"},
+			Usage:    "only sync events with these kind numbers",
+			Category: CategoryFilterAttributes,
+		},
+		&cli.IntFlag{
+			Name:     "since",
+			Aliases:  []string{"s"},
+			Usage:    "only sync events newer than this (unix timestamp)",
+			Category: CategoryFilterAttributes,
+		},
+		&cli.IntFlag{
+			Name:     "until",
+			Aliases:  []string{"u"},
+			Usage:    "only sync events older than this (unix timestamp)",
+			Category: CategoryFilterAttributes,
+		},
+	},
+	ArgsUsage: "<relay>",
+	Action: func(c *cli.Context) (err error) {
+		if c.Args().Len() != 1 {
+			return errors.New("sync needs one relay")
+		}
+		f := &filter.T{}
+		if authors := c.StringSlice("author"); len(authors) > 0 {
+			f.Authors = authors
+		}
+		if k := c.IntSlice("kind"); len(k) > 0 {
+			f.Kinds = kinds.FromIntSlice(k)
+		}
+		if since := c.Int("since"); since != 0 {
+			f.Since = timestamp.T(since).Ptr()
+		}
+		if until := c.Int("until"); until != 0 {
+			f.Until = timestamp.T(until).Ptr()
+		}
+		db := &badger.BadgerBackend{Path: c.String("db"), Log: log,
+			ReapInterval: -1}
+		if err = db.Init(); err != nil {
+			return fmt.Errorf("failed to open event store: %w", err)
+		}
+		defer db.Close()
+		items, err := db.NegentropyItems(c.Context, f, 0)
+		if err != nil {
+			return err
+		}
+		var r *relay.T
+		if r, err = relay.Connect(c.Context, c.Args().First()); err != nil {
+			return err
+		}
+		defer func() { log.Fail(r.Close()) }()
+		have, need, err := r.Reconcile(c.Context, f, items)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d local events, %d only here, %d only on %s\n",
+			len(items), len(have), len(need), r.URL())
+		var saved int
+		for start := 0; start < len(need); start += syncBatchSize {
+			ids := need[start:batchEnd(start, len(need))]
+			var evs []*event.T
+			if evs, err = r.QuerySync(c.Context,
+				&filter.T{IDs: ids, Limit: len(ids)}); err != nil {
+				return err
+			}
+			for _, ev := range evs {
+				if err = db.SaveEvent(c.Context, ev); err != nil &&
+					!errors.Is(err, eventstore.ErrDupEvent) {
+					return err
+				}
+				saved++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "downloaded %d events\n", saved)
+		if !c.Bool("upload") {
+			return nil
+		}
+		var published int
+		for start := 0; start < len(have); start += syncBatchSize {
+			ids := have[start:batchEnd(start, len(have))]
+			var ch chan *event.T
+			if ch, err = db.QueryEvents(c.Context,
+				&filter.T{IDs: ids, Limit: len(ids)}); err != nil {
+				return err
+			}
+			var evs []*event.T
+			for ev := range ch {
+				evs = append(evs, ev)
+			}
+			for _, ev := range evs {
+				if err = r.Publish(c.Context, ev); err != nil {
+					lineProcessingError(c, "failed to publish %s: %s", ev.ID,
+						err)
+					continue
+				}
+				published++
+			}
+		}
+		fmt.Fprintf(os.Stderr, "published %d events\n", published)
+		return nil
+	},
+}
+
+// batchEnd returns the end of the batch of ids that begins at start.
+func batchEnd(start, n int) int {
+	if start+syncBatchSize < n {
+		return start + syncBatchSize
+	}
+	return n
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Hubmakerlabs/replicatr/cmd/replicatrd/replicatr"
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"golang.org/x/exp/slices"
+	"mleku.online/git/slog"
+)
+
+// ConfigFileName is the name of the configuration file that is read from the
+// profile directory.
+const ConfigFileName = "config.json"
+
+// ExcessTags is the parameters for the PreventExcessTags policy.
+type ExcessTags struct {
+	Max    int     `json:"max"`
+	Ignore kinds.T `json:"ignore_kinds,omitempty"`
+	Only   kinds.T `json:"only_kinds,omitempty"`
+}
+
+// Policies selects which of the built-in event and filter policies are applied
+// to the relay, and their parameters. Zero values leave the policy disabled.
+type Policies struct {
+	PreventExcessTags            *ExcessTags `json:"prevent_excess_tags,omitempty"`
+	PreventLargeTags             int         `json:"prevent_large_tags,omitempty"`
+	RestrictToSpecifiedKinds     kinds.T     `json:"restrict_to_specified_kinds,omitempty"`
+	PreventTimestampsInThePast   int64       `json:"prevent_timestamps_in_the_past,omitempty"`
+	PreventTimestampsInTheFuture int64       `json:"prevent_timestamps_in_the_future,omitempty"`
+	NoComplexFilters             bool        `json:"no_complex_filters,omitempty"`
+	NoEmptyFilters               bool        `json:"no_empty_filters,omitempty"`
+	AntiSyncBots                 bool        `json:"anti_sync_bots,omitempty"`
+	NoSearchQueries              bool        `json:"no_search_queries,omitempty"`
+	RemoveSearchQueries          bool        `json:"remove_search_queries,omitempty"`
+	RejectKind4Snoopers          bool        `json:"reject_kind4_snoopers,omitempty"`
+	RemoveAllButKinds            kinds.T     `json:"remove_all_but_kinds,omitempty"`
+	RemoveAllButTags             []string    `json:"remove_all_but_tags,omitempty"`
+	// WriteAllowlist is the hex pubkeys that clients must authenticate as to
+	// publish events
+	WriteAllowlist []string `json:"write_allowlist,omitempty"`
+	// ReadAccess restricts which authenticated pubkeys may read some kinds
+	ReadAccess []replicatr.ReadAccess `json:"read_access,omitempty"`
+}
+
+// C is the configuration for the relay, stored as JSON in the profile
+// directory.
+type C struct {
+	Info       *nip11.Info           `json:"info"`
+	Policies   Policies              `json:"policies"`
+	RateLimits *replicatr.RateLimits `json:"rate_limits,omitempty"`
+	SendQueue  SendQueue             `json:"send_queue"`
+	Search     Search                `json:"search"`
+	// ServiceURL is the address of the relay, such as
+	// https://relay.example.com, which NIP-42 and NIP-98 auth events must be
+	// for. Without it, it is taken from the headers of requests, and the
+	// management api only accepts requests from trusted proxies.
+	ServiceURL string `json:"service_url,omitempty"`
+	// TrustedProxies is the IP addresses or CIDR networks of the reverse
+	// proxies in front of the relay, whose X-Forwarded-For headers identify
+	// clients. Other peers are identified by their own address. It is only
+	// read at startup.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// Quota limits the events stored of each pubkey, events over it are
+	// rejected. Retention is the rules for deleting stored events that a
+	// background janitor applies. Both are only read at startup.
+	Quota     badger.Quota      `json:"quota"`
+	Retention *badger.Retention `json:"retention,omitempty"`
+	// Mirror is the upstream relays whose events are added to this relay,
+	// which is only read at startup
+	Mirror []Upstream `json:"mirror,omitempty"`
+	// LogLevel is one of off, fatal, error, warn, info, debug or trace
+	LogLevel string `json:"log_level,omitempty"`
+}
+
+// Search configures the full text search index of the event store.
+type Search struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// Tags is the names of the tags whose values are searchable as well as
+	// the content of events
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Upstream is a remote relay that events are mirrored from.
+type Upstream struct {
+	URL string `json:"url"`
+	// Filters select the events that are mirrored, such as by authors, kinds
+	// or tags. With no filters every event the upstream relay sends is
+	// mirrored.
+	Filters filters.T `json:"filters,omitempty"`
+}
+
+// SendQueue is the size and high-water mark of the outbound message queue of
+// each client, zero values use the defaults.
+type SendQueue struct {
+	Size      int `json:"size,omitempty"`
+	HighWater int `json:"high_water,omitempty"`
+}
+
+// DefaultConfig returns a configuration for a relay with no restrictions.
+func DefaultConfig() *C {
+	return &C{
+		Info: &nip11.Info{
+			Software: AppName,
+			Version:  Version,
+			Limitation: &nip11.Limits{
+				MaxMessageLength: replicatr.MaxMessageSize,
+			},
+			Fees: &nip11.Fees{},
+		},
+	}
+}
+
+// loadConfig reads the configuration from the profile directory. If there is
+// no configuration file, the default configuration is written there, so the
+// operator has a template to edit.
+func loadConfig(dataDir string) (cfg *C, err error) {
+	fp := filepath.Join(dataDir, ConfigFileName)
+	var b []byte
+	if b, err = os.ReadFile(fp); errors.Is(err, os.ErrNotExist) {
+		cfg = DefaultConfig()
+		err = saveConfig(dataDir, cfg)
+		return
+	} else if err != nil {
+		return
+	}
+	cfg = DefaultConfig()
+	if err = json.Unmarshal(b, cfg); err != nil {
+		return
+	}
+	if cfg.Info == nil {
+		cfg.Info = DefaultConfig().Info
+	}
+	if cfg.Info.Limitation == nil {
+		cfg.Info.Limitation = &nip11.Limits{}
+	}
+	if cfg.Info.Limitation.MaxMessageLength == 0 {
+		cfg.Info.Limitation.MaxMessageLength = replicatr.MaxMessageSize
+	}
+	return
+}
+
+// saveConfig writes the configuration to the profile directory.
+func saveConfig(dataDir string, cfg *C) (err error) {
+	if err = os.MkdirAll(dataDir, 0700); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = json.MarshalIndent(cfg, "", "\t"); err != nil {
+		return
+	}
+	return os.WriteFile(filepath.Join(dataDir, ConfigFileName), b, 0600)
+}
+
+// setLogLevel sets the log level from its name in the configuration, an empty
+// name leaves it unchanged.
+func setLogLevel(name string) (err error) {
+	switch strings.ToLower(name) {
+	case "":
+	case "off":
+		slog.SetLogLevel(slog.Off)
+	case "fatal":
+		slog.SetLogLevel(slog.Fatal)
+	case "error":
+		slog.SetLogLevel(slog.Error)
+	case "warn":
+		slog.SetLogLevel(slog.Warn)
+	case "info":
+		slog.SetLogLevel(slog.Info)
+	case "debug":
+		slog.SetLogLevel(slog.Debug)
+	case "trace":
+		slog.SetLogLevel(slog.Trace)
+	default:
+		err = fmt.Errorf("unknown log level '%s'", name)
+	}
+	return
+}
+
+// reloadConfig reads the configuration file again and applies the settings
+// that can be changed while the relay is running: the relay information and
+// limits, the policies, the rate limits, the send queue sizes and the log
+// level.
+//
+// The relay reads these settings while serving clients, so each is replaced
+// as a whole rather than modified.
+func reloadConfig(dataDir string, cfg *C, rl *replicatr.Relay,
+	pol *activePolicies) (err error) {
+
+	var n *C
+	if n, err = loadConfig(dataDir); err != nil {
+		return
+	}
+	if err = setLogLevel(n.LogLevel); err != nil {
+		return
+	}
+	// the policies can also change the limits, so they are built before the
+	// limits are published
+	lim := *n.Info.Limitation
+	set := n.Policies.build(rl, &lim, !cfg.Search.Disabled)
+	// the relay information is shared with the relay, so the fields are
+	// copied rather than replacing it, which also keeps the supported NIPs.
+	// the configuration is saved by the management api while holding the
+	// same lock.
+	rl.Info.Lock()
+	rl.Info.Name = n.Info.Name
+	rl.Info.Description = n.Info.Description
+	rl.Info.PubKey = n.Info.PubKey
+	rl.Info.Contact = n.Info.Contact
+	rl.Info.Limitation = &lim
+	rl.Info.RelayCountries = n.Info.RelayCountries
+	rl.Info.LanguageTags = n.Info.LanguageTags
+	rl.Info.Tags = n.Info.Tags
+	rl.Info.PostingPolicy = n.Info.PostingPolicy
+	rl.Info.PaymentsURL = n.Info.PaymentsURL
+	rl.Info.Fees = n.Info.Fees
+	rl.Info.Icon = n.Info.Icon
+	cfg.Policies, cfg.RateLimits, cfg.SendQueue, cfg.LogLevel = n.Policies,
+		n.RateLimits, n.SendQueue, n.LogLevel
+	rl.Info.Unlock()
+	pol.Store(set)
+	rl.MaxMessageSize.Store(int64(lim.MaxMessageLength))
+	rl.RateLimiter.SetLimits(n.rateLimits())
+	// new queue sizes apply to clients that connect after the reload
+	n.SendQueue.apply(rl)
+	return
+}
+
+// rateLimits returns the configured rate limits, which are all disabled if
+// there are none.
+func (cfg *C) rateLimits() replicatr.RateLimits {
+	if cfg.RateLimits == nil {
+		return replicatr.RateLimits{}
+	}
+	return *cfg.RateLimits
+}
+
+// apply sets the send queue sizes of the relay, using the defaults for those
+// that are not configured.
+func (q SendQueue) apply(rl *replicatr.Relay) {
+	size, highWater := replicatr.SendQueueSize, replicatr.SendQueueHighWater
+	if q.Size > 0 {
+		size = q.Size
+	}
+	if q.HighWater > 0 {
+		highWater = q.HighWater
+	}
+	rl.SendQueueSize.Store(int64(size))
+	rl.SendQueueHighWater.Store(int64(highWater))
+}
+
+// policySet is the event and filter policies built from the configuration.
+type policySet struct {
+	rejectEvent     []replicatr.RejectEvent
+	rejectFilter    []replicatr.RejectFilter
+	overwriteFilter []replicatr.OverwriteFilter
+}
+
+// activePolicies is the policies the relay applies, which are replaced when
+// the configuration is reloaded.
+type activePolicies struct {
+	atomic.Pointer[policySet]
+}
+
+// Apply adds functions to the relay that run the active policies. Filter
+// policies are applied both to REQ and COUNT filters.
+func (a *activePolicies) Apply(rl *replicatr.Relay) {
+	rl.RejectEvent = append(rl.RejectEvent,
+		func(c context.T, ev *event.T) (rej bool, msg string) {
+			for _, fn := range a.Load().rejectEvent {
+				if rej, msg = fn(c, ev); rej {
+					return
+				}
+			}
+			return
+		})
+	rejectFilter := func(c context.T, f *filter.T) (rej bool, msg string) {
+		for _, fn := range a.Load().rejectFilter {
+			if rej, msg = fn(c, f); rej {
+				return
+			}
+		}
+		return
+	}
+	rl.RejectFilter = append(rl.RejectFilter, rejectFilter)
+	rl.RejectCountFilter = append(rl.RejectCountFilter, rejectFilter)
+	overwriteFilter := func(c context.T, f *filter.T) {
+		for _, fn := range a.Load().overwriteFilter {
+			fn(c, f)
+		}
+	}
+	rl.OverwriteFilter = append(rl.OverwriteFilter, overwriteFilter)
+	rl.OverwriteCountFilter = append(rl.OverwriteCountFilter, overwriteFilter)
+}
+
+// build creates the enabled policies. Proof of work is required if the limits
+// set a minimum difficulty, and the limits are marked as restricting writes
+// only if there is a write allowlist. NIP-13 is only advertised while proof of work is
+// required, and NIP-50 while the store is searchable and the policies let
+// clients search, as the policies can be changed by reloading the
+// configuration.
+func (p *Policies) build(rl *replicatr.Relay, lim *nip11.Limits,
+	searchable bool) (set *policySet) {
+
+	set = &policySet{}
+	if searchable && !p.NoSearchQueries && !p.RemoveSearchQueries {
+		rl.Info.AddNIPs(50)
+	} else {
+		rl.Info.RemoveNIPs(50)
+	}
+	if lim.MinPowDifficulty > 0 {
+		rl.Info.AddNIPs(13)
+		set.rejectEvent = append(set.rejectEvent,
+			replicatr.PreventInsufficientPoW(lim.MinPowDifficulty))
+	} else {
+		rl.Info.RemoveNIPs(13)
+	}
+	if p.PreventExcessTags != nil {
+		// the policy uses binary searches so the kinds must be sorted
+		slices.Sort(p.PreventExcessTags.Ignore)
+		slices.Sort(p.PreventExcessTags.Only)
+		set.rejectEvent = append(set.rejectEvent,
+			replicatr.PreventExcessTags(p.PreventExcessTags.Max,
+				p.PreventExcessTags.Ignore, p.PreventExcessTags.Only))
+	}
+	if p.PreventLargeTags > 0 {
+		set.rejectEvent = append(set.rejectEvent,
+			replicatr.PreventLargeTags(p.PreventLargeTags))
+	}
+	if len(p.RestrictToSpecifiedKinds) > 0 {
+		slices.Sort(p.RestrictToSpecifiedKinds)
+		set.rejectEvent = append(set.rejectEvent,
+			replicatr.RestrictToSpecifiedKinds(p.RestrictToSpecifiedKinds...))
+	}
+	if p.PreventTimestampsInThePast > 0 {
+		set.rejectEvent = append(set.rejectEvent,
+			replicatr.PreventTimestampsInThePast(
+				timestamp.T(p.PreventTimestampsInThePast)))
+	}
+	if p.PreventTimestampsInTheFuture > 0 {
+		set.rejectEvent = append(set.rejectEvent,
+			replicatr.PreventTimestampsInTheFuture(
+				timestamp.T(p.PreventTimestampsInTheFuture)))
+	}
+	// the limits saved by the management api include what was set here, so
+	// it is cleared as well as set
+	lim.RestrictedWrites = len(p.WriteAllowlist) > 0
+	if len(p.WriteAllowlist) > 0 {
+		set.rejectEvent = append(set.rejectEvent,
+			replicatr.RestrictWritesToPubKeys(p.WriteAllowlist...))
+	}
+	for _, ra := range p.ReadAccess {
+		set.rejectFilter = append(set.rejectFilter,
+			replicatr.RestrictReadsOfKinds(ra.Kinds, ra.PubKeys...))
+	}
+	if p.NoComplexFilters {
+		set.rejectFilter = append(set.rejectFilter, replicatr.NoComplexFilters)
+	}
+	if p.NoEmptyFilters {
+		set.rejectFilter = append(set.rejectFilter, replicatr.NoEmptyFilters)
+	}
+	if p.AntiSyncBots {
+		set.rejectFilter = append(set.rejectFilter, replicatr.AntiSyncBots)
+	}
+	if p.NoSearchQueries {
+		set.rejectFilter = append(set.rejectFilter, replicatr.NoSearchQueries)
+	}
+	if p.RejectKind4Snoopers {
+		set.rejectFilter = append(set.rejectFilter,
+			replicatr.RejectKind4Snoopers)
+	}
+	if p.RemoveSearchQueries {
+		set.overwriteFilter = append(set.overwriteFilter,
+			replicatr.RemoveSearchQueries)
+	}
+	if len(p.RemoveAllButKinds) > 0 {
+		set.overwriteFilter = append(set.overwriteFilter,
+			replicatr.RemoveAllButKinds(p.RemoveAllButKinds...))
+	}
+	if len(p.RemoveAllButTags) > 0 {
+		set.overwriteFilter = append(set.overwriteFilter,
+			replicatr.RemoveAllButTags(p.RemoveAllButTags...))
+	}
+	return
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/cmd/replicatrd/replicatr"
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip86"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip98"
+	"mleku.online/git/slog"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg, err := loadConfig(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk := keys.GeneratePrivateKey()
+	pk, _ := keys.GetPublicKey(sk)
+	cfg.Info.PubKey = pk
+	rl := replicatr.NewRelay(slog.New(os.Stderr, "test"), cfg.Info)
+	pol := &activePolicies{}
+	pol.Store(cfg.Policies.build(rl, rl.Info.Limitation, true))
+	pol.Apply(rl)
+	rl.RateLimiter = replicatr.NewRateLimiter(cfg.rateLimits())
+	ws := &replicatr.WebSocket{RemoteIP: "198.51.100.1"}
+	if ok, _ := rl.RateLimiter.AddConnection(ws); !ok {
+		t.Fatal("connection was not added")
+	}
+
+	ev := &event.T{PubKey: pk, Kind: kind.TextNote, Content: "hello"}
+	if err = ev.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	rejected := func() bool {
+		for _, rej := range rl.RejectEvent {
+			if r, _ := rej(context.Bg(), ev); r {
+				return true
+			}
+		}
+		return false
+	}
+	if rejected() {
+		t.Fatal("event rejected before the policies were configured")
+	}
+
+	// the relay information and the management api are served while the
+	// configuration is reloaded
+	rl.Management.URL = "https://relay.example.com"
+	var wg sync.WaitGroup
+	var served atomic.Int32
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept", "application/nostr+json")
+			rl.ServeHTTP(httptest.NewRecorder(), r)
+			// each request has another body, so its auth event is new
+			body := []byte(`{"method":"supportedmethods","params":[]}` +
+				strings.Repeat(" ", i))
+			auth := nip98.CreateUnsignedAuthEvent(pk,
+				rl.Management.URL+"/", "POST", body)
+			if err := auth.Sign(sk); err != nil {
+				t.Error(err)
+				return
+			}
+			h, _ := nip98.Header(auth)
+			r = httptest.NewRequest("POST", "/", bytes.NewReader(body))
+			r.Header.Set("Content-Type", nip86.ContentType)
+			r.Header.Set("Authorization", h)
+			w := httptest.NewRecorder()
+			rl.ServeHTTP(w, r)
+			if w.Code != 200 {
+				t.Errorf("management request failed: %d %s", w.Code, w.Body)
+				return
+			}
+			served.Add(1)
+		}
+	}()
+	// requests are served before and after the reload
+	waitServed := func(n int32) {
+		for served.Load() < n && !t.Failed() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitServed(1)
+
+	n := DefaultConfig()
+	n.Info.PubKey = pk
+	n.Info.Limitation.MinPowDifficulty = 30
+	n.Info.Limitation.MaxMessageLength = 1000
+	n.Policies.WriteAllowlist = []string{pk}
+	n.RateLimits = &replicatr.RateLimits{MaxConnectionsPerIP: 1}
+	n.SendQueue.Size = 10
+	if err = saveConfig(dataDir, n); err != nil {
+		t.Fatal(err)
+	}
+	if err = reloadConfig(dataDir, cfg, rl, pol); err != nil {
+		t.Fatal(err)
+	}
+	waitServed(served.Load() + 2)
+	close(stop)
+	wg.Wait()
+
+	if !rejected() {
+		t.Error("event without proof of work was not rejected after reload")
+	}
+	if !rl.Info.HasNIP(13) {
+		t.Error("proof of work is not advertised after reload")
+	}
+	if lim := rl.Info.Limitation; lim.MinPowDifficulty != 30 ||
+		!lim.RestrictedWrites {
+		t.Errorf("advertised limits are %+v", lim)
+	}
+	if rl.MaxMessageSize.Load() != 1000 || rl.SendQueueSize.Load() != 10 ||
+		rl.SendQueueHighWater.Load() != replicatr.SendQueueHighWater {
+		t.Errorf("message size %d, send queue %d, high water %d",
+			rl.MaxMessageSize.Load(), rl.SendQueueSize.Load(),
+			rl.SendQueueHighWater.Load())
+	}
+	// the connection opened before the reload counts against the new limit
+	if ok, _ := rl.RateLimiter.AddConnection(
+		&replicatr.WebSocket{RemoteIP: "198.51.100.1"}); ok {
+		t.Error("connection limit is not enforced for open connections")
+	}
+	if cfg.RateLimits == nil || len(cfg.Policies.WriteAllowlist) != 1 {
+		t.Error("reloaded settings are not kept in the configuration")
+	}
+}
+
+// servedInfo returns the relay information document that the relay serves.
+func servedInfo(t *testing.T, rl *replicatr.Relay) (doc *servedDoc) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/nostr+json")
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, r)
+	doc = &servedDoc{}
+	if err := json.Unmarshal(w.Body.Bytes(), doc); err != nil {
+		t.Fatalf("%s decoding %s", err, w.Body)
+	}
+	return
+}
+
+type servedDoc struct {
+	NIPs       []int        `json:"supported_nips"`
+	Limitation nip11.Limits `json:"limitation"`
+}
+
+func servedNIPs(t *testing.T, rl *replicatr.Relay) []int {
+	t.Helper()
+	return servedInfo(t, rl).NIPs
+}
+
+func servedLimits(t *testing.T, rl *replicatr.Relay) nip11.Limits {
+	t.Helper()
+	return servedInfo(t, rl).Limitation
+}
+
+func TestAdvertiseSearch(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		searchable bool
+		p          Policies
+		want       bool
+	}{
+		{"searchable", true, Policies{}, true},
+		{"search disabled", false, Policies{}, false},
+		{"no search queries", true, Policies{NoSearchQueries: true}, false},
+		{"search queries removed", true,
+			Policies{RemoveSearchQueries: true}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rl := replicatr.NewRelay(slog.New(os.Stderr, "test"),
+				DefaultConfig().Info)
+			test.p.build(rl, rl.Info.Limitation, test.searchable)
+			nips := servedNIPs(t, rl)
+			if got := slices.Contains(nips, 50); got != test.want {
+				t.Errorf("supported nips are %v, want 50 listed %v", nips,
+					test.want)
+			}
+		})
+	}
+}
+
+func TestReloadConfigOff(t *testing.T) {
+	dataDir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.Info.Limitation.MinPowDifficulty = 20
+	cfg.Policies.WriteAllowlist = []string{keys.GeneratePrivateKey()}
+	if err := saveConfig(dataDir, cfg); err != nil {
+		t.Fatal(err)
+	}
+	rl := replicatr.NewRelay(slog.New(os.Stderr, "test"), cfg.Info)
+	pol := &activePolicies{}
+	pol.Store(cfg.Policies.build(rl, rl.Info.Limitation, true))
+	pol.Apply(rl)
+	rl.RateLimiter = replicatr.NewRateLimiter(cfg.rateLimits())
+	if nips := servedNIPs(t, rl); !slices.Contains(nips, 13) {
+		t.Fatalf("proof of work is not advertised in %v", nips)
+	}
+	// the management api saves the configuration with the limits the
+	// policies set
+	if err := saveConfig(dataDir, cfg); err != nil {
+		t.Fatal(err)
+	}
+	n, err := loadConfig(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Info.Limitation.MinPowDifficulty = 0
+	n.Policies.WriteAllowlist = nil
+	if err = saveConfig(dataDir, n); err != nil {
+		t.Fatal(err)
+	}
+	if err = reloadConfig(dataDir, cfg, rl, pol); err != nil {
+		t.Fatal(err)
+	}
+	if nips := servedNIPs(t, rl); slices.Contains(nips, 13) {
+		t.Errorf("proof of work is advertised in %v after reload", nips)
+	}
+	if lim := servedLimits(t, rl); lim.MinPowDifficulty != 0 ||
+		lim.RestrictedWrites {
+		t.Errorf("advertised limits are %+v after reload", lim)
+	}
+	ev := &event.T{PubKey: fmt.Sprintf("%064x", 1), Kind: kind.TextNote}
+	for _, rej := range rl.RejectEvent {
+		if r, msg := rej(context.Bg(), ev); r {
+			t.Errorf("event rejected after reload: %s", msg)
+		}
+	}
+}
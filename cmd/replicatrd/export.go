@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+// progressInterval is how often export and import report their progress.
+const progressInterval = 5 * time.Second
+
+// filterArgs selects the events that are exported or imported.
+type filterArgs struct {
+	Kinds   []int    `arg:"-k,--kind,separate" help:"only events of this kind, can be given more than once"`
+	Authors []string `arg:"-a,--author,separate" help:"only events by this hex pubkey, can be given more than once"`
+	Since   int64    `arg:"--since" help:"only events created at or after this unix timestamp"`
+	Until   int64    `arg:"--until" help:"only events created at or before this unix timestamp"`
+}
+
+// exportCmd writes the stored events as newline delimited JSON. Export and
+// import open the database themselves, so they are run while the relay is
+// stopped, such as to move the events to a new database.
+type exportCmd struct {
+	filterArgs
+	Output string `arg:"-o,--output" help:"file to write the events to instead of stdout"`
+	Resume bool   `arg:"--resume" help:"continue an interrupted export, appending to the output file"`
+}
+
+// importCmd stores the events from newline delimited JSON.
+type importCmd struct {
+	filterArgs
+	Input    string `arg:"positional" default:"-" help:"file to read the events from, - is stdin"`
+	NoVerify bool   `arg:"--no-verify" help:"store events without checking their ids and signatures"`
+	Resume   bool   `arg:"--resume" help:"skip the part of the input that a previous import of it got through"`
+}
+
+// filter returns the filter the arguments describe.
+func (a *filterArgs) filter() (f *filter.T, err error) {
+	f = &filter.T{}
+	for _, k := range a.Kinds {
+		if k < 0 || k > 65535 {
+			return nil, fmt.Errorf("invalid kind %d", k)
+		}
+		f.Kinds = append(f.Kinds, kind.T(k))
+	}
+	for _, pk := range a.Authors {
+		if b, err := hex.Dec(pk); err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("invalid author pubkey '%s'", pk)
+		}
+		f.Authors = append(f.Authors, pk)
+	}
+	if a.Since != 0 {
+		f.Since = timestamp.T(a.Since).Ptr()
+	}
+	if a.Until != 0 {
+		f.Until = timestamp.T(a.Until).Ptr()
+	}
+	return
+}
+
+// interruptible returns a context that is canceled by SIGINT or SIGTERM, so
+// an export or import can stop at a point it can be resumed from.
+func interruptible() (c context.T, cancel context.F) {
+	c, cancel = context.Cancel(context.Bg())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-c.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return
+}
+
+// runExport writes the events selected by the arguments to the output.
+func runExport(db *badger.BadgerBackend, a *exportCmd) (err error) {
+	var f *filter.T
+	if f, err = a.filter(); err != nil {
+		return
+	}
+	out := os.Stdout
+	var after *event.T
+	if a.Output != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if a.Resume {
+			flags = os.O_CREATE | os.O_RDWR
+		}
+		if out, err = os.OpenFile(a.Output, flags, 0600); err != nil {
+			return
+		}
+		defer out.Close()
+		if a.Resume {
+			if after, err = lastEvent(out); err != nil {
+				return fmt.Errorf("unable to resume export: %w", err)
+			}
+			if _, err = out.Seek(0, io.SeekEnd); err != nil {
+				return
+			}
+		}
+	} else if a.Resume {
+		return errors.New("resuming an export needs an output file")
+	}
+	if after != nil {
+		db.I.F("resuming export after event %s", after.ID)
+	}
+	c, cancel := interruptible()
+	defer cancel()
+	var n int
+	n, err = exportEvents(c, db, out, f, after)
+	db.I.F("exported %d events", n)
+	if errors.Is(err, context.Canceled) && a.Output != "" {
+		db.I.Ln("export interrupted, run it again with --resume to continue")
+	}
+	return
+}
+
+// exportEvents writes the events that match the filter to w, one JSON object
+// per line, starting after the event after if it isn't nil.
+func exportEvents(c context.T, db *badger.BadgerBackend, w io.Writer,
+	f *filter.T, after *event.T) (n int, err error) {
+
+	bw := bufio.NewWriter(w)
+	last := time.Now()
+	err = db.Export(c, f, after, func(ev *event.T) (err error) {
+		var b []byte
+		if b, err = json.Marshal(ev); err != nil {
+			return
+		}
+		if _, err = bw.Write(append(b, '\n')); err != nil {
+			return
+		}
+		n++
+		if time.Since(last) >= progressInterval {
+			last = time.Now()
+			db.I.F("exported %d events, up to %s", n,
+				ev.CreatedAt.Time().UTC().Format(time.RFC3339))
+			// what is written so far can be resumed from
+			return bw.Flush()
+		}
+		return
+	})
+	if ferr := bw.Flush(); err == nil {
+		err = ferr
+	}
+	return
+}
+
+// lastEvent returns the last complete line of an export file, and truncates
+// the file after it, removing what was being written when the export was
+// interrupted. It returns nil if the file has no complete lines.
+func lastEvent(file *os.File) (ev *event.T, err error) {
+	var fi os.FileInfo
+	if fi, err = file.Stat(); err != nil {
+		return
+	}
+	var end, start int64
+	if end, err = lastNewline(file, fi.Size()); err != nil {
+		return
+	}
+	// truncate after the newline, or to nothing if there is none
+	if err = file.Truncate(end + 1); err != nil {
+		return
+	}
+	if end < 0 {
+		return
+	}
+	if start, err = lastNewline(file, end); err != nil {
+		return
+	}
+	line := make([]byte, end-start-1)
+	if _, err = file.ReadAt(line, start+1); err != nil {
+		return
+	}
+	ev = &event.T{}
+	if err = json.Unmarshal(line, ev); err != nil {
+		return nil, fmt.Errorf("last line of %s is not an event: %w",
+			file.Name(), err)
+	}
+	return
+}
+
+// lastNewline returns the offset of the last newline in the file before the
+// offset before, or -1 if there is none.
+func lastNewline(file *os.File, before int64) (offset int64, err error) {
+	buf := make([]byte, 64*1024)
+	for before > 0 {
+		start := before - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:before-start]
+		if _, err = file.ReadAt(chunk, start); err != nil {
+			return
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] == '\n' {
+				return start + int64(i), nil
+			}
+		}
+		before = start
+	}
+	return -1, nil
+}
+
+// importCursor is the name of the cursor that holds how far into a file an
+// import got. The cursor holds a byte offset, not a timestamp.
+func importCursor(path string) string { return "import " + path }
+
+// runImport stores the events from the input that are selected by the
+// arguments.
+func runImport(db *badger.BadgerBackend, a *importCmd) (err error) {
+	var f *filter.T
+	if f, err = a.filter(); err != nil {
+		return
+	}
+	in := os.Stdin
+	var cursor string
+	var offset int64
+	if a.Input != "-" {
+		var path string
+		if path, err = filepath.Abs(a.Input); err != nil {
+			return
+		}
+		if in, err = os.Open(path); err != nil {
+			return
+		}
+		defer in.Close()
+		cursor = importCursor(path)
+		if a.Resume {
+			var ts timestamp.T
+			if ts, err = db.GetCursor(cursor); err != nil {
+				return
+			}
+			if offset = int64(ts); offset > 0 {
+				db.I.F("resuming import of %s at byte %d", path, offset)
+				if _, err = in.Seek(offset, io.SeekStart); err != nil {
+					return
+				}
+			}
+		}
+	} else if a.Resume {
+		return errors.New("resuming an import needs an input file")
+	}
+	c, cancel := interruptible()
+	defer cancel()
+	im := &importer{db: db, filter: f, verify: !a.NoVerify}
+	if cursor != "" {
+		im.progress = func(read int64) error {
+			return db.SetCursor(cursor, timestamp.T(offset+read))
+		}
+	}
+	err = im.run(c, in)
+	db.I.F("imported %d events, skipped %d already stored or deleted, "+
+		"%d over quota, %d not matching and %d invalid", im.stored,
+		im.skipped, im.overQuota, im.unmatched, im.invalid)
+	if errors.Is(err, context.Canceled) && cursor != "" {
+		db.I.Ln("import interrupted, run it again with --resume to continue")
+	}
+	return
+}
+
+// importer stores events read as newline delimited JSON.
+type importer struct {
+	db     *badger.BadgerBackend
+	filter *filter.T
+	verify bool
+	// progress is called with the number of bytes of complete lines read, at
+	// every progress report and when the import stops.
+	progress func(read int64) error
+
+	stored, skipped, overQuota, unmatched, invalid int
+}
+
+// run reads and stores events until the end of r or an error.
+func (im *importer) run(c context.T, r io.Reader) (err error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var read int64
+	var line int
+	last := time.Now()
+	defer func() {
+		if im.progress != nil {
+			if perr := im.progress(read); err == nil {
+				err = perr
+			}
+		}
+	}()
+	for {
+		if err = c.Err(); err != nil {
+			return
+		}
+		var b []byte
+		b, err = br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(b) == 0 {
+				return nil
+			}
+			// the last line has no newline
+			err = nil
+		} else if err != nil {
+			return
+		}
+		line++
+		if err = im.store(c, b); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		read += int64(len(b))
+		if time.Since(last) >= progressInterval {
+			last = time.Now()
+			im.db.I.F("imported %d events from %d lines", im.stored, line)
+			if im.progress != nil {
+				if err = im.progress(read); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// store stores the event on a line, counting whether it was stored, skipped,
+// over the quota of its pubkey, didn't match the filter or was invalid. Only
+// storage errors are returned.
+func (im *importer) store(c context.T, b []byte) (err error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return
+	}
+	ev := &event.T{}
+	if err = json.Unmarshal(b, ev); err != nil {
+		im.db.W.F("invalid event: %s", err)
+		im.invalid++
+		return nil
+	}
+	if im.verify {
+		var ok bool
+		if ev.GetID() != ev.ID {
+			im.db.W.F("event %s has an invalid id", ev.ID)
+			im.invalid++
+			return nil
+		} else if ok, err = ev.CheckSignature(); err != nil || !ok {
+			im.db.W.F("event %s has an invalid signature", ev.ID)
+			im.invalid++
+			return nil
+		}
+	}
+	if !im.filter.Matches(ev) {
+		im.unmatched++
+		return
+	}
+	if ev.Kind.IsReplaceable() || ev.Kind.IsParameterizedReplaceable() {
+		err = im.db.ReplaceEvent(c, ev)
+	} else {
+		err = im.db.SaveEvent(c, ev)
+	}
+	switch {
+	case errors.Is(err, eventstore.ErrDupEvent),
+		errors.Is(err, eventstore.ErrOutdatedEvent),
+		errors.Is(err, eventstore.ErrEventDeleted):
+		im.skipped++
+		return nil
+	case errors.Is(err, eventstore.ErrQuotaExceeded):
+		im.overQuota++
+		return nil
+	case err != nil:
+		return
+	}
+	im.stored++
+	return
+}
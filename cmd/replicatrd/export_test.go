@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"mleku.online/git/slog"
+)
+
+func testBackend(t *testing.T) (b *badger.BadgerBackend) {
+	b = &badger.BadgerBackend{Path: t.TempDir(),
+		Log: slog.New(os.Stderr, "test")}
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	return
+}
+
+func storedIDs(t *testing.T, b *badger.BadgerBackend) (ids []string) {
+	if err := b.Export(context.Bg(), &filter.T{}, nil,
+		func(ev *event.T) error {
+			ids = append(ids, ev.ID.String())
+			return nil
+		}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestExportImport(t *testing.T) {
+	c := context.Bg()
+	src, dst := testBackend(t), testBackend(t)
+	sk := keys.GeneratePrivateKey()
+	pk, _ := keys.GetPublicKey(sk)
+	for i := 0; i < 50; i++ {
+		ev := &event.T{
+			PubKey:    pk,
+			CreatedAt: timestamp.T(1700000000 + i),
+			Kind:      1,
+			Content:   fmt.Sprint(i),
+		}
+		if i%10 == 0 {
+			// versions of a profile, only the last one is stored
+			ev.Kind = 0
+		}
+		if err := ev.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		store := src.SaveEvent
+		if ev.Kind == 0 {
+			store = src.ReplaceEvent
+		}
+		if err := store(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	n, err := exportEvents(c, src, &out, &filter.T{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 46 {
+		t.Fatalf("exported %d events, want 46", n)
+	}
+	lines := strings.SplitAfter(out.String(), "\n")
+	// an event with a changed content and a line that isn't an event
+	tampered := strings.Replace(lines[0], `"content":"1"`,
+		`"content":"one"`, 1)
+	in := tampered + "not json\n\n" + out.String()
+	im := &importer{db: dst, filter: &filter.T{}, verify: true}
+	var read int64
+	im.progress = func(r int64) error { read = r; return nil }
+	if err = im.run(c, strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	if im.stored != 46 || im.invalid != 2 || im.skipped != 0 {
+		t.Fatalf("stored %d, skipped %d and %d invalid", im.stored,
+			im.skipped, im.invalid)
+	}
+	if read != int64(len(in)) {
+		t.Fatalf("progress is %d bytes, want %d", read, len(in))
+	}
+	if fmt.Sprint(storedIDs(t, dst)) != fmt.Sprint(storedIDs(t, src)) {
+		t.Fatal("imported events differ from the exported ones")
+	}
+	// importing again skips everything
+	im = &importer{db: dst, filter: &filter.T{Kinds: []kind.T{0}},
+		verify: true}
+	if err = im.run(c, strings.NewReader(out.String())); err != nil {
+		t.Fatal(err)
+	}
+	if im.stored != 0 || im.skipped != 1 || im.unmatched != 45 {
+		t.Fatalf("stored %d, skipped %d and %d not matching", im.stored,
+			im.skipped, im.unmatched)
+	}
+}
+
+func TestResumeExport(t *testing.T) {
+	c := context.Bg()
+	db := testBackend(t)
+	for i := 0; i < 5; i++ {
+		ev := &event.T{PubKey: fmt.Sprintf("%064x", i), Kind: 1,
+			CreatedAt: timestamp.T(1700000000 + i)}
+		ev.ID = ev.GetID()
+		if err := db.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	if _, err := exportEvents(c, db, &out, &filter.T{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(out.String(), "\n")
+	path := filepath.Join(t.TempDir(), "export.jsonl")
+	// interrupted while writing the fourth event
+	partial := strings.Join(lines[:3], "") + lines[3][:10]
+	if err := os.WriteFile(path, []byte(partial), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := runExport(db, &exportCmd{Output: path, Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != out.String() {
+		t.Fatalf("resumed export is\n%s\nwant\n%s", b, out.String())
+	}
+}
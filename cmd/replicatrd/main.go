@@ -3,18 +3,24 @@ package main
 import (
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/Hubmakerlabs/replicatr/cmd/replicatrd/replicatr"
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
-	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
 	"github.com/alexflint/go-arg"
 	"mleku.online/git/slog"
 )
 
 var args struct {
-	Listen  string `arg:"-l,--listen" default:"0.0.0.0:3334"`
-	Profile string `arg:"-p,--profile" default:"replicatr"`
+	Listen          string        `arg:"-l,--listen" default:"0.0.0.0:3334"`
+	Profile         string        `arg:"-p,--profile" default:"replicatr"`
+	ShutdownTimeout time.Duration `arg:"--shutdown-timeout" default:"30s" help:"how long to wait for clients and writes to finish when shutting down"`
+	Export          *exportCmd    `arg:"subcommand:export" help:"write the stored events as newline delimited JSON, offline: stop the relay first"`
+	Import          *importCmd    `arg:"subcommand:import" help:"store events from newline delimited JSON, offline: stop the relay first"`
 }
 
 var (
@@ -32,34 +38,129 @@ func main() {
 	}
 	dataDir := filepath.Join(dataDirBase, args.Profile)
 	log.D.F("using profile directory: '%s", args.Profile)
-	rl := replicatr.NewRelay(log, &nip11.Info{
-		Name:        "",
-		Description: "",
-		PubKey:      "",
-		Contact:     "",
-		Software:    AppName,
-		Version:     Version,
-		Limitation: &nip11.Limits{
-			MaxMessageLength: replicatr.MaxMessageSize,
-		},
-		RelayCountries: nil,
-		LanguageTags:   nil,
-		Tags:           nil,
-		PostingPolicy:  "",
-		PaymentsURL:    "",
-		Fees:           &nip11.Fees{},
-		Icon:           "",
-	})
-	rl.Info.AddNIPs(1, 23, 9, 11, 15, 42, 45)
-	db := &badger.BadgerBackend{Path: dataDir, Log: log}
+	var cfg *C
+	if cfg, err = loadConfig(dataDir); log.E.Chk(err) {
+		log.E.F("unable to load configuration: '%s'", err)
+		os.Exit(1)
+	}
+	if err = setLogLevel(cfg.LogLevel); log.E.Chk(err) {
+		os.Exit(1)
+	}
+	rl := replicatr.NewRelay(log, cfg.Info)
+	rl.ServiceURL = cfg.ServiceURL
+	rl.SearchTags = cfg.Search.Tags
+	rl.Info.AddNIPs(1, 23, 9, 11, 15, 40, 42, 45, 77)
+	if rl.TrustedProxies, err = replicatr.ParseTrustedProxies(
+		cfg.TrustedProxies); log.E.Chk(err) {
+		os.Exit(1)
+	}
+	cfg.SendQueue.apply(rl)
+	db := &badger.BadgerBackend{
+		Path:           dataDir,
+		Log:            log,
+		SearchDisabled: cfg.Search.Disabled,
+		SearchTags:     cfg.Search.Tags,
+		Quota:          cfg.Quota,
+		Retention:      cfg.Retention,
+	}
+	offline := args.Export != nil || args.Import != nil
+	if offline {
+		// export and import copy the events as they are, expired and old
+		// events are left for the relay to delete
+		db.ReapInterval, db.Retention = -1, nil
+	}
 	if err = db.Init(); rl.E.Chk(err) {
 		rl.E.F("unable to start database: '%s'", err)
+		if offline {
+			// badger locks its directory, so only one process can open it
+			rl.E.Ln("export and import can't run while the relay is running")
+		}
 		os.Exit(1)
 	}
+	if offline {
+		if args.Export != nil {
+			err = runExport(db, args.Export)
+		} else {
+			err = runImport(db, args.Import)
+		}
+		db.Close()
+		if err != nil {
+			log.E.Ln(err)
+			os.Exit(1)
+		}
+		return
+	}
 	rl.StoreEvent = append(rl.StoreEvent, db.SaveEvent)
+	rl.ReplaceEvent = append(rl.ReplaceEvent, db.ReplaceEvent)
 	rl.QueryEvents = append(rl.QueryEvents, db.QueryEvents)
 	rl.CountEvents = append(rl.CountEvents, db.CountEvents)
 	rl.DeleteEvent = append(rl.DeleteEvent, db.DeleteEvent)
+	rl.NegentropyItems = append(rl.NegentropyItems, db.NegentropyItems)
+	mirror := newMirror(db, rl, cfg.Mirror)
+	rl.OnShutdown = append(rl.OnShutdown, func(c context.T) { db.Close() })
+	// the policies are run through activePolicies so that they can be
+	// replaced when the configuration is reloaded
+	pol := &activePolicies{}
+	pol.Store(cfg.Policies.build(rl, rl.Info.Limitation, !cfg.Search.Disabled))
+	pol.Apply(rl)
+	var mgmt *management
+	if mgmt, err = newManagement(db, rl, cfg, dataDir); rl.E.Chk(err) {
+		rl.E.F("unable to load access control lists: '%s'", err)
+		os.Exit(1)
+	}
+	mgmt.Apply()
+	if rl.Info.PubKey == "" {
+		rl.W.Ln("relay information has no pubkey, management api is disabled")
+	} else if cfg.ServiceURL == "" && len(rl.TrustedProxies) == 0 {
+		rl.W.Ln("service url is not configured, management api is disabled")
+	}
+	// the rate limiter is created even with no limits, so that they can be
+	// set by reloading the configuration
+	rl.RateLimiter = replicatr.NewRateLimiter(cfg.rateLimits())
+	mirror.Start()
+	srv := &http.Server{Addr: args.Listen, Handler: rl}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
 	rl.I.Ln("listening on", args.Listen)
-	rl.E.Chk(http.ListenAndServe(args.Listen, rl))
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case err = <-serveErr:
+			rl.E.F("server stopped: %s", err)
+			shutdown(rl, srv, mirror)
+			os.Exit(1)
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				rl.I.Ln("reloading configuration")
+				if err = reloadConfig(dataDir, cfg, rl, pol); rl.E.Chk(err) {
+					rl.E.F("unable to reload configuration: '%s'", err)
+				}
+				continue
+			}
+			rl.I.F("received %s, shutting down", sig)
+			go func() {
+				// a second signal skips the graceful shutdown
+				<-sigs
+				rl.W.Ln("exiting without finishing shutdown")
+				os.Exit(1)
+			}()
+			shutdown(rl, srv, mirror)
+			return
+		}
+	}
+}
+
+// shutdown stops the http server, the mirror and the relay, waiting at most
+// the shutdown timeout for them to finish.
+func shutdown(rl *replicatr.Relay, srv *http.Server, m *mirror) {
+	c, cancel := context.Timeout(context.Bg(), args.ShutdownTimeout)
+	defer cancel()
+	// stop accepting new connections before closing the existing ones
+	rl.E.Chk(srv.Shutdown(c))
+	// the mirror adds events and stores its cursors in the database, so it
+	// stops before the relay stops adding events and closes the database
+	m.Stop(c)
+	rl.Shutdown(c)
+	rl.I.Ln("shutdown complete")
 }
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Hubmakerlabs/replicatr/cmd/replicatrd/replicatr"
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip86"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+)
+
+// The names of the access control lists stored in the database.
+const (
+	bannedPubKeys  = "bannedpubkeys"
+	allowedPubKeys = "allowedpubkeys"
+	bannedEvents   = "bannedevents"
+	allowedKinds   = "allowedkinds"
+	blockedIPs     = "blockedips"
+)
+
+// management implements the NIP-86 relay management API. The access control
+// lists are stored in the database and kept in memory, so the policies that
+// enforce them don't need to read the database.
+type management struct {
+	db      *badger.BadgerBackend
+	rl      *replicatr.Relay
+	cfg     *C
+	dataDir string
+	// lists maps the name of each list to its entries and their reasons
+	lists map[string]map[string]string
+	sync.RWMutex
+}
+
+// newManagement loads the access control lists from the database.
+func newManagement(db *badger.BadgerBackend, rl *replicatr.Relay, cfg *C,
+	dataDir string) (m *management, err error) {
+
+	m = &management{
+		db:      db,
+		rl:      rl,
+		cfg:     cfg,
+		dataDir: dataDir,
+		lists:   make(map[string]map[string]string),
+	}
+	for _, list := range []string{bannedPubKeys, allowedPubKeys, bannedEvents,
+		allowedKinds, blockedIPs} {
+
+		m.lists[list] = make(map[string]string)
+		var entries []badger.ACLEntry
+		if entries, err = db.ListACL(list); err != nil {
+			return
+		}
+		for _, e := range entries {
+			m.lists[list][e.Entry] = e.Reason
+		}
+	}
+	return
+}
+
+// Apply adds the management API and the policies that enforce the access
+// control lists to the relay.
+func (m *management) Apply() {
+	m.rl.Info.AddNIPs(86)
+	m.rl.Management = replicatr.ManagementAPI{
+		URL: m.cfg.ServiceURL,
+		BanPubKey: func(c context.T, pubkey, reason string) (err error) {
+			if err = m.remove(allowedPubKeys, pubkey); err != nil {
+				return
+			}
+			return m.add(bannedPubKeys, pubkey, reason)
+		},
+		ListBannedPubKeys: func(c context.T) ([]nip86.PubKeyReason, error) {
+			return listOf(m, bannedPubKeys, func(k, r string) nip86.PubKeyReason {
+				return nip86.PubKeyReason{PubKey: k, Reason: r}
+			}), nil
+		},
+		AllowPubKey: func(c context.T, pubkey, reason string) (err error) {
+			if err = m.remove(bannedPubKeys, pubkey); err != nil {
+				return
+			}
+			return m.add(allowedPubKeys, pubkey, reason)
+		},
+		ListAllowedPubKeys: func(c context.T) ([]nip86.PubKeyReason, error) {
+			return listOf(m, allowedPubKeys, func(k, r string) nip86.PubKeyReason {
+				return nip86.PubKeyReason{PubKey: k, Reason: r}
+			}), nil
+		},
+		ListEventsNeedingModeration: func(c context.T) ([]nip86.IDReason,
+			error) {
+			// there is no moderation queue, events are accepted or rejected
+			// as they arrive
+			return []nip86.IDReason{}, nil
+		},
+		AllowEvent: func(c context.T, id, reason string) error {
+			return m.remove(bannedEvents, id)
+		},
+		BanEvent: func(c context.T, id, reason string) (err error) {
+			if err = m.add(bannedEvents, id, reason); err != nil {
+				return
+			}
+			return m.deleteEvent(c, id)
+		},
+		ListBannedEvents: func(c context.T) ([]nip86.IDReason, error) {
+			return listOf(m, bannedEvents, func(k, r string) nip86.IDReason {
+				return nip86.IDReason{ID: k, Reason: r}
+			}), nil
+		},
+		ChangeRelayName: func(c context.T, name string) error {
+			return m.changeInfo(func() { m.rl.Info.Name = name })
+		},
+		ChangeRelayDescription: func(c context.T, desc string) error {
+			return m.changeInfo(func() { m.rl.Info.Description = desc })
+		},
+		ChangeRelayIcon: func(c context.T, icon string) error {
+			return m.changeInfo(func() { m.rl.Info.Icon = icon })
+		},
+		AllowKind: func(c context.T, k kind.T) error {
+			return m.add(allowedKinds, strconv.Itoa(int(k)), "")
+		},
+		DisallowKind: func(c context.T, k kind.T) error {
+			return m.remove(allowedKinds, strconv.Itoa(int(k)))
+		},
+		ListAllowedKinds: func(c context.T) (k kinds.T, err error) {
+			k = kinds.T{}
+			m.RLock()
+			defer m.RUnlock()
+			for s := range m.lists[allowedKinds] {
+				var n int
+				if n, err = strconv.Atoi(s); err != nil {
+					return
+				}
+				k = append(k, kind.T(n))
+			}
+			sort.Slice(k, func(i, j int) bool { return k[i] < k[j] })
+			return
+		},
+		BlockIP: func(c context.T, ip, reason string) error {
+			return m.add(blockedIPs, ip, reason)
+		},
+		UnblockIP: func(c context.T, ip, reason string) error {
+			return m.remove(blockedIPs, ip)
+		},
+		ListBlockedIPs: func(c context.T) ([]nip86.IPReason, error) {
+			return listOf(m, blockedIPs, func(k, r string) nip86.IPReason {
+				return nip86.IPReason{IP: k, Reason: r}
+			}), nil
+		},
+		Explain: m.db.Explain,
+	}
+	m.rl.RejectConnection = append(m.rl.RejectConnection, m.rejectConnection)
+	m.rl.RejectEvent = append(m.rl.RejectEvent, m.rejectEvent)
+	m.rl.RejectFilter = append(m.rl.RejectFilter, m.rejectFilter)
+	m.rl.RejectCountFilter = append(m.rl.RejectCountFilter, m.rejectFilter)
+}
+
+// add puts an entry in a list, in the database and in memory.
+func (m *management) add(list, entry, reason string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	if err = m.db.SetACL(list, entry, reason); err != nil {
+		return
+	}
+	m.lists[list][entry] = reason
+	return
+}
+
+// remove deletes an entry from a list, in the database and in memory.
+func (m *management) remove(list, entry string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	if err = m.db.DeleteACL(list, entry); err != nil {
+		return
+	}
+	delete(m.lists[list], entry)
+	return
+}
+
+// has returns the reason an entry is in a list, and false if it is not.
+func (m *management) has(list, entry string) (reason string, ok bool) {
+	m.RLock()
+	reason, ok = m.lists[list][entry]
+	m.RUnlock()
+	return
+}
+
+// size returns the number of entries in a list.
+func (m *management) size(list string) (n int) {
+	m.RLock()
+	n = len(m.lists[list])
+	m.RUnlock()
+	return
+}
+
+// listOf returns the entries of a list converted to their API type, sorted so
+// the results are stable.
+func listOf[V any](m *management, list string, conv func(entry,
+	reason string) V) (res []V) {
+
+	m.RLock()
+	defer m.RUnlock()
+	entries := make([]string, 0, len(m.lists[list]))
+	for e := range m.lists[list] {
+		entries = append(entries, e)
+	}
+	sort.Strings(entries)
+	res = make([]V, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, conv(e, m.lists[list][e]))
+	}
+	return
+}
+
+// deleteEvent removes a banned event from the event stores.
+func (m *management) deleteEvent(c context.T, id string) (err error) {
+	for _, query := range m.rl.QueryEvents {
+		var ch chan *event.T
+		if ch, err = query(c, &filter.T{IDs: tag.T{id}}); err != nil {
+			return
+		}
+		// read all the results before deleting so the query is not left
+		// blocked if a deletion fails
+		var evs []*event.T
+		for ev := range ch {
+			evs = append(evs, ev)
+		}
+		for _, ev := range evs {
+			for _, del := range m.rl.DeleteEvent {
+				if err = del(c, ev); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// changeInfo modifies the relay information and writes it to the
+// configuration file so the change survives a restart.
+func (m *management) changeInfo(change func()) (err error) {
+	m.rl.Info.Lock()
+	defer m.rl.Info.Unlock()
+	change()
+	return saveConfig(m.dataDir, m.cfg)
+}
+
+// withReason formats the reason for a rejection, adding the reason the
+// operator gave if there is one.
+func withReason(msg, reason string) string {
+	if reason != "" {
+		return fmt.Sprintf("%s: %s", msg, reason)
+	}
+	return msg
+}
+
+// rejectConnection refuses connections from blocked IP addresses.
+func (m *management) rejectConnection(r *http.Request, ip string) (rej bool,
+	msg string) {
+
+	if reason, ok := m.has(blockedIPs, ip); ok {
+		return true, withReason("blocked: ip address is blocked", reason)
+	}
+	return
+}
+
+// rejectEvent enforces the access control lists on events.
+func (m *management) rejectEvent(c context.T, ev *event.T) (rej bool,
+	msg string) {
+
+	if ip := replicatr.GetIP(c); ip != "" {
+		if reason, ok := m.has(blockedIPs, ip); ok {
+			return true, withReason("blocked: ip address is blocked", reason)
+		}
+	}
+	if reason, ok := m.has(bannedPubKeys, ev.PubKey); ok {
+		return true, withReason("blocked: pubkey is banned", reason)
+	}
+	if _, ok := m.has(allowedPubKeys, ev.PubKey); !ok &&
+		m.size(allowedPubKeys) > 0 {
+		return true, "blocked: pubkey is not allowed to publish to this relay"
+	}
+	if reason, ok := m.has(bannedEvents, ev.ID.String()); ok {
+		return true, withReason("blocked: event is banned", reason)
+	}
+	if _, ok := m.has(allowedKinds, strconv.Itoa(int(ev.Kind))); !ok &&
+		m.size(allowedKinds) > 0 {
+		return true, fmt.Sprintf("blocked: kind %d is not allowed on this "+
+			"relay", ev.Kind)
+	}
+	return
+}
+
+// rejectFilter enforces the blocked IP address list on requests, for clients
+// that connected before their address was blocked.
+func (m *management) rejectFilter(c context.T, f *filter.T) (rej bool,
+	msg string) {
+
+	if ip := replicatr.GetIP(c); ip != "" {
+		if reason, ok := m.has(blockedIPs, ip); ok {
+			return true, withReason("blocked: ip address is blocked", reason)
+		}
+	}
+	return
+}
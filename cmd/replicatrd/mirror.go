@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/cmd/replicatrd/replicatr"
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/normalize"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/pool"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+const (
+	// mirrorMinBackoff is how long to wait before reconnecting to an
+	// upstream relay the first time, doubling after each failure up to
+	// mirrorMaxBackoff.
+	mirrorMinBackoff = time.Second
+	mirrorMaxBackoff = 5 * time.Minute
+	// mirrorStableSession is how long a connection must last for the backoff
+	// to start from the minimum again after it ends.
+	mirrorStableSession = time.Minute
+	// mirrorSaveInterval is how often the cursor of an upstream relay is
+	// stored while following new events.
+	mirrorSaveInterval = 10 * time.Second
+)
+
+// mirror subscribes to upstream relays and adds the events they send to the
+// relay, so they go through its policies like events published by clients.
+// The created_at of the newest event received from each upstream is stored in
+// the database, so after a restart only newer events are requested.
+type mirror struct {
+	db        *badger.BadgerBackend
+	rl        *replicatr.Relay
+	upstreams []Upstream
+	pool      *pool.Simple
+	cancel    context.F
+	wg        sync.WaitGroup
+}
+
+func newMirror(db *badger.BadgerBackend, rl *replicatr.Relay,
+	upstreams []Upstream) *mirror {
+
+	return &mirror{db: db, rl: rl, upstreams: upstreams}
+}
+
+// Start connects to the upstream relays in the background.
+func (m *mirror) Start() {
+	var c context.T
+	c, m.cancel = context.Cancel(context.Bg())
+	m.pool = pool.NewSimplePool(c)
+	for _, u := range m.upstreams {
+		m.wg.Add(1)
+		go func(u Upstream) {
+			defer m.wg.Done()
+			m.run(c, u)
+		}(u)
+	}
+}
+
+// Stop disconnects from the upstream relays and waits until their cursors are
+// stored, or the context is done.
+func (m *mirror) Stop(c context.T) {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-c.Done():
+		m.rl.W.Ln("mirroring did not stop before the shutdown timeout")
+	}
+}
+
+// run mirrors an upstream relay until the mirror is stopped, reconnecting
+// with an exponential backoff whenever the connection fails.
+func (m *mirror) run(c context.T, u Upstream) {
+	url := normalize.URL(u.URL)
+	fs := u.Filters
+	if len(fs) == 0 {
+		fs = filters.T{{}}
+	}
+	// the filters are part of the name so that changing them starts the
+	// mirroring again from the beginning
+	name := "mirror " + url + " " + fs.String()
+	cursor, err := m.db.GetCursor(name)
+	if m.rl.E.Chk(err) {
+		return
+	}
+	backoff := mirrorMinBackoff
+	for {
+		start := time.Now()
+		if _, err = m.pool.EnsureRelay(url); err == nil {
+			m.rl.I.F("mirroring %s since %d", url, cursor)
+			cursor = m.session(c, url, fs, name, cursor)
+			if time.Since(start) > mirrorStableSession {
+				backoff = mirrorMinBackoff
+			}
+		} else {
+			m.rl.W.F("unable to connect to upstream %s: %s", url, err)
+		}
+		if c.Err() != nil {
+			return
+		}
+		m.rl.D.F("reconnecting to upstream %s in %v", url, backoff)
+		select {
+		case <-c.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > mirrorMaxBackoff {
+			backoff = mirrorMaxBackoff
+		}
+	}
+}
+
+// session fetches the stored events since the cursor from an upstream relay
+// and then follows new events until the subscription ends or an event could
+// not be added, returning the new cursor.
+func (m *mirror) session(c context.T, url string, fs filters.T, name string,
+	cursor timestamp.T) timestamp.T {
+
+	// stored events arrive newest first, so the cursor is only advanced once
+	// all of them have been received
+	newest := cursor
+	for _, f := range fs {
+		n, ok := m.backfill(c, url, f, cursor)
+		if !ok {
+			return cursor
+		}
+		if n > newest {
+			newest = n
+		}
+	}
+	m.saveCursor(name, newest)
+	saved := newest
+	// new events arrive in about the order they were created, so from here
+	// the cursor follows them
+	live := make(filters.T, len(fs))
+	for i, f := range fs {
+		live[i] = filterSince(f, newest)
+	}
+	ticker := time.NewTicker(mirrorSaveInterval)
+	defer ticker.Stop()
+	sc, cancel := context.Cancel(c)
+	defer cancel()
+	events := m.pool.SubMany(sc, []string{url}, live, false)
+	for {
+		select {
+		case ie, more := <-events:
+			if !more {
+				m.rl.D.F("subscription to upstream %s ended", url)
+				if newest != saved {
+					m.saveCursor(name, newest)
+				}
+				return newest
+			}
+			ok, err := m.ingest(c, url, ie.Event)
+			if err != nil {
+				// the event is requested again from the next session, with
+				// the ones after it that were already added
+				if ie.Event.CreatedAt < newest {
+					newest = ie.Event.CreatedAt
+				}
+				if newest != saved {
+					m.saveCursor(name, newest)
+				}
+				return newest
+			}
+			if ok && ie.Event.CreatedAt > newest {
+				newest = ie.Event.CreatedAt
+			}
+		case <-ticker.C:
+			if newest != saved {
+				m.saveCursor(name, newest)
+				saved = newest
+			}
+		}
+	}
+}
+
+// backfill fetches the stored events that match a filter since the cursor
+// from an upstream relay. Relays limit how many events they return for each
+// request, so it pages back through them with until, newest first, until no
+// more are returned. It returns the newest created_at received, and false if
+// the connection failed before all the stored events were received or one of
+// them could not be added.
+func (m *mirror) backfill(c context.T, url string, f *filter.T,
+	cursor timestamp.T) (newest timestamp.T, ok bool) {
+
+	newest = cursor
+	page := filterSince(f, cursor)
+	// the ids of the events at the until of the page that have already been
+	// received, as the next page returns them again
+	var boundary map[string]struct{}
+	for {
+		var n int
+		oldest := timestamp.T(-1)
+		var atOldest map[string]struct{}
+		for ie := range m.pool.SubManyEose(c, []string{url},
+			filters.T{page}, true) {
+
+			ev := ie.Event
+			// events newer than the until of the page were received in a
+			// previous page, if the relay returns them again
+			if page.Until != nil && ev.CreatedAt > page.Until.T() {
+				continue
+			}
+			id := ev.ID.String()
+			if _, seen := boundary[id]; seen {
+				continue
+			}
+			n++
+			added, err := m.ingest(c, url, ev)
+			if err != nil {
+				return cursor, false
+			}
+			if added && ev.CreatedAt > newest {
+				newest = ev.CreatedAt
+			}
+			switch {
+			case oldest < 0 || ev.CreatedAt < oldest:
+				oldest, atOldest = ev.CreatedAt, map[string]struct{}{id: {}}
+			case ev.CreatedAt == oldest:
+				atOldest[id] = struct{}{}
+			}
+		}
+		if rl, found := m.pool.Relays.Load(url); c.Err() != nil || !found ||
+			!rl.IsConnected() {
+			return cursor, false
+		}
+		if n == 0 {
+			return newest, true
+		}
+		m.rl.D.F("received %d stored events from upstream %s", n, url)
+		if page.Until != nil && oldest == page.Until.T() {
+			for id := range boundary {
+				atOldest[id] = struct{}{}
+			}
+		}
+		boundary = atOldest
+		page.Until = oldest.Ptr()
+	}
+}
+
+// ingest checks the id and signature of an event received from an upstream
+// relay and adds it to the relay. It returns whether the event was added, or
+// was already stored or deleted, and is not from the future, so that the
+// cursor may advance to it. Events that are invalid or rejected by the
+// policies of the relay are skipped, but if the relay failed to add the event
+// it returns the error, so that the event is requested again later.
+func (m *mirror) ingest(c context.T, url string, ev *event.T) (ok bool,
+	err error) {
+
+	if ev.GetID() != ev.ID {
+		m.rl.D.F("event %s from upstream %s has an incorrect id", ev.ID, url)
+		return
+	}
+	if valid, sigErr := ev.CheckSignature(); sigErr != nil || !valid {
+		m.rl.D.F("event %s from upstream %s has an invalid signature",
+			ev.ID, url)
+		return
+	}
+	if err = m.rl.AddEvent(c, ev); err != nil {
+		switch {
+		case errors.Is(err, eventstore.ErrEventDeleted):
+			err = nil
+		case retryable(err):
+			m.rl.W.F("event %s from upstream %s could not be added: %s",
+				ev.ID, url, err)
+			return
+		default:
+			m.rl.D.F("event %s from upstream %s was not added: %s", ev.ID,
+				url, err)
+			return false, nil
+		}
+	}
+	return ev.CreatedAt <= timestamp.Now(), nil
+}
+
+// retryable returns whether an error from adding an event is a failure of the
+// relay, such as of its store or a rate limit, rather than a rejection of the
+// event, by the prefix of its message.
+func retryable(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "error:") ||
+		strings.HasPrefix(msg, "rate-limited:")
+}
+
+// saveCursor stores the cursor of an upstream relay.
+func (m *mirror) saveCursor(name string, cursor timestamp.T) {
+	m.rl.E.Chk(m.db.SetCursor(name, cursor))
+}
+
+// filterSince returns a copy of a filter that only matches events created at
+// or after a timestamp, if that is later than its own since.
+func filterSince(f *filter.T, t timestamp.T) *filter.T {
+	g := *f
+	if t > 0 && (g.Since == nil || g.Since.T() < t) {
+		g.Since = t.Ptr()
+	}
+	return &g
+}
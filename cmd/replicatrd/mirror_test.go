@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/cmd/replicatrd/replicatr"
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/memory"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/normalize"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/pool"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"mleku.online/git/slog"
+)
+
+// testUpstream starts a relay that returns events from memory, and returns
+// its url.
+func testUpstream(t *testing.T, evs []*event.T) string {
+	db := &memory.Store{}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	rl := replicatr.NewRelay(slog.New(os.Stderr, "upstream"), &nip11.Info{})
+	rl.QueryEvents = append(rl.QueryEvents, db.QueryEvents)
+	for _, ev := range evs {
+		if err := db.SaveEvent(context.Bg(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(rl)
+	t.Cleanup(srv.Close)
+	return normalize.URL("ws" + strings.TrimPrefix(srv.URL, "http"))
+}
+
+func TestMirrorStoreFailure(t *testing.T) {
+	sk := keys.GeneratePrivateKey()
+	pk, _ := keys.GetPublicKey(sk)
+	var evs []*event.T
+	for i := 0; i < 5; i++ {
+		ev := &event.T{PubKey: pk, CreatedAt: timestamp.T(1700000000 + i),
+			Kind: kind.TextNote, Content: fmt.Sprint(i)}
+		if err := ev.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	url := testUpstream(t, evs)
+
+	db := testBackend(t)
+	rl := replicatr.NewRelay(slog.New(os.Stderr, "test"), &nip11.Info{})
+	// the store fails to save one of the events until it is fixed
+	var failing atomic.Bool
+	failing.Store(true)
+	rl.StoreEvent = append(rl.StoreEvent,
+		func(c context.T, ev *event.T) error {
+			if failing.Load() && ev.ID == evs[2].ID {
+				return errors.New("disk full")
+			}
+			return db.SaveEvent(c, ev)
+		})
+	rl.RejectEvent = append(rl.RejectEvent,
+		func(c context.T, ev *event.T) (bool, string) {
+			return ev.Content == "spam", "no spam"
+		})
+	m := newMirror(db, rl, []Upstream{{URL: url}})
+	c, cancel := context.Cancel(context.Bg())
+	defer cancel()
+	m.pool = pool.NewSimplePool(c)
+	if _, err := m.pool.EnsureRelay(url); err != nil {
+		t.Fatal(err)
+	}
+
+	// events rejected by the policies are skipped, failures are returned
+	spam := &event.T{PubKey: pk, CreatedAt: 1700000010, Kind: kind.TextNote,
+		Content: "spam"}
+	if err := spam.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := m.ingest(c, url, spam); ok || err != nil {
+		t.Errorf("ingesting a rejected event returned %v, %v", ok, err)
+	}
+	if ok, err := m.ingest(c, url, evs[2]); ok || err == nil {
+		t.Errorf("ingesting an event the store failed to save returned "+
+			"%v, %v", ok, err)
+	}
+	if ok, err := m.ingest(c, url, evs[3]); !ok || err != nil {
+		t.Errorf("ingesting an event returned %v, %v", ok, err)
+	}
+
+	// the cursor isn't stored until all the stored events have been added
+	fs := filters.T{{}}
+	name := "mirror " + url + " " + fs.String()
+	if cursor := m.session(c, url, fs, name, 0); cursor != 0 {
+		t.Errorf("cursor advanced to %d past an event that wasn't stored",
+			cursor)
+	}
+	if cursor, err := m.db.GetCursor(name); err != nil || cursor != 0 {
+		t.Errorf("stored cursor %d, error %v", cursor, err)
+	}
+	if _, ok := m.backfill(c, url, &filter.T{}, 0); ok {
+		t.Error("backfill succeeded although an event wasn't stored")
+	}
+
+	failing.Store(false)
+	sc, stop := context.Cancel(c)
+	done := make(chan timestamp.T)
+	go func() { done <- m.session(sc, url, fs, name, 0) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cursor, err := m.db.GetCursor(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor == evs[4].CreatedAt {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cursor is %d, want %d", cursor, evs[4].CreatedAt)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	<-done
+	if ids := storedIDs(t, db); len(ids) != len(evs) {
+		t.Errorf("stored %d events, want %d", len(ids), len(evs))
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip40"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/normalize"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
 )
 
 // AddEvent sends an event through then normal add pipeline, as if it was
@@ -21,6 +24,15 @@ func (rl *Relay) AddEvent(c context.T, ev *event.T) (err error) {
 		rl.E.Ln(err)
 		return
 	}
+	if !rl.beginWrite() {
+		return errors.New("error: relay is shutting down")
+	}
+	defer rl.endWrite()
+	if nip40.IsExpired(ev, timestamp.Now()) {
+		err = errors.New("invalid: event has expired")
+		rl.D.Ln(err)
+		return
+	}
 	for _, rej := range rl.RejectEvent {
 		if reject, msg := rej(c, ev); reject {
 			if msg == "" {
@@ -34,58 +46,39 @@ func (rl *Relay) AddEvent(c context.T, ev *event.T) (err error) {
 			}
 		}
 	}
+	if ev.Kind == kind.Deletion {
+		// this always returns "blocked: " whenever it returns an error
+		if err = rl.handleDeleteRequest(c, ev); err != nil {
+			return
+		}
+	}
 	if ev.Kind.IsEphemeral() {
 		rl.D.Ln("ephemeral event")
 		// do not store ephemeral events
 	} else {
-		if ev.Kind.IsReplaceable() {
-			rl.D.Ln("replaceable event")
-			// replaceable event, delete before storing
-			for _, query := range rl.QueryEvents {
-				var ch chan *event.T
-				ch, err = query(c, &filter.T{
-					Authors: tag.T{ev.PubKey},
-					Kinds:   kinds.T{ev.Kind},
-				})
-				if rl.E.Chk(err) {
-					continue
-				}
-				if previous := <-ch; previous != nil && isOlder(previous, ev) {
-					for _, del := range rl.DeleteEvent {
-						rl.D.Chk(del(c, previous))
-					}
-				}
-			}
-		} else if ev.Kind.IsParameterizedReplaceable() {
-			rl.D.Ln("parameterized replaceable event")
-			// parameterized replaceable event, delete before storing
-			d := ev.Tags.GetFirst([]string{"d", ""})
-			if d != nil {
-				for _, query := range rl.QueryEvents {
-					var ch chan *event.T
-					if ch, err = query(c, &filter.T{
-						Authors: tag.T{ev.PubKey},
-						Kinds:   kinds.T{ev.Kind},
-						Tags:    filter.TagMap{"d": []string{d.Value()}},
-					}); rl.E.Chk(err) {
-						continue
-					}
-					if previous := <-ch; previous != nil && isOlder(previous, ev) {
-						for _, del := range rl.DeleteEvent {
-							rl.E.Chk(del(c, previous))
-						}
-					}
-				}
+		stores := rl.StoreEvent
+		if ev.Kind.IsReplaceable() || ev.Kind.IsParameterizedReplaceable() {
+			if len(rl.ReplaceEvent) > 0 {
+				rl.D.Ln("replacing event")
+				// the stores delete the older versions themselves
+				stores = rl.ReplaceEvent
+			} else if rl.deleteOlderVersions(c, ev) {
+				rl.D.Ln("a newer version of the event is stored")
+				return nil
 			}
 		}
 		// store
-		for i, store := range rl.StoreEvent {
+		for i, store := range stores {
 			rl.D.Ln("running event store function", i)
 			if saveErr := store(c, ev); rl.E.Chk(saveErr) {
 				switch {
-				case errors.Is(saveErr, eventstore.ErrDupEvent):
+				case errors.Is(saveErr, eventstore.ErrDupEvent),
+					errors.Is(saveErr, eventstore.ErrOutdatedEvent):
 					rl.D.Ln(saveErr)
 					return nil
+				case errors.Is(saveErr, eventstore.ErrEventDeleted),
+					errors.Is(saveErr, eventstore.ErrQuotaExceeded):
+					return saveErr
 				default:
 					err = fmt.Errorf(normalize.OKMessage(saveErr.Error(), "error"))
 					rl.D.Ln(err)
@@ -103,3 +96,44 @@ func (rl *Relay) AddEvent(c context.T, ev *event.T) (err error) {
 	rl.BroadcastEvent(ev)
 	return nil
 }
+
+// deleteOlderVersions deletes the stored versions of a replaceable or
+// parameterized replaceable event that it replaces, for stores that can't
+// replace events themselves, and returns whether a newer version is stored.
+// This isn't atomic, so concurrent updates may both be stored.
+func (rl *Relay) deleteOlderVersions(c context.T, ev *event.T) (outdated bool) {
+	f := &filter.T{
+		Authors: tag.T{ev.PubKey},
+		Kinds:   kinds.T{ev.Kind},
+	}
+	if ev.Kind.IsParameterizedReplaceable() {
+		d := ev.Tags.GetFirst([]string{"d", ""})
+		if d == nil {
+			return
+		}
+		f.Tags = filter.TagMap{"d": []string{d.Value()}}
+	}
+	for _, query := range rl.QueryEvents {
+		ch, err := query(c, f)
+		if rl.E.Chk(err) {
+			continue
+		}
+		var older []*event.T
+		for previous := range ch {
+			if isOlder(previous, ev) {
+				older = append(older, previous)
+			} else if previous.ID != ev.ID {
+				outdated = true
+			}
+		}
+		if outdated {
+			return
+		}
+		for _, previous := range older {
+			for _, del := range rl.DeleteEvent {
+				rl.E.Chk(del(c, previous))
+			}
+		}
+	}
+	return
+}
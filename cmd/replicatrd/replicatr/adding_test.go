@@ -0,0 +1,98 @@
+package replicatr
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+func TestAddEventReplaceConcurrent(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	rl := testRelay(t)
+	c := context.Bg()
+	pubkey := hexString(r)
+	const n = 32
+	var newest *event.T
+	versions := make([]*event.T, n)
+	for i := range versions {
+		versions[i] = &event.T{ID: eventid.T(hexString(r)), PubKey: pubkey,
+			CreatedAt: timestamp.T(1000 + r.Intn(n)),
+			Kind:      kind.ProfileMetadata}
+		if newest == nil || isOlder(newest, versions[i]) {
+			newest = versions[i]
+		}
+	}
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, v := range versions {
+		wg.Add(1)
+		go func(v *event.T) {
+			defer wg.Done()
+			<-start
+			if err := rl.AddEvent(c, v); err != nil {
+				t.Error(err)
+			}
+		}(v)
+	}
+	close(start)
+	wg.Wait()
+	ids := queryIDs(t, rl, &filter.T{Kinds: kinds.T{kind.ProfileMetadata},
+		Authors: tag.T{pubkey}})
+	if len(ids) != 1 || ids[0] != newest.ID.String() {
+		t.Fatalf("stored versions %v, want only %s", ids, newest.ID)
+	}
+}
+
+func TestAddEventOverQuota(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	rl := testRelayWith(t, &badger.BadgerBackend{
+		Quota: badger.Quota{MaxEvents: 8}})
+	c := context.Bg()
+	pubkey := hexString(r)
+	// events of the same pubkey are counted by concurrent saves
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	var stored, rejected int
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(ev *event.T) {
+			defer wg.Done()
+			<-start
+			err := rl.AddEvent(c, ev)
+			mx.Lock()
+			defer mx.Unlock()
+			switch {
+			case err == nil:
+				stored++
+			case strings.HasPrefix(err.Error(),
+				"blocked: storage quota exceeded"):
+				rejected++
+			default:
+				t.Error(err)
+			}
+		}(&event.T{ID: eventid.T(hexString(r)), PubKey: pubkey,
+			CreatedAt: timestamp.T(1000 + i), Kind: kind.TextNote})
+	}
+	close(start)
+	wg.Wait()
+	if stored != 8 || rejected != 8 {
+		t.Fatalf("stored %d and rejected %d events, want 8 of each", stored,
+			rejected)
+	}
+	ids := queryIDs(t, rl, &filter.T{Authors: tag.T{pubkey}})
+	if len(ids) != 8 {
+		t.Fatalf("%d events are stored, want 8", len(ids))
+	}
+}
@@ -8,21 +8,16 @@ import (
 
 // BroadcastEvent emits an event to all listeners whose filters' match, skipping all filters and actions
 // it also doesn't attempt to store the event or trigger any reactions or callbacks
+//
+// Only the filters found in the subscription index for the event are
+// evaluated, rather than every filter of every listener.
 func (rl *Relay) BroadcastEvent(evt *event.T) {
-	listeners.Range(func(ws *WebSocket, subs ListenerMap) bool {
-
-		rl.D.Ln("broadcasting event")
-		subs.Range(func(id string, listener *Listener) bool {
-			if !listener.filters.Match(evt) {
-				return true
-			}
-			rl.E.Chk(ws.WriteEnvelope(
-				&eventenvelope.T{
-					SubscriptionID: subscriptionid.T(id),
-					Event:          evt},
-			))
-			return true
-		})
-		return true
-	})
+	rl.D.Ln("broadcasting event")
+	for _, sub := range subscriptions.Match(evt, rl.SearchTags) {
+		rl.E.Chk(sub.ws.writeLiveEvent(
+			&eventenvelope.T{
+				SubscriptionID: subscriptionid.T(sub.id),
+				Event:          evt},
+		))
+	}
 }
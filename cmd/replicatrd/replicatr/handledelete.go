@@ -4,50 +4,99 @@ import (
 	"fmt"
 
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
 )
 
+// handleDeleteRequest deletes the events that a NIP-09 deletion event refers
+// to, by id in its e tags, and by address in its a tags, which deletes every
+// version of a replaceable event created up to the deletion. The deletion
+// event itself is stored afterwards, so that the store can refuse the deleted
+// events if they are published again.
 func (rl *Relay) handleDeleteRequest(c context.T, evt *event.T) (err error) {
-	// event deletion -- nip09
 	for _, t := range evt.Tags {
-		if len(t) >= 2 && t[0] == "e" {
-			// first we fetch the event
-			for _, query := range rl.QueryEvents {
-				var ch chan *event.T
-				if ch, err = query(c, &filter.T{IDs: tag.T{t[1]}}); rl.E.Chk(err) {
-					continue
-				}
-				target := <-ch
-				if target == nil {
-					continue
-				}
-				// got the event, now check if the user can delete it
-				acceptDeletion := target.PubKey == evt.PubKey
-				var msg string
-				if acceptDeletion == false {
-					msg = "you are not the author of this event"
+		if len(t) < 2 {
+			continue
+		}
+		switch t[0] {
+		case "e":
+			err = rl.deleteTargets(c, evt, &filter.T{IDs: tag.T{t[1]}}, nil)
+		case "a":
+			k, pkb, d := eventstore.GetAddrTagElements(t[1])
+			if pkb == nil {
+				continue
+			}
+			err = rl.deleteTargets(c, evt, &filter.T{
+				Kinds:   kinds.T{kind.T(k)},
+				Authors: tag.T{hex.Enc(pkb)},
+				Until:   evt.CreatedAt.Ptr(),
+			}, func(target *event.T) bool {
+				if !target.Kind.IsParameterizedReplaceable() {
+					return d == ""
 				}
-				// but if we have a function to overwrite this outcome, use that instead
-				for _, odo := range rl.OverwriteDeletionOutcome {
-					acceptDeletion, msg = odo(c, target, evt)
+				td := target.Tags.GetFirst([]string{"d", ""})
+				return td != nil && td.Value() == d || td == nil && d == ""
+			})
+		}
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// deleteTargets deletes the events matching a filter that the author of a
+// deletion event is allowed to delete, and that match, if it isn't nil.
+func (rl *Relay) deleteTargets(c context.T, evt *event.T, f *filter.T,
+	match func(target *event.T) bool) (err error) {
+
+	for _, query := range rl.QueryEvents {
+		var ch chan *event.T
+		if ch, err = query(c, f); rl.E.Chk(err) {
+			continue
+		}
+		var found bool
+		for target := range ch {
+			// deleting a deletion has no effect
+			if target.Kind == kind.Deletion ||
+				match != nil && !match(target) {
+				continue
+			}
+			found = true
+			// got the event, now check if the user can delete it
+			acceptDeletion := target.PubKey == evt.PubKey
+			var msg string
+			if acceptDeletion == false {
+				msg = "you are not the author of this event"
+			}
+			// but if we have a function to overwrite this outcome, use that instead
+			for _, odo := range rl.OverwriteDeletionOutcome {
+				acceptDeletion, msg = odo(c, target, evt)
+			}
+			if acceptDeletion {
+				// delete it
+				for _, del := range rl.DeleteEvent {
+					rl.E.Chk(del(c, target))
 				}
-				if acceptDeletion {
-					// delete it
-					for _, del := range rl.DeleteEvent {
-						rl.E.Chk(del(c, target))
-					}
-				} else {
-					// fail and stop here
-					err = fmt.Errorf("blocked: %s", msg)
-					rl.E.Ln(err)
-					return
+			} else {
+				// fail and stop here
+				err = fmt.Errorf("blocked: %s", msg)
+				rl.E.Ln(err)
+				// let the query finish
+				for range ch {
 				}
-				// don't try to query this same event again
-				break
+				return
 			}
 		}
+		if found {
+			// don't try to query the same events again
+			break
+		}
 	}
 	return nil
 }
@@ -0,0 +1,141 @@
+package replicatr
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/badger"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"mleku.online/git/slog"
+)
+
+// testRelay returns a relay that stores events in a badger database in a
+// temporary directory.
+func testRelay(t *testing.T) (rl *Relay) {
+	return testRelayWith(t, &badger.BadgerBackend{})
+}
+
+// testRelayWith is testRelay with the settings of a database.
+func testRelayWith(t *testing.T, db *badger.BadgerBackend) (rl *Relay) {
+	lg := slog.New(os.Stderr, "test")
+	rl = NewRelay(lg, &nip11.Info{})
+	db.Path, db.Log = t.TempDir(), lg
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	rl.StoreEvent = append(rl.StoreEvent, db.SaveEvent)
+	rl.ReplaceEvent = append(rl.ReplaceEvent, db.ReplaceEvent)
+	rl.QueryEvents = append(rl.QueryEvents, db.QueryEvents)
+	rl.DeleteEvent = append(rl.DeleteEvent, db.DeleteEvent)
+	rl.CountEvents = append(rl.CountEvents, db.CountEvents)
+	return
+}
+
+// queryIDs returns the ids of the events stored in a relay that match a
+// filter.
+func queryIDs(t *testing.T, rl *Relay, f *filter.T) (ids []string) {
+	ch, err := rl.QueryEvents[0](context.Bg(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ev := range ch {
+		ids = append(ids, ev.ID.String())
+	}
+	return
+}
+
+func TestDeleteByID(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	rl := testRelay(t)
+	c := context.Bg()
+	author, other := hexString(r), hexString(r)
+	note := &event.T{ID: eventid.T(hexString(r)), PubKey: author,
+		CreatedAt: 100, Kind: kind.TextNote}
+	if err := rl.AddEvent(c, note); err != nil {
+		t.Fatal(err)
+	}
+	// only the author can delete it
+	del := &event.T{ID: eventid.T(hexString(r)), PubKey: other, CreatedAt: 200,
+		Kind: kind.Deletion, Tags: tags.T{{"e", note.ID.String()}}}
+	if err := rl.AddEvent(c, del); err == nil {
+		t.Fatal("deletion by another pubkey was accepted")
+	}
+	del.PubKey = author
+	if err := rl.AddEvent(c, del); err != nil {
+		t.Fatal(err)
+	}
+	if ids := queryIDs(t, rl, &filter.T{IDs: tag.T{note.ID.String()}}); len(ids) != 0 {
+		t.Fatal("deleted event is still stored")
+	}
+	// the deletion is kept, and the deleted event can't be stored again
+	ids := queryIDs(t, rl, &filter.T{Kinds: kinds.T{kind.Deletion}})
+	if len(ids) != 1 || ids[0] != del.ID.String() {
+		t.Fatalf("got deletions %v, want %s", ids, del.ID)
+	}
+	if err := rl.AddEvent(c, note); !errors.Is(err, eventstore.ErrEventDeleted) {
+		t.Fatalf("got error %v storing a deleted event, want %v", err,
+			eventstore.ErrEventDeleted)
+	}
+	// deleting the deletion has no effect
+	undel := &event.T{ID: eventid.T(hexString(r)), PubKey: author,
+		CreatedAt: 300, Kind: kind.Deletion, Tags: tags.T{{"e", del.ID.String()}}}
+	if err := rl.AddEvent(c, undel); err != nil {
+		t.Fatal(err)
+	}
+	if ids := queryIDs(t, rl, &filter.T{IDs: tag.T{del.ID.String()}}); len(ids) != 1 {
+		t.Fatal("deletion was deleted")
+	}
+}
+
+func TestDeleteByAddress(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	rl := testRelay(t)
+	c := context.Bg()
+	author := hexString(r)
+	article := func(createdAt timestamp.T, d string) *event.T {
+		return &event.T{ID: eventid.T(hexString(r)), PubKey: author,
+			CreatedAt: createdAt, Kind: kind.Article, Tags: tags.T{{"d", d}}}
+	}
+	deleted, kept := article(100, "deleted"), article(100, "kept")
+	for _, ev := range []*event.T{deleted, kept} {
+		if err := rl.AddEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	del := &event.T{ID: eventid.T(hexString(r)), PubKey: author, CreatedAt: 200,
+		Kind: kind.Deletion,
+		Tags: tags.T{{"a", "30023:" + author + ":deleted"}}}
+	if err := rl.AddEvent(c, del); err != nil {
+		t.Fatal(err)
+	}
+	ids := queryIDs(t, rl, &filter.T{Kinds: kinds.T{kind.Article}})
+	if len(ids) != 1 || ids[0] != kept.ID.String() {
+		t.Fatalf("got articles %v, want %s", ids, kept.ID)
+	}
+	// versions up to the deletion can't be stored again, later ones can
+	older := article(150, "deleted")
+	if err := rl.AddEvent(c, older); !errors.Is(err, eventstore.ErrEventDeleted) {
+		t.Fatalf("got error %v storing a deleted version, want %v", err,
+			eventstore.ErrEventDeleted)
+	}
+	newer := article(250, "deleted")
+	if err := rl.AddEvent(c, newer); err != nil {
+		t.Fatal(err)
+	}
+	if ids = queryIDs(t, rl, &filter.T{IDs: tag.T{newer.ID.String()}}); len(ids) != 1 {
+		t.Fatal("version after the deletion was not stored")
+	}
+}
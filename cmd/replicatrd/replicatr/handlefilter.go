@@ -9,8 +9,10 @@ import (
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/noticeenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip40"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/normalize"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
 )
 
 type handleFilterParams struct {
@@ -34,6 +36,7 @@ func (rl *Relay) handleFilter(h handleFilterParams) (err error) {
 		rl.E.Chk(err)
 		return
 	}
+	rl.clampFilterLimit(h.f)
 	// then check if we'll reject this filter (we apply this after overwriting
 	// because we may, for example, remove some things from the incoming filters
 	// that we know we don't support, and then if the end result is an empty
@@ -56,6 +59,10 @@ func (rl *Relay) handleFilter(h handleFilterParams) (err error) {
 		}
 		go func(ch chan *event.T) {
 			for ev := range ch {
+				// expired events may not have been reaped from the store yet
+				if nip40.IsExpired(ev, timestamp.Now()) {
+					continue
+				}
 				for _, ovw := range rl.OverwriteResponseEvent {
 					ovw(h.c, ev)
 				}
@@ -11,5 +11,16 @@ func (rl *Relay) HandleNIP11(w http.ResponseWriter, r *http.Request) {
 	for _, ovw := range rl.OverwriteRelayInfo {
 		info = ovw(r.Context(), r, info)
 	}
-	rl.E.Chk(json.NewEncoder(w).Encode(info))
+	// the information can be changed by the management api and when the
+	// configuration is reloaded
+	info.Lock()
+	b, err := json.Marshal(info)
+	info.Unlock()
+	if rl.E.Chk(err) {
+		http.Error(w, "failed to encode relay information",
+			http.StatusInternalServerError)
+		return
+	}
+	_, err = w.Write(append(b, '\n'))
+	rl.D.Chk(err)
 }
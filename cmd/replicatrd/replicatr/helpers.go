@@ -11,7 +11,6 @@ import (
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/authenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
-	"github.com/sebest/xff"
 	"mleku.online/git/slog"
 )
 
@@ -32,11 +31,30 @@ func RequestAuth(c context.T) {
 	log.E.Chk(ws.WriteEnvelope(&authenvelope.Challenge{Challenge: ws.Challenge}))
 }
 
-func GetConnection(c context.T) *WebSocket { return c.Value(wsKey).(*WebSocket) }
+// GetConnection returns the WebSocket of a context, or nil if the context is
+// not from a client connection, such as for events added with AddEvent.
+func GetConnection(c context.T) (ws *WebSocket) {
+	ws, _ = c.Value(wsKey).(*WebSocket)
+	return
+}
 
-func GetAuthed(c context.T) string { return GetConnection(c).AuthedPublicKey }
+// GetAuthed returns the pubkey the client of a context has authenticated as,
+// or an empty string if it has not or there is no client connection.
+func GetAuthed(c context.T) string {
+	if ws := GetConnection(c); ws != nil {
+		return ws.AuthedPublicKey()
+	}
+	return ""
+}
 
-func GetIP(c context.T) string { return xff.GetRemoteAddr(GetConnection(c).Request) }
+// GetIP returns the IP address of the client of a context, or an empty string
+// if there is no client connection.
+func GetIP(c context.T) string {
+	if ws := GetConnection(c); ws != nil {
+		return ws.RemoteIP
+	}
+	return ""
+}
 
 func GetSubscriptionID(c context.T) string { return c.Value(subscriptionIdKey).(string) }
 
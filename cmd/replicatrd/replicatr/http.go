@@ -3,6 +3,7 @@ package replicatr
 import (
 	"net/http"
 
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip86"
 	"github.com/rs/cors"
 )
 
@@ -15,6 +16,8 @@ func (rl *Relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		rl.HandleWebsocket(w, r)
 	} else if r.Header.Get("Accept") == "application/nostr+json" {
 		cors.AllowAll().Handler(http.HandlerFunc(rl.HandleNIP11)).ServeHTTP(w, r)
+	} else if r.Header.Get("Content-Type") == nip86.ContentType {
+		rl.HandleNIP86(w, r)
 	} else {
 		rl.serveMux.ServeHTTP(w, r)
 	}
@@ -0,0 +1,101 @@
+package replicatr
+
+import (
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/reqenvelope"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+)
+
+// The limits advertised in the NIP-11 relay information document are enforced
+// by the functions in this file, so that what the relay advertises and what it
+// enforces are always the same thing. A zero value means no limit.
+
+// limits returns the limits in the relay information, which can be replaced
+// when the configuration is reloaded.
+func (rl *Relay) limits() *nip11.Limits {
+	rl.Info.Lock()
+	defer rl.Info.Unlock()
+	return rl.Info.Limitation
+}
+
+// rejectEventOverLimits checks an event against the MaxEventTags and
+// MaxContentLength limits and returns a reason for an OK envelope if it is
+// over them.
+func (rl *Relay) rejectEventOverLimits(ev *event.T) (rej bool, msg string) {
+	lim := rl.limits()
+	if lim == nil {
+		return
+	}
+	if lim.MaxEventTags > 0 && len(ev.Tags) > lim.MaxEventTags {
+		return true, fmt.Sprintf("invalid: event has %d tags, maximum is %d",
+			len(ev.Tags), lim.MaxEventTags)
+	}
+	if lim.MaxContentLength > 0 && len(ev.Content) > lim.MaxContentLength {
+		return true, fmt.Sprintf("invalid: content is %d bytes, maximum is %d",
+			len(ev.Content), lim.MaxContentLength)
+	}
+	return
+}
+
+// rejectReqOverLimits checks the subscription id and filters of a REQ or
+// COUNT against the MaxSubidLength and MaxFilters limits and returns a reason
+// for a CLOSED envelope if they are over them.
+func (rl *Relay) rejectReqOverLimits(id string,
+	f filters.T) (rej bool, msg string) {
+
+	lim := rl.limits()
+	if lim == nil {
+		return
+	}
+	if lim.MaxSubidLength > 0 && len(id) > lim.MaxSubidLength {
+		return true, fmt.Sprintf("invalid: subscription id is %d "+
+			"characters, maximum is %d", len(id), lim.MaxSubidLength)
+	}
+	if lim.MaxFilters > 0 && len(f) > lim.MaxFilters {
+		return true, fmt.Sprintf("blocked: subscription has %d filters, "+
+			"maximum is %d", len(f), lim.MaxFilters)
+	}
+	return
+}
+
+// addSubscription adds the subscription of a REQ to the listeners of a
+// WebSocket and returns a reason for a CLOSED envelope if the WebSocket
+// already has MaxSubscriptions other subscriptions open.
+func (rl *Relay) addSubscription(ws *WebSocket, env *reqenvelope.T,
+	cancel context.C) (rej bool, msg string) {
+
+	var max int
+	if lim := rl.limits(); lim != nil {
+		max = lim.MaxSubscriptions
+	}
+	if !AddListener(env.SubscriptionID.String(), ws, env.Filters, cancel,
+		max) {
+		return true, fmt.Sprintf("blocked: too many open subscriptions, "+
+			"maximum is %d", max)
+	}
+	return
+}
+
+// clampFilterLimit reduces the limit of a filter to the MaxLimit, and sets it
+// to MaxLimit if the filter has no limit.
+func (rl *Relay) clampFilterLimit(f *filter.T) {
+	lim := rl.limits()
+	if lim == nil || lim.MaxLimit <= 0 {
+		return
+	}
+	if f.Limit == 0 || f.Limit > lim.MaxLimit {
+		f.Limit = lim.MaxLimit
+	}
+}
+
+// authRequired returns true if clients must authenticate before sending
+// events or requests.
+func (rl *Relay) authRequired() bool {
+	lim := rl.limits()
+	return lim != nil && lim.AuthRequired
+}
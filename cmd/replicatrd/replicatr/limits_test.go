@@ -0,0 +1,160 @@
+package replicatr
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/reqenvelope"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+)
+
+func TestRejectEventOverLimits(t *testing.T) {
+	rl := testRelay(t)
+	ev := &event.T{Tags: tags.T{{"t", "a"}, {"t", "b"}}, Content: "hello"}
+	if rej, msg := rl.rejectEventOverLimits(ev); rej {
+		t.Fatalf("rejected without limits: %s", msg)
+	}
+	for _, tc := range []struct {
+		lim    nip11.Limits
+		prefix string
+	}{
+		{nip11.Limits{MaxEventTags: 2, MaxContentLength: 5}, ""},
+		{nip11.Limits{MaxEventTags: 1}, "invalid: event has 2 tags"},
+		{nip11.Limits{MaxContentLength: 4}, "invalid: content is 5 bytes"},
+	} {
+		lim := tc.lim
+		rl.Info.Limitation = &lim
+		rej, msg := rl.rejectEventOverLimits(ev)
+		if rej != (tc.prefix != "") || !strings.HasPrefix(msg, tc.prefix) {
+			t.Errorf("limits %+v: got %v %q, want %q", tc.lim, rej, msg,
+				tc.prefix)
+		}
+	}
+}
+
+func TestRejectReqOverLimits(t *testing.T) {
+	rl := testRelay(t)
+	f := filters.T{{}, {}, {}}
+	if rej, msg := rl.rejectReqOverLimits("sub", f); rej {
+		t.Fatalf("rejected without limits: %s", msg)
+	}
+	for _, tc := range []struct {
+		lim    nip11.Limits
+		prefix string
+	}{
+		{nip11.Limits{MaxSubidLength: 3, MaxFilters: 3}, ""},
+		{nip11.Limits{MaxSubidLength: 2}, "invalid: subscription id is 3"},
+		{nip11.Limits{MaxFilters: 2}, "blocked: subscription has 3 filters"},
+	} {
+		lim := tc.lim
+		rl.Info.Limitation = &lim
+		rej, msg := rl.rejectReqOverLimits("sub", f)
+		if rej != (tc.prefix != "") || !strings.HasPrefix(msg, tc.prefix) {
+			t.Errorf("limits %+v: got %v %q, want %q", tc.lim, rej, msg,
+				tc.prefix)
+		}
+	}
+}
+
+func TestClampFilterLimit(t *testing.T) {
+	rl := testRelay(t)
+	f := &filter.T{}
+	rl.clampFilterLimit(f)
+	if f.Limit != 0 {
+		t.Fatalf("limit is %d without a MaxLimit", f.Limit)
+	}
+	rl.Info.Limitation = &nip11.Limits{MaxLimit: 10}
+	for _, tc := range []struct{ limit, want int }{
+		{0, 10},
+		{5, 5},
+		{10, 10},
+		{11, 10},
+	} {
+		f = &filter.T{Limit: tc.limit}
+		rl.clampFilterLimit(f)
+		if f.Limit != tc.want {
+			t.Errorf("limit %d clamped to %d, want %d", tc.limit, f.Limit,
+				tc.want)
+		}
+	}
+}
+
+func TestMaxSubscriptions(t *testing.T) {
+	rl := testRelay(t)
+	const max = 5
+	rl.Info.Limitation = &nip11.Limits{MaxSubscriptions: max}
+	ws := &WebSocket{}
+	t.Cleanup(func() { RemoveListener(ws) })
+	req := func(id string) *reqenvelope.T {
+		return &reqenvelope.T{SubscriptionID: subscriptionid.T(id),
+			Filters: filters.T{{}}}
+	}
+	// REQs handled at the same time can't open more than the maximum
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	var opened []string
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			_, cancel := context.CancelCause(context.Bg())
+			if rej, _ := rl.addSubscription(ws, req(id), cancel); !rej {
+				mx.Lock()
+				opened = append(opened, id)
+				mx.Unlock()
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+	if len(opened) != max || CountListeners(ws, "") != max {
+		t.Fatalf("opened %d subscriptions, %d listeners, want %d",
+			len(opened), CountListeners(ws, ""), max)
+	}
+	_, cancel := context.CancelCause(context.Bg())
+	rej, msg := rl.addSubscription(ws, req("new"), cancel)
+	if !rej || !strings.HasPrefix(msg, "blocked: too many open") {
+		t.Fatalf("got %v %q opening a subscription over the maximum", rej,
+			msg)
+	}
+	// an open subscription can be replaced, and closing one makes room
+	if rej, msg = rl.addSubscription(ws, req(opened[0]), cancel); rej {
+		t.Fatalf("replacing a subscription: %s", msg)
+	}
+	RemoveListenerId(ws, opened[1])
+	if rej, msg = rl.addSubscription(ws, req("new"), cancel); rej {
+		t.Fatalf("opening a subscription after closing one: %s", msg)
+	}
+}
+
+func TestLimitsHandler(t *testing.T) {
+	rl := testRelay(t)
+	rl.Info.Limitation = &nip11.Limits{MaxFilters: 1, MaxSubscriptions: 1}
+	tc := dialRelay(t, rl)
+	f := map[string]any{"kinds": []int{1}}
+	tc.send("REQ", "a", f, f)
+	tc.expectClosed("blocked: subscription has 2 filters")
+	tc.send("COUNT", "c", f, f)
+	tc.expectClosed("blocked: subscription has 2 filters")
+	tc.send("REQ", "a", f)
+	tc.expect("EOSE")
+	tc.send("REQ", "b", f)
+	tc.expectClosed("blocked: too many open subscriptions")
+	// CLOSE has no reply, and messages are handled concurrently
+	tc.send("CLOSE", "a")
+	for deadline := time.Now().Add(5 * time.Second); listeners.Size() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription was not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tc.send("REQ", "b", f)
+	tc.expect("EOSE")
+}
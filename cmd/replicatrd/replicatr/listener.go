@@ -46,25 +46,73 @@ func GetListeningFilters() (respFilters filters.T) {
 }
 
 func SetListener(id string, ws *WebSocket, f filters.T, c context.C) {
-	subs, _ := listeners.LoadOrCompute(ws, func() ListenerMap {
-		return xsync.NewMapOf[*Listener]()
+	AddListener(id, ws, f, c, 0)
+	subscriptions.Set(ws, id, f)
+}
+
+// AddListener adds a subscription to the listeners of a WebSocket unless the
+// WebSocket already has max other subscriptions open, then it returns false. A
+// max of 0 is no limit. The count and the addition are done under the lock of
+// the WebSocket's entry, so subscriptions opened at the same time can't exceed
+// the limit together. Live events are only sent to the subscription once it is
+// set with SetListener.
+func AddListener(id string, ws *WebSocket, f filters.T, c context.C,
+	max int) (ok bool) {
+
+	listeners.Compute(ws, func(subs ListenerMap,
+		loaded bool) (ListenerMap, bool) {
+
+		if !loaded {
+			subs = xsync.NewMapOf[*Listener]()
+		}
+		// a subscription with an id that is already open replaces it and
+		// does not add a new one
+		n := subs.Size()
+		if _, replaced := subs.Load(id); replaced {
+			n--
+		}
+		if max > 0 && n >= max {
+			return subs, !loaded
+		}
+		subs.Store(id, &Listener{filters: f, cancel: c})
+		ok = true
+		return subs, false
 	})
-	subs.Store(id, &Listener{filters: f, cancel: c})
+	return
+}
+
+// CountListeners returns the number of subscriptions open on a WebSocket,
+// other than the one with the given id.
+func CountListeners(ws *WebSocket, except string) (n int) {
+	if subs, ok := listeners.Load(ws); ok {
+		n = subs.Size()
+		if _, ok = subs.Load(except); ok {
+			n--
+		}
+	}
+	return
 }
 
 // RemoveListenerId removes a specific subscription id from listeners for a
 // given ws client and cancel its specific context
 func RemoveListenerId(ws *WebSocket, id string) {
-	if subs, ok := listeners.Load(ws); ok {
+	subscriptions.Remove(ws, id)
+	listeners.Compute(ws, func(subs ListenerMap,
+		loaded bool) (ListenerMap, bool) {
+
+		if !loaded {
+			return subs, true
+		}
 		if listener, ok := subs.LoadAndDelete(id); ok {
 			listener.cancel(fmt.Errorf("subscription closed by client"))
 		}
-		if subs.Size() == 0 {
-			listeners.Delete(ws)
-		}
-	}
+		return subs, subs.Size() == 0
+	})
 }
 
 // RemoveListener removes WebSocket conn from listeners (no need to cancel
 // contexts as they are all inherited from the main connection context)
-func RemoveListener(ws *WebSocket) { listeners.Delete(ws) }
+func RemoveListener(ws *WebSocket) {
+	subscriptions.RemoveConnection(ws)
+	listeners.Delete(ws)
+}
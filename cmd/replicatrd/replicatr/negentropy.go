@@ -0,0 +1,127 @@
+package replicatr
+
+import (
+	"errors"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/negenvelope"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/negentropy"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/normalize"
+)
+
+// negentropyFrameSizeLimit returns the limit on the size of the negentropy
+// messages sent to clients, which keeps the hex encoded messages within the
+// size of message the relay accepts itself.
+func (rl *Relay) negentropyFrameSizeLimit() int {
+	limit := int(rl.MaxMessageSize.Load())/2 - 1024
+	if limit < negentropy.MinFrameSizeLimit {
+		return negentropy.MinFrameSizeLimit
+	}
+	return limit
+}
+
+// handleNegOpen starts a NIP-77 reconciliation of the events that match the
+// filter of a NEG-OPEN, replacing an open one with the same id.
+func (rl *Relay) handleNegOpen(c context.T, ws *WebSocket,
+	env *negenvelope.Open) {
+
+	id := env.ID.String()
+	fail := func(reason string) {
+		rl.E.Chk(ws.WriteEnvelope(&negenvelope.Err{ID: env.ID, Reason: reason}))
+	}
+	ws.negLock.Lock()
+	// a reconciliation with the same id is replaced even if the new one fails
+	delete(ws.negSessions, id)
+	open := len(ws.negSessions)
+	ws.negLock.Unlock()
+	if len(rl.NegentropyItems) == 0 {
+		fail("error: this relay does not support NIP-77")
+		return
+	}
+	if rl.authRequired() && ws.AuthedPublicKey() == "" {
+		fail("auth-required: this relay requires authentication")
+		return
+	}
+	if open >= MaxNegentropySessions {
+		fail("blocked: too many open reconciliations")
+		return
+	}
+	if ok, reason := rl.RateLimiter.AllowReq(ws, ""); !ok {
+		fail(reason)
+		return
+	}
+	f := env.Filter
+	for _, ovw := range rl.OverwriteFilter {
+		ovw(c, f)
+	}
+	for _, reject := range rl.RejectFilter {
+		if rej, msg := reject(c, f); rej {
+			fail(normalize.OKMessage(msg, "blocked"))
+			return
+		}
+	}
+	v := negentropy.NewVector()
+	for _, getItems := range rl.NegentropyItems {
+		items, err := getItems(c, f, rl.MaxNegentropyItems)
+		if errors.Is(err, negentropy.ErrTooManyItems) ||
+			(rl.MaxNegentropyItems > 0 &&
+				v.Size()+len(items) > rl.MaxNegentropyItems) {
+			fail("blocked: too many events to reconcile, use a narrower " +
+				"filter")
+			return
+		}
+		if rl.E.Chk(err) {
+			fail("error: " + err.Error())
+			return
+		}
+		for _, it := range items {
+			rl.E.Chk(v.Insert(it))
+		}
+	}
+	v.Seal()
+	n, err := negentropy.New(v, rl.negentropyFrameSizeLimit())
+	if rl.E.Chk(err) {
+		fail("error: " + err.Error())
+		return
+	}
+	var reply []byte
+	if reply, _, _, err = n.Reconcile(env.Message); err != nil {
+		fail("error: " + err.Error())
+		return
+	}
+	ws.negLock.Lock()
+	if ws.negSessions == nil {
+		ws.negSessions = make(map[string]*negentropy.T)
+	}
+	ws.negSessions[id] = n
+	ws.negLock.Unlock()
+	rl.E.Chk(ws.WriteEnvelope(&negenvelope.Msg{ID: env.ID, Message: reply}))
+}
+
+// handleNegMsg continues a reconciliation.
+func (rl *Relay) handleNegMsg(ws *WebSocket, env *negenvelope.Msg) {
+	id := env.ID.String()
+	ws.negLock.Lock()
+	defer ws.negLock.Unlock()
+	n, ok := ws.negSessions[id]
+	if !ok {
+		rl.E.Chk(ws.WriteEnvelope(&negenvelope.Err{ID: env.ID,
+			Reason: "closed: no open reconciliation with this id"}))
+		return
+	}
+	reply, _, _, err := n.Reconcile(env.Message)
+	if err != nil {
+		delete(ws.negSessions, id)
+		rl.E.Chk(ws.WriteEnvelope(&negenvelope.Err{ID: env.ID,
+			Reason: "error: " + err.Error()}))
+		return
+	}
+	rl.E.Chk(ws.WriteEnvelope(&negenvelope.Msg{ID: env.ID, Message: reply}))
+}
+
+// handleNegClose ends a reconciliation.
+func (rl *Relay) handleNegClose(ws *WebSocket, env *negenvelope.Close) {
+	ws.negLock.Lock()
+	delete(ws.negSessions, env.ID.String())
+	ws.negLock.Unlock()
+}
@@ -0,0 +1,314 @@
+package replicatr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip86"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip98"
+)
+
+// ManagementAPI is the set of functions that implement the NIP-86 relay
+// management API. Methods whose function is nil are not supported.
+type ManagementAPI struct {
+	// URL is the address of the relay, such as https://relay.example.com,
+	// that the NIP-98 auth events of management requests must be for. If it
+	// is empty the address is taken from the X-Forwarded-Host and
+	// X-Forwarded-Proto headers of requests from trusted proxies, and
+	// requests from other peers are refused.
+	URL string
+
+	RejectAPICall []func(c context.T, pubkey string,
+		req *nip86.Request) (reject bool, msg string)
+
+	BanPubKey                   func(c context.T, pubkey, reason string) error
+	ListBannedPubKeys           func(c context.T) ([]nip86.PubKeyReason, error)
+	AllowPubKey                 func(c context.T, pubkey, reason string) error
+	ListAllowedPubKeys          func(c context.T) ([]nip86.PubKeyReason, error)
+	ListEventsNeedingModeration func(c context.T) ([]nip86.IDReason, error)
+	AllowEvent                  func(c context.T, id, reason string) error
+	BanEvent                    func(c context.T, id, reason string) error
+	ListBannedEvents            func(c context.T) ([]nip86.IDReason, error)
+	ChangeRelayName             func(c context.T, name string) error
+	ChangeRelayDescription      func(c context.T, desc string) error
+	ChangeRelayIcon             func(c context.T, icon string) error
+	AllowKind                   func(c context.T, k kind.T) error
+	DisallowKind                func(c context.T, k kind.T) error
+	ListAllowedKinds            func(c context.T) (kinds.T, error)
+	BlockIP                     func(c context.T, ip, reason string) error
+	UnblockIP                   func(c context.T, ip, reason string) error
+	ListBlockedIPs              func(c context.T) ([]nip86.IPReason, error)
+	Explain                     func(c context.T, f *filter.T) (*eventstore.Plan, error)
+}
+
+// supportedMethods returns the names of the methods that have a function.
+func (m *ManagementAPI) supportedMethods() (methods []string) {
+	for _, s := range []struct {
+		name string
+		ok   bool
+	}{
+		{nip86.BanPubKey, m.BanPubKey != nil},
+		{nip86.ListBannedPubKeys, m.ListBannedPubKeys != nil},
+		{nip86.AllowPubKey, m.AllowPubKey != nil},
+		{nip86.ListAllowedPubKeys, m.ListAllowedPubKeys != nil},
+		{nip86.ListEventsNeedingModeration, m.ListEventsNeedingModeration != nil},
+		{nip86.AllowEvent, m.AllowEvent != nil},
+		{nip86.BanEvent, m.BanEvent != nil},
+		{nip86.ListBannedEvents, m.ListBannedEvents != nil},
+		{nip86.ChangeRelayName, m.ChangeRelayName != nil},
+		{nip86.ChangeRelayDescription, m.ChangeRelayDescription != nil},
+		{nip86.ChangeRelayIcon, m.ChangeRelayIcon != nil},
+		{nip86.AllowKind, m.AllowKind != nil},
+		{nip86.DisallowKind, m.DisallowKind != nil},
+		{nip86.ListAllowedKinds, m.ListAllowedKinds != nil},
+		{nip86.BlockIP, m.BlockIP != nil},
+		{nip86.UnblockIP, m.UnblockIP != nil},
+		{nip86.ListBlockedIPs, m.ListBlockedIPs != nil},
+		{nip86.Explain, m.Explain != nil},
+	} {
+		if s.ok {
+			methods = append(methods, s.name)
+		}
+	}
+	return append([]string{nip86.SupportedMethods}, methods...)
+}
+
+// HandleNIP86 serves the management API. Requests must be authenticated with
+// NIP-98 by the public key in the relay information document.
+func (rl *Relay) HandleNIP86(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	respond := func(status int, resp nip86.Response) {
+		w.WriteHeader(status)
+		rl.E.Chk(json.NewEncoder(w).Encode(resp))
+	}
+	if r.Method != http.MethodPost {
+		respond(http.StatusMethodNotAllowed,
+			nip86.Response{Error: "management requests must be POST"})
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, rl.MaxMessageSize.Load()))
+	if rl.E.Chk(err) {
+		respond(http.StatusBadRequest,
+			nip86.Response{Error: "failed to read request"})
+		return
+	}
+	url := rl.managementURL(r)
+	if url == "" {
+		respond(http.StatusUnauthorized, nip86.Response{Error: "the relay " +
+			"address for authenticating management requests is not configured"})
+		return
+	}
+	var pubkey string
+	if pubkey, err = rl.nip98Replays.ValidateRequest(r, url,
+		body); err != nil {
+		rl.D.F("management request rejected: %s", err)
+		respond(http.StatusUnauthorized, nip86.Response{Error: err.Error()})
+		return
+	}
+	if operator := rl.operator(); operator == "" || pubkey != operator {
+		respond(http.StatusUnauthorized,
+			nip86.Response{Error: "pubkey is not the relay operator"})
+		return
+	}
+	req := &nip86.Request{}
+	if err = json.Unmarshal(body, req); err != nil {
+		respond(http.StatusBadRequest,
+			nip86.Response{Error: "invalid request: " + err.Error()})
+		return
+	}
+	c := r.Context()
+	for _, rej := range rl.Management.RejectAPICall {
+		if reject, msg := rej(c, pubkey, req); reject {
+			respond(http.StatusForbidden, nip86.Response{Error: msg})
+			return
+		}
+	}
+	rl.I.F("management call %s %s by %s", req.Method, req.Params, pubkey)
+	var result any
+	if result, err = rl.callManagementAPI(c, req); err != nil {
+		respond(http.StatusOK, nip86.Response{Error: err.Error()})
+		return
+	}
+	respond(http.StatusOK, nip86.Response{Result: result})
+}
+
+// operator returns the public key of the relay operator in the relay
+// information, which can be changed when the configuration is reloaded.
+func (rl *Relay) operator() string {
+	rl.Info.Lock()
+	defer rl.Info.Unlock()
+	return rl.Info.PubKey
+}
+
+// managementURL returns the URL a management request was sent to, which its
+// NIP-98 auth event must be for, or an empty string if it is not known. It is
+// not taken from the headers of clients, or an auth event signed for another
+// relay could be used.
+func (rl *Relay) managementURL(r *http.Request) string {
+	if rl.Management.URL != "" {
+		return nip98.RequestURL(rl.Management.URL, r)
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" || !rl.trustedProxy(peerIP(r)) {
+		return ""
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	return nip98.RequestURL(proto+"://"+host, r)
+}
+
+// callManagementAPI calls the function for the method of a request.
+func (rl *Relay) callManagementAPI(c context.T,
+	req *nip86.Request) (result any, err error) {
+
+	m := &rl.Management
+	unsupported := fmt.Errorf("method %s is not supported", req.Method)
+	// most methods take a string and an optional reason, and return true
+	stringReason := func(fn func(c context.T, s, reason string) error) (any,
+		error) {
+
+		if fn == nil {
+			return nil, unsupported
+		}
+		var s, reason string
+		if s, err = req.String(0); err != nil {
+			return nil, err
+		}
+		if s == "" {
+			return nil, fmt.Errorf("%s requires a parameter", req.Method)
+		}
+		if reason, err = req.String(1); err != nil {
+			return nil, err
+		}
+		return true, fn(c, s, reason)
+	}
+	onlyString := func(fn func(c context.T, s string) error) (any, error) {
+		if fn == nil {
+			return nil, unsupported
+		}
+		var s string
+		if s, err = req.String(0); err != nil {
+			return nil, err
+		}
+		return true, fn(c, s)
+	}
+	// pubkeys and event ids are checked, and ip addresses normalized, so that
+	// the lists only hold entries that can match
+	hexParam := func(fn func(c context.T, s, reason string) error) func(
+		c context.T, s, reason string) error {
+
+		if fn == nil {
+			return nil
+		}
+		return func(c context.T, s, reason string) error {
+			if !keys.IsValid32ByteHex(s) {
+				return fmt.Errorf("'%s' is not 64 lowercase hex characters", s)
+			}
+			return fn(c, s, reason)
+		}
+	}
+	ipParam := func(fn func(c context.T, s, reason string) error) func(
+		c context.T, s, reason string) error {
+
+		if fn == nil {
+			return nil
+		}
+		return func(c context.T, s, reason string) error {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("'%s' is not an ip address", s)
+			}
+			return fn(c, ip.String(), reason)
+		}
+	}
+	kindParam := func(fn func(c context.T, k kind.T) error) (any, error) {
+		if fn == nil {
+			return nil, unsupported
+		}
+		var k int
+		if k, err = req.Int(0); err != nil {
+			return nil, err
+		}
+		if k < 0 || k > 65535 {
+			return nil, fmt.Errorf("kind %d is out of range", k)
+		}
+		return true, fn(c, kind.T(k))
+	}
+	switch req.Method {
+	case nip86.SupportedMethods:
+		return m.supportedMethods(), nil
+	case nip86.BanPubKey:
+		return stringReason(hexParam(m.BanPubKey))
+	case nip86.AllowPubKey:
+		return stringReason(hexParam(m.AllowPubKey))
+	case nip86.AllowEvent:
+		return stringReason(hexParam(m.AllowEvent))
+	case nip86.BanEvent:
+		return stringReason(hexParam(m.BanEvent))
+	case nip86.BlockIP:
+		return stringReason(ipParam(m.BlockIP))
+	case nip86.UnblockIP:
+		return stringReason(ipParam(m.UnblockIP))
+	case nip86.ChangeRelayName:
+		return onlyString(m.ChangeRelayName)
+	case nip86.ChangeRelayDescription:
+		return onlyString(m.ChangeRelayDescription)
+	case nip86.ChangeRelayIcon:
+		return onlyString(m.ChangeRelayIcon)
+	case nip86.AllowKind:
+		return kindParam(m.AllowKind)
+	case nip86.DisallowKind:
+		return kindParam(m.DisallowKind)
+	case nip86.ListBannedPubKeys:
+		if m.ListBannedPubKeys == nil {
+			return nil, unsupported
+		}
+		return m.ListBannedPubKeys(c)
+	case nip86.ListAllowedPubKeys:
+		if m.ListAllowedPubKeys == nil {
+			return nil, unsupported
+		}
+		return m.ListAllowedPubKeys(c)
+	case nip86.ListEventsNeedingModeration:
+		if m.ListEventsNeedingModeration == nil {
+			return nil, unsupported
+		}
+		return m.ListEventsNeedingModeration(c)
+	case nip86.ListBannedEvents:
+		if m.ListBannedEvents == nil {
+			return nil, unsupported
+		}
+		return m.ListBannedEvents(c)
+	case nip86.ListAllowedKinds:
+		if m.ListAllowedKinds == nil {
+			return nil, unsupported
+		}
+		return m.ListAllowedKinds(c)
+	case nip86.ListBlockedIPs:
+		if m.ListBlockedIPs == nil {
+			return nil, unsupported
+		}
+		return m.ListBlockedIPs(c)
+	case nip86.Explain:
+		if m.Explain == nil {
+			return nil, unsupported
+		}
+		var f *filter.T
+		if f, err = req.Filter(0); err != nil {
+			return nil, err
+		}
+		return m.Explain(c, f)
+	}
+	return nil, unsupported
+}
@@ -0,0 +1,81 @@
+package replicatr
+
+import (
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+)
+
+// ReadAccess restricts reading events of some kinds to some users.
+type ReadAccess struct {
+	Kinds   kinds.T  `json:"kinds"`
+	PubKeys []string `json:"pubkeys"`
+}
+
+func pubkeySet(pubkeys []string) (set map[string]struct{}) {
+	set = make(map[string]struct{}, len(pubkeys))
+	for _, pk := range pubkeys {
+		set[pk] = struct{}{}
+	}
+	return
+}
+
+// RestrictWritesToPubKeys returns a RejectEvent that only accepts events from
+// clients that have authenticated as one of the given pubkeys. Events that are
+// not from a client connection, such as those added by the relay itself, are
+// accepted.
+func RestrictWritesToPubKeys(pubkeys ...string) RejectEvent {
+	allowed := pubkeySet(pubkeys)
+	return func(c context.T, ev *event.T) (rej bool, msg string) {
+		ws := GetConnection(c)
+		if ws == nil {
+			return
+		}
+		pubkey := ws.AuthedPublicKey()
+		if pubkey == "" {
+			return true, "auth-required: this relay only accepts events " +
+				"from authenticated users"
+		}
+		if _, ok := allowed[pubkey]; !ok {
+			return true, "restricted: you are not allowed to publish to " +
+				"this relay"
+		}
+		return
+	}
+}
+
+// RestrictReadsOfKinds returns a RejectFilter that only lets clients that
+// have authenticated as one of the given pubkeys request events of the given
+// kinds. A filter without kinds can return events of any kind, so it is
+// restricted as well.
+func RestrictReadsOfKinds(k kinds.T, pubkeys ...string) RejectFilter {
+	allowed := pubkeySet(pubkeys)
+	return func(c context.T, f *filter.T) (reject bool, msg string) {
+		if f.Kinds != nil {
+			restricted := false
+			for _, fk := range f.Kinds {
+				if k.Contains(fk) {
+					restricted = true
+					break
+				}
+			}
+			if !restricted {
+				return
+			}
+		}
+		ws := GetConnection(c)
+		if ws == nil {
+			return
+		}
+		pubkey := ws.AuthedPublicKey()
+		if pubkey == "" {
+			return true, "auth-required: reading these kinds requires " +
+				"authentication"
+		}
+		if _, ok := allowed[pubkey]; !ok {
+			return true, "restricted: you are not allowed to read these kinds"
+		}
+		return
+	}
+}
@@ -1,10 +1,13 @@
 package replicatr
 
 import (
+	"fmt"
+
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip13"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
 	"golang.org/x/exp/slices"
 )
@@ -110,3 +113,16 @@ func PreventTimestampsInTheFuture(thresholdSeconds timestamp.T) RejectEvent {
 		return false, ""
 	}
 }
+
+// PreventInsufficientPoW rejects events that do not have an ID with at least
+// minDifficulty leading zero bits, or that did not commit to a target of at
+// least minDifficulty in their NIP-13 nonce tag.
+func PreventInsufficientPoW(minDifficulty int) RejectEvent {
+	return func(c context.T, ev *event.T) (reject bool, msg string) {
+		if err := nip13.CheckEvent(ev, minDifficulty); err != nil {
+			return true, fmt.Sprintf("pow: difficulty of at least %d "+
+				"is required", minDifficulty)
+		}
+		return false, ""
+	}
+}
@@ -0,0 +1,368 @@
+package replicatr
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+)
+
+// RateLimits are the parameters of the RateLimiter. Rates are per second, and
+// a zero value disables the limit.
+//
+// Clients are identified by their remote IP address, or by their public key
+// once they have authenticated with NIP-42, so an authenticated user has the
+// same budget from every connection they open.
+type RateLimits struct {
+	EventsPerSecond     float64         `json:"events_per_second,omitempty"`
+	EventBurst          int             `json:"event_burst,omitempty"`
+	Kinds               []KindRateLimit `json:"kinds,omitempty"`
+	ReqsPerSecond       float64         `json:"reqs_per_second,omitempty"`
+	ReqBurst            int             `json:"req_burst,omitempty"`
+	MaxSubscriptions    int             `json:"max_subscriptions,omitempty"`
+	MaxConnectionsPerIP int             `json:"max_connections_per_ip,omitempty"`
+}
+
+// KindRateLimit is a rate limit for events of specific kinds, which is applied
+// instead of the general event rate limit for those kinds.
+type KindRateLimit struct {
+	Kinds           kinds.T `json:"kinds"`
+	EventsPerSecond float64 `json:"events_per_second"`
+	EventBurst      int     `json:"event_burst,omitempty"`
+}
+
+// RateLimiter limits how fast clients can publish events and open
+// subscriptions, and how many subscriptions and connections they can have
+// open at once.
+type RateLimiter struct {
+	// limits is replaced with its token buckets by SetLimits
+	limits atomic.Pointer[rateLimits]
+	// the connections of each IP address and authenticated public key
+	conns   map[string]map[*WebSocket]struct{}
+	connsMx sync.Mutex
+}
+
+type rateLimits struct {
+	RateLimits
+	events *tokenBuckets
+	kinds  []*tokenBuckets
+	reqs   *tokenBuckets
+}
+
+// NewRateLimiter creates a RateLimiter with the given limits.
+func NewRateLimiter(l RateLimits) (r *RateLimiter) {
+	r = &RateLimiter{conns: make(map[string]map[*WebSocket]struct{})}
+	r.SetLimits(l)
+	return
+}
+
+// SetLimits changes the limits while clients are connected. The token buckets
+// start full again, and the open connections keep counting against the new
+// limits.
+func (r *RateLimiter) SetLimits(l RateLimits) {
+	rls := &rateLimits{
+		RateLimits: l,
+		events:     newTokenBuckets(l.EventsPerSecond, l.EventBurst),
+		reqs:       newTokenBuckets(l.ReqsPerSecond, l.ReqBurst),
+	}
+	for _, k := range l.Kinds {
+		rls.kinds = append(rls.kinds, newTokenBuckets(k.EventsPerSecond,
+			k.EventBurst))
+	}
+	r.limits.Store(rls)
+}
+
+// ParseTrustedProxies parses the addresses of the reverse proxies in front of
+// the relay, which are IP addresses or CIDR networks, for
+// Relay.TrustedProxies.
+func ParseTrustedProxies(addrs []string) (nets []*net.IPNet, err error) {
+	for _, a := range addrs {
+		if strings.Contains(a, "/") {
+			var n *net.IPNet
+			if _, n, err = net.ParseCIDR(a); err != nil {
+				return nil, err
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy address '%s'", a)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return
+}
+
+// trustedProxy returns whether an IP address is one of the trusted proxies.
+func (rl *Relay) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range rl.TrustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP address of the peer that sent a request, without the
+// port.
+func peerIP(r *http.Request) (ip string) {
+	ip = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return
+}
+
+// RemoteIP returns the IP address of the client of a request, without the
+// port.
+//
+// The X-Forwarded-For header is only believed when the request comes from a
+// trusted proxy, as any client can set it. The client is then the last
+// address in it that is not also a trusted proxy, because the addresses
+// before that are as the client sent them.
+func (rl *Relay) RemoteIP(r *http.Request) (ip string) {
+	if ip = peerIP(r); !rl.trustedProxy(ip) {
+		return
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"),
+		","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		// in the same form as addresses in the lists of blocked ips
+		ip = hop.String()
+		if !rl.trustedProxy(ip) {
+			break
+		}
+	}
+	return
+}
+
+// rateLimitKey returns the key a connection is rate limited by.
+func rateLimitKey(ws *WebSocket) string {
+	if pubkey := ws.AuthedPublicKey(); pubkey != "" {
+		return pubkey
+	}
+	return ws.RemoteIP
+}
+
+// AddConnection registers a new connection under its IP address. It returns
+// false and a reason if the address already has too many open connections,
+// and then the connection is not registered. The check and the registration
+// are done under one lock, so connections opened at the same time can't
+// exceed the limit together.
+func (r *RateLimiter) AddConnection(ws *WebSocket) (ok bool, reason string) {
+	if r == nil {
+		return true, ""
+	}
+	l := r.limits.Load()
+	r.connsMx.Lock()
+	defer r.connsMx.Unlock()
+	if l.MaxConnectionsPerIP > 0 &&
+		len(r.conns[ws.RemoteIP]) >= l.MaxConnectionsPerIP {
+		return false, fmt.Sprintf("rate-limited: too many connections, "+
+			"maximum is %d", l.MaxConnectionsPerIP)
+	}
+	r.addConnection(ws.RemoteIP, ws)
+	return true, ""
+}
+
+// SetAuthedPublicKey sets the public key a connection has authenticated as,
+// and registers the connection under it instead of under the key it was
+// authenticated as before, if any. Connections of a public key are not
+// limited by MaxConnectionsPerIP.
+func (r *RateLimiter) SetAuthedPublicKey(ws *WebSocket, pubkey string) {
+	if r == nil {
+		ws.setAuthedPublicKey(pubkey)
+		return
+	}
+	r.connsMx.Lock()
+	defer r.connsMx.Unlock()
+	if prev := ws.AuthedPublicKey(); prev != "" {
+		r.removeConnection(prev, ws)
+	}
+	ws.setAuthedPublicKey(pubkey)
+	r.addConnection(pubkey, ws)
+}
+
+func (r *RateLimiter) addConnection(key string, ws *WebSocket) {
+	if r.conns[key] == nil {
+		r.conns[key] = make(map[*WebSocket]struct{})
+	}
+	r.conns[key][ws] = struct{}{}
+}
+
+// RemoveConnection removes a connection that has been closed.
+func (r *RateLimiter) RemoveConnection(ws *WebSocket) {
+	if r == nil {
+		return
+	}
+	r.connsMx.Lock()
+	defer r.connsMx.Unlock()
+	for _, key := range []string{ws.RemoteIP, ws.AuthedPublicKey()} {
+		if key != "" {
+			r.removeConnection(key, ws)
+		}
+	}
+}
+
+func (r *RateLimiter) removeConnection(key string, ws *WebSocket) {
+	delete(r.conns[key], ws)
+	if len(r.conns[key]) == 0 {
+		delete(r.conns, key)
+	}
+}
+
+// AllowEvent returns false and a reason if the client of a connection is
+// publishing events of a kind faster than allowed.
+func (r *RateLimiter) AllowEvent(ws *WebSocket, k kind.T) (ok bool,
+	reason string) {
+
+	if r == nil {
+		return true, ""
+	}
+	l := r.limits.Load()
+	key := rateLimitKey(ws)
+	for i, kl := range l.Kinds {
+		if kl.Kinds.Contains(k) {
+			if !l.kinds[i].allow(key, time.Now()) {
+				return false, fmt.Sprintf("rate-limited: publishing kind %d "+
+					"events too fast, maximum is %g per second", k,
+					kl.EventsPerSecond)
+			}
+			return true, ""
+		}
+	}
+	if !l.events.allow(key, time.Now()) {
+		return false, fmt.Sprintf("rate-limited: publishing events too fast, "+
+			"maximum is %g per second", l.EventsPerSecond)
+	}
+	return true, ""
+}
+
+// AllowReq returns false and a reason if the client of a connection is sending
+// REQ or COUNT requests faster than allowed, or a REQ with subscription id sub
+// would exceed the number of subscriptions the client can have open. An empty
+// sub skips the subscription check.
+func (r *RateLimiter) AllowReq(ws *WebSocket, sub string) (ok bool,
+	reason string) {
+
+	if r == nil {
+		return true, ""
+	}
+	l := r.limits.Load()
+	key := rateLimitKey(ws)
+	if !l.reqs.allow(key, time.Now()) {
+		return false, fmt.Sprintf("rate-limited: sending requests too fast, "+
+			"maximum is %g per second", l.ReqsPerSecond)
+	}
+	if sub == "" || l.MaxSubscriptions <= 0 {
+		return true, ""
+	}
+	var n int
+	r.connsMx.Lock()
+	for conn := range r.conns[key] {
+		if conn == ws {
+			// replacing an open subscription doesn't add a new one
+			n += CountListeners(conn, sub)
+		} else {
+			n += CountListeners(conn, "")
+		}
+	}
+	r.connsMx.Unlock()
+	if n >= l.MaxSubscriptions {
+		return false, fmt.Sprintf("rate-limited: too many open "+
+			"subscriptions, maximum is %d", l.MaxSubscriptions)
+	}
+	return true, ""
+}
+
+// pruneInterval is how often buckets that are full are discarded.
+const pruneInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBuckets is a set of token buckets with the same rate and burst size,
+// one for each key. A nil tokenBuckets allows everything.
+type tokenBuckets struct {
+	rate, burst float64
+	buckets     map[string]*tokenBucket
+	lastPrune   time.Time
+	sync.Mutex
+}
+
+// newTokenBuckets returns a set of token buckets that are refilled at rate
+// tokens per second and hold at most burst tokens. If the burst is not set it
+// is one second's worth of tokens. A rate that is not positive disables the
+// limit.
+func newTokenBuckets(rate float64, burst int) *tokenBuckets {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBuckets{
+		rate:    rate,
+		burst:   b,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of a key, and returns false if it is
+// empty.
+func (t *tokenBuckets) allow(key string, now time.Time) bool {
+	if t == nil {
+		return true
+	}
+	t.Lock()
+	defer t.Unlock()
+	if now.Sub(t.lastPrune) > pruneInterval {
+		t.prune(now)
+	}
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: t.burst, last: now}
+		t.buckets[key] = b
+	}
+	b.tokens = math.Min(t.burst, b.tokens+now.Sub(b.last).Seconds()*t.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune discards the buckets that have refilled, as they are the same as a new
+// bucket.
+func (t *tokenBuckets) prune(now time.Time) {
+	for key, b := range t.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*t.rate >= t.burst {
+			delete(t.buckets, key)
+		}
+	}
+	t.lastPrune = now
+}
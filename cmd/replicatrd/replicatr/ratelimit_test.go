@@ -0,0 +1,79 @@
+package replicatr
+
+import (
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	rl := &Relay{}
+	var err error
+	if rl.TrustedProxies, err = ParseTrustedProxies(
+		[]string{"10.0.0.1", "192.168.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		peer, xff, want string
+	}{
+		// the header is ignored from peers that are not trusted proxies
+		{"203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"10.0.0.1:4000", "", "10.0.0.1"},
+		{"10.0.0.1:4000", "198.51.100.1", "198.51.100.1"},
+		// addresses the client added before the proxies are ignored
+		{"10.0.0.1:4000", "1.2.3.4, 198.51.100.1, 192.168.1.1",
+			"198.51.100.1"},
+		{"10.0.0.1:4000", "garbage, 198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1:4000", "198.51.100.1, garbage", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.peer
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if ip := rl.RemoteIP(r); ip != test.want {
+			t.Errorf("peer %s with X-Forwarded-For '%s' is %s, want %s",
+				test.peer, test.xff, ip, test.want)
+		}
+	}
+	if _, err = ParseTrustedProxies([]string{"localhost"}); err == nil {
+		t.Error("parsed a host name as a trusted proxy")
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	r := NewRateLimiter(RateLimits{MaxConnectionsPerIP: 3})
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := r.AddConnection(&WebSocket{
+				RemoteIP: "198.51.100.1"}); ok {
+				added.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := added.Load(); n != 3 {
+		t.Fatalf("added %d connections, want 3", n)
+	}
+	// connections authenticated as a pubkey still count against their
+	// address
+	ws := &WebSocket{RemoteIP: "198.51.100.2"}
+	if ok, _ := r.AddConnection(ws); !ok {
+		t.Fatal("connection was not added")
+	}
+	r.SetAuthedPublicKey(ws, "pubkey1")
+	r.SetAuthedPublicKey(ws, "pubkey2")
+	if len(r.conns["pubkey1"]) != 0 || len(r.conns["pubkey2"]) != 1 ||
+		len(r.conns["198.51.100.2"]) != 1 {
+		t.Fatalf("connections after authenticating again: %v", r.conns)
+	}
+	r.RemoveConnection(ws)
+	if len(r.conns) != 1 {
+		t.Fatalf("connections left after removing: %v", r.conns)
+	}
+}
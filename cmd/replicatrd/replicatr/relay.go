@@ -1,13 +1,17 @@
 package replicatr
 
 import (
+	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/negentropy"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip98"
 	"github.com/fasthttp/websocket"
 	"github.com/puzpuzpuz/xsync/v2"
 	"mleku.online/git/slog"
@@ -25,8 +29,21 @@ const (
 	MaxMessageSize  int = 512000 // ???
 )
 
+// default outbound queue sizes
+const (
+	SendQueueSize      = 1024
+	SendQueueHighWater = 768
+)
+
+// limits of NIP-77 negentropy reconciliations
+const (
+	MaxNegentropyItems    = 500000 // events in the set being reconciled
+	MaxNegentropySessions = 4      // open reconciliations per connection
+)
+
 // function types used in the relay state
 type (
+	RejectConnection          func(r *http.Request, ip string) (reject bool, msg string)
 	RejectEvent               func(c context.T, ev *event.T) (rej bool, msg string)
 	RejectFilter              func(c context.T, f *filter.T) (reject bool, msg string)
 	OverwriteFilter           func(c context.T, f *filter.T)
@@ -38,10 +55,12 @@ type (
 	QueryEvents               func(c context.T, f *filter.T) (C chan *event.T, err error)
 	CountEvents               func(c context.T, f *filter.T) (cnt int64, err error)
 	OnEventSaved              func(c context.T, ev *event.T)
+	NegentropyItems           func(c context.T, f *filter.T, max int) (items []negentropy.Item, err error)
 )
 
 type Relay struct {
 	ServiceURL               string
+	RejectConnection         []RejectConnection
 	RejectEvent              []RejectEvent
 	RejectFilter             []RejectFilter
 	RejectCountFilter        []RejectFilter
@@ -51,13 +70,32 @@ type Relay struct {
 	OverwriteCountFilter     []OverwriteFilter
 	OverwriteRelayInfo       []OverwriteRelayInformation
 	StoreEvent               []Events
-	DeleteEvent              []Events
-	QueryEvents              []QueryEvents
-	CountEvents              []CountEvents
-	OnConnect                []Hook
-	OnDisconnect             []Hook
-	OnEventSaved             []OnEventSaved
-	// editing info will affect
+	// ReplaceEvent stores replaceable events instead of StoreEvent, deleting
+	// the versions they replace atomically, see eventstore.Replacer
+	ReplaceEvent    []Events
+	DeleteEvent     []Events
+	QueryEvents     []QueryEvents
+	CountEvents     []CountEvents
+	OnConnect       []Hook
+	OnDisconnect    []Hook
+	OnEventSaved    []OnEventSaved
+	OnShutdown      []Hook
+	NegentropyItems []NegentropyItems
+	// Management implements the NIP-86 relay management API
+	Management ManagementAPI
+	// nip98Replays is the auth events management requests were accepted
+	// with, which can't be used again
+	nip98Replays nip98.ReplayCache
+	// RateLimiter limits how fast clients can send messages, it is disabled
+	// if it is nil. Its limits can be changed while the relay is running with
+	// SetLimits.
+	RateLimiter *RateLimiter
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For headers
+	// are believed, see RemoteIP
+	TrustedProxies []*net.IPNet
+	// editing info will affect. it is shared with the connections, so it is
+	// changed while holding its lock, and the limits are replaced rather than
+	// modified.
 	Info *nip11.Info
 	*slog.Log
 	// for establishing websockets
@@ -72,7 +110,22 @@ type Relay struct {
 	WriteWait      time.Duration // Time allowed to write a message to the peer.
 	PongWait       time.Duration // Time allowed to read the next pong message from the peer.
 	PingPeriod     time.Duration // Send pings to peer with this period. Must be less than pongWait.
-	MaxMessageSize int64         // Maximum message size allowed from peer.
+	MaxMessageSize atomic.Int64  // Maximum message size allowed from peer.
+	// outbound queue options, which apply to clients that connect after they
+	// are changed
+	SendQueueSize      atomic.Int64 // Messages queued for a client, which is evicted if it stays full.
+	SendQueueHighWater atomic.Int64 // Queued messages above which live events are dropped.
+	Metrics            Metrics
+	// MaxNegentropyItems is the most events a NIP-77 reconciliation can be
+	// over, zero is no limit.
+	MaxNegentropyItems int
+	// SearchTags is the names of the tags whose values live events are
+	// searched in along with their content, which are the same as the store
+	// indexes, so a search subscription gets the events a query would return.
+	SearchTags []string
+	// shutdown state
+	shuttingDown atomic.Bool
+	writes       atomic.Int64
 }
 
 func NewRelay(logger *slog.Log, inf *nip11.Info) (r *Relay) {
@@ -88,13 +141,16 @@ func NewRelay(logger *slog.Log, inf *nip11.Info) (r *Relay) {
 			WriteBufferSize: WriteBufferSize,
 			CheckOrigin:     func(r *http.Request) bool { return true },
 		},
-		clients:        xsync.NewTypedMapOf[*websocket.Conn, struct{}](PointerHasher[websocket.Conn]),
-		serveMux:       &http.ServeMux{},
-		WriteWait:      WriteWait,
-		PongWait:       PongWait,
-		PingPeriod:     PingPeriod,
-		MaxMessageSize: int64(maxMessageLength),
+		clients:            xsync.NewTypedMapOf[*websocket.Conn, struct{}](PointerHasher[websocket.Conn]),
+		serveMux:           &http.ServeMux{},
+		WriteWait:          WriteWait,
+		PongWait:           PongWait,
+		PingPeriod:         PingPeriod,
+		MaxNegentropyItems: MaxNegentropyItems,
 	}
+	r.MaxMessageSize.Store(int64(maxMessageLength))
+	r.SendQueueSize.Store(SendQueueSize)
+	r.SendQueueHighWater.Store(SendQueueHighWater)
 	r.Info.Software = Software
 	r.Info.Version = Version
 	return
@@ -8,6 +8,8 @@ import (
 	"time"
 
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/closedenvelope"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
 	"github.com/fasthttp/websocket"
 	"github.com/rs/cors"
 )
@@ -43,13 +45,77 @@ func (rl *Relay) Start(host string, port int, started ...chan bool) (err error)
 	return
 }
 
-// Shutdown sends a websocket close control message to all connected clients.
+// Shutdown stops the relay gracefully: it stops accepting connections, sends
+// CLOSED to every open subscription, waits for events that are being added to
+// be stored, disconnects the clients and then runs the OnShutdown hooks, where
+// stores should be closed. Waiting stops when the context is done, but the
+// clients are still disconnected and the hooks are still run.
 func (rl *Relay) Shutdown(c context.T) {
-	rl.Log.E.Chk(rl.httpServer.Shutdown(c))
+	rl.shuttingDown.Store(true)
+	if rl.httpServer != nil {
+		rl.Log.E.Chk(rl.httpServer.Shutdown(c))
+	}
+	rl.closeSubscriptions(c, "error: relay is shutting down")
+	rl.waitForWrites(c)
 	rl.clients.Range(func(conn *websocket.Conn, _ struct{}) bool {
-		rl.E.Chk(conn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(time.Second)))
+		rl.E.Chk(conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+			time.Now().Add(time.Second)))
 		rl.E.Chk(conn.Close())
 		rl.clients.Delete(conn)
 		return true
 	})
+	for _, onShutdown := range rl.OnShutdown {
+		onShutdown(c)
+	}
+}
+
+// closeSubscriptions sends CLOSED with a reason to every open subscription,
+// and waits until the messages have been written or the context is done.
+func (rl *Relay) closeSubscriptions(c context.T, reason string) {
+	var conns []*WebSocket
+	listeners.Range(func(ws *WebSocket, subs ListenerMap) bool {
+		subs.Range(func(id string, _ *Listener) bool {
+			rl.D.Chk(ws.WriteEnvelope(&closedenvelope.T{
+				ID:     subscriptionid.T(id),
+				Reason: reason,
+			}))
+			return true
+		})
+		conns = append(conns, ws)
+		return true
+	})
+	for _, ws := range conns {
+		ws.flush(c)
+	}
+}
+
+// beginWrite is called before an event is stored or deleted, and returns
+// false if the relay is shutting down. If it returns true endWrite must be
+// called when the write is finished.
+func (rl *Relay) beginWrite() bool {
+	rl.writes.Add(1)
+	if rl.shuttingDown.Load() {
+		rl.writes.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (rl *Relay) endWrite() { rl.writes.Add(-1) }
+
+// waitForWrites waits until the writes that started before the relay began
+// shutting down have finished, or the context is done.
+func (rl *Relay) waitForWrites(c context.T) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for rl.writes.Load() > 0 {
+		select {
+		case <-c.Done():
+			rl.W.F("shutdown deadline passed with %d writes in progress",
+				rl.writes.Load())
+			return
+		case <-ticker.C:
+		}
+	}
 }
@@ -0,0 +1,228 @@
+package replicatr
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip50"
+)
+
+// subscription identifies a subscription of a client.
+type subscription struct {
+	ws *WebSocket
+	id string
+}
+
+// indexedFilter is a filter of a subscription in the subscription index.
+type indexedFilter struct {
+	sub subscription
+	f   *filter.T
+	// the index keys the filter is stored under, if all is false
+	keys []string
+	all  bool
+	// the terms of the search field of the filter, which filter.T.Matches
+	// does not check
+	terms []string
+}
+
+type filterSet map[*indexedFilter]struct{}
+
+// subIndex is an inverted index of the filters of open subscriptions, so the
+// subscriptions that a new event may match can be found without evaluating
+// every filter.
+//
+// Each filter is indexed under only one of its fields, the one that is most
+// selective: ids, then authors, then a tag, then kinds. Filters without any of
+// these are candidates for every event. The candidates found for an event are
+// then evaluated fully with filter.T.Matches, and live events are only sent to
+// search subscriptions if their text has all the search terms.
+type subIndex struct {
+	index map[string]filterSet
+	all   filterSet
+	// the indexed filters of each subscription of each connection
+	conns map[*WebSocket]map[string][]*indexedFilter
+	sync.RWMutex
+}
+
+func newSubIndex() *subIndex {
+	return &subIndex{
+		index: make(map[string]filterSet),
+		all:   make(filterSet),
+		conns: make(map[*WebSocket]map[string][]*indexedFilter),
+	}
+}
+
+// subscriptions is the index of the filters in listeners.
+var subscriptions = newSubIndex()
+
+// The index keys are prefixed with the field they are for.
+func idKey(id string) string         { return "i" + id }
+func authorKey(pubkey string) string { return "a" + pubkey }
+func kindKey(k kind.T) string        { return "k" + strconv.Itoa(int(k)) }
+func tagKey(name, value string) string {
+	return "t" + name + "\x00" + value
+}
+
+// indexKeys returns the keys a filter is indexed under, or all if it has to
+// be checked against every event. A field that is set but empty never
+// matches, so a filter with one is not indexed under any key.
+func indexKeys(f *filter.T) (keys []string, all bool) {
+	switch {
+	case f.IDs != nil:
+		for _, id := range f.IDs {
+			keys = append(keys, idKey(id))
+		}
+		return
+	case f.Authors != nil:
+		for _, a := range f.Authors {
+			keys = append(keys, authorKey(a))
+		}
+		return
+	}
+	// the tag with the first name in order is used, so the keys are the same
+	// every time
+	names := make([]string, 0, len(f.Tags))
+	for name, values := range f.Tags {
+		if values != nil {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		for _, v := range f.Tags[names[0]] {
+			keys = append(keys, tagKey(names[0], v))
+		}
+		return
+	}
+	if f.Kinds != nil {
+		for _, k := range f.Kinds {
+			keys = append(keys, kindKey(k))
+		}
+		return
+	}
+	return nil, true
+}
+
+func (x *subIndex) insert(f *indexedFilter) {
+	if f.all {
+		x.all[f] = struct{}{}
+		return
+	}
+	for _, k := range f.keys {
+		set, ok := x.index[k]
+		if !ok {
+			set = make(filterSet)
+			x.index[k] = set
+		}
+		set[f] = struct{}{}
+	}
+}
+
+func (x *subIndex) delete(f *indexedFilter) {
+	if f.all {
+		delete(x.all, f)
+		return
+	}
+	for _, k := range f.keys {
+		if set, ok := x.index[k]; ok {
+			delete(set, f)
+			if len(set) == 0 {
+				delete(x.index, k)
+			}
+		}
+	}
+}
+
+// Set indexes the filters of a subscription, replacing the filters of a
+// subscription with the same id on the same connection.
+func (x *subIndex) Set(ws *WebSocket, id string, ff filters.T) {
+	x.Lock()
+	defer x.Unlock()
+	x.remove(ws, id)
+	subs, ok := x.conns[ws]
+	if !ok {
+		subs = make(map[string][]*indexedFilter)
+		x.conns[ws] = subs
+	}
+	indexed := make([]*indexedFilter, 0, len(ff))
+	for _, f := range ff {
+		if f == nil {
+			continue
+		}
+		inf := &indexedFilter{sub: subscription{ws, id}, f: f}
+		inf.keys, inf.all = indexKeys(f)
+		inf.terms = nip50.QueryTerms(f.Search)
+		x.insert(inf)
+		indexed = append(indexed, inf)
+	}
+	subs[id] = indexed
+}
+
+// Remove removes the filters of a subscription from the index.
+func (x *subIndex) Remove(ws *WebSocket, id string) {
+	x.Lock()
+	defer x.Unlock()
+	x.remove(ws, id)
+}
+
+func (x *subIndex) remove(ws *WebSocket, id string) {
+	subs, ok := x.conns[ws]
+	if !ok {
+		return
+	}
+	for _, f := range subs[id] {
+		x.delete(f)
+	}
+	delete(subs, id)
+	if len(subs) == 0 {
+		delete(x.conns, ws)
+	}
+}
+
+// RemoveConnection removes all the subscriptions of a connection from the
+// index.
+func (x *subIndex) RemoveConnection(ws *WebSocket) {
+	x.Lock()
+	defer x.Unlock()
+	for id := range x.conns[ws] {
+		x.remove(ws, id)
+	}
+}
+
+// Match returns the subscriptions that have a filter that matches an event.
+// Each subscription is returned only once. Search terms are matched against
+// the content and the values of the tags named in searchTags.
+func (x *subIndex) Match(ev *event.T, searchTags []string) (
+	subs []subscription) {
+
+	x.RLock()
+	defer x.RUnlock()
+	matched := make(map[subscription]struct{})
+	check := func(set filterSet) {
+		for f := range set {
+			if _, ok := matched[f.sub]; ok {
+				continue
+			}
+			if f.f.Matches(ev) && nip50.Matches(f.terms, ev, searchTags...) {
+				matched[f.sub] = struct{}{}
+				subs = append(subs, f.sub)
+			}
+		}
+	}
+	check(x.index[idKey(ev.ID.String())])
+	check(x.index[authorKey(ev.PubKey)])
+	check(x.index[kindKey(ev.Kind)])
+	for _, t := range ev.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		check(x.index[tagKey(t.Key(), t.Value())])
+	}
+	check(x.all)
+	return
+}
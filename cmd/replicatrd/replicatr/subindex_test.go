@@ -0,0 +1,209 @@
+package replicatr
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+)
+
+// hexString returns a pseudo random 64 character hex string.
+func hexString(r *rand.Rand) string {
+	b := make([]byte, 32)
+	r.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// testSubscriptions generates n subscriptions over a set of connections,
+// with filters of the kinds clients typically send: feeds of followed
+// authors, mentions of a pubkey, threads of an event, single events, and
+// global feeds of a kind.
+func testSubscriptions(r *rand.Rand, n int,
+	pubkeys []string) (subs map[subscription]filters.T) {
+
+	subs = make(map[subscription]filters.T, n)
+	conns := make([]*WebSocket, n/10+1)
+	for i := range conns {
+		conns[i] = &WebSocket{}
+	}
+	for i := 0; i < n; i++ {
+		var f *filter.T
+		switch i % 5 {
+		case 0:
+			authors := make(tag.T, 0, 10)
+			for j := 0; j < 10; j++ {
+				authors = append(authors, pubkeys[r.Intn(len(pubkeys))])
+			}
+			f = &filter.T{Authors: authors, Kinds: kinds.T{kind.TextNote}}
+		case 1:
+			f = &filter.T{Tags: filter.TagMap{
+				"p": {pubkeys[r.Intn(len(pubkeys))]}}}
+		case 2:
+			f = &filter.T{Kinds: kinds.T{kind.TextNote, kind.Reaction},
+				Tags: filter.TagMap{"e": {hexString(r)}}}
+		case 3:
+			f = &filter.T{IDs: tag.T{hexString(r)}}
+		case 4:
+			f = &filter.T{Kinds: kinds.T{kind.T(30000 + r.Intn(100))}}
+		}
+		sub := subscription{conns[r.Intn(len(conns))], fmt.Sprint(i)}
+		subs[sub] = filters.T{f}
+	}
+	return
+}
+
+func testEvent(r *rand.Rand, pubkeys []string) *event.T {
+	ev := &event.T{
+		ID:     eventid.T(hexString(r)),
+		PubKey: pubkeys[r.Intn(len(pubkeys))],
+		Kind:   kind.TextNote,
+		Tags:   tags.T{{"p", pubkeys[r.Intn(len(pubkeys))]}},
+	}
+	if r.Intn(2) == 0 {
+		ev.Kind = kind.T(30000 + r.Intn(100))
+	}
+	return ev
+}
+
+func testPubkeys(r *rand.Rand, n int) (pubkeys []string) {
+	for i := 0; i < n; i++ {
+		pubkeys = append(pubkeys, hexString(r))
+	}
+	return
+}
+
+// scanMatch is how subscriptions were matched before the index, by
+// evaluating every filter.
+func scanMatch(subs map[subscription]filters.T,
+	ev *event.T) (matched []subscription) {
+
+	for sub, ff := range subs {
+		if ff.Match(ev) {
+			matched = append(matched, sub)
+		}
+	}
+	return
+}
+
+func sortSubs(subs []subscription) {
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].id < subs[j].id
+	})
+}
+
+func TestSubIndexMatch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pubkeys := testPubkeys(r, 200)
+	subs := testSubscriptions(r, 2000, pubkeys)
+	x := newSubIndex()
+	for sub, ff := range subs {
+		x.Set(sub.ws, sub.id, ff)
+	}
+	for i := 0; i < 1000; i++ {
+		ev := testEvent(r, pubkeys)
+		want, got := scanMatch(subs, ev), x.Match(ev, nil)
+		sortSubs(want)
+		sortSubs(got)
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Fatalf("event %d: index matched %d subscriptions, "+
+				"scanning matched %d", i, len(got), len(want))
+		}
+	}
+	// removing everything must leave the index empty
+	for sub := range subs {
+		x.Remove(sub.ws, sub.id)
+	}
+	if len(x.index) != 0 || len(x.all) != 0 || len(x.conns) != 0 {
+		t.Fatalf("index not empty after removing all subscriptions: "+
+			"%d keys, %d unindexed, %d connections", len(x.index),
+			len(x.all), len(x.conns))
+	}
+}
+
+func TestSubIndexReplace(t *testing.T) {
+	x := newSubIndex()
+	ws := &WebSocket{}
+	ev := &event.T{ID: "abcd", PubKey: "1234", Kind: kind.TextNote}
+	x.Set(ws, "sub", filters.T{{Authors: tag.T{"1234"}}})
+	if n := len(x.Match(ev, nil)); n != 1 {
+		t.Fatalf("matched %d subscriptions, want 1", n)
+	}
+	// a REQ with the same id replaces the filters of the subscription
+	x.Set(ws, "sub", filters.T{{Authors: tag.T{"5678"}}})
+	if n := len(x.Match(ev, nil)); n != 0 {
+		t.Fatalf("matched %d subscriptions after replacing, want 0", n)
+	}
+	x.RemoveConnection(ws)
+	if len(x.index) != 0 || len(x.conns) != 0 {
+		t.Fatal("index not empty after removing connection")
+	}
+}
+
+func TestSubIndexSearch(t *testing.T) {
+	x := newSubIndex()
+	ws := &WebSocket{}
+	x.Set(ws, "sub", filters.T{{Kinds: kinds.T{kind.TextNote},
+		Search: "nostr relay"}})
+	for _, tc := range []struct {
+		content string
+		tags    tags.T
+		want    int
+	}{
+		{"a Nostr relay", nil, 1},
+		{"nostr only", nil, 0},
+		{"relays are not relay-less nostr", nil, 1},
+		// the values of the search tags are searched like the store does
+		{"nostr", tags.T{{"t", "relay"}}, 1},
+		{"nostr", tags.T{{"subject", "relay"}}, 0},
+	} {
+		ev := &event.T{ID: "abcd", PubKey: "1234", Kind: kind.TextNote,
+			Content: tc.content, Tags: tc.tags}
+		if n := len(x.Match(ev, []string{"t"})); n != tc.want {
+			t.Errorf("%q with tags %v matched %d subscriptions, want %d",
+				tc.content, tc.tags, n, tc.want)
+		}
+	}
+}
+
+const benchmarkSubscriptions = 10000
+
+func BenchmarkFanoutIndexed(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	pubkeys := testPubkeys(r, 1000)
+	subs := testSubscriptions(r, benchmarkSubscriptions, pubkeys)
+	x := newSubIndex()
+	for sub, ff := range subs {
+		x.Set(sub.ws, sub.id, ff)
+	}
+	evs := make([]*event.T, 1000)
+	for i := range evs {
+		evs[i] = testEvent(r, pubkeys)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x.Match(evs[i%len(evs)], nil)
+	}
+}
+
+func BenchmarkFanoutScan(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	pubkeys := testPubkeys(r, 1000)
+	subs := testSubscriptions(r, benchmarkSubscriptions, pubkeys)
+	evs := make([]*event.T, 1000)
+	for i := range evs {
+		evs[i] = testEvent(r, pubkeys)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scanMatch(subs, evs[i%len(evs)])
+	}
+}
@@ -1,23 +1,211 @@
 package replicatr
 
 import (
+	"errors"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/noticeenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/interfaces/enveloper"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/negentropy"
 	"github.com/fasthttp/websocket"
 )
 
+// ErrSlowConsumer is returned when writing to a connection whose send queue
+// is full, which evicts the client.
+var ErrSlowConsumer = errors.New("client is not reading fast enough")
+
+// ErrConnectionClosed is returned when writing to a connection whose writer
+// has stopped, because it was closed or a write to it failed.
+var ErrConnectionClosed = errors.New("connection is closed")
+
 // WebSocket is a wrapper around a fasthttp/websocket with mutex locking and
 // NIP-42 Auth support
 type WebSocket struct {
 	conn            *websocket.Conn
 	mutex           sync.Mutex
 	Request         *http.Request // original request
+	RemoteIP        string        // address of the client, see Relay.RemoteIP
 	Challenge       string        // nip42
-	AuthedPublicKey string
+	authedPublicKey string        // guarded by authLock
 	Authed          chan struct{}
 	authLock        sync.Mutex
+	// open NIP-77 reconciliations by subscription id
+	negSessions map[string]*negentropy.T
+	negLock     sync.Mutex
+	// queue is the outbound message queue, if it is nil messages are written
+	// directly
+	queue *sendQueue
+}
+
+// AuthedPublicKey returns the public key the client has authenticated as, or
+// an empty string if it has not.
+func (ws *WebSocket) AuthedPublicKey() string {
+	ws.authLock.Lock()
+	defer ws.authLock.Unlock()
+	return ws.authedPublicKey
+}
+
+func (ws *WebSocket) setAuthedPublicKey(pubkey string) {
+	ws.authLock.Lock()
+	ws.authedPublicKey = pubkey
+	ws.authLock.Unlock()
+}
+
+// Metrics counts the clients that could not keep up with the messages sent to
+// them.
+type Metrics struct {
+	// DroppedMessages is the number of live events not sent to clients whose
+	// send queue was over the high-water mark.
+	DroppedMessages atomic.Int64
+	// EvictedClients is the number of clients disconnected because their
+	// send queue stayed full for longer than the write wait.
+	EvictedClients atomic.Int64
+}
+
+type queuedMessage struct {
+	typ int
+	b   []byte
+}
+
+// sendQueue is a bounded queue of messages to a client, which is drained by
+// a writer goroutine so that writing to one client never blocks on another.
+type sendQueue struct {
+	send      chan queuedMessage
+	highWater int
+	writeWait time.Duration
+	evict     chan struct{}
+	evicted   atomic.Bool
+	// closed is closed when the writer stops, after which nothing in the
+	// queue is written
+	closed  chan struct{}
+	metrics *Metrics
+}
+
+// startWriter creates the send queue of a connection and the goroutine that
+// writes it to the connection until the context is canceled.
+//
+// Live events are dropped while more than highWater messages are queued, and
+// the client is disconnected with a NOTICE when the queue of size messages
+// stays full for writeWait.
+func (ws *WebSocket) startWriter(c context.T, size, highWater int,
+	writeWait time.Duration, metrics *Metrics) {
+
+	ws.queue = &sendQueue{
+		send:      make(chan queuedMessage, size),
+		highWater: highWater,
+		writeWait: writeWait,
+		evict:     make(chan struct{}),
+		closed:    make(chan struct{}),
+		metrics:   metrics,
+	}
+	go ws.writer(c)
+}
+
+func (ws *WebSocket) writer(c context.T) {
+	q := ws.queue
+	defer close(q.closed)
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-q.evict:
+			// the queued messages are abandoned, the client only gets told
+			// why it is being disconnected
+			log.I.F("evicting slow client %s", ws.RemoteIP)
+			log.E.Chk(ws.conn.SetWriteDeadline(time.Now().Add(q.writeWait)))
+			log.D.Chk(ws.conn.WriteMessage(websocket.TextMessage,
+				(&noticeenvelope.T{Text: "error: disconnected because " +
+					"messages are not being read fast enough"}).Bytes()))
+			log.D.Chk(ws.conn.Close())
+			return
+		case m := <-q.send:
+			log.E.Chk(ws.conn.SetWriteDeadline(time.Now().Add(q.writeWait)))
+			if err := ws.conn.WriteMessage(m.typ, m.b); err != nil {
+				log.D.F("failed to write to client: %s", err)
+				log.D.Chk(ws.conn.Close())
+				return
+			}
+		}
+	}
+}
+
+// enqueue adds a message to the send queue, or writes it directly if there
+// is none. Messages that can be dropped are discarded if the queue is over
+// the high-water mark. Other messages wait for room in the queue, and the
+// client is evicted only if there is none for as long as a write may take,
+// which means it has stopped reading. Nothing is queued once the writer has
+// stopped, and a client whose connection closed while a message waited is not
+// counted as evicted.
+func (ws *WebSocket) enqueue(typ int, b []byte, droppable bool) (err error) {
+	q := ws.queue
+	if q == nil {
+		ws.mutex.Lock()
+		defer ws.mutex.Unlock()
+		return ws.conn.WriteMessage(typ, b)
+	}
+	if q.evicted.Load() {
+		return ErrSlowConsumer
+	}
+	select {
+	case <-q.closed:
+		return ErrConnectionClosed
+	default:
+	}
+	if droppable && q.highWater > 0 && len(q.send) >= q.highWater {
+		q.metrics.DroppedMessages.Add(1)
+		return
+	}
+	select {
+	case q.send <- queuedMessage{typ, b}:
+		return
+	default:
+	}
+	timer := time.NewTimer(q.writeWait)
+	defer timer.Stop()
+	select {
+	case q.send <- queuedMessage{typ, b}:
+		return
+	case <-q.evict:
+		return ErrSlowConsumer
+	case <-q.closed:
+		return ErrConnectionClosed
+	case <-timer.C:
+	}
+	select {
+	case <-q.closed:
+		// the writer stopped as the wait ran out
+		return ErrConnectionClosed
+	default:
+	}
+	if q.evicted.CompareAndSwap(false, true) {
+		q.metrics.EvictedClients.Add(1)
+		close(q.evict)
+	}
+	return ErrSlowConsumer
+}
+
+// flush waits until the queued messages have been written, the connection
+// has failed or the context is done.
+func (ws *WebSocket) flush(c context.T) {
+	q := ws.queue
+	if q == nil {
+		return
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for len(q.send) > 0 && !q.evicted.Load() {
+		select {
+		case <-c.Done():
+			return
+		case <-q.closed:
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 // // WriteJSON writes an object as JSON to the websocket
@@ -27,16 +215,28 @@ type WebSocket struct {
 // 	return ws.conn.WriteJSON(any)
 // }
 
-// WriteMessage writes a message with a given websocket type specifier
+// WriteMessage writes a message with a given websocket type specifier.
+// Control messages are written immediately, other messages are queued.
 func (ws *WebSocket) WriteMessage(t int, b []byte) (err error) {
-	ws.mutex.Lock()
-	defer ws.mutex.Unlock()
-	return ws.conn.WriteMessage(t, b)
+	switch t {
+	case websocket.PingMessage, websocket.PongMessage,
+		websocket.CloseMessage:
+		wait := WriteWait
+		if ws.queue != nil {
+			wait = ws.queue.writeWait
+		}
+		return ws.conn.WriteControl(t, b, time.Now().Add(wait))
+	}
+	return ws.enqueue(t, b, false)
 }
 
 // WriteEnvelope writes a message with a given websocket type specifier
 func (ws *WebSocket) WriteEnvelope(env enveloper.I) (err error) {
-	ws.mutex.Lock()
-	defer ws.mutex.Unlock()
-	return ws.conn.WriteMessage(websocket.TextMessage, env.Bytes())
+	return ws.enqueue(websocket.TextMessage, env.Bytes(), false)
+}
+
+// writeLiveEvent writes an envelope that may be dropped if the client is
+// falling behind, which is used for events sent to open subscriptions.
+func (ws *WebSocket) writeLiveEvent(env enveloper.I) (err error) {
+	return ws.enqueue(websocket.TextMessage, env.Bytes(), true)
 }
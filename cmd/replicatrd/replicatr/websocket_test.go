@@ -0,0 +1,156 @@
+package replicatr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/fasthttp/websocket"
+)
+
+func TestSendQueue(t *testing.T) {
+	var m Metrics
+	ws := &WebSocket{queue: &sendQueue{
+		send:      make(chan queuedMessage, 4),
+		highWater: 2,
+		writeWait: 10 * time.Millisecond,
+		evict:     make(chan struct{}),
+		closed:    make(chan struct{}),
+		metrics:   &m,
+	}}
+	msg := []byte(`["NOTICE","test"]`)
+	for i := 0; i < 3; i++ {
+		if err := ws.enqueue(websocket.TextMessage, msg, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the third live event is over the high-water mark
+	if n := m.DroppedMessages.Load(); n != 1 {
+		t.Fatalf("dropped %d messages, want 1", n)
+	}
+	// other messages are queued until the queue is full, and evict the
+	// client if it stays full for the write wait
+	for i := 0; i < 2; i++ {
+		if err := ws.enqueue(websocket.TextMessage, msg, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ws.enqueue(websocket.TextMessage, msg, false)
+	if !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("got error %v, want %v", err, ErrSlowConsumer)
+	}
+	if n := m.EvictedClients.Load(); n != 1 {
+		t.Fatalf("evicted %d clients, want 1", n)
+	}
+	select {
+	case <-ws.queue.evict:
+	default:
+		t.Fatal("writer was not told to evict the client")
+	}
+	// once evicted nothing more is queued and the client is counted once
+	err = ws.enqueue(websocket.TextMessage, msg, false)
+	if !errors.Is(err, ErrSlowConsumer) || m.EvictedClients.Load() != 1 {
+		t.Fatalf("got error %v and %d evictions after eviction", err,
+			m.EvictedClients.Load())
+	}
+}
+
+func TestSendQueueClosed(t *testing.T) {
+	var m Metrics
+	ws := &WebSocket{queue: &sendQueue{
+		send:      make(chan queuedMessage, 1),
+		writeWait: time.Second,
+		evict:     make(chan struct{}),
+		closed:    make(chan struct{}),
+		metrics:   &m,
+	}}
+	msg := []byte(`["NOTICE","test"]`)
+	if err := ws.enqueue(websocket.TextMessage, msg, false); err != nil {
+		t.Fatal(err)
+	}
+	// the writer stops while a message waits for room in the full queue
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(ws.queue.closed)
+	}()
+	err := ws.enqueue(websocket.TextMessage, msg, false)
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("got error %v, want %v", err, ErrConnectionClosed)
+	}
+	err = ws.enqueue(websocket.TextMessage, msg, false)
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("got error %v after closing, want %v", err,
+			ErrConnectionClosed)
+	}
+	// a closed connection is not a slow consumer
+	if n := m.EvictedClients.Load(); n != 0 || ws.queue.evicted.Load() {
+		t.Fatalf("evicted %d clients whose connection closed", n)
+	}
+}
+
+func TestSendQueueStoredEvents(t *testing.T) {
+	rl := testRelay(t)
+	rl.SendQueueSize.Store(4)
+	rl.SendQueueHighWater.Store(2)
+	c := context.Bg()
+	const n = 50
+	for i := 0; i < n; i++ {
+		ev := &event.T{PubKey: fmt.Sprintf("%064x", 1),
+			CreatedAt: timestamp.T(1000 + i), Kind: kind.TextNote,
+			Content: fmt.Sprint(i)}
+		ev.ID = ev.GetID()
+		if err := rl.AddEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(rl)
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a REQ that returns more stored events than the queue holds doesn't
+	// evict a client that reads them
+	if err = conn.WriteMessage(websocket.TextMessage,
+		[]byte(`["REQ","s",{"limit":100}]`)); err != nil {
+		t.Fatal(err)
+	}
+	var events int
+	for {
+		if err = conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		var b []byte
+		if _, b, err = conn.ReadMessage(); err != nil {
+			t.Fatalf("read %d events, then %v", events, err)
+		}
+		var msg []json.RawMessage
+		if err = json.Unmarshal(b, &msg); err != nil || len(msg) == 0 {
+			t.Fatalf("unexpected message %s", b)
+		}
+		var label string
+		_ = json.Unmarshal(msg[0], &label)
+		if label == "EOSE" {
+			break
+		} else if label != "EVENT" {
+			t.Fatalf("unexpected message %s", b)
+		}
+		events++
+	}
+	if events != n {
+		t.Errorf("got %d events, want %d", events, n)
+	}
+	if e := rl.Metrics.EvictedClients.Load(); e != 0 {
+		t.Errorf("evicted %d clients", e)
+	}
+}
@@ -17,9 +17,9 @@ import (
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/countenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/eoseenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/eventenvelope"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/negenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/okenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/reqenvelope"
-	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip42"
 	"github.com/fasthttp/websocket"
 	"github.com/minio/sha256-simd"
@@ -27,35 +27,63 @@ import (
 
 func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	var err error
-	var conn *websocket.Conn
-	conn, err = rl.upgrader.Upgrade(w, r, nil)
-	if rl.E.Chk(err) {
-		rl.E.F("failed to upgrade websocket: %v", err)
+	if rl.shuttingDown.Load() {
+		http.Error(w, "relay is shutting down", http.StatusServiceUnavailable)
 		return
 	}
-	rl.clients.Store(conn, struct{}{})
-	ticker := time.NewTicker(rl.PingPeriod)
 	// NIP-42 challenge
 	challenge := make([]byte, 8)
 	_, err = rand.Read(challenge)
 	rl.E.Chk(err)
 	ws := &WebSocket{
-		conn:      conn,
 		Request:   r,
+		RemoteIP:  rl.RemoteIP(r),
 		Challenge: hex.Enc(challenge),
 	}
+	for _, rej := range rl.RejectConnection {
+		if reject, msg := rej(r, ws.RemoteIP); reject {
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+	}
+	// the connection is counted before upgrading, so that simultaneous
+	// upgrades from one address can't exceed the limit
+	if ok, reason := rl.RateLimiter.AddConnection(ws); !ok {
+		http.Error(w, reason, http.StatusTooManyRequests)
+		return
+	}
+	var conn *websocket.Conn
+	conn, err = rl.upgrader.Upgrade(w, r, nil)
+	if rl.E.Chk(err) {
+		rl.E.F("failed to upgrade websocket: %v", err)
+		rl.RateLimiter.RemoveConnection(ws)
+		return
+	}
+	ws.conn = conn
+	rl.clients.Store(conn, struct{}{})
+	ticker := time.NewTicker(rl.PingPeriod)
 	c, cancel := context.Cancel(
 		context.Value(
 			context.Bg(),
 			wsKey, ws,
 		),
 	)
+	ws.startWriter(c, int(rl.SendQueueSize.Load()),
+		int(rl.SendQueueHighWater.Load()), rl.WriteWait,
+		&rl.Metrics)
+	if rl.authRequired() {
+		// send the challenge right away, so the client can authenticate
+		// before its first request
+		rl.E.Chk(ws.WriteEnvelope(&authenvelope.Challenge{
+			Challenge: ws.Challenge}))
+	}
 	kill := func() {
 		for _, onDisconnect := range rl.OnDisconnect {
 			onDisconnect(c)
 		}
 		ticker.Stop()
 		cancel()
+		rl.RateLimiter.RemoveConnection(ws)
 		if _, ok := rl.clients.Load(conn); ok {
 			_ = conn.Close()
 			rl.clients.Delete(conn)
@@ -79,6 +107,30 @@ func (rl *Relay) wsProcessMessages(msg []byte, c context.T, ws *WebSocket) {
 	switch env := en.(type) {
 	case *eventenvelope.T:
 		rl.T.Ln("event envelope")
+		if rej, reason := rl.rejectEventOverLimits(env.Event); rej {
+			rl.E.Chk(ws.WriteEnvelope(&okenvelope.T{
+				ID:     env.Event.ID,
+				OK:     false,
+				Reason: reason,
+			}))
+			return
+		}
+		if rl.authRequired() && ws.AuthedPublicKey() == "" {
+			rl.E.Chk(ws.WriteEnvelope(&okenvelope.T{
+				ID:     env.Event.ID,
+				OK:     false,
+				Reason: "auth-required: this relay requires authentication",
+			}))
+			return
+		}
+		if ok, reason := rl.RateLimiter.AllowEvent(ws, env.Event.Kind); !ok {
+			rl.E.Chk(ws.WriteEnvelope(&okenvelope.T{
+				ID:     env.Event.ID,
+				OK:     false,
+				Reason: reason,
+			}))
+			return
+		}
 		// check id
 		evs := env.Event.ToCanonical().Bytes()
 		rl.T.F("serialized %s", evs)
@@ -112,15 +164,9 @@ func (rl *Relay) wsProcessMessages(msg []byte, c context.T, ws *WebSocket) {
 			return
 		}
 		rl.T.Ln("signature was valid")
-		var writeErr error
-		if env.Event.Kind == kind.Deletion {
-			// this always returns "blocked: " whenever it returns an error
-			writeErr = rl.handleDeleteRequest(c, env.Event)
-		} else {
-			rl.D.Ln("adding event")
-			// this will also always return a prefixed reason
-			writeErr = rl.AddEvent(c, env.Event)
-		}
+		rl.D.Ln("adding event")
+		// this will always return a prefixed reason
+		writeErr := rl.AddEvent(c, env.Event)
 		var reason string
 		if ok = !rl.E.Chk(writeErr); !ok {
 			reason = writeErr.Error()
@@ -145,6 +191,28 @@ func (rl *Relay) wsProcessMessages(msg []byte, c context.T, ws *WebSocket) {
 			}))
 			return
 		}
+		if rej, reason := rl.rejectReqOverLimits(env.ID.String(),
+			env.Filters); rej {
+			rl.E.Chk(ws.WriteEnvelope(&closedenvelope.T{
+				ID:     env.ID,
+				Reason: reason,
+			}))
+			return
+		}
+		if rl.authRequired() && ws.AuthedPublicKey() == "" {
+			rl.E.Chk(ws.WriteEnvelope(&closedenvelope.T{
+				ID:     env.ID,
+				Reason: "auth-required: this relay requires authentication",
+			}))
+			return
+		}
+		if ok, reason := rl.RateLimiter.AllowReq(ws, ""); !ok {
+			rl.E.Chk(ws.WriteEnvelope(&closedenvelope.T{
+				ID:     env.ID,
+				Reason: reason,
+			}))
+			return
+		}
 		var total int64
 		for _, f := range env.Filters {
 			total += rl.handleCountRequest(c, ws, f)
@@ -154,12 +222,45 @@ func (rl *Relay) wsProcessMessages(msg []byte, c context.T, ws *WebSocket) {
 			Count: total,
 		}))
 	case *reqenvelope.T:
+		if rej, reason := rl.rejectReqOverLimits(
+			env.SubscriptionID.String(), env.Filters); rej {
+			rl.E.Chk(ws.WriteEnvelope(&closedenvelope.T{
+				ID:     env.SubscriptionID,
+				Reason: reason,
+			}))
+			return
+		}
+		if rl.authRequired() && ws.AuthedPublicKey() == "" {
+			rl.E.Chk(ws.WriteEnvelope(&closedenvelope.T{
+				ID:     env.SubscriptionID,
+				Reason: "auth-required: this relay requires authentication",
+			}))
+			return
+		}
+		if ok, reason := rl.RateLimiter.AllowReq(ws,
+			env.SubscriptionID.String()); !ok {
+			rl.E.Chk(ws.WriteEnvelope(&closedenvelope.T{
+				ID:     env.SubscriptionID,
+				Reason: reason,
+			}))
+			return
+		}
 		wg := sync.WaitGroup{}
 		wg.Add(len(env.Filters))
 		// a context just for the "stored events" request handler
 		reqCtx, cancelReqCtx := context.CancelCause(c)
 		// expose subscription id in the context
 		reqCtx = context.Value(reqCtx, subscriptionIdKey, env.SubscriptionID)
+		// the subscription is counted before its filters are handled, so that
+		// concurrent REQs can't exceed MaxSubscriptions together
+		if rej, reason := rl.addSubscription(ws, env, cancelReqCtx); rej {
+			rl.E.Chk(ws.WriteEnvelope(&closedenvelope.T{
+				ID:     env.SubscriptionID,
+				Reason: reason,
+			}))
+			cancelReqCtx(errors.New("too many subscriptions"))
+			return
+		}
 		// handle each filter separately -- dispatching events as they're loaded from databases
 		for _, f := range env.Filters {
 			err = rl.handleFilter(handleFilterParams{
@@ -180,6 +281,7 @@ func (rl *Relay) wsProcessMessages(msg []byte, c context.T, ws *WebSocket) {
 					Reason: reason,
 				}))
 				cancelReqCtx(errors.New("filter rejected"))
+				RemoveListenerId(ws, env.SubscriptionID.String())
 				return
 			}
 		}
@@ -193,10 +295,17 @@ func (rl *Relay) wsProcessMessages(msg []byte, c context.T, ws *WebSocket) {
 		SetListener(env.SubscriptionID.String(), ws, env.Filters, cancelReqCtx)
 	case *closeenvelope.T:
 		RemoveListenerId(ws, env.T.String())
+	case *negenvelope.Open:
+		rl.handleNegOpen(c, ws, env)
+	case *negenvelope.Msg:
+		rl.handleNegMsg(ws, env)
+	case *negenvelope.Close:
+		rl.handleNegClose(ws, env)
 	case *authenvelope.Response:
 		wsBaseUrl := strings.Replace(rl.ServiceURL, "http", "ws", 1)
 		if pubkey, ok := nip42.ValidateAuthEvent(env.Event, ws.Challenge, wsBaseUrl); ok {
-			ws.AuthedPublicKey = pubkey
+			// from now on the client is rate limited by its public key
+			rl.RateLimiter.SetAuthedPublicKey(ws, pubkey)
 			ws.authLock.Lock()
 			if ws.Authed != nil {
 				close(ws.Authed)
@@ -229,7 +338,7 @@ type readParams struct {
 
 func (rl *Relay) websocketReadMessages(p readParams) {
 	defer p.kill()
-	p.conn.SetReadLimit(rl.MaxMessageSize)
+	p.conn.SetReadLimit(rl.MaxMessageSize.Load())
 	rl.E.Chk(p.conn.SetReadDeadline(time.Now().Add(rl.PongWait)))
 	p.conn.SetPongHandler(func(string) (err error) {
 		err = p.conn.SetReadDeadline(time.Now().Add(rl.PongWait))
@@ -253,7 +362,7 @@ func (rl *Relay) websocketReadMessages(p readParams) {
 				websocket.CloseAbnormalClosure,  // 1006
 			) {
 				rl.E.F("unexpected close error from %s: %v",
-					p.r.Header.Get("X-Forwarded-For"), err)
+					p.ws.RemoteIP, err)
 			}
 			return
 		}
@@ -0,0 +1,237 @@
+package replicatr
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip11"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/fasthttp/websocket"
+)
+
+// testClient is a client connected to a test relay.
+type testClient struct {
+	t    *testing.T
+	url  string
+	conn *websocket.Conn
+}
+
+// dialRelay serves a relay and connects a client to it.
+func dialRelay(t *testing.T, rl *Relay) (tc *testClient) {
+	srv := httptest.NewServer(rl)
+	t.Cleanup(srv.Close)
+	// the auth events are for the url the relay is served on
+	rl.ServiceURL = srv.URL
+	return redial(t, srv.URL)
+}
+
+// redial connects another client to the relay a client is connected to.
+func redial(t *testing.T, url string) (tc *testClient) {
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(url, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testClient{t, url, conn}
+}
+
+// send writes a message made of the JSON encoding of the values.
+func (tc *testClient) send(msg ...any) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if err = tc.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// expect reads a message and fails if its label is not the given one. The
+// message is decoded into the values after the label.
+func (tc *testClient) expect(label string, fields ...any) {
+	tc.t.Helper()
+	err := tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	var b []byte
+	if _, b, err = tc.conn.ReadMessage(); err != nil {
+		tc.t.Fatalf("waiting for %s: %v", label, err)
+	}
+	var msg []json.RawMessage
+	if err = json.Unmarshal(b, &msg); err != nil || len(msg) == 0 {
+		tc.t.Fatalf("unexpected message %s", b)
+	}
+	var got string
+	if _ = json.Unmarshal(msg[0], &got); got != label {
+		tc.t.Fatalf("got message %s, want %s", b, label)
+	}
+	for i, f := range fields {
+		if i+1 >= len(msg) {
+			tc.t.Fatalf("message %s is too short", b)
+		}
+		if err = json.Unmarshal(msg[i+1], f); err != nil {
+			tc.t.Fatalf("decoding %s: %v", b, err)
+		}
+	}
+}
+
+// expectOK reads an OK message and fails if its result is not ok or its
+// reason does not start with the prefix.
+func (tc *testClient) expectOK(ok bool, prefix string) {
+	tc.t.Helper()
+	var id, reason string
+	var got bool
+	tc.expect("OK", &id, &got, &reason)
+	if got != ok || !strings.HasPrefix(reason, prefix) {
+		tc.t.Fatalf("got OK %v %q, want %v %q", got, reason, ok, prefix)
+	}
+}
+
+// expectClosed reads a CLOSED message and fails if its reason does not start
+// with the prefix.
+func (tc *testClient) expectClosed(prefix string) {
+	tc.t.Helper()
+	var id, reason string
+	tc.expect("CLOSED", &id, &reason)
+	if !strings.HasPrefix(reason, prefix) {
+		tc.t.Fatalf("got CLOSED %q, want %q", reason, prefix)
+	}
+}
+
+// auth authenticates a client with a secret key in response to a challenge.
+func (tc *testClient) auth(sk, challenge string) {
+	tc.t.Helper()
+	ev := signedEvent(tc.t, sk, kind.ClientAuthentication, tags.T{
+		{"relay", "ws" + strings.TrimPrefix(tc.url, "http")},
+		{"challenge", challenge},
+	})
+	tc.send("AUTH", ev)
+	tc.expectOK(true, "")
+}
+
+func signedEvent(t *testing.T, sk string, k kind.T, tg tags.T) (ev *event.T) {
+	pk, err := keys.GetPublicKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = &event.T{PubKey: pk, CreatedAt: timestamp.Now(), Kind: k, Tags: tg}
+	if err = ev.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestAuthRequired(t *testing.T) {
+	rl := testRelay(t)
+	rl.Info.Limitation = &nip11.Limits{AuthRequired: true}
+	tc := dialRelay(t, rl)
+	// the challenge is sent on connect
+	var challenge string
+	tc.expect("AUTH", &challenge)
+	if challenge == "" {
+		t.Fatal("empty challenge")
+	}
+	sk := keys.GeneratePrivateKey()
+	ev := signedEvent(t, sk, kind.TextNote, nil)
+	f := map[string]any{"kinds": []int{1}}
+	tc.send("EVENT", ev)
+	tc.expectOK(false, "auth-required:")
+	tc.send("REQ", "s", f)
+	tc.expectClosed("auth-required:")
+	tc.send("COUNT", "c", f)
+	tc.expectClosed("auth-required:")
+	// a wrong challenge doesn't authenticate
+	tc.send("AUTH", signedEvent(t, sk, kind.ClientAuthentication, tags.T{
+		{"relay", "ws" + strings.TrimPrefix(tc.url, "http")},
+		{"challenge", "0" + challenge},
+	}))
+	tc.expectOK(false, "error:")
+	tc.send("EVENT", ev)
+	tc.expectOK(false, "auth-required:")
+	tc.auth(sk, challenge)
+	tc.send("EVENT", ev)
+	tc.expectOK(true, "")
+	tc.send("REQ", "s", f)
+	var got event.T
+	tc.expect("EVENT", new(string), &got)
+	if got.ID != ev.ID {
+		t.Fatalf("got event %s, want %s", got.ID, ev.ID)
+	}
+	tc.expect("EOSE")
+	var count struct{ Count int64 }
+	tc.send("COUNT", "c", f)
+	tc.expect("COUNT", new(string), &count)
+	if count.Count != 1 {
+		t.Fatalf("counted %d events, want 1", count.Count)
+	}
+}
+
+func TestRestrictWritesToPubKeys(t *testing.T) {
+	rl := testRelay(t)
+	allowed, other := keys.GeneratePrivateKey(), keys.GeneratePrivateKey()
+	pk, _ := keys.GetPublicKey(allowed)
+	rl.RejectEvent = append(rl.RejectEvent, RestrictWritesToPubKeys(pk))
+	tc := dialRelay(t, rl)
+	// an unauthenticated client is asked to authenticate
+	tc.send("EVENT", signedEvent(t, other, kind.TextNote, nil))
+	var challenge string
+	tc.expect("AUTH", &challenge)
+	tc.expectOK(false, "auth-required:")
+	tc.auth(other, challenge)
+	tc.send("EVENT", signedEvent(t, other, kind.TextNote, nil))
+	tc.expectOK(false, "restricted:")
+	// a client authenticated as an allowed pubkey can publish events of
+	// other authors too
+	tc = redial(t, tc.url)
+	tc.send("EVENT", signedEvent(t, other, kind.TextNote, nil))
+	tc.expect("AUTH", &challenge)
+	tc.expectOK(false, "auth-required:")
+	tc.auth(allowed, challenge)
+	tc.send("EVENT", signedEvent(t, other, kind.TextNote, nil))
+	tc.expectOK(true, "")
+}
+
+func TestRestrictReadsOfKinds(t *testing.T) {
+	rl := testRelay(t)
+	allowed, other := keys.GeneratePrivateKey(), keys.GeneratePrivateKey()
+	pk, _ := keys.GetPublicKey(allowed)
+	rl.RejectFilter = append(rl.RejectFilter,
+		RestrictReadsOfKinds([]kind.T{kind.Reaction}, pk))
+	tc := dialRelay(t, rl)
+	// other kinds can be read without authenticating
+	tc.send("REQ", "s", map[string]any{"kinds": []int{1}})
+	tc.expect("EOSE")
+	// a filter without kinds can return the restricted kinds, a rejected
+	// filter is also reported in a notice
+	var challenge string
+	for _, f := range []map[string]any{
+		{"kinds": []int{1, 7}},
+		{},
+	} {
+		tc.send("REQ", "s", f)
+		tc.expect("NOTICE")
+		tc.expect("AUTH", &challenge)
+		tc.expectClosed("auth-required:")
+	}
+	tc.auth(other, challenge)
+	tc.send("REQ", "s", map[string]any{"kinds": []int{7}})
+	tc.expect("NOTICE")
+	tc.expectClosed("restricted:")
+	tc = redial(t, tc.url)
+	tc.send("REQ", "s", map[string]any{"kinds": []int{7}})
+	tc.expect("NOTICE")
+	tc.expect("AUTH", &challenge)
+	tc.expectClosed("auth-required:")
+	tc.auth(allowed, challenge)
+	tc.send("REQ", "s", map[string]any{"kinds": []int{7}})
+	tc.expect("EOSE")
+}
@@ -16,7 +16,6 @@ require (
 	github.com/minio/sha256-simd v1.0.1
 	github.com/puzpuzpuz/xsync/v2 v2.5.1
 	github.com/rs/cors v1.10.1
-	github.com/sebest/xff v0.0.0-20210106013422-671bd2870b3a
 	github.com/urfave/cli/v2 v2.27.1
 	golang.org/x/exp v0.0.0-20240119083558-1b970713d09a
 	golang.org/x/net v0.20.0
@@ -18,6 +18,10 @@ const (
 	LReq
 	LCount
 	LAuth
+	LNegOpen
+	LNegMsg
+	LNegClose
+	LNegErr
 )
 
 // List is the nip1 envelope labels, matching the above enums.
@@ -32,6 +36,11 @@ var List = EnvelopeLabel{
 	LReq:    []byte("REQ"),
 	LCount:  []byte("COUNT"),
 	LAuth:   []byte("AUTH"),
+	// nip77 negentropy
+	LNegOpen:  []byte("NEG-OPEN"),
+	LNegMsg:   []byte("NEG-MSG"),
+	LNegClose: []byte("NEG-CLOSE"),
+	LNegErr:   []byte("NEG-ERR"),
 }
 
 type EnvelopeLabel map[T][]byte
@@ -58,6 +67,11 @@ var (
 	CLOSED = string(List[LClosed])
 	COUNT  = string(List[LCount])
 	AUTH   = string(List[LAuth])
+
+	NEGOPEN  = string(List[LNegOpen])
+	NEGMSG   = string(List[LNegMsg])
+	NEGCLOSE = string(List[LNegClose])
+	NEGERR   = string(List[LNegErr])
 )
 
 func GetLabel(s string) (l T) {
@@ -0,0 +1,41 @@
+package negenvelope
+
+import (
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/labels"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/interfaces/enveloper"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/array"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/text"
+)
+
+// Close is sent by a client to end a reconciliation.
+type Close struct {
+	ID subscriptionid.T
+}
+
+var _ enveloper.I = &Close{}
+
+func (E *Close) UnmarshalJSON(b []byte) error {
+	return E.Unmarshal(text.NewBuffer(b))
+}
+
+func (E *Close) Label() string { return labels.NEGCLOSE }
+
+func (E *Close) ToArray() array.T { return array.T{labels.NEGCLOSE, E.ID} }
+
+func (E *Close) String() string { return E.ToArray().String() }
+
+func (E *Close) Bytes() []byte { return E.ToArray().Bytes() }
+
+func (E *Close) MarshalJSON() ([]byte, error) { return E.Bytes(), nil }
+
+// Unmarshal the envelope.
+func (E *Close) Unmarshal(buf *text.Buffer) (err error) {
+	if E == nil {
+		return fmt.Errorf("cannot unmarshal to nil pointer")
+	}
+	E.ID, err = readID(buf)
+	return
+}
@@ -0,0 +1,50 @@
+package negenvelope
+
+import (
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/labels"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/interfaces/enveloper"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/array"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/text"
+)
+
+// Err is sent by a relay when it refuses or ends a reconciliation.
+type Err struct {
+	ID     subscriptionid.T
+	Reason string
+}
+
+var _ enveloper.I = &Err{}
+
+func (E *Err) UnmarshalJSON(b []byte) error {
+	return E.Unmarshal(text.NewBuffer(b))
+}
+
+func (E *Err) Label() string { return labels.NEGERR }
+
+func (E *Err) ToArray() array.T { return array.T{labels.NEGERR, E.ID, E.Reason} }
+
+func (E *Err) String() string { return E.ToArray().String() }
+
+func (E *Err) Bytes() []byte { return E.ToArray().Bytes() }
+
+func (E *Err) MarshalJSON() ([]byte, error) { return E.Bytes(), nil }
+
+// Unmarshal the envelope.
+func (E *Err) Unmarshal(buf *text.Buffer) (err error) {
+	if E == nil {
+		return fmt.Errorf("cannot unmarshal to nil pointer")
+	}
+	if E.ID, err = readID(buf); err != nil {
+		return
+	}
+	var reason []byte
+	if reason, err = readString(buf); err != nil {
+		return fmt.Errorf("did not find reason value in negentropy error " +
+			"envelope")
+	}
+	E.Reason = string(text.UnescapeByteString(reason))
+	return
+}
@@ -0,0 +1,48 @@
+package negenvelope
+
+import (
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/labels"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/interfaces/enveloper"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/array"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/text"
+)
+
+// Msg carries a negentropy message in either direction.
+type Msg struct {
+	ID      subscriptionid.T
+	Message []byte
+}
+
+var _ enveloper.I = &Msg{}
+
+func (E *Msg) UnmarshalJSON(b []byte) error {
+	return E.Unmarshal(text.NewBuffer(b))
+}
+
+func (E *Msg) Label() string { return labels.NEGMSG }
+
+func (E *Msg) ToArray() array.T {
+	return array.T{labels.NEGMSG, E.ID, hex.Enc(E.Message)}
+}
+
+func (E *Msg) String() string { return E.ToArray().String() }
+
+func (E *Msg) Bytes() []byte { return E.ToArray().Bytes() }
+
+func (E *Msg) MarshalJSON() ([]byte, error) { return E.Bytes(), nil }
+
+// Unmarshal the envelope.
+func (E *Msg) Unmarshal(buf *text.Buffer) (err error) {
+	if E == nil {
+		return fmt.Errorf("cannot unmarshal to nil pointer")
+	}
+	if E.ID, err = readID(buf); err != nil {
+		return
+	}
+	E.Message, err = readMessage(buf)
+	return
+}
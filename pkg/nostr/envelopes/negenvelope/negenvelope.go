@@ -0,0 +1,61 @@
+// Package negenvelope implements the NIP-77 negentropy envelopes, NEG-OPEN,
+// NEG-MSG, NEG-CLOSE and NEG-ERR.
+package negenvelope
+
+import (
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/text"
+	"mleku.online/git/slog"
+)
+
+var log = slog.GetStd()
+
+// readID reads the subscription ID that follows the label of an envelope.
+func readID(buf *text.Buffer) (id subscriptionid.T, err error) {
+	// Next, find the comma after the label.
+	if err = buf.ScanThrough(','); err != nil {
+		return
+	}
+	// Next character we find will be open quotes for the subscription ID.
+	if err = buf.ScanThrough('"'); err != nil {
+		return
+	}
+	var sid []byte
+	if sid, err = buf.ReadUntil('"'); log.Fail(err) {
+		err = fmt.Errorf("unterminated quotes in JSON, probably truncated read")
+		return
+	}
+	// move past the closing quote
+	if err = buf.ScanThrough('"'); err != nil {
+		return
+	}
+	return subscriptionid.T(sid), nil
+}
+
+// readString reads the next string of an envelope.
+func readString(buf *text.Buffer) (s []byte, err error) {
+	if err = buf.ScanThrough('"'); err != nil {
+		return
+	}
+	if s, err = buf.ReadUntil('"'); log.Fail(err) {
+		err = fmt.Errorf("unterminated quotes in JSON, probably truncated read")
+		return
+	}
+	err = buf.ScanThrough('"')
+	return
+}
+
+// readMessage reads a hex encoded negentropy message.
+func readMessage(buf *text.Buffer) (msg []byte, err error) {
+	var s []byte
+	if s, err = readString(buf); err != nil {
+		return
+	}
+	if msg, err = hex.Dec(string(s)); err != nil {
+		err = fmt.Errorf("negentropy message is not hex: %w", err)
+	}
+	return
+}
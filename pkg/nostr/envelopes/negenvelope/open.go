@@ -0,0 +1,63 @@
+package negenvelope
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/labels"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/interfaces/enveloper"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/array"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/wire/text"
+)
+
+// Open is sent by a client to start reconciling the events matching a filter,
+// with the first negentropy message.
+type Open struct {
+	ID      subscriptionid.T
+	Filter  *filter.T
+	Message []byte
+}
+
+var _ enveloper.I = &Open{}
+
+func (E *Open) UnmarshalJSON(b []byte) error {
+	return E.Unmarshal(text.NewBuffer(b))
+}
+
+func (E *Open) Label() string { return labels.NEGOPEN }
+
+func (E *Open) ToArray() array.T {
+	return array.T{labels.NEGOPEN, E.ID, E.Filter, hex.Enc(E.Message)}
+}
+
+func (E *Open) String() string { return E.ToArray().String() }
+
+func (E *Open) Bytes() []byte { return E.ToArray().Bytes() }
+
+func (E *Open) MarshalJSON() ([]byte, error) { return E.Bytes(), nil }
+
+// Unmarshal the envelope.
+func (E *Open) Unmarshal(buf *text.Buffer) (err error) {
+	if E == nil {
+		return fmt.Errorf("cannot unmarshal to nil pointer")
+	}
+	if E.ID, err = readID(buf); err != nil {
+		return
+	}
+	if err = buf.ScanUntil('{'); err != nil {
+		return fmt.Errorf("filter not found in negentropy open envelope")
+	}
+	var f []byte
+	if f, err = buf.ReadEnclosed(); log.Fail(err) {
+		return
+	}
+	E.Filter = &filter.T{}
+	if err = json.Unmarshal(f, E.Filter); err != nil {
+		return
+	}
+	E.Message, err = readMessage(buf)
+	return
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/eoseenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/eventenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/labels"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/negenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/noticeenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/okenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/reqenvelope"
@@ -141,6 +142,14 @@ func Read(buf *text.Buffer, match string) (env enveloper.I, err error) {
 			log.D.Ln(err)
 			return
 		}
+	case labels.NEGOPEN:
+		env = &negenvelope.Open{}
+	case labels.NEGMSG:
+		env = &negenvelope.Msg{}
+	case labels.NEGCLOSE:
+		env = &negenvelope.Close{}
+	case labels.NEGERR:
+		env = &negenvelope.Err{}
 	default:
 		// this should not happen so it is an error
 		err = fmt.Errorf("unable to match envelope '%s': '%s'", match, buf)
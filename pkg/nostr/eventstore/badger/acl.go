@@ -0,0 +1,62 @@
+package badger
+
+import (
+	"github.com/dgraph-io/badger/v4"
+)
+
+// ACLEntry is an entry in an access control list, such as a banned public key
+// or a blocked IP address, with the reason it was added.
+type ACLEntry struct {
+	Entry  string
+	Reason string
+}
+
+// aclKey returns the key of an entry in a list, which is the list name and the
+// entry separated by a zero byte.
+func aclKey(list, entry string) []byte {
+	k := make([]byte, 0, 1+len(list)+1+len(entry))
+	k = append(k, aclPrefix)
+	k = append(k, list...)
+	k = append(k, 0)
+	return append(k, entry...)
+}
+
+// SetACL adds an entry to an access control list, or replaces its reason if
+// it is already there.
+func (b *BadgerBackend) SetACL(list, entry, reason string) (err error) {
+	return b.Update(func(txn *badger.Txn) error {
+		return txn.Set(aclKey(list, entry), []byte(reason))
+	})
+}
+
+// DeleteACL removes an entry from an access control list.
+func (b *BadgerBackend) DeleteACL(list, entry string) (err error) {
+	return b.Update(func(txn *badger.Txn) error {
+		return txn.Delete(aclKey(list, entry))
+	})
+}
+
+// ListACL returns all the entries of an access control list.
+func (b *BadgerBackend) ListACL(list string) (entries []ACLEntry, err error) {
+	err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := aclKey(list, "")
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var reason []byte
+			if reason, err = item.ValueCopy(nil); err != nil {
+				return
+			}
+			entries = append(entries, ACLEntry{
+				Entry:  string(item.Key()[len(prefix):]),
+				Reason: string(reason),
+			})
+		}
+		return
+	})
+	return
+}
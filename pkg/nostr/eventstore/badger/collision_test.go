@@ -0,0 +1,149 @@
+package badger
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+)
+
+// colliding returns a 32 byte hex value that starts with the same 8 bytes as
+// every other value with the same prefix.
+func colliding(prefix uint64, i int) string {
+	return fmt.Sprintf("%016x%048x", prefix, i)
+}
+
+func queryIDs(t *testing.T, b *BadgerBackend, f *filter.T) (ids []string) {
+	for _, ev := range storetest.Query(t, b, f) {
+		ids = append(ids, ev.ID.String())
+	}
+	return
+}
+
+// collidingEvents stores events whose ids, pubkeys and tag values all start
+// with the same 8 bytes.
+func collidingEvents(t testing.TB, b *BadgerBackend, n int) (evs []*event.T) {
+	for i := 0; i < n; i++ {
+		pk := colliding(0xbeef, i)
+		ev := &event.T{
+			ID:        eventid.T(colliding(0xdead, i)),
+			PubKey:    pk,
+			CreatedAt: 1700000000,
+			Kind:      1,
+			Tags: tags.T{
+				{"e", colliding(0xcafe, i)},
+				{"a", "30023:" + pk + ":article"},
+			},
+			Content: fmt.Sprint(i),
+		}
+		if err := b.SaveEvent(context.Bg(), ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	return
+}
+
+func TestCollidingIDs(t *testing.T) {
+	b := testBackend(t)
+	c := context.Bg()
+	evs := collidingEvents(t, b, 3)
+	if err := b.SaveEvent(c, evs[1]); !errors.Is(err,
+		eventstore.ErrDupEvent) {
+		t.Fatalf("saving an event again got %v", err)
+	}
+	for _, ev := range evs {
+		got := queryIDs(t, b, &filter.T{IDs: []string{ev.ID.String()}})
+		if fmt.Sprint(got) != fmt.Sprint([]string{ev.ID.String()}) {
+			t.Fatalf("query for %s got %v", ev.ID, got)
+		}
+		n, err := b.CountEvents(c, &filter.T{IDs: []string{ev.ID.String()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("count for %s is %d", ev.ID, n)
+		}
+	}
+	// an id that was never stored, with the same prefix
+	if got := queryIDs(t, b, &filter.T{
+		IDs: []string{colliding(0xdead, 99)}}); len(got) != 0 {
+		t.Fatalf("query for a missing id got %v", got)
+	}
+	if err := b.DeleteEvent(c, evs[1]); err != nil {
+		t.Fatal(err)
+	}
+	for i, ev := range evs {
+		got := queryIDs(t, b, &filter.T{IDs: []string{ev.ID.String()}})
+		if deleted := len(got) == 0; deleted != (i == 1) {
+			t.Fatalf("after deleting event 1, query for event %d got %v",
+				i, got)
+		}
+	}
+	// deleting an event that isn't stored leaves the others alone
+	missing := *evs[0]
+	missing.ID = eventid.T(colliding(0xdead, 99))
+	if err := b.DeleteEvent(c, &missing); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryIDs(t, b, &filter.T{}); len(got) != 2 {
+		t.Fatalf("after deleting a missing event %d are stored", len(got))
+	}
+}
+
+func TestCollidingPubkeysAndTags(t *testing.T) {
+	b := testBackend(t)
+	evs := collidingEvents(t, b, 3)
+	for i, ev := range evs {
+		want := fmt.Sprint([]string{ev.ID.String()})
+		for _, f := range []*filter.T{
+			{Authors: []string{ev.PubKey}},
+			{Authors: []string{ev.PubKey}, Kinds: kinds.T{1}},
+			{Tags: filter.TagMap{"#e": {ev.Tags[0][1]}}},
+			{Tags: filter.TagMap{"e": {ev.Tags[0][1]}}},
+			{Tags: filter.TagMap{"#a": {ev.Tags[1][1]}}},
+		} {
+			if got := queryIDs(t, b, f); fmt.Sprint(got) != want {
+				t.Fatalf("event %d: query %s got %v", i, f, got)
+			}
+		}
+	}
+	// a tag value with the wrong tag name
+	if got := queryIDs(t, b, &filter.T{
+		Tags: filter.TagMap{"p": {evs[0].Tags[0][1]}}}); len(got) != 0 {
+		t.Fatalf("query for an e tag as a p tag got %v", got)
+	}
+}
+
+func BenchmarkCollidingIDs(b *testing.B) {
+	for _, n := range []int{1, 16, 256} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			db := testBackend(b)
+			evs := collidingEvents(b, db, n)
+			c := context.Bg()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ev := evs[i%n]
+				if err := db.SaveEvent(c, ev); !errors.Is(err,
+					eventstore.ErrDupEvent) {
+					b.Fatal(err)
+				}
+				ch, err := db.QueryEvents(c,
+					&filter.T{IDs: []string{ev.ID.String()}})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for range ch {
+				}
+			}
+		})
+	}
+}
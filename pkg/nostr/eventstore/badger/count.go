@@ -15,12 +15,12 @@ import (
 func (b *BadgerBackend) CountEvents(c context.T, f *filter.T) (int64, error) {
 	var count int64 = 0
 
-	queries, extraFilter, since, err := prepareQueries(f)
-	if err != nil {
-		return 0, err
-	}
+	err := b.View(func(txn *badger.Txn) (err error) {
+		queries, extraFilter, since, _, err := b.planQuery(txn, f)
+		if err != nil {
+			return err
+		}
 
-	err = b.View(func(txn *badger.Txn) (err error) {
 		// iterate only through keys and in reverse order
 		opts := badger.IteratorOptions{
 			Reverse: true,
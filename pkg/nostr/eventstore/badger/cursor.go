@@ -0,0 +1,45 @@
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// cursorKey returns the key of a named cursor.
+func cursorKey(name string) []byte {
+	return append([]byte{cursorPrefix}, name...)
+}
+
+// SetCursor stores the timestamp that a named cursor has reached, such as
+// the created_at of the newest event mirrored from an upstream relay.
+func (b *BadgerBackend) SetCursor(name string, ts timestamp.T) (err error) {
+	return b.Update(func(txn *badger.Txn) error {
+		return txn.Set(cursorKey(name),
+			binary.BigEndian.AppendUint64(nil, uint64(ts)))
+	})
+}
+
+// GetCursor returns the timestamp stored for a named cursor, or zero if it
+// has not been set.
+func (b *BadgerBackend) GetCursor(name string) (ts timestamp.T, err error) {
+	err = b.View(func(txn *badger.Txn) (err error) {
+		var item *badger.Item
+		if item, err = txn.Get(cursorKey(name)); errors.Is(err,
+			badger.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return errors.New("cursor value is not 8 bytes")
+			}
+			ts = timestamp.T(binary.BigEndian.Uint64(val))
+			return nil
+		})
+	})
+	return
+}
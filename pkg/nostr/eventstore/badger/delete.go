@@ -1,68 +1,95 @@
 package badger
 
 import (
+	"errors"
+	"sync/atomic"
+
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
 
-	"github.com/Hubmakerlabs/replicatr/pkg/hex"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
 	"github.com/dgraph-io/badger/v4"
 )
 
-var serialDelete uint32 = 0
+// serialDelete counts the deletions, which happen concurrently.
+var serialDelete atomic.Uint32
 
 func (b *BadgerBackend) DeleteEvent(c context.T, evt *event.T) (err error) {
 	deletionHappened := false
 
-	err = b.Update(func(txn *badger.Txn) (err error) {
-		idx := make([]byte, 1, 5)
-		idx[0] = rawEventStorePrefix
-
-		// query event by id to get its idx
-		idPrefix8, _ := hex.Dec(evt.ID[0 : 8*2].String())
-		prefix := make([]byte, 1+8)
-		prefix[0] = indexIdPrefix
-		copy(prefix[1:], idPrefix8)
-		opts := badger.IteratorOptions{
-			PrefetchValues: false,
+	for {
+		// deletions of events by the same pubkey conflict on its usage, and
+		// are retried
+		err = b.Update(func(txn *badger.Txn) (err error) {
+			deletionHappened, err = b.deleteEvent(txn, evt)
+			return
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			break
 		}
-		it := txn.NewIterator(opts)
-		it.Seek(prefix)
-		if it.ValidForPrefix(prefix) {
-			idx = append(idx, it.Item().Key()[1+8:]...)
+		if err = c.Err(); err != nil {
+			return
 		}
-		it.Close()
+	}
+	if err != nil {
+		return err
+	}
 
-		// if no idx was found, end here, this event doesn't exist
-		if len(idx) == 1 {
-			return nil
-		}
+	if deletionHappened {
+		b.collectGarbage()
+	}
 
-		// set this so we'll run the GC later
-		deletionHappened = true
+	return nil
+}
 
-		// calculate all index keys we have for this event and delete them
-		for _, k := range getIndexKeysForEvent(evt, idx[1:]) {
-			if err := txn.Delete(k); err != nil {
-				return err
-			}
-		}
+// deleteEvent removes an event and its indexes in a transaction, and returns
+// whether it was stored.
+func (b *BadgerBackend) deleteEvent(txn *badger.Txn, evt *event.T) (deleted bool,
+	err error) {
 
-		// delete the raw event
-		return txn.Delete(idx)
-	})
-	if err != nil {
-		return err
+	// query event by id to get its idx, and the stored event the index keys
+	// are made from
+	var idx []byte
+	if idx, evt, err = getByID(txn, evt.ID); err != nil || idx == nil {
+		// this event doesn't exist
+		return
+	}
+	var item *badger.Item
+	if item, err = txn.Get(idx); err != nil {
+		return
+	}
+	var size int64
+	if err = item.Value(func(val []byte) error {
+		size = int64(len(val))
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = unaccount(txn, evt, size); err != nil {
+		return
 	}
 
-	// after deleting, run garbage collector (sometimes)
-	if deletionHappened {
-		serialDelete = (serialDelete + 1) % 256
-		if serialDelete == 0 {
-			if err := b.RunValueLogGC(0.8); err != nil && err != badger.ErrNoRewrite {
-				log.D.Ln("badger gc error:" + err.Error())
-			}
+	// calculate all index keys we have for this event and delete them
+	for _, k := range getIndexKeysForEvent(evt, idx[1:]) {
+		if err = txn.Delete(k); err != nil {
+			return
 		}
 	}
 
-	return nil
+	for _, e := range b.getSearchEntriesForEvent(evt, idx[1:]) {
+		if err = txn.Delete(e.key); err != nil {
+			return
+		}
+	}
+
+	// delete the raw event
+	return true, txn.Delete(idx)
+}
+
+// collectGarbage runs the garbage collector after every 256 deletions.
+func (b *BadgerBackend) collectGarbage() {
+	if serialDelete.Add(1)%256 == 0 {
+		if err := b.RunValueLogGC(0.8); err != nil && err != badger.ErrNoRewrite {
+			log.D.Ln("badger gc error:" + err.Error())
+		}
+	}
 }
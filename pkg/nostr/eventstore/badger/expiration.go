@@ -0,0 +1,98 @@
+package badger
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DefaultReapInterval is how often expired events are deleted if the
+// ReapInterval of the BadgerBackend is not set.
+const DefaultReapInterval = time.Minute
+
+// reaper deletes expired events every ReapInterval until the context is
+// canceled.
+func (b *BadgerBackend) reaper(c context.T) {
+	ticker := time.NewTicker(b.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+			n, err := b.DeleteExpired(c, timestamp.Now())
+			if err != nil {
+				b.E.F("badger: failed to delete expired events: %s", err)
+				continue
+			}
+			if n > 0 {
+				b.D.F("badger: deleted %d expired events", n)
+			}
+		}
+	}
+}
+
+// DeleteExpired deletes all events with a NIP-40 expiration timestamp that is
+// not after now, and returns how many were deleted.
+func (b *BadgerBackend) DeleteExpired(c context.T,
+	now timestamp.T) (n int, err error) {
+
+	// collect the expired events first, as deleting them needs a write
+	// transaction of its own
+	var expired []*event.T
+	err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{indexExpirationPrefix}
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			if binary.BigEndian.Uint32(key[1:1+4]) > uint32(now) {
+				// the index is in order of expiration, so the rest are
+				// still valid
+				break
+			}
+			idx := make([]byte, 5)
+			idx[0] = rawEventStorePrefix
+			copy(idx[1:], key[1+4:])
+			var item *badger.Item
+			if item, err = txn.Get(idx); err != nil {
+				b.D.F("badger: failed to get expired event %x: %s", idx, err)
+				continue
+			}
+			if err = item.Value(func(val []byte) (err error) {
+				var ev *event.T
+				if ev, err = nostrbinary.Unmarshal(val); err != nil {
+					return
+				}
+				expired = append(expired, ev)
+				return
+			}); err != nil {
+				b.D.F("badger: failed to decode expired event %x: %s", idx, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, ev := range expired {
+		select {
+		case <-c.Done():
+			return
+		default:
+		}
+		if err = b.DeleteEvent(c, ev); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
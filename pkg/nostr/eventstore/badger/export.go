@@ -0,0 +1,109 @@
+package badger
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip40"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Export calls fn with every stored event that matches the filter, oldest
+// first, walking the created_at index from since to until. The limit and
+// search of the filter are ignored, and expired events are left out.
+//
+// If after is not nil the export resumes after that event, which is the last
+// one written by a previous export. Events with the same created_at are
+// visited in the order they were stored, so if after has been deleted since
+// all the events of its created_at are exported again.
+func (b *BadgerBackend) Export(c context.T, f *filter.T, after *event.T,
+	fn func(ev *event.T) error) (err error) {
+
+	var since, until uint32 = 0, math.MaxUint32
+	if f.Since != nil {
+		since = uint32(*f.Since)
+	}
+	if f.Until != nil && uint32(*f.Until) < until {
+		until = uint32(*f.Until)
+	}
+	if after != nil && uint32(after.CreatedAt) > since {
+		since = uint32(after.CreatedAt)
+	}
+	match := eventstore.MatchFilter(f)
+	now := timestamp.Now()
+	return b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{indexCreatedAtPrefix}
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		start := binary.BigEndian.AppendUint32([]byte{indexCreatedAtPrefix},
+			since)
+		// the events with the created_at of after are held back until after
+		// is found, as they have already been exported
+		resuming := after != nil
+		var pending []*event.T
+		flush := func() (err error) {
+			resuming = false
+			for _, ev := range pending {
+				if err = fn(ev); err != nil {
+					return
+				}
+			}
+			pending = nil
+			return
+		}
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			if err = c.Err(); err != nil {
+				return
+			}
+			key := it.Item().Key()
+			createdAt := binary.BigEndian.Uint32(key[1 : 1+4])
+			if createdAt > until {
+				break
+			}
+			if resuming && createdAt != uint32(after.CreatedAt) {
+				// after is gone, so its created_at is exported again
+				if err = flush(); err != nil {
+					return
+				}
+			}
+			idx := make([]byte, 5)
+			idx[0] = rawEventStorePrefix
+			copy(idx[1:], key[1+4:])
+			var item *badger.Item
+			if item, err = txn.Get(idx); err != nil {
+				b.D.F("badger: failed to get %x from created_at index: %s",
+					idx, err)
+				continue
+			}
+			var ev *event.T
+			if err = item.Value(func(val []byte) (err error) {
+				ev, err = nostrbinary.Unmarshal(val)
+				return
+			}); err != nil {
+				b.D.F("badger: value read error (idx %x): %s", idx, err)
+				continue
+			}
+			if resuming && ev.ID == after.ID {
+				resuming, pending = false, nil
+				continue
+			}
+			if nip40.IsExpired(ev, now) || !match.Matches(ev) {
+				continue
+			}
+			if resuming {
+				pending = append(pending, ev)
+				continue
+			}
+			if err = fn(ev); err != nil {
+				return
+			}
+		}
+		return flush()
+	})
+}
@@ -0,0 +1,82 @@
+package badger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+func exportIDs(t *testing.T, b *BadgerBackend, f *filter.T,
+	after *event.T) (ids []string) {
+
+	if err := b.Export(context.Bg(), f, after, func(ev *event.T) error {
+		ids = append(ids, ev.ID.String())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestExport(t *testing.T) {
+	b := testBackend(t)
+	c := context.Bg()
+	var evs []*event.T
+	for i := 0; i < 20; i++ {
+		ev := &event.T{
+			PubKey: fmt.Sprintf("%064x", i%2),
+			// pairs of events with the same created_at
+			CreatedAt: timestamp.T(1700000000 + i/2),
+			Kind:      1,
+			Content:   fmt.Sprint(i),
+		}
+		ev.ID = ev.GetID()
+		if err := b.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	all := exportIDs(t, b, &filter.T{}, nil)
+	if len(all) != len(evs) {
+		t.Fatalf("exported %d events, want %d", len(all), len(evs))
+	}
+	for i, id := range all {
+		if id != evs[i].ID.String() {
+			t.Fatalf("event %d exported out of order", i)
+		}
+	}
+	// resuming after each event exports the rest
+	for i, ev := range evs {
+		rest := exportIDs(t, b, &filter.T{}, ev)
+		if fmt.Sprint(rest) != fmt.Sprint(all[i+1:]) {
+			t.Fatalf("resuming after event %d exported %v, want %v", i,
+				rest, all[i+1:])
+		}
+	}
+	// resuming after a deleted event exports its created_at again
+	if err := b.DeleteEvent(c, evs[5]); err != nil {
+		t.Fatal(err)
+	}
+	rest := exportIDs(t, b, &filter.T{}, evs[5])
+	if want := append([]string{all[4]}, all[6:]...); fmt.Sprint(rest) !=
+		fmt.Sprint(want) {
+		t.Fatalf("resuming after a deleted event exported %v, want %v",
+			rest, want)
+	}
+	f := &filter.T{
+		Authors: []string{evs[1].PubKey},
+		Kinds:   kinds.T{1},
+		Since:   evs[4].CreatedAt.Ptr(),
+		Until:   evs[15].CreatedAt.Ptr(),
+	}
+	if got := exportIDs(t, b, f, nil); fmt.Sprint(got) !=
+		fmt.Sprint([]string{all[7], all[9], all[11], all[13],
+			all[15]}) {
+		t.Fatalf("filtered export got %v", got)
+	}
+}
@@ -1,18 +1,33 @@
 package badger
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
+	"math"
 
 	"github.com/Hubmakerlabs/replicatr/pkg/hex"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
-	"golang.org/x/exp/slices"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip40"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
 	"mleku.online/git/slog"
 )
 
 var log = slog.GetStd()
 
-func getTagIndexPrefix(tagValue string) ([]byte, int) {
+// maxTagValueLength is the longest tag value that is stored in the tag
+// indexes, longer values are indexed by a hash.
+const maxTagValueLength = 100
+
+// getTagIndexPrefix returns the index key of a tag, with room for the
+// created_at and idx at the end, and the offset where they go. The key starts
+// with the tag name, so tags with the same value and different names are in
+// different ranges of the index.
+func getTagIndexPrefix(name byte, tagValue string) ([]byte, int) {
 	// the key with full length for created_at and idx at the end, but not
 	// filled with these
 	var k []byte
@@ -20,28 +35,38 @@ func getTagIndexPrefix(tagValue string) ([]byte, int) {
 	// start
 	var offset int
 
-	if kind, pkb, d := eventstore.GetAddrTagElements(tagValue); len(pkb) == 32 {
+	if len(tagValue) > maxTagValueLength {
+		// store a prefix of the hash of long values
+		h := sha256.Sum256([]byte(tagValue))
+		k = make([]byte, 1+1+8+4+4)
+		k[0] = indexTagHashPrefix
+		k[1] = name
+		copy(k[1+1:], h[0:8])
+		offset = 1 + 1 + 8
+	} else if kind, pkb, d := eventstore.GetAddrTagElements(tagValue); len(pkb) == 32 {
 		// store value in the new special "a" tag index
-		k = make([]byte, 1+2+8+len(d)+4+4)
+		k = make([]byte, 1+1+2+8+len(d)+4+4)
 		k[0] = indexTagAddrPrefix
-		binary.BigEndian.PutUint16(k[1:], kind)
-		copy(k[1+2:], pkb[0:8])
-		copy(k[1+2+8:], d)
-		offset = 1 + 2 + 8 + len(d)
+		k[1] = name
+		binary.BigEndian.PutUint16(k[1+1:], kind)
+		copy(k[1+1+2:], pkb[0:8])
+		copy(k[1+1+2+8:], d)
+		offset = 1 + 1 + 2 + 8 + len(d)
 	} else if vb, _ := hex.Dec(tagValue); len(vb) == 32 {
 		// store value as bytes
-		k = make([]byte, 1+8+4+4)
+		k = make([]byte, 1+1+8+4+4)
 		k[0] = indexTag32Prefix
-		copy(k[1:], vb[0:8])
-		offset = 1 + 8
+		k[1] = name
+		copy(k[1+1:], vb[0:8])
+		offset = 1 + 1 + 8
 	} else {
 		// store whatever as utf-8
-		k = make([]byte, 1+len(tagValue)+4+4)
+		k = make([]byte, 1+1+len(tagValue)+4+4)
 		k[0] = indexTagPrefix
-		copy(k[1:], tagValue)
-		offset = 1 + len(tagValue)
+		k[1] = name
+		copy(k[1+1:], tagValue)
+		offset = 1 + 1 + len(tagValue)
 	}
-
 	return k, offset
 }
 
@@ -92,35 +117,102 @@ func getIndexKeysForEvent(evt *event.T, idx []byte) [][]byte {
 		keys = append(keys, k)
 	}
 
-	// ~ by tagvalue+date
-	slices.SortFunc(evt.Tags, eventstore.TagSorter)
-	for i, tag := range evt.Tags {
-		if len(tag) < 2 || len(tag[0]) != 1 || len(tag[1]) == 0 || len(tag[1]) > 100 {
+	// ~ by tagname+tagvalue+date
+	keys = append(keys, getTagIndexKeys(evt, idx)...)
+
+	{
+		// ~ by date only
+		k := make([]byte, 1+4+4)
+		k[0] = indexCreatedAtPrefix
+		binary.BigEndian.PutUint32(k[1:], uint32(evt.CreatedAt))
+		copy(k[1+4:], idx)
+		keys = append(keys, k)
+	}
+
+	if k, ok := getExpirationIndexKey(evt, idx); ok {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// getExpirationIndexKey returns the expiration index key for an event, and
+// false if it has no NIP-40 expiration.
+func getExpirationIndexKey(evt *event.T, idx []byte) (k []byte, ok bool) {
+	var exp timestamp.T
+	if exp, ok = nip40.Expiration(evt); !ok {
+		return
+	}
+	// ~ by expiration date, clamped to the range of the key so that far
+	// future expirations don't wrap around into the past
+	if exp > math.MaxUint32 {
+		exp = math.MaxUint32
+	}
+	k = make([]byte, 1+4+4)
+	k[0] = indexExpirationPrefix
+	binary.BigEndian.PutUint32(k[1:], uint32(exp))
+	copy(k[1+4:], idx)
+	return
+}
+
+// getTagIndexKeys returns the tag index keys for an event. Only tags with a
+// single letter name and a value are indexed.
+func getTagIndexKeys(evt *event.T, idx []byte) (keys [][]byte) {
+	seen := make(map[string]struct{})
+	for _, tag := range evt.Tags {
+		if len(tag) < 2 || len(tag[0]) != 1 || len(tag[1]) == 0 {
 			// not indexable
 			continue
 		}
-		if i > 0 && evt.Tags[i-1][1] == tag[1] {
+		// get key prefix (with full length) and offset where to write the
+		// last parts
+		k, offset := getTagIndexPrefix(tag[0][0], tag[1])
+		if _, ok := seen[string(k[:offset])]; ok {
 			// duplicate
 			continue
 		}
-
-		// get key prefix (with full length) and offset where to write the last parts
-		k, offset := getTagIndexPrefix(tag[1])
-
+		seen[string(k[:offset])] = struct{}{}
 		// write the last parts (created_at and idx)
 		binary.BigEndian.PutUint32(k[offset:], uint32(evt.CreatedAt))
 		copy(k[offset+4:], idx)
 		keys = append(keys, k)
 	}
+	return
+}
 
-	{
-		// ~ by date only
-		k := make([]byte, 1+4+4)
-		k[0] = indexCreatedAtPrefix
-		binary.BigEndian.PutUint32(k[1:], uint32(evt.CreatedAt))
-		copy(k[1+4:], idx)
-		keys = append(keys, k)
-	}
+// getByID returns the key of the raw event stored with an id and the event,
+// or a nil key if there is none. The id index only has the first 8 bytes of
+// the id, so every event with the same prefix is decoded to compare the full
+// id.
+func getByID(txn *badger.Txn, id eventid.T) (idx []byte, evt *event.T,
+	err error) {
 
-	return keys
+	var id8 []byte
+	if len(id) != 64 {
+		return nil, nil, fmt.Errorf("invalid id '%s'", id)
+	}
+	if id8, err = hex.Dec(id[:8*2].String()); err != nil {
+		return nil, nil, fmt.Errorf("invalid id '%s'", id)
+	}
+	prefix := append([]byte{indexIdPrefix}, id8...)
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		candidate := append([]byte{rawEventStorePrefix}, key[1+8:]...)
+		var item *badger.Item
+		if item, err = txn.Get(candidate); err != nil {
+			return nil, nil, err
+		}
+		if err = item.Value(func(val []byte) (err error) {
+			evt, err = nostrbinary.Unmarshal(val)
+			return
+		}); err != nil {
+			return nil, nil, err
+		}
+		if evt.ID == id {
+			return candidate, evt, nil
+		}
+	}
+	return nil, nil, nil
 }
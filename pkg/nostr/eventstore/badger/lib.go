@@ -3,7 +3,10 @@ package badger
 import (
 	"encoding/binary"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
 	"github.com/dgraph-io/badger/v4"
 	"mleku.online/git/slog"
@@ -20,16 +23,57 @@ const (
 	indexTagPrefix        byte = 6
 	indexTag32Prefix      byte = 7
 	indexTagAddrPrefix    byte = 8
+	indexExpirationPrefix byte = 9
+	aclPrefix             byte = 10
+	indexSearchPrefix     byte = 11
+	cursorPrefix          byte = 12
+	tombstonePrefix       byte = 13
+	replaceablePrefix     byte = 14
+	indexTagHashPrefix    byte = 15
+	pubkeyUsagePrefix     byte = 16
 )
 
 var _ eventstore.Store = (*BadgerBackend)(nil)
+var _ eventstore.Explainer = (*BadgerBackend)(nil)
+var _ eventstore.Pager = (*BadgerBackend)(nil)
 
 type BadgerBackend struct {
 	Path     string
 	MaxLimit int
+	// ReapInterval is how often expired events are deleted. If it is zero the
+	// DefaultReapInterval is used, if it is negative expired events are never
+	// deleted, only hidden from query results.
+	ReapInterval time.Duration
+	// SearchDisabled turns off the full text search index. Filters with a
+	// search field then return nothing, and events stored while it is set
+	// are not searchable if it is turned on again.
+	SearchDisabled bool
+	// SearchTags is the names of the tags whose values are indexed for
+	// search along with the content. Changing it only affects events stored
+	// afterwards.
+	SearchTags []string
+	// MaxSearchCandidates is how many of the most recent events containing
+	// each search term are considered for the results, if it is zero the
+	// DefaultMaxSearchCandidates is used.
+	MaxSearchCandidates int
+	// MaxFanOut is the most ranges of an index that a query reads, each with
+	// its own iterator, if it is zero the DefaultMaxFanOut is used. Filters
+	// that would need more, such as many authors with many kinds, use another
+	// index.
+	MaxFanOut int
+	// Quota limits the events that are stored of each pubkey, events that
+	// would take a pubkey over it are rejected.
+	Quota Quota
+	// Retention is the rules the janitor deletes stored events by, if it is
+	// nil the janitor doesn't run.
+	Retention *Retention
 	*slog.Log
 	*badger.DB
-	seq *badger.Sequence
+	seq         *badger.Sequence
+	stopReaper  context.F
+	stopJanitor context.F
+	// background is the reaper and the janitor, which Close waits for
+	background sync.WaitGroup
 }
 
 func (b *BadgerBackend) Init() (err error) {
@@ -51,12 +95,44 @@ func (b *BadgerBackend) Init() (err error) {
 		b.MaxLimit = 500
 	}
 
+	if b.ReapInterval == 0 {
+		b.ReapInterval = DefaultReapInterval
+	}
+	if b.ReapInterval > 0 {
+		var c context.T
+		c, b.stopReaper = context.Cancel(context.Bg())
+		b.background.Add(1)
+		go func() {
+			defer b.background.Done()
+			b.reaper(c)
+		}()
+	}
+	if b.Retention != nil {
+		var c context.T
+		c, b.stopJanitor = context.Cancel(context.Bg())
+		b.background.Add(1)
+		go func() {
+			defer b.background.Done()
+			b.janitor(c)
+		}()
+	}
+
 	return nil
 }
 
 func (b *BadgerBackend) Close() {
-	log.E.Chk(b.DB.Close())
+	if b.stopReaper != nil {
+		b.stopReaper()
+	}
+	if b.stopJanitor != nil {
+		b.stopJanitor()
+	}
+	// a deletion that is running finishes before the database is closed
+	b.background.Wait()
+	// the sequence writes its lease back to the database, so it has to be
+	// released first
 	log.E.Chk(b.seq.Release())
+	log.E.Chk(b.DB.Close())
 }
 
 func (b *BadgerBackend) Serial() []byte {
@@ -5,65 +5,97 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
 	"github.com/dgraph-io/badger/v4"
 )
 
-func (b *BadgerBackend) runMigrations() (err error) {
-	return b.Update(func(txn *badger.Txn) (err error) {
-		var version uint16
+// migration is a step that brings the database up to a schema version.
+// Migrations run in increasing order of version and there is no rollback.
+type migration struct {
+	version uint16
+	name    string
+	run     func(b *BadgerBackend) error
+}
+
+// migrations is every schema version step, in increasing order. The last
+// one is the version of a new database.
+var migrations = []migration{
+	{3, "check for data from before version 3", (*BadgerBackend).checkEmpty},
+	{4, "build the search index", (*BadgerBackend).buildSearchIndex},
+	{5, "rewrite gob encoded events", (*BadgerBackend).rewriteLegacyEvents},
+	{6, "index tags by name", (*BadgerBackend).reindexTags},
+	{7, "count the events of each pubkey", (*BadgerBackend).countUsage},
+	{8, "index expirations", (*BadgerBackend).indexExpirations},
+}
 
+// SchemaVersion returns the schema version the database is at.
+func (b *BadgerBackend) SchemaVersion() (version uint16, err error) {
+	err = b.View(func(txn *badger.Txn) (err error) {
 		var item *badger.Item
-		item, err = txn.Get([]byte{dbVersionKey})
-		if errors.Is(err, badger.ErrKeyNotFound) {
-			version = 0
+		if item, err = txn.Get([]byte{dbVersionKey}); errors.Is(err,
+			badger.ErrKeyNotFound) {
+			return nil
 		} else if err != nil {
 			return
-		} else {
-			log.E.Chk(item.Value(func(val []byte) (err error) {
-				version = binary.BigEndian.Uint16(val)
-				return nil
-			}))
 		}
-
-		// do the migrations in increasing steps (there is no rollback)
-		//
-
-		// the 3 first migrations go to trash because on version 3 we need to export and import all the data anyway
-		if version < 3 {
-			// if there is any data in the relay we will stop and notify the user,
-			// otherwise we just set version to 3 and proceed
-			prefix := []byte{indexIdPrefix}
-			it := txn.NewIterator(badger.IteratorOptions{
-				PrefetchValues: true,
-				PrefetchSize:   100,
-				Prefix:         prefix,
-			})
-			defer it.Close()
-
-			hasAnyEntries := false
-			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-				hasAnyEntries = true
-				break
-			}
-
-			if hasAnyEntries {
-				return fmt.Errorf("your database is at version %d, but "+
-					"in order to migrate up to version 3 you must "+
-					"manually export all the events and then import "+
-					"again: run an old version of this software, export "+
-					"the data, then delete the database files, run the "+
-					"new version, import the data back in", version)
+		return item.Value(func(val []byte) error {
+			if len(val) != 2 {
+				return errors.New("schema version is not 2 bytes")
 			}
+			version = binary.BigEndian.Uint16(val)
+			return nil
+		})
+	})
+	return
+}
 
-			log.E.Chk(b.bumpVersion(txn, 3))
+func (b *BadgerBackend) runMigrations() (err error) {
+	var version uint16
+	if version, err = b.SchemaVersion(); err != nil {
+		return
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
 		}
-
-		if version < 4 {
-			// ...
+		log.I.F("badger: migrating to version %d: %s", m.version, m.name)
+		if err = m.run(b); err != nil {
+			return fmt.Errorf("migrating to version %d: %w", m.version, err)
 		}
+		if err = b.Update(func(txn *badger.Txn) error {
+			return b.bumpVersion(txn, m.version)
+		}); err != nil {
+			return
+		}
+		version = m.version
+	}
+	return
+}
 
-		return nil
-	})
+// checkEmpty fails if there are any events stored. The first 3 versions had
+// to be exported and imported again, so if there is any data in the relay we
+// stop and notify the user, otherwise the database goes to version 3.
+func (b *BadgerBackend) checkEmpty() (err error) {
+	var hasAnyEntries bool
+	if err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{indexIdPrefix}
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		it.Seek(prefix)
+		hasAnyEntries = it.ValidForPrefix(prefix)
+		return
+	}); err != nil {
+		return
+	}
+	if hasAnyEntries {
+		return fmt.Errorf("your database is at a version below 3 and " +
+			"must be exported and imported again: run an old version of " +
+			"this software, export the data, then delete the database " +
+			"files, run the new version and import the data back in " +
+			"with 'replicatrd import'")
+	}
+	return
 }
 
 func (b *BadgerBackend) bumpVersion(txn *badger.Txn, version uint16) (err error) {
@@ -71,3 +103,150 @@ func (b *BadgerBackend) bumpVersion(txn *badger.Txn, version uint16) (err error)
 	binary.BigEndian.PutUint16(buf, version)
 	return txn.Set([]byte{dbVersionKey}, buf)
 }
+
+// rewriteLegacyEvents re-encodes the stored events that are still gob encoded.
+// The indexes only refer to the serial of the raw event key, so they don't
+// change.
+func (b *BadgerBackend) rewriteLegacyEvents() (err error) {
+	wb := b.NewWriteBatch()
+	defer wb.Cancel()
+	var n int
+	if err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{rawEventStorePrefix}
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			idx := item.KeyCopy(nil)
+			var ev *event.T
+			var legacy bool
+			if err = item.Value(func(val []byte) (err error) {
+				if legacy = nostrbinary.IsLegacy(val); legacy {
+					ev, err = nostrbinary.Unmarshal(val)
+				}
+				return
+			}); err != nil {
+				b.D.F("badger: failed to decode event %x: %s", idx, err)
+				continue
+			}
+			if !legacy {
+				continue
+			}
+			var bin []byte
+			if bin, err = nostrbinary.Marshal(ev); err != nil {
+				return
+			}
+			if err = wb.Set(idx, bin); err != nil {
+				return
+			}
+			n++
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = wb.Flush(); err != nil {
+		return
+	}
+	log.I.F("badger: rewrote %d gob encoded events", n)
+	return
+}
+
+// reindexTags replaces the tag indexes, which used to only have the tag value,
+// with ones that start with the tag name.
+func (b *BadgerBackend) reindexTags() (err error) {
+	for _, prefix := range []byte{indexTagPrefix, indexTag32Prefix,
+		indexTagAddrPrefix, indexTagHashPrefix} {
+
+		if err = b.DropPrefix([]byte{prefix}); err != nil {
+			return
+		}
+	}
+	wb := b.NewWriteBatch()
+	defer wb.Cancel()
+	var n int
+	if err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{rawEventStorePrefix}
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			idx := item.KeyCopy(nil)
+			var ev *event.T
+			if err = item.Value(func(val []byte) (err error) {
+				ev, err = nostrbinary.Unmarshal(val)
+				return
+			}); err != nil {
+				b.D.F("badger: failed to decode event %x: %s", idx, err)
+				continue
+			}
+			for _, k := range getTagIndexKeys(ev, idx[1:]) {
+				if err = wb.Set(k, nil); err != nil {
+					return
+				}
+			}
+			n++
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = wb.Flush(); err != nil {
+		return
+	}
+	log.I.F("badger: reindexed the tags of %d events", n)
+	return
+}
+
+// indexExpirations adds the events with a NIP-40 expiration that were stored
+// before there was an expiration index to it, so that the reaper deletes them.
+func (b *BadgerBackend) indexExpirations() (err error) {
+	wb := b.NewWriteBatch()
+	defer wb.Cancel()
+	var n int
+	if err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{rawEventStorePrefix}
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			idx := item.KeyCopy(nil)
+			var ev *event.T
+			if err = item.Value(func(val []byte) (err error) {
+				ev, err = nostrbinary.Unmarshal(val)
+				return
+			}); err != nil {
+				b.D.F("badger: failed to decode event %x: %s", idx, err)
+				continue
+			}
+			k, ok := getExpirationIndexKey(ev, idx[1:])
+			if !ok {
+				continue
+			}
+			if err = wb.Set(k, nil); err != nil {
+				return
+			}
+			n++
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = wb.Flush(); err != nil {
+		return
+	}
+	log.I.F("badger: indexed the expiration of %d events", n)
+	return
+}
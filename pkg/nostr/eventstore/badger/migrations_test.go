@@ -0,0 +1,198 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// migrateFrom sets the schema version and runs the migrations after it.
+func migrateFrom(t *testing.T, b *BadgerBackend, version uint16) error {
+	if err := b.Update(func(txn *badger.Txn) error {
+		return b.bumpVersion(txn, version)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return b.runMigrations()
+}
+
+func TestMigrations(t *testing.T) {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version <= migrations[i-1].version {
+			t.Fatalf("migration to %d is after the migration to %d",
+				migrations[i].version, migrations[i-1].version)
+		}
+	}
+	b := testBackend(t)
+	version, err := b.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := migrations[len(migrations)-1].version; version != latest {
+		t.Fatalf("new database is at version %d, want %d", version, latest)
+	}
+}
+
+func TestMigrateCheckEmpty(t *testing.T) {
+	b := testBackend(t)
+	if err := migrateFrom(t, b, 0); err != nil {
+		t.Fatal(err)
+	}
+	ev := &event.T{PubKey: fmt.Sprintf("%064x", 1), Kind: 1}
+	ev.ID = ev.GetID()
+	if err := b.SaveEvent(context.Bg(), ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateFrom(t, b, 2); err == nil {
+		t.Fatal("migrated a database from before version 3 with events")
+	}
+	if version, _ := b.SchemaVersion(); version != 2 {
+		t.Fatalf("failed migration changed the version to %d", version)
+	}
+}
+
+func TestMigrateSearchIndex(t *testing.T) {
+	b := testBackend(t)
+	c := context.Bg()
+	ev := &event.T{
+		PubKey:    fmt.Sprintf("%064x", 1),
+		CreatedAt: 1700000000,
+		Kind:      1,
+		Content:   "the quick brown fox",
+	}
+	ev.ID = ev.GetID()
+	if err := b.SaveEvent(c, ev); err != nil {
+		t.Fatal(err)
+	}
+	// remove the event from the search index, as if it was stored before
+	// there was one
+	if err := b.DropPrefix([]byte{indexSearchPrefix}); err != nil {
+		t.Fatal(err)
+	}
+	f := &filter.T{Search: "fox"}
+	if got := len(storetest.Query(t, b, f)); got != 0 {
+		t.Fatalf("found %d events with no search index", got)
+	}
+	if err := migrateFrom(t, b, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(storetest.Query(t, b, f)); got != 1 {
+		t.Fatalf("found %d events after the migration, want 1", got)
+	}
+}
+
+func TestMigrateGob(t *testing.T) {
+	b := testBackend(t)
+	c := context.Bg()
+	const n = 10
+	for i := 0; i < n; i++ {
+		ev := &event.T{
+			PubKey:    fmt.Sprintf("%064x", i),
+			CreatedAt: timestamp.T(1700000000 + i),
+			Kind:      1,
+			Tags:      tags.T{{"t", "migration"}},
+			Content:   fmt.Sprintf("event %d", i),
+		}
+		ev.ID = ev.GetID()
+		ev.Sig = fmt.Sprintf("%0128x", i)
+		if err := b.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// store every event the way older versions did
+	rewrite := func(legacy bool) (count int) {
+		prefix := []byte{rawEventStorePrefix}
+		if err := b.Update(func(txn *badger.Txn) (err error) {
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+			defer it.Close()
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				var val []byte
+				if val, err = it.Item().ValueCopy(nil); err != nil {
+					return
+				}
+				if nostrbinary.IsLegacy(val) {
+					count++
+				}
+				if !legacy {
+					continue
+				}
+				var ev *event.T
+				if ev, err = nostrbinary.Unmarshal(val); err != nil {
+					return
+				}
+				var buf bytes.Buffer
+				if err = gob.NewEncoder(&buf).Encode(ev); err != nil {
+					return
+				}
+				if err = txn.Set(it.Item().KeyCopy(nil),
+					buf.Bytes()); err != nil {
+					return
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	rewrite(true)
+	if got := len(storetest.Query(t, b, &filter.T{})); got != n {
+		t.Fatalf("got %d gob encoded events, want %d", got, n)
+	}
+	if err := migrateFrom(t, b, 4); err != nil {
+		t.Fatal(err)
+	}
+	if count := rewrite(false); count != 0 {
+		t.Fatalf("%d events are still gob encoded", count)
+	}
+	evs := storetest.Query(t, b,
+		&filter.T{Tags: filter.TagMap{"t": {"migration"}}})
+	if len(evs) != n {
+		t.Fatalf("got %d events after the migration, want %d", len(evs), n)
+	}
+	for _, ev := range evs {
+		if ev.GetID() != ev.ID {
+			t.Fatalf("event %s changed in the migration", ev.ID)
+		}
+	}
+}
+
+func TestMigrateExpirationIndex(t *testing.T) {
+	b := testBackend(t)
+	c := context.Bg()
+	ev := &event.T{
+		PubKey:    fmt.Sprintf("%064x", 1),
+		CreatedAt: 1700000000,
+		Kind:      1,
+		Tags:      tags.T{{"expiration", "1700000100"}},
+	}
+	ev.ID = ev.GetID()
+	if err := b.SaveEvent(c, ev); err != nil {
+		t.Fatal(err)
+	}
+	// remove the event from the expiration index, as if it was stored
+	// before there was one
+	if err := b.DropPrefix([]byte{indexExpirationPrefix}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.DeleteExpired(c, 1700000200); err != nil || n != 0 {
+		t.Fatalf("deleted %d events with no expiration index, error %v", n,
+			err)
+	}
+	if err := migrateFrom(t, b, 7); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.DeleteExpired(c, 1700000200); err != nil || n != 1 {
+		t.Fatalf("deleted %d events after the migration, error %v", n, err)
+	}
+}
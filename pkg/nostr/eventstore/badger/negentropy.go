@@ -0,0 +1,85 @@
+package badger
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/negentropy"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip40"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// NegentropyItems returns the items for a negentropy reconciliation of the
+// events that match a filter, walking the created_at index from since to
+// until. The limit of the filter is ignored, as the whole set has to be
+// reconciled, but if more than max events match negentropy.ErrTooManyItems is
+// returned. A max of zero means there is no limit.
+func (b *BadgerBackend) NegentropyItems(c context.T, f *filter.T,
+	max int) (items []negentropy.Item, err error) {
+
+	var since, until uint32 = 0, math.MaxUint32
+	if f.Since != nil {
+		since = uint32(*f.Since)
+	}
+	if f.Until != nil && uint32(*f.Until) < until {
+		until = uint32(*f.Until)
+	}
+	match := eventstore.MatchFilter(f)
+	now := timestamp.Now()
+	err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{indexCreatedAtPrefix}
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		start := binary.BigEndian.AppendUint32([]byte{indexCreatedAtPrefix},
+			since)
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			select {
+			case <-c.Done():
+				return c.Err()
+			default:
+			}
+			key := it.Item().Key()
+			if binary.BigEndian.Uint32(key[1:1+4]) > until {
+				break
+			}
+			idx := make([]byte, 5)
+			idx[0] = rawEventStorePrefix
+			copy(idx[1:], key[1+4:])
+			var item *badger.Item
+			if item, err = txn.Get(idx); err != nil {
+				b.D.F("badger: failed to get %x from created_at index: %s",
+					idx, err)
+				continue
+			}
+			var ev *event.T
+			if err = item.Value(func(val []byte) (err error) {
+				ev, err = nostrbinary.Unmarshal(val)
+				return
+			}); err != nil {
+				b.D.F("badger: value read error (idx %x): %s", idx, err)
+				continue
+			}
+			if nip40.IsExpired(ev, now) || !match.Matches(ev) {
+				continue
+			}
+			if max > 0 && len(items) == max {
+				return negentropy.ErrTooManyItems
+			}
+			var ni negentropy.Item
+			if ni, err = negentropy.NewItem(uint64(ev.CreatedAt),
+				ev.ID.String()); err != nil {
+				b.D.F("badger: event %s has an invalid id", ev.ID)
+				continue
+			}
+			items = append(items, ni)
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,126 @@
+package badger
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+// saveTies stores n events created in each of the given number of seconds,
+// and returns them in the order queries return them.
+func saveTies(t *testing.T, b *BadgerBackend, pubkey string, seconds,
+	n int) (evs []*event.T) {
+
+	for i := 0; i < seconds*n; i++ {
+		ev := &event.T{
+			PubKey:    pubkey,
+			CreatedAt: timestamp.T(1700000000 + i/n),
+			Kind:      1,
+			Tags:      tags.T{{"t", "a"}, {"t", "b"}},
+			Content:   fmt.Sprint(i),
+		}
+		ev.ID = ev.GetID()
+		if err := b.SaveEvent(context.Bg(), ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	sort.Slice(evs, func(i, j int) bool { return eventstore.Less(evs[i], evs[j]) })
+	return
+}
+
+func TestQueryOrder(t *testing.T) {
+	b := testBackend(t)
+	b.MaxLimit = 7
+	r := rand.New(rand.NewSource(1))
+	all := saveTies(t, b, hexString(r), 4, 5)
+	// the limit cuts the events of a second at the same place every time
+	for i := 0; i < 3; i++ {
+		storetest.SameEvents(t,
+			storetest.Query(t, b, &filter.T{Kinds: kinds.T{1}}), all[:7])
+	}
+	// events found by both tag values are returned once
+	storetest.SameEvents(t, storetest.Query(t, b, &filter.T{
+		Tags: filter.TagMap{"#t": {"a", "b"}}}), all[:7])
+	ch, err := b.QueryEventsAfter(context.Bg(), &filter.T{},
+		eventstore.CursorOf(all[7]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var after []*event.T
+	for ev := range ch {
+		after = append(after, ev)
+	}
+	storetest.SameEvents(t, after, all[8:15])
+}
+
+func TestQueryLargeSecond(t *testing.T) {
+	b := testBackend(t)
+	b.MaxLimit = 7
+	r := rand.New(rand.NewSource(2))
+	all := saveTies(t, b, hexString(r), 1, 300)
+	// only the events of the second that can be returned are kept, and each
+	// is found by both tag values
+	f := &filter.T{Tags: filter.TagMap{"#t": {"a", "b"}}}
+	storetest.SameEvents(t, storetest.Query(t, b, f), all[:7])
+	ch, err := b.QueryEventsAfter(context.Bg(), f,
+		eventstore.CursorOf(all[150]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var after []*event.T
+	for ev := range ch {
+		after = append(after, ev)
+	}
+	storetest.SameEvents(t, after, all[151:158])
+}
+
+// hidePager hides that a store is a Pager, like stores that can't resume
+// after a cursor.
+type hidePager struct{ eventstore.Store }
+
+func TestPaginate(t *testing.T) {
+	b := testBackend(t)
+	b.MaxLimit = 7
+	r := rand.New(rand.NewSource(1))
+	all := saveTies(t, b, hexString(r), 8, 5)
+	saveTies(t, b, hexString(r), 3, 2)
+	author := all[0].PubKey
+	for _, c := range []struct {
+		name string
+		r    eventstore.RelayInterface
+		f    *filter.T
+		want []*event.T
+	}{
+		{"pager", eventstore.RelayWrapper{Store: b},
+			&filter.T{Authors: []string{author}, Limit: 3}, all},
+		{"pager until", eventstore.RelayWrapper{Store: b},
+			&filter.T{Authors: []string{author}, Limit: 2,
+				Until: all[12].CreatedAt.Ptr()}, all[10:]},
+		// without a cursor the events of a second have to fit in a page
+		{"until", eventstore.RelayWrapper{Store: hidePager{b}},
+			&filter.T{Authors: []string{author}}, all},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var got []*event.T
+			if err := eventstore.Paginate(context.Bg(), c.r, c.f,
+				func(ev *event.T) error {
+					got = append(got, ev)
+					return nil
+				}); err != nil {
+				t.Fatal(err)
+			}
+			storetest.SameEvents(t, got, c.want)
+		})
+	}
+}
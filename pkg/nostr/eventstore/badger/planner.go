@@ -0,0 +1,261 @@
+package badger
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DefaultMaxFanOut is the most ranges of an index that a query reads if
+// MaxFanOut is not set. Each range is read by its own iterator.
+const DefaultMaxFanOut = 64
+
+// estimateLimit is the most index entries that are counted to estimate the
+// cost of reading an index for a query.
+const estimateLimit = 1000
+
+// strategy is a way to find the events that match a filter in an index.
+type strategy struct {
+	index    string
+	prefixes [][]byte
+	// skipTimestamp is set for indexes whose keys have no created_at
+	skipTimestamp bool
+	// coversKinds is set if every event in the ranges has one of the kinds of
+	// the filter
+	coversKinds bool
+	eventstore.Candidate
+}
+
+// strategies returns the ways a filter can be queried. The ids of a filter
+// are always used if there are any, otherwise the other indexes are in order
+// of preference when their costs are the same, and the created_at index,
+// which has everything, is last.
+func strategies(f *filter.T) (s []*strategy, err error) {
+	if len(f.IDs) > 0 {
+		ids := &strategy{index: "ids", skipTimestamp: true}
+		for _, idHex := range f.IDs {
+			if len(idHex) != 64 {
+				return nil, fmt.Errorf("invalid id '%s'", idHex)
+			}
+			idPrefix8, _ := hex.Dec(idHex[0 : 8*2])
+			ids.prefixes = append(ids.prefixes,
+				append([]byte{indexIdPrefix}, idPrefix8...))
+		}
+		return []*strategy{ids}, nil
+	}
+	var pubkeyPrefixes [][]byte
+	for _, pubkeyHex := range f.Authors {
+		if len(pubkeyHex) != 64 {
+			return nil, fmt.Errorf("invalid pubkey '%s'", pubkeyHex)
+		}
+		pubkeyPrefix8, _ := hex.Dec(pubkeyHex[0 : 8*2])
+		pubkeyPrefixes = append(pubkeyPrefixes, pubkeyPrefix8)
+	}
+	if len(pubkeyPrefixes) > 0 && len(f.Kinds) > 0 {
+		pk := &strategy{index: "authors+kinds", coversKinds: true}
+		for _, pubkeyPrefix8 := range pubkeyPrefixes {
+			for _, k := range f.Kinds {
+				prefix := make([]byte, 1+8+2)
+				prefix[0] = indexPubkeyKindPrefix
+				copy(prefix[1:], pubkeyPrefix8)
+				binary.BigEndian.PutUint16(prefix[1+8:], uint16(k))
+				pk.prefixes = append(pk.prefixes, prefix)
+			}
+		}
+		s = append(s, pk)
+	}
+	if len(pubkeyPrefixes) > 0 {
+		p := &strategy{index: "authors"}
+		for _, pubkeyPrefix8 := range pubkeyPrefixes {
+			p.prefixes = append(p.prefixes,
+				append([]byte{indexPubkeyPrefix}, pubkeyPrefix8...))
+		}
+		s = append(s, p)
+	}
+	// tags with the same name are in the same ranges whether they were named
+	// with a '#' or not
+	tagValues := make(map[byte][]string)
+	for name, values := range f.Tags {
+		if len(name) == 2 && name[0] == '#' {
+			name = name[1:]
+		}
+		// only tags with single letter names are indexed, the others are
+		// only in the post filter
+		if len(name) == 1 && len(values) > 0 {
+			tagValues[name[0]] = append(tagValues[name[0]], values...)
+		}
+	}
+	names := make([]byte, 0, len(tagValues))
+	for name := range tagValues {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	for _, name := range names {
+		t := &strategy{index: "tag #" + string(name)}
+		for _, value := range tagValues[name] {
+			// get key prefix (with full length) and offset where to write the
+			// last parts, and remove the last parts to get just the prefix
+			k, offset := getTagIndexPrefix(name, value)
+			t.prefixes = append(t.prefixes, k[0:offset])
+		}
+		s = append(s, t)
+	}
+	if len(f.Kinds) > 0 {
+		k := &strategy{index: "kinds", coversKinds: true}
+		for _, kind := range f.Kinds {
+			prefix := make([]byte, 1+2)
+			prefix[0] = indexKindPrefix
+			binary.BigEndian.PutUint16(prefix[1:], uint16(kind))
+			k.prefixes = append(k.prefixes, prefix)
+		}
+		s = append(s, k)
+	}
+	s = append(s, &strategy{index: "created_at",
+		prefixes: [][]byte{{indexCreatedAtPrefix}}})
+	return
+}
+
+// countRange counts the entries of an index range created from since to
+// until, stopping at limit.
+func countRange(txn *badger.Txn, prefix []byte, since, until uint32,
+	limit int) (n int) {
+
+	it := txn.NewIterator(badger.IteratorOptions{Reverse: true})
+	defer it.Close()
+	for it.Seek(binary.BigEndian.AppendUint32(prefix, until)); it.ValidForPrefix(prefix) && n < limit; it.Next() {
+		key := it.Item().Key()
+		idxOffset := len(key) - 4
+		if binary.BigEndian.Uint32(key[idxOffset-4:idxOffset]) < since {
+			break
+		}
+		n++
+	}
+	return
+}
+
+// planQuery chooses the index that a filter is queried with, the one with
+// the fewest entries to read in the time range of the filter. The entries are
+// counted up to the fewest of any index counted before, so only the first
+// index is counted up to the estimateLimit. Indexes that need more ranges
+// than MaxFanOut are not considered, except for the ids, which are lookups of
+// a few entries each.
+func (b *BadgerBackend) planQuery(txn *badger.Txn, f *filter.T) (
+	queries []query,
+	extraFilter *filter.T,
+	since uint32,
+	plan *eventstore.Plan,
+	err error,
+) {
+	var cands []*strategy
+	if cands, err = strategies(f); err != nil {
+		return
+	}
+	var until uint32 = math.MaxUint32
+	if f.Until != nil {
+		if fu := uint32(*f.Until); fu < until {
+			until = fu + 1
+		}
+	}
+	if f.Since != nil {
+		since = uint32(*f.Since)
+	}
+	maxFanOut := b.MaxFanOut
+	if maxFanOut <= 0 {
+		maxFanOut = DefaultMaxFanOut
+	}
+	var best *strategy
+	for _, s := range cands {
+		s.Index, s.Ranges = s.index, len(s.prefixes)
+		if s.skipTimestamp {
+			// id lookups are counted by the number of ids
+			s.Estimate = len(s.prefixes)
+			best = s
+			break
+		}
+		if len(s.prefixes) > maxFanOut {
+			s.Rejected = fmt.Sprintf("%d ranges are over the limit of %d",
+				len(s.prefixes), maxFanOut)
+			continue
+		}
+		limit := estimateLimit
+		if best != nil {
+			limit = best.Estimate
+		}
+		for _, prefix := range s.prefixes {
+			s.Estimate += countRange(txn, prefix, since, until,
+				limit-s.Estimate)
+			if s.Estimate >= limit {
+				s.AtLeast = true
+				break
+			}
+		}
+		if best == nil || s.Estimate < best.Estimate {
+			best = s
+		}
+	}
+	plan = &eventstore.Plan{
+		Index:    best.Index,
+		Ranges:   best.Ranges,
+		Estimate: best.Estimate,
+		AtLeast:  best.AtLeast,
+	}
+	for _, s := range cands {
+		if s != best && s.Rejected == "" {
+			s.Rejected = "no fewer entries than " + best.index
+		}
+		plan.Candidates = append(plan.Candidates, s.Candidate)
+	}
+	for i, prefix := range best.prefixes {
+		queries = append(queries, query{
+			i:             i,
+			prefix:        prefix,
+			startingPoint: binary.BigEndian.AppendUint32(prefix, until),
+			results:       make(chan *event.T, 12),
+			skipTimestamp: best.skipTimestamp,
+		})
+	}
+	// the events found are checked for the fields that the index doesn't
+	// cover exactly, the ids, pubkeys and tag values are only prefixes
+	extraFilter = eventstore.MatchFilter(f)
+	if best.coversKinds {
+		extraFilter.Kinds = nil
+	}
+	if !best.skipTimestamp {
+		extraFilter.Since, extraFilter.Until = nil, nil
+	}
+	if extraFilter.IDs == nil && extraFilter.Kinds == nil &&
+		extraFilter.Authors == nil && extraFilter.Tags == nil &&
+		extraFilter.Since == nil && extraFilter.Until == nil {
+		extraFilter = nil
+	} else {
+		plan.PostFilter = extraFilter.String()
+	}
+	return
+}
+
+// Explain returns the plan for a filter, with the indexes that were
+// considered and their estimated costs, without running the query.
+func (b *BadgerBackend) Explain(c context.T, f *filter.T) (
+	plan *eventstore.Plan, err error) {
+
+	if f.Search != "" {
+		plan = &eventstore.Plan{Index: "search"}
+		if b.SearchDisabled {
+			plan.Index = "none, search is disabled"
+		}
+		return
+	}
+	err = b.View(func(txn *badger.Txn) (err error) {
+		_, _, _, plan, err = b.planQuery(txn, f)
+		return
+	})
+	return
+}
@@ -0,0 +1,104 @@
+package badger
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+func TestPlanQuery(t *testing.T) {
+	b := testBackend(t)
+	b.MaxLimit = 10000
+	c := context.Bg()
+	r := rand.New(rand.NewSource(1))
+	busy, quiet := hexString(r), hexString(r)
+	var evs []*event.T
+	save := func(pubkey string, k kind.T, tt tags.T) {
+		ev := &event.T{
+			PubKey:    pubkey,
+			CreatedAt: timestamp.T(1700000000 + len(evs)),
+			Kind:      k,
+			Tags:      tt,
+			Content:   fmt.Sprint(len(evs)),
+		}
+		ev.ID = ev.GetID()
+		if err := b.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	for i := 0; i < 1500; i++ {
+		save(busy, 1, tags.T{{"t", "nostr"}})
+	}
+	for i := 0; i < 5; i++ {
+		save(quiet, 7, tags.T{{"t", "rare"}})
+	}
+	save(quiet, 1, tags.T{{"t", "nostr"}})
+	var many []string
+	for i := 0; i < 100; i++ {
+		many = append(many, hexString(r))
+	}
+	for _, c := range []struct {
+		f     *filter.T
+		index string
+	}{
+		{&filter.T{}, "created_at"},
+		{&filter.T{IDs: []string{evs[3].ID.String()}}, "ids"},
+		{&filter.T{Kinds: kinds.T{7}}, "kinds"},
+		{&filter.T{Kinds: kinds.T{1, 7}, Authors: []string{quiet}},
+			"authors+kinds"},
+		{&filter.T{Kinds: kinds.T{1},
+			Tags: filter.TagMap{"#t": {"rare"}}}, "tag #t"},
+		{&filter.T{Authors: []string{quiet},
+			Tags: filter.TagMap{"#t": {"nostr"}}}, "authors"},
+		// too many ranges for authors+kinds or authors, and kind 7 is rare
+		{&filter.T{Authors: append(many, quiet),
+			Kinds: kinds.T{7, 8, 9}}, "kinds"},
+		{&filter.T{Authors: append(many, busy),
+			Kinds: kinds.T{1, 8, 9}}, "kinds"},
+	} {
+		plan, err := b.Explain(context.Bg(), c.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plan.Index != c.index {
+			t.Fatalf("filter %s uses %s, want %s:\n%s", c.f, plan.Index,
+				c.index, plan)
+		}
+		if plan.Ranges > DefaultMaxFanOut {
+			t.Fatalf("filter %s reads %d ranges", c.f, plan.Ranges)
+		}
+		// the results are the same whichever index is used
+		var want []string
+		for _, ev := range evs {
+			if eventstore.MatchFilter(c.f).Matches(ev) {
+				want = append(want, ev.ID.String())
+			}
+		}
+		got := queryIDs(t, b, c.f)
+		sort.Strings(want)
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("filter %s using %s got %d events, want %d", c.f,
+				plan.Index, len(got), len(want))
+		}
+		n, err := b.CountEvents(context.Bg(), c.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(n) != len(want) {
+			t.Fatalf("filter %s using %s counted %d events, want %d", c.f,
+				plan.Index, n, len(want))
+		}
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"container/heap"
 	"encoding/binary"
 	"errors"
-	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
-	"github.com/Hubmakerlabs/replicatr/pkg/hex"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip40"
 	nostr_binary "github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
 	"github.com/dgraph-io/badger/v4"
 )
 
@@ -27,11 +30,44 @@ type queryEvent struct {
 	query int
 }
 
+// QueryEvents returns the events that match the filter, newest first and, for
+// events created at the same time, by descending id, up to the limit of the
+// filter or the MaxLimit.
 func (b *BadgerBackend) QueryEvents(c context.T, f *filter.T) (chan *event.T, error) {
+	return b.QueryEventsAfter(c, f, nil)
+}
+
+// QueryEventsAfter is QueryEvents for the events that come after a cursor, or
+// all of them if it is nil.
+func (b *BadgerBackend) QueryEventsAfter(c context.T, f *filter.T,
+	after *eventstore.Cursor) (chan *event.T, error) {
+
+	if after != nil && (f.Until == nil || after.CreatedAt < f.Until.T()) {
+		// the events after the cursor were created at or before it
+		fc := *f
+		fc.Until = after.CreatedAt.Ptr()
+		f = &fc
+	}
+	if f.Search != "" {
+		if b.SearchDisabled {
+			ch := make(chan *event.T)
+			close(ch)
+			return ch, nil
+		}
+		// search results are ranked by relevance, not in the order of the
+		// cursor, so it only sets their until
+		return b.querySearch(c, f)
+	}
+
 	ch := make(chan *event.T)
 
-	queries, extraFilter, since, err := prepareQueries(f)
-	if err != nil {
+	var queries []query
+	var extraFilter *filter.T
+	var since uint32
+	if err := b.View(func(txn *badger.Txn) (err error) {
+		queries, extraFilter, since, _, err = b.planQuery(txn, f)
+		return
+	}); err != nil {
 		return nil, err
 	}
 
@@ -42,14 +78,19 @@ func (b *BadgerBackend) QueryEvents(c context.T, f *filter.T) (chan *event.T, er
 				Reverse: true,
 			}
 
-			// actually iterate
-			iteratorClosers := make([]func(), len(queries))
-			for i, q := range queries {
-				go func(i int, q query) {
-					it := txn.NewIterator(opts)
-					iteratorClosers[i] = it.Close
-
+			// actually iterate. each query closes its own iterator, and stops
+			// when done is closed, which happens when the limit is reached
+			// or the query is canceled. the transaction is discarded after
+			// they have all returned.
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			for _, q := range queries {
+				wg.Add(1)
+				go func(q query) {
+					defer wg.Done()
 					defer close(q.results)
+					it := txn.NewIterator(opts)
+					defer it.Close()
 
 					for it.Seek(q.startingPoint); it.ValidForPrefix(q.prefix); it.Next() {
 						item := it.Item()
@@ -70,7 +111,7 @@ func (b *BadgerBackend) QueryEvents(c context.T, f *filter.T) (chan *event.T, er
 						copy(idx[1:], key[idxOffset:])
 
 						// fetch actual event
-						item, err = txn.Get(idx)
+						item, err := txn.Get(idx)
 						if err != nil {
 							if errors.Is(err, badger.ErrDiscardedTxn) {
 								return
@@ -79,22 +120,32 @@ func (b *BadgerBackend) QueryEvents(c context.T, f *filter.T) (chan *event.T, er
 								idx, q.prefix, key, err)
 							return
 						}
-						b.Fail(item.Value(func(val []byte) (err error) {
-							var evt *event.T
+						var evt *event.T
+						if b.Fail(item.Value(func(val []byte) (err error) {
 							if evt, err = nostr_binary.Unmarshal(val); err != nil {
 								b.D.F("badger: value read error (id %x): %s", val[0:32], err)
-								return err
 							}
+							return
+						})) {
+							continue
+						}
 
-							// check if this matches the other filters that were not part of the index
-							if extraFilter == nil || extraFilter.Matches(evt) {
-								q.results <- evt
-							}
+						// expired events that have not been reaped yet are not returned
+						if nip40.IsExpired(evt, timestamp.Now()) {
+							continue
+						}
 
-							return nil
-						}))
+						// check if this matches the other filters that were not part of the index
+						if extraFilter != nil && !extraFilter.Matches(evt) {
+							continue
+						}
+						select {
+						case q.results <- evt:
+						case <-done:
+							return
+						}
 					}
-				}(i, q)
+				}(q)
 			}
 
 			// max number of events we'll return
@@ -118,9 +169,8 @@ func (b *BadgerBackend) QueryEvents(c context.T, f *filter.T) (chan *event.T, er
 			// now it's a good time to schedule this
 			defer func() {
 				close(ch)
-				for _, itclose := range iteratorClosers {
-					itclose()
-				}
+				close(done)
+				wg.Wait()
 			}()
 
 			// queue may be empty here if we have literally nothing
@@ -130,17 +180,61 @@ func (b *BadgerBackend) QueryEvents(c context.T, f *filter.T) (chan *event.T, er
 
 			heap.Init(&emitQueue)
 
+			// the events created at the same time are collected and emitted
+			// by descending id, so the order, and where the limit cuts it, is
+			// the same every time. only as many as can still be emitted are
+			// kept, so a second with very many events doesn't fill memory,
+			// and an event found by more than one query is kept once.
+			var group []*event.T
+			addToGroup := func(evt *event.T) {
+				if after != nil && after.Passed(evt) {
+					return
+				}
+				i := sort.Search(len(group), func(i int) bool {
+					return group[i].ID <= evt.ID
+				})
+				if i < len(group) && group[i].ID == evt.ID {
+					return
+				}
+				size := limit - emittedEvents
+				if i >= size {
+					return
+				}
+				if len(group) == size {
+					group = group[:size-1]
+				}
+				group = append(group, nil)
+				copy(group[i+1:], group[i:])
+				group[i] = evt
+			}
+			emitGroup := func() (done bool) {
+				for _, evt := range group {
+					select {
+					case ch <- evt:
+					case <-c.Done():
+						return true
+					}
+					// stop when reaching limit
+					emittedEvents++
+					if emittedEvents == limit {
+						return true
+					}
+				}
+				group = group[:0]
+				return false
+			}
+
 			// iterate until we've emitted all events required
-			for {
-				// emit latest event in queue
+			groupCreatedAt := emitQueue[0].CreatedAt
+			for len(emitQueue) > 0 {
 				latest := emitQueue[0]
-				ch <- latest.T
-
-				// stop when reaching limit
-				emittedEvents++
-				if emittedEvents == limit {
-					break
+				if latest.CreatedAt != groupCreatedAt {
+					if emitGroup() {
+						return nil
+					}
+					groupCreatedAt = latest.CreatedAt
 				}
+				addToGroup(latest.T)
 
 				// fetch a new one from query results and replace the previous one with it
 				if evt, ok := <-queries[latest.query].results; ok {
@@ -149,13 +243,9 @@ func (b *BadgerBackend) QueryEvents(c context.T, f *filter.T) (chan *event.T, er
 				} else {
 					// if this query has no more events we just remove this and proceed normally
 					heap.Remove(&emitQueue, 0)
-
-					// check if the list is empty and end
-					if len(emitQueue) == 0 {
-						break
-					}
 				}
 			}
+			emitGroup()
 
 			return nil
 		})
@@ -192,122 +282,3 @@ func (pq *priorityQueue) Pop() any {
 	*pq = old[0 : n-1]
 	return item
 }
-
-func prepareQueries(f *filter.T) (
-	queries []query,
-	extraFilter *filter.T,
-	since uint32,
-	err error,
-) {
-	var index byte
-
-	if len(f.IDs) > 0 {
-		index = indexIdPrefix
-		queries = make([]query, len(f.IDs))
-		for i, idHex := range f.IDs {
-			prefix := make([]byte, 1+8)
-			prefix[0] = index
-			if len(idHex) != 64 {
-				return nil, nil, 0, fmt.Errorf("invalid id '%s'", idHex)
-			}
-			idPrefix8, _ := hex.Dec(idHex[0 : 8*2])
-			copy(prefix[1:], idPrefix8)
-			queries[i] = query{i: i, prefix: prefix, skipTimestamp: true}
-		}
-	} else if len(f.Authors) > 0 {
-		if len(f.Kinds) == 0 {
-			index = indexPubkeyPrefix
-			queries = make([]query, len(f.Authors))
-			for i, pubkeyHex := range f.Authors {
-				if len(pubkeyHex) != 64 {
-					return nil, nil, 0, fmt.Errorf("invalid pubkey '%s'", pubkeyHex)
-				}
-				pubkeyPrefix8, _ := hex.Dec(pubkeyHex[0 : 8*2])
-				prefix := make([]byte, 1+8)
-				prefix[0] = index
-				copy(prefix[1:], pubkeyPrefix8)
-				queries[i] = query{i: i, prefix: prefix}
-			}
-		} else {
-			index = indexPubkeyKindPrefix
-			queries = make([]query, len(f.Authors)*len(f.Kinds))
-			i := 0
-			for _, pubkeyHex := range f.Authors {
-				for _, kind := range f.Kinds {
-					if len(pubkeyHex) != 64 {
-						return nil, nil, 0, fmt.Errorf("invalid pubkey '%s'", pubkeyHex)
-					}
-					pubkeyPrefix8, _ := hex.Dec(pubkeyHex[0 : 8*2])
-					prefix := make([]byte, 1+8+2)
-					prefix[0] = index
-					copy(prefix[1:], pubkeyPrefix8)
-					binary.BigEndian.PutUint16(prefix[1+8:], uint16(kind))
-					queries[i] = query{i: i, prefix: prefix}
-					i++
-				}
-			}
-		}
-		extraFilter = &filter.T{Tags: f.Tags}
-	} else if len(f.Tags) > 0 {
-		// determine the size of the queries array by inspecting all tags sizes
-		size := 0
-		for _, values := range f.Tags {
-			size += len(values)
-		}
-		if size == 0 {
-			return nil, nil, 0, fmt.Errorf("empty tag filters")
-		}
-
-		queries = make([]query, size)
-
-		extraFilter = &filter.T{Kinds: f.Kinds}
-		i := 0
-		for _, values := range f.Tags {
-			for _, value := range values {
-				// get key prefix (with full length) and offset where to write the last parts
-				k, offset := getTagIndexPrefix(value)
-				// remove the last parts part to get just the prefix we want here
-				prefix := k[0:offset]
-
-				queries[i] = query{i: i, prefix: prefix}
-				i++
-			}
-		}
-	} else if len(f.Kinds) > 0 {
-		index = indexKindPrefix
-		queries = make([]query, len(f.Kinds))
-		for i, kind := range f.Kinds {
-			prefix := make([]byte, 1+2)
-			prefix[0] = index
-			binary.BigEndian.PutUint16(prefix[1:], uint16(kind))
-			queries[i] = query{i: i, prefix: prefix}
-		}
-	} else {
-		index = indexCreatedAtPrefix
-		queries = make([]query, 1)
-		prefix := make([]byte, 1)
-		prefix[0] = index
-		queries[0] = query{i: 0, prefix: prefix}
-		extraFilter = nil
-	}
-
-	var until uint32 = 4294967295
-	if f.Until != nil {
-		if fu := uint32(*f.Until); fu < until {
-			until = fu + 1
-		}
-	}
-	for i, q := range queries {
-		queries[i].startingPoint = binary.BigEndian.AppendUint32(q.prefix, uint32(until))
-		queries[i].results = make(chan *event.T, 12)
-	}
-
-	// this is where we'll end the iteration
-	if f.Since != nil {
-		if fs := uint32(*f.Since); fs > since {
-			since = fs
-		}
-	}
-
-	return queries, extraFilter, since, nil
-}
@@ -0,0 +1,182 @@
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Quota is the most events, and bytes of their encoding, that are stored of
+// each pubkey. A zero value is no limit. Deletion events are stored over the
+// quota, so users can always free up space.
+type Quota struct {
+	MaxEvents int64 `json:"max_events,omitempty"`
+	MaxBytes  int64 `json:"max_bytes,omitempty"`
+}
+
+// check returns ErrQuotaExceeded if storing an event of size bytes takes the
+// usage over the quota.
+func (q Quota) check(u Usage, size int64) error {
+	if q.MaxEvents > 0 && u.Events+1 > q.MaxEvents {
+		return fmt.Errorf("%w, %d of %d events stored",
+			eventstore.ErrQuotaExceeded, u.Events, q.MaxEvents)
+	}
+	if q.MaxBytes > 0 && u.Bytes+size > q.MaxBytes {
+		return fmt.Errorf("%w, %d of %d bytes stored",
+			eventstore.ErrQuotaExceeded, u.Bytes, q.MaxBytes)
+	}
+	return nil
+}
+
+// Usage is how many events of a pubkey are stored and the bytes of their
+// encoding.
+type Usage struct {
+	Events int64 `json:"events"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// usageKey returns the key of the usage of a pubkey, which is the pubkey as
+// bytes, or as it is if it isn't hex.
+func usageKey(pubkey string) []byte {
+	pk, err := hex.Dec(pubkey)
+	if err != nil || len(pk) != 32 {
+		pk = []byte(pubkey)
+	}
+	return append([]byte{pubkeyUsagePrefix}, pk...)
+}
+
+// getUsage reads the usage stored at a key.
+func getUsage(txn *badger.Txn, key []byte) (u Usage, err error) {
+	var item *badger.Item
+	if item, err = txn.Get(key); errors.Is(err, badger.ErrKeyNotFound) {
+		return Usage{}, nil
+	} else if err != nil {
+		return
+	}
+	err = item.Value(func(val []byte) error {
+		if len(val) != 16 {
+			return fmt.Errorf("usage %x is not 16 bytes", key)
+		}
+		u.Events = int64(binary.BigEndian.Uint64(val))
+		u.Bytes = int64(binary.BigEndian.Uint64(val[8:]))
+		return nil
+	})
+	return
+}
+
+// setUsage writes the usage stored at a key, removing it if there are no
+// events left.
+func setUsage(txn *badger.Txn, key []byte, u Usage) error {
+	if u.Events <= 0 {
+		return txn.Delete(key)
+	}
+	return txn.Set(key, u.encode())
+}
+
+// encode returns the value a usage is stored as.
+func (u Usage) encode() []byte {
+	val := make([]byte, 0, 16)
+	val = binary.BigEndian.AppendUint64(val, uint64(u.Events))
+	return binary.BigEndian.AppendUint64(val, uint64(u.Bytes))
+}
+
+// account adds an event that is being stored, with an encoding of size bytes,
+// to the usage of its pubkey, or returns ErrQuotaExceeded if that takes it
+// over the quota.
+func (b *BadgerBackend) account(txn *badger.Txn, evt *event.T,
+	size int64) (err error) {
+
+	key := usageKey(evt.PubKey)
+	var u Usage
+	if u, err = getUsage(txn, key); err != nil {
+		return
+	}
+	if evt.Kind != kind.Deletion {
+		if err = b.Quota.check(u, size); err != nil {
+			return
+		}
+	}
+	u.Events, u.Bytes = u.Events+1, u.Bytes+size
+	return setUsage(txn, key, u)
+}
+
+// unaccount removes an event that is being deleted, with an encoding of size
+// bytes, from the usage of its pubkey.
+func unaccount(txn *badger.Txn, evt *event.T, size int64) (err error) {
+	key := usageKey(evt.PubKey)
+	var u Usage
+	if u, err = getUsage(txn, key); err != nil {
+		return
+	}
+	u.Events, u.Bytes = u.Events-1, u.Bytes-size
+	return setUsage(txn, key, u)
+}
+
+// Usage returns how many events of a pubkey are stored and the bytes of their
+// encoding, which is what the Quota limits.
+func (b *BadgerBackend) Usage(pubkey string) (u Usage, err error) {
+	err = b.View(func(txn *badger.Txn) (err error) {
+		u, err = getUsage(txn, usageKey(pubkey))
+		return
+	})
+	return
+}
+
+// countUsage counts the events and bytes stored of each pubkey, for databases
+// from before they were counted when events are saved and deleted.
+func (b *BadgerBackend) countUsage() (err error) {
+	if err = b.DropPrefix([]byte{pubkeyUsagePrefix}); err != nil {
+		return
+	}
+	usage := make(map[string]*Usage)
+	if err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{rawEventStorePrefix}
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			var ev *event.T
+			var size int64
+			if err = item.Value(func(val []byte) (err error) {
+				size = int64(len(val))
+				ev, err = nostrbinary.Unmarshal(val)
+				return
+			}); err != nil {
+				b.D.F("badger: failed to decode event %x: %s", item.Key(), err)
+				continue
+			}
+			u, ok := usage[ev.PubKey]
+			if !ok {
+				u = &Usage{}
+				usage[ev.PubKey] = u
+			}
+			u.Events, u.Bytes = u.Events+1, u.Bytes+size
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	wb := b.NewWriteBatch()
+	defer wb.Cancel()
+	for pubkey, u := range usage {
+		if err = wb.Set(usageKey(pubkey), u.encode()); err != nil {
+			return
+		}
+	}
+	if err = wb.Flush(); err != nil {
+		return
+	}
+	log.I.F("badger: counted the events of %d pubkeys", len(usage))
+	return
+}
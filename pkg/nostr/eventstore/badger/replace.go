@@ -0,0 +1,146 @@
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/dgraph-io/badger/v4"
+)
+
+var _ eventstore.Replacer = (*BadgerBackend)(nil)
+
+// replaceableD returns the d tag that identifies the versions of a
+// replaceable event along with its pubkey and kind, which is empty for events
+// that are replaceable without parameters, and whether it is replaceable.
+func replaceableD(evt *event.T) (d string, ok bool) {
+	switch {
+	case evt.Kind.IsReplaceable():
+		return "", true
+	case evt.Kind.IsParameterizedReplaceable():
+		if t := evt.Tags.GetFirst([]string{"d", ""}); t != nil {
+			d = t.Value()
+		}
+		return d, true
+	}
+	return "", false
+}
+
+// replaceableKey returns the key that every replacement of the versions of an
+// event reads and writes, which is the kind, pubkey and d tag, and holds the
+// id of the latest version.
+func replaceableKey(k uint16, pubkey []byte, d string) []byte {
+	key := make([]byte, 0, 1+2+32+len(d))
+	key = append(key, replaceablePrefix)
+	key = binary.BigEndian.AppendUint16(key, k)
+	key = append(key, pubkey...)
+	return append(key, d...)
+}
+
+// ReplaceEvent implements eventstore.Replacer. The stored versions are found
+// and deleted, and the event stored, in one transaction. Replacements of the
+// same event conflict with each other through the replaceable key, so when
+// they run concurrently one of them is retried and sees the other's version.
+func (b *BadgerBackend) ReplaceEvent(c context.T, evt *event.T) (err error) {
+	d, ok := replaceableD(evt)
+	if !ok {
+		return b.SaveEvent(c, evt)
+	}
+	var pubkey, id []byte
+	if pubkey, err = hex.Dec(evt.PubKey); err != nil || len(pubkey) != 32 {
+		return fmt.Errorf("invalid pubkey '%s'", evt.PubKey)
+	}
+	if id, err = hex.Dec(evt.ID.String()); err != nil || len(id) != 32 {
+		return fmt.Errorf("invalid id '%s'", evt.ID)
+	}
+	key := replaceableKey(uint16(evt.Kind), pubkey, d)
+	var deleted bool
+	for {
+		err = b.Update(func(txn *badger.Txn) (err error) {
+			deleted = false
+			if _, err = txn.Get(key); err != nil &&
+				!errors.Is(err, badger.ErrKeyNotFound) {
+				return
+			}
+			var versions []*event.T
+			if versions, err = getVersions(txn, evt, pubkey, d); err != nil {
+				return
+			}
+			for _, v := range versions {
+				if v.ID == evt.ID {
+					return eventstore.ErrDupEvent
+				}
+				if !eventstore.IsOlder(v, evt) {
+					return eventstore.ErrOutdatedEvent
+				}
+			}
+			// the older versions are deleted first so they don't count
+			// towards the quota of the pubkey
+			for _, v := range versions {
+				if _, err = b.deleteEvent(txn, v); err != nil {
+					return
+				}
+				deleted = true
+			}
+			if err = b.saveEvent(txn, evt); err != nil {
+				return
+			}
+			return txn.Set(key, id)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+		if err = c.Err(); err != nil {
+			return
+		}
+	}
+	if deleted && err == nil {
+		b.collectGarbage()
+	}
+	return
+}
+
+// getVersions returns the stored events with the same pubkey, kind and d tag
+// as an event.
+func getVersions(txn *badger.Txn, evt *event.T, pubkey []byte,
+	d string) (versions []*event.T, err error) {
+
+	prefix := make([]byte, 0, 1+8+2)
+	prefix = append(prefix, indexPubkeyKindPrefix)
+	prefix = append(prefix, pubkey[:8]...)
+	prefix = binary.BigEndian.AppendUint16(prefix, uint16(evt.Kind))
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		k := it.Item().Key()
+		// the key ends with the created_at and the serial of the event
+		idx := append([]byte{rawEventStorePrefix}, k[len(prefix)+4:]...)
+		var item *badger.Item
+		if item, err = txn.Get(idx); errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return
+		}
+		var v *event.T
+		if err = item.Value(func(val []byte) (err error) {
+			v, err = nostrbinary.Unmarshal(val)
+			return
+		}); err != nil {
+			return
+		}
+		// the index only has a prefix of the pubkey
+		if v.PubKey != evt.PubKey {
+			continue
+		}
+		if vd, _ := replaceableD(v); vd != d {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return
+}
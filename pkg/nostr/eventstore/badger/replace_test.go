@@ -0,0 +1,125 @@
+package badger
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"mleku.online/git/slog"
+)
+
+func testBackend(t testing.TB) (b *BadgerBackend) {
+	b = &BadgerBackend{Path: t.TempDir(), Log: slog.New(os.Stderr, "test")}
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	return
+}
+
+func hexString(r *rand.Rand) string {
+	b := make([]byte, 32)
+	r.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func TestReplaceEventConcurrent(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := testBackend(t)
+	c := context.Bg()
+	pubkey := hexString(r)
+	for _, k := range []kind.T{kind.ProfileMetadata, kind.Article} {
+		t.Run(fmt.Sprint(k), func(t *testing.T) {
+			const n = 64
+			versions := make([]*event.T, n)
+			for i := range versions {
+				versions[i] = &event.T{
+					ID:     eventid.T(hexString(r)),
+					PubKey: pubkey,
+					// some versions are created at the same time, then the
+					// lowest id wins
+					CreatedAt: timestamp.T(1000 + r.Intn(n/2)),
+					Kind:      k,
+					Tags:      tags.T{{"d", "test"}},
+				}
+			}
+			newest := versions[0]
+			for _, v := range versions[1:] {
+				if eventstore.IsOlder(newest, v) {
+					newest = v
+				}
+			}
+			// the replacements start together so their transactions overlap
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			for _, v := range versions {
+				wg.Add(1)
+				go func(v *event.T) {
+					defer wg.Done()
+					<-start
+					err := b.ReplaceEvent(c, v)
+					if err != nil && !errors.Is(err, eventstore.ErrOutdatedEvent) {
+						t.Error(err)
+					}
+				}(v)
+			}
+			close(start)
+			wg.Wait()
+			evs := storetest.Query(t, b, &filter.T{Kinds: kinds.T{k},
+				Authors: tag.T{pubkey}})
+			if len(evs) != 1 || evs[0].ID != newest.ID {
+				t.Fatalf("%d versions are stored, want only %s", len(evs),
+					newest.ID)
+			}
+			// replacing with an older version or the same one stores nothing
+			if err := b.ReplaceEvent(c, versions[0]); versions[0] != newest &&
+				!errors.Is(err, eventstore.ErrOutdatedEvent) {
+				t.Fatalf("got error %v replacing with an older version", err)
+			}
+			if err := b.ReplaceEvent(c, newest); !errors.Is(err,
+				eventstore.ErrDupEvent) {
+				t.Fatalf("got error %v replacing with the same version", err)
+			}
+		})
+	}
+}
+
+func TestReplaceEventAddresses(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	b := testBackend(t)
+	c := context.Bg()
+	pubkey := hexString(r)
+	article := func(createdAt timestamp.T, d string) *event.T {
+		return &event.T{ID: eventid.T(hexString(r)), PubKey: pubkey,
+			CreatedAt: createdAt, Kind: kind.Article, Tags: tags.T{{"d", d}}}
+	}
+	// versions with another d tag or pubkey are not replaced
+	other := article(100, "other")
+	otherAuthor := article(100, "test")
+	otherAuthor.PubKey = hexString(r)
+	for _, ev := range []*event.T{other, otherAuthor, article(100, "test"),
+		article(200, "test")} {
+
+		if err := b.ReplaceEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evs := storetest.Query(t, b, &filter.T{Kinds: kinds.T{kind.Article}})
+	if len(evs) != 3 {
+		t.Fatalf("%d articles are stored, want 3", len(evs))
+	}
+}
@@ -0,0 +1,314 @@
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DefaultJanitorInterval is how often the janitor applies the retention rules
+// if their Interval is not set.
+const DefaultJanitorInterval = time.Hour
+
+// janitorBatch is how many events the janitor deletes in each transaction.
+const janitorBatch = 100
+
+// Retention is the rules for deleting stored events that the janitor applies.
+// A zero value leaves a rule out. Ages are in seconds from the created_at of
+// the events.
+type Retention struct {
+	// Kinds is how long the events of some kinds are kept.
+	Kinds []KindRetention `json:"kinds,omitempty"`
+	// MaxEventsPerPubkey and MaxBytesPerPubkey are the most events, and bytes
+	// of their encoding, that are kept of each pubkey. The oldest are deleted
+	// first, and replaceable events, which are the current state of
+	// something, are kept.
+	MaxEventsPerPubkey int64 `json:"max_events_per_pubkey,omitempty"`
+	MaxBytesPerPubkey  int64 `json:"max_bytes_per_pubkey,omitempty"`
+	// MaxReactionsPerTarget is how many of the newest reactions to each event
+	// are kept.
+	MaxReactionsPerTarget int `json:"max_reactions_per_target,omitempty"`
+	// UnlistedMaxAge is how long the events of pubkeys that are not in the
+	// Allowlist are kept.
+	UnlistedMaxAge int64    `json:"unlisted_max_age,omitempty"`
+	Allowlist      []string `json:"allowlist,omitempty"`
+	// Interval is the seconds between the runs of the janitor, if it is zero
+	// the DefaultJanitorInterval is used.
+	Interval int64 `json:"interval,omitempty"`
+}
+
+// KindRetention is how long the events of some kinds are kept.
+type KindRetention struct {
+	Kinds  kinds.T `json:"kinds"`
+	MaxAge int64   `json:"max_age"`
+}
+
+// janitor applies the retention rules every interval until the context is
+// canceled.
+func (b *BadgerBackend) janitor(c context.T) {
+	interval := DefaultJanitorInterval
+	if b.Retention.Interval > 0 {
+		interval = time.Duration(b.Retention.Interval) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+			n, err := b.ApplyRetention(c, b.Retention, timestamp.Now())
+			if err != nil {
+				b.E.F("badger: failed to apply retention rules: %s", err)
+				continue
+			}
+			if n > 0 {
+				b.I.F("badger: janitor deleted %d events", n)
+			}
+		}
+	}
+}
+
+// ApplyRetention deletes the events that the retention rules don't keep at
+// the time now, and returns how many were deleted.
+func (b *BadgerBackend) ApplyRetention(c context.T, r *Retention,
+	now timestamp.T) (n int, err error) {
+
+	// the raw event keys are collected first, as deleting the events needs
+	// write transactions of its own
+	var idxs [][]byte
+	if err = b.View(func(txn *badger.Txn) (err error) {
+		for _, kr := range r.Kinds {
+			if kr.MaxAge <= 0 {
+				continue
+			}
+			cutoff := now - timestamp.T(kr.MaxAge)
+			for _, k := range kr.Kinds {
+				prefix := binary.BigEndian.AppendUint16(
+					[]byte{indexKindPrefix}, uint16(k))
+				if err = b.eachEvent(txn, prefix, false,
+					func(idx []byte, ev *event.T, size int64) bool {
+						if ev.CreatedAt >= cutoff {
+							return false
+						}
+						idxs = append(idxs, idx)
+						return true
+					}); err != nil {
+					return
+				}
+			}
+		}
+		if r.UnlistedMaxAge > 0 || r.MaxEventsPerPubkey > 0 ||
+			r.MaxBytesPerPubkey > 0 {
+
+			if idxs, err = b.pubkeyRetention(txn, r, now, idxs); err != nil {
+				return
+			}
+		}
+		if r.MaxReactionsPerTarget > 0 {
+			if idxs, err = b.reactionRetention(txn, r, idxs); err != nil {
+				return
+			}
+		}
+		return
+	}); err != nil {
+		return
+	}
+	return b.deleteSerials(c, idxs)
+}
+
+// pubkeyRetention adds the raw event keys of the events that the rules for
+// pubkeys don't keep to idxs.
+func (b *BadgerBackend) pubkeyRetention(txn *badger.Txn, r *Retention,
+	now timestamp.T, idxs [][]byte) ([][]byte, error) {
+
+	allowed := make(map[string]bool, len(r.Allowlist))
+	for _, pubkey := range r.Allowlist {
+		allowed[pubkey] = true
+	}
+	cutoff := now - timestamp.T(r.UnlistedMaxAge)
+	prefix := []byte{pubkeyUsagePrefix}
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		pk := it.Item().KeyCopy(nil)[1:]
+		if len(pk) != 32 {
+			// not a pubkey that is in the indexes
+			continue
+		}
+		pubkey := hex.Enc(pk)
+		u, err := getUsage(txn, it.Item().Key())
+		if err != nil {
+			return idxs, err
+		}
+		over := func() bool {
+			return (r.MaxEventsPerPubkey > 0 &&
+				u.Events > r.MaxEventsPerPubkey) ||
+				(r.MaxBytesPerPubkey > 0 && u.Bytes > r.MaxBytesPerPubkey)
+		}
+		unlisted := r.UnlistedMaxAge > 0 && !allowed[pubkey]
+		if !unlisted && !over() {
+			continue
+		}
+		// the events of the pubkey, oldest first
+		if err = b.eachEvent(txn, append([]byte{indexPubkeyPrefix}, pk[:8]...),
+			false, func(idx []byte, ev *event.T, size int64) bool {
+				// the index only has a prefix of the pubkey
+				if ev.PubKey != pubkey {
+					return true
+				}
+				expired := unlisted && ev.CreatedAt < cutoff
+				if !expired && !over() {
+					return false
+				}
+				if !expired && (ev.Kind.IsReplaceable() ||
+					ev.Kind.IsParameterizedReplaceable()) {
+					return true
+				}
+				idxs = append(idxs, idx)
+				u.Events, u.Bytes = u.Events-1, u.Bytes-size
+				return true
+			}); err != nil {
+			return idxs, err
+		}
+	}
+	return idxs, nil
+}
+
+// reactionRetention adds the raw event keys of the reactions that are older
+// than the newest MaxReactionsPerTarget to the same event to idxs.
+func (b *BadgerBackend) reactionRetention(txn *badger.Txn, r *Retention,
+	idxs [][]byte) ([][]byte, error) {
+
+	reactions := make(map[string]int)
+	prefix := binary.BigEndian.AppendUint16([]byte{indexKindPrefix},
+		uint16(kind.Reaction))
+	err := b.eachEvent(txn, prefix, true,
+		func(idx []byte, ev *event.T, size int64) bool {
+			// the event reacted to is the last e tag
+			var target string
+			for _, t := range ev.Tags {
+				if len(t) >= 2 && t[0] == "e" {
+					target = t[1]
+				}
+			}
+			if target == "" {
+				return true
+			}
+			reactions[target]++
+			if reactions[target] > r.MaxReactionsPerTarget {
+				idxs = append(idxs, idx)
+			}
+			return true
+		})
+	return idxs, err
+}
+
+// eachEvent calls fn with the raw event key, the event and the size of its
+// encoding for each entry of an index range whose keys end with the created_at
+// and serial, oldest first or newest first if reverse is set, until fn returns
+// false.
+func (b *BadgerBackend) eachEvent(txn *badger.Txn, prefix []byte, reverse bool,
+	fn func(idx []byte, ev *event.T, size int64) bool) (err error) {
+
+	it := txn.NewIterator(badger.IteratorOptions{
+		Prefix:  prefix,
+		Reverse: reverse,
+	})
+	defer it.Close()
+	start := prefix
+	if reverse {
+		start = append(append([]byte{}, prefix...), 0xff, 0xff, 0xff, 0xff,
+			0xff)
+	}
+	for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		idx := append([]byte{rawEventStorePrefix}, key[len(key)-4:]...)
+		var item *badger.Item
+		if item, err = txn.Get(idx); errors.Is(err, badger.ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return
+		}
+		var ev *event.T
+		var size int64
+		if err = item.Value(func(val []byte) (err error) {
+			size = int64(len(val))
+			ev, err = nostrbinary.Unmarshal(val)
+			return
+		}); err != nil {
+			b.D.F("badger: failed to decode event %x: %s", idx, err)
+			err = nil
+			continue
+		}
+		if !fn(idx, ev, size) {
+			return
+		}
+	}
+	return
+}
+
+// deleteSerials deletes the events stored at raw event keys, a batch in each
+// transaction, and returns how many were deleted.
+func (b *BadgerBackend) deleteSerials(c context.T, idxs [][]byte) (n int,
+	err error) {
+
+	for len(idxs) > 0 {
+		if err = c.Err(); err != nil {
+			return
+		}
+		batch := idxs
+		if len(batch) > janitorBatch {
+			batch = batch[:janitorBatch]
+		}
+		var deleted int
+		err = b.Update(func(txn *badger.Txn) (err error) {
+			deleted = 0
+			for _, idx := range batch {
+				var item *badger.Item
+				if item, err = txn.Get(idx); errors.Is(err,
+					badger.ErrKeyNotFound) {
+					// more than one rule can delete an event
+					continue
+				} else if err != nil {
+					return
+				}
+				var ev *event.T
+				if err = item.Value(func(val []byte) (err error) {
+					ev, err = nostrbinary.Unmarshal(val)
+					return
+				}); err != nil {
+					return
+				}
+				var ok bool
+				if ok, err = b.deleteEvent(txn, ev); err != nil {
+					return
+				} else if ok {
+					deleted++
+				}
+			}
+			return
+		})
+		if errors.Is(err, badger.ErrConflict) {
+			// an event of the same pubkey was saved, so the batch is retried
+			continue
+		} else if err != nil {
+			return
+		}
+		n += deleted
+		for i := 0; i < deleted; i++ {
+			b.collectGarbage()
+		}
+		idxs = idxs[len(batch):]
+	}
+	return
+}
@@ -0,0 +1,208 @@
+package badger
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+func newEvent(pubkey string, k kind.T, createdAt timestamp.T,
+	tt tags.T) *event.T {
+
+	ev := &event.T{PubKey: pubkey, CreatedAt: createdAt, Kind: k, Tags: tt,
+		Content: fmt.Sprint(rand.Int())}
+	ev.ID = ev.GetID()
+	return ev
+}
+
+func encodedSize(t *testing.T, evs ...*event.T) (size int64) {
+	for _, ev := range evs {
+		bin, err := nostrbinary.Marshal(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += int64(len(bin))
+	}
+	return
+}
+
+func checkUsage(t *testing.T, b *BadgerBackend, pubkey string,
+	evs ...*event.T) {
+
+	t.Helper()
+	u, err := b.Usage(pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Usage{int64(len(evs)), encodedSize(t, evs...)}); u != want {
+		t.Errorf("usage is %+v, want %+v", u, want)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	b := testBackend(t)
+	c := context.Bg()
+	r := rand.New(rand.NewSource(1))
+	author := hexString(r)
+	var evs []*event.T
+	for i := 0; i < 3; i++ {
+		ev := newEvent(author, kind.TextNote, timestamp.T(100+i), nil)
+		if err := b.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	checkUsage(t, b, author, evs...)
+	b.Quota = Quota{MaxEvents: 3}
+	err := b.SaveEvent(c, newEvent(author, kind.TextNote, 200, nil))
+	if !errors.Is(err, eventstore.ErrQuotaExceeded) {
+		t.Fatalf("saving over the quota returned %v", err)
+	}
+	// other pubkeys have their own quota
+	if err = b.SaveEvent(c, newEvent(hexString(r), kind.TextNote, 200,
+		nil)); err != nil {
+		t.Fatal(err)
+	}
+	// deletions are stored over the quota
+	deletion := newEvent(author, kind.Deletion, 300,
+		tags.T{{"e", evs[0].ID.String()}})
+	if err = b.SaveEvent(c, deletion); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.DeleteEvent(c, evs[0]); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage(t, b, author, evs[1], evs[2], deletion)
+	if err = b.DeleteEvent(c, evs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SaveEvent(c, newEvent(author, kind.TextNote, 400,
+		nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// replacing an event doesn't need room for both versions
+	other := hexString(r)
+	profile := newEvent(other, kind.ProfileMetadata, 100, nil)
+	b.Quota = Quota{MaxBytes: encodedSize(t, profile) + 10}
+	if err = b.ReplaceEvent(c, profile); err != nil {
+		t.Fatal(err)
+	}
+	update := newEvent(other, kind.ProfileMetadata, 200, nil)
+	if err = b.ReplaceEvent(c, update); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage(t, b, other, update)
+	err = b.SaveEvent(c, newEvent(other, kind.TextNote, 300, nil))
+	if !errors.Is(err, eventstore.ErrQuotaExceeded) {
+		t.Fatalf("saving over the quota returned %v", err)
+	}
+}
+
+func TestMigrateUsage(t *testing.T) {
+	b := testBackend(t)
+	c := context.Bg()
+	r := rand.New(rand.NewSource(1))
+	a, bb := hexString(r), hexString(r)
+	var evs []*event.T
+	for i := 0; i < 5; i++ {
+		ev := newEvent([]string{a, bb}[i%2], kind.TextNote,
+			timestamp.T(100+i), nil)
+		if err := b.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+	}
+	if err := b.DropPrefix([]byte{pubkeyUsagePrefix}); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage(t, b, a)
+	if err := migrateFrom(t, b, 6); err != nil {
+		t.Fatal(err)
+	}
+	checkUsage(t, b, a, evs[0], evs[2], evs[4])
+	checkUsage(t, b, bb, evs[1], evs[3])
+}
+
+func TestRetention(t *testing.T) {
+	b := testBackend(t)
+	b.MaxLimit = 10000
+	c := context.Bg()
+	r := rand.New(rand.NewSource(1))
+	listed, unlisted, busy := hexString(r), hexString(r), hexString(r)
+	note := newEvent(listed, kind.TextNote, 1000, nil)
+	var keep, drop []*event.T
+	save := func(ev *event.T, kept bool) {
+		if err := b.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+		if kept {
+			keep = append(keep, ev)
+		} else {
+			drop = append(drop, ev)
+		}
+	}
+	save(note, true)
+	// kinds with a max age
+	save(newEvent(listed, kind.EncryptedDirectMessage, 1500, nil), false)
+	save(newEvent(listed, kind.EncryptedDirectMessage, 2500, nil), true)
+	// pubkeys that are not in the allowlist
+	save(newEvent(unlisted, kind.TextNote, 1500, nil), false)
+	save(newEvent(unlisted, kind.ProfileMetadata, 1500, nil), false)
+	save(newEvent(unlisted, kind.TextNote, 2500, nil), true)
+	// the most events of each pubkey, keeping replaceable events
+	save(newEvent(busy, kind.ProfileMetadata, 100, nil), true)
+	for i := 0; i < 6; i++ {
+		save(newEvent(busy, kind.TextNote, timestamp.T(2100+i), nil), i >= 2)
+	}
+	// the newest reactions to each event
+	for i := 0; i < 4; i++ {
+		save(newEvent(hexString(r), kind.Reaction, timestamp.T(2200+i),
+			tags.T{{"e", hexString(r)}, {"e", note.ID.String()}}), i >= 1)
+	}
+	rules := &Retention{
+		Kinds: []KindRetention{{Kinds: kinds.T{kind.EncryptedDirectMessage},
+			MaxAge: 1000}},
+		MaxEventsPerPubkey:    5,
+		MaxReactionsPerTarget: 3,
+		UnlistedMaxAge:        1000,
+		Allowlist:             []string{listed, busy},
+	}
+	n, err := b.ApplyRetention(c, rules, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(drop) {
+		t.Errorf("deleted %d events, want %d", n, len(drop))
+	}
+	var got, want []string
+	for _, ev := range storetest.Query(t, b, &filter.T{}) {
+		got = append(got, ev.ID.String())
+	}
+	for _, ev := range keep {
+		want = append(want, ev.ID.String())
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	// applying the rules again deletes nothing
+	if n, err = b.ApplyRetention(c, rules, 3000); err != nil || n != 0 {
+		t.Errorf("applying the rules again deleted %d events, error %v", n,
+			err)
+	}
+}
@@ -1,51 +1,83 @@
 package badger
 
 import (
+	"errors"
+
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
 
-	"github.com/Hubmakerlabs/replicatr/pkg/hex"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
 	"github.com/dgraph-io/badger/v4"
 )
 
 func (b *BadgerBackend) SaveEvent(c context.T, evt *event.T) (err error) {
-	return b.Update(func(txn *badger.Txn) (err error) {
-		b.D.Ln("saving event")
-		// query event by id to ensure we don't save duplicates
-		id, _ := hex.Dec(evt.ID.String())
-		prefix := make([]byte, 1+8)
-		prefix[0] = indexIdPrefix
-		copy(prefix[1:], id)
-		it := txn.NewIterator(badger.IteratorOptions{})
-		defer it.Close()
-		it.Seek(prefix)
-		if it.ValidForPrefix(prefix) {
-			// event exists
-			return eventstore.ErrDupEvent
+	for {
+		// saves of events by the same pubkey conflict on its usage, and are
+		// retried
+		if err = b.Update(func(txn *badger.Txn) error {
+			return b.saveEvent(txn, evt)
+		}); !errors.Is(err, badger.ErrConflict) {
+			return
 		}
-		b.D.Ln("encoding to binary")
-		// encode to binary
-		var bin []byte
-		if bin, err = nostrbinary.Marshal(evt); b.Fail(err) {
-			return err
+		if err = c.Err(); err != nil {
+			return
 		}
-		b.D.F("binary encoded %x", bin)
-		idx := b.Serial()
-		// raw event store
-		b.D.F("setting event")
-		if err = txn.Set(idx, bin); b.Fail(err) {
+	}
+}
+
+// saveEvent stores an event and its indexes in a transaction, unless it is
+// already stored or was deleted.
+func (b *BadgerBackend) saveEvent(txn *badger.Txn, evt *event.T) (err error) {
+	b.D.Ln("saving event")
+	// query event by id to ensure we don't save duplicates
+	var dup []byte
+	if dup, _, err = getByID(txn, evt.ID); b.Fail(err) {
+		return err
+	} else if dup != nil {
+		return eventstore.ErrDupEvent
+	}
+	// events that were deleted by their author can't be stored again
+	var deleted bool
+	if deleted, err = isDeleted(txn, evt); b.Fail(err) {
+		return err
+	} else if deleted {
+		return eventstore.ErrEventDeleted
+	}
+	b.D.Ln("encoding to binary")
+	// encode to binary
+	var bin []byte
+	if bin, err = nostrbinary.Marshal(evt); b.Fail(err) {
+		return err
+	}
+	b.D.F("binary encoded %x", bin)
+	// the events of each pubkey are counted for its quota
+	if err = b.account(txn, evt, int64(len(bin))); err != nil {
+		return err
+	}
+	idx := b.Serial()
+	// raw event store
+	b.D.F("setting event")
+	if err = txn.Set(idx, bin); b.Fail(err) {
+		return err
+	}
+	b.D.F("get index keys for event")
+	for _, k := range getIndexKeysForEvent(evt, idx[1:]) {
+		b.D.F("index key %x", k)
+		if err = txn.Set(k, nil); b.Fail(err) {
 			return err
 		}
-		b.D.F("get index keys for event")
-		for _, k := range getIndexKeysForEvent(evt, idx[1:]) {
-			b.D.F("index key %x", k)
-			if err = txn.Set(k, nil); b.Fail(err) {
-				return err
-			}
+	}
+	if err = setSearchEntries(txn,
+		b.getSearchEntriesForEvent(evt, idx[1:])); b.Fail(err) {
+		return err
+	}
+	if evt.Kind == kind.Deletion {
+		if err = setTombstones(txn, evt); b.Fail(err) {
+			return err
 		}
-		b.D.F("event saved")
-		return nil
-	})
+	}
+	b.D.F("event saved")
+	return nil
 }
@@ -0,0 +1,273 @@
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip40"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip50"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nostrbinary"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// DefaultMaxSearchCandidates is the number of most recent events containing
+// each search term that are considered if MaxSearchCandidates is not set.
+const DefaultMaxSearchCandidates = 10000
+
+// searchEntry is a key of the search index and the number of times its term
+// occurs in the event.
+type searchEntry struct {
+	key   []byte
+	count uint16
+}
+
+// searchTermPrefix returns the prefix of the search index keys of a term.
+func searchTermPrefix(term string) (k []byte) {
+	k = make([]byte, 0, 1+len(term)+1+4+4)
+	k = append(k, indexSearchPrefix)
+	k = append(k, term...)
+	// terms never contain a zero byte, so this ends the term
+	return append(k, 0)
+}
+
+// getSearchEntriesForEvent returns the search index keys of an event:
+//
+//	[prefix][term][0][created_at][idx]
+func (b *BadgerBackend) getSearchEntriesForEvent(ev *event.T,
+	idx []byte) (entries []searchEntry) {
+
+	if b.SearchDisabled {
+		return
+	}
+	for term, n := range nip50.Tokenize(nip50.Text(ev, b.SearchTags)) {
+		k := searchTermPrefix(term)
+		k = binary.BigEndian.AppendUint32(k, uint32(ev.CreatedAt))
+		k = append(k, idx...)
+		if n > math.MaxUint16 {
+			n = math.MaxUint16
+		}
+		entries = append(entries, searchEntry{k, uint16(n)})
+	}
+	return
+}
+
+// searchCandidate is an event that contains all the search terms.
+type searchCandidate struct {
+	idx       uint32
+	createdAt uint32
+	score     int
+}
+
+// querySearch finds the events that contain all the terms of the search field
+// of a filter and match its other fields. The results are ordered by the
+// number of times the terms occur in them, then by how recent they are.
+//
+// Only the MaxSearchCandidates most recent events containing each term are
+// considered, so very common terms only find recent events.
+func (b *BadgerBackend) querySearch(c context.T, f *filter.T) (ch chan *event.T,
+	err error) {
+
+	terms := nip50.QueryTerms(f.Search)
+	if len(terms) == 0 {
+		// nothing can contain a search that has no terms, such as one of
+		// only punctuation or extensions
+		ch = make(chan *event.T)
+		close(ch)
+		return
+	}
+	var since, until uint32 = 0, math.MaxUint32
+	if f.Since != nil {
+		since = uint32(*f.Since)
+	}
+	if f.Until != nil && uint32(*f.Until) < until {
+		until = uint32(*f.Until)
+	}
+	limit := b.MaxLimit
+	if f.Limit > 0 && f.Limit < limit {
+		limit = f.Limit
+	}
+	maxCandidates := b.MaxSearchCandidates
+	if maxCandidates <= 0 {
+		maxCandidates = DefaultMaxSearchCandidates
+	}
+	// the search terms are matched by the index, the rest of the filter is
+	// checked on the events
+	extraFilter := *f
+	extraFilter.Search = ""
+	ch = make(chan *event.T)
+	go func() {
+		defer close(ch)
+		err := b.View(func(txn *badger.Txn) (err error) {
+			var candidates map[uint32]*searchCandidate
+			for _, term := range terms {
+				found := b.scanSearchTerm(txn, term, since, until,
+					maxCandidates)
+				if candidates == nil {
+					candidates = found
+				} else {
+					// the terms are ANDed
+					for idx, cand := range candidates {
+						if other, ok := found[idx]; ok {
+							cand.score += other.score
+						} else {
+							delete(candidates, idx)
+						}
+					}
+				}
+				if len(candidates) == 0 {
+					return
+				}
+			}
+			ranked := make([]*searchCandidate, 0, len(candidates))
+			for _, cand := range candidates {
+				ranked = append(ranked, cand)
+			}
+			sort.Slice(ranked, func(i, j int) bool {
+				if ranked[i].score != ranked[j].score {
+					return ranked[i].score > ranked[j].score
+				}
+				return ranked[i].createdAt > ranked[j].createdAt
+			})
+			now := timestamp.Now()
+			emitted := 0
+			for _, cand := range ranked {
+				idx := make([]byte, 5)
+				idx[0] = rawEventStorePrefix
+				binary.BigEndian.PutUint32(idx[1:], cand.idx)
+				var item *badger.Item
+				if item, err = txn.Get(idx); err != nil {
+					if errors.Is(err, badger.ErrDiscardedTxn) {
+						return
+					}
+					b.D.F("badger: failed to get %x from search index: %s",
+						idx, err)
+					continue
+				}
+				var ev *event.T
+				if err = item.Value(func(val []byte) (err error) {
+					ev, err = nostrbinary.Unmarshal(val)
+					return
+				}); err != nil {
+					b.D.F("badger: value read error (idx %x): %s", idx, err)
+					continue
+				}
+				if nip40.IsExpired(ev, now) || !extraFilter.Matches(ev) {
+					continue
+				}
+				select {
+				case <-c.Done():
+					return nil
+				case ch <- ev:
+				}
+				if emitted++; emitted == limit {
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.D.F("badger: search txn error: %s", err)
+		}
+	}()
+	return
+}
+
+// scanSearchTerm returns the most recent events containing a term that were
+// created between since and until, with the number of times the term occurs
+// in them as their score.
+func (b *BadgerBackend) scanSearchTerm(txn *badger.Txn, term string, since,
+	until uint32, max int) (found map[uint32]*searchCandidate) {
+
+	found = make(map[uint32]*searchCandidate)
+	prefix := searchTermPrefix(term)
+	it := txn.NewIterator(badger.IteratorOptions{
+		PrefetchValues: true,
+		Reverse:        true,
+	})
+	defer it.Close()
+	start := binary.BigEndian.AppendUint32(append([]byte{}, prefix...), until)
+	// the keys of events created at until sort after the starting point
+	start = append(start, 0xff, 0xff, 0xff, 0xff)
+	for it.Seek(start); it.ValidForPrefix(prefix) && len(found) < max; it.Next() {
+		item := it.Item()
+		key := item.Key()
+		createdAt := binary.BigEndian.Uint32(key[len(prefix):])
+		if createdAt < since {
+			break
+		}
+		idx := binary.BigEndian.Uint32(key[len(prefix)+4:])
+		var count uint16 = 1
+		if err := item.Value(func(val []byte) (err error) {
+			if len(val) == 2 {
+				count = binary.BigEndian.Uint16(val)
+			}
+			return
+		}); err != nil {
+			b.D.F("badger: failed to read search index key %x: %s", key, err)
+			continue
+		}
+		found[idx] = &searchCandidate{idx: idx, createdAt: createdAt,
+			score: int(count)}
+	}
+	return
+}
+
+// setSearchEntries writes the search index keys of an event.
+func setSearchEntries(txn *badger.Txn, entries []searchEntry) (err error) {
+	for _, e := range entries {
+		if err = txn.Set(e.key,
+			binary.BigEndian.AppendUint16(nil, e.count)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// buildSearchIndex adds all the stored events to the search index.
+func (b *BadgerBackend) buildSearchIndex() (err error) {
+	wb := b.NewWriteBatch()
+	defer wb.Cancel()
+	var n int
+	if err = b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{rawEventStorePrefix}
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Prefix:         prefix,
+		})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			idx := item.KeyCopy(nil)
+			var ev *event.T
+			if err = item.Value(func(val []byte) (err error) {
+				ev, err = nostrbinary.Unmarshal(val)
+				return
+			}); err != nil {
+				b.D.F("badger: failed to decode event %x: %s", idx, err)
+				continue
+			}
+			for _, e := range b.getSearchEntriesForEvent(ev, idx[1:]) {
+				if err = wb.Set(e.key, binary.BigEndian.AppendUint16(nil,
+					e.count)); err != nil {
+					return
+				}
+			}
+			n++
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if err = wb.Flush(); err != nil {
+		return
+	}
+	log.I.F("badger: added %d events to the search index", n)
+	return
+}
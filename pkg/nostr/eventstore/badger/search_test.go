@@ -0,0 +1,162 @@
+package badger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestSearchWithoutTerms(t *testing.T) {
+	b := testBackend(t)
+	ev := &event.T{
+		PubKey:    fmt.Sprintf("%064x", 1),
+		CreatedAt: 1700000000,
+		Kind:      1,
+		Content:   "the quick brown fox",
+	}
+	ev.ID = ev.GetID()
+	if err := b.SaveEvent(context.Bg(), ev); err != nil {
+		t.Fatal(err)
+	}
+	// a search that has no terms finds nothing, like one with terms that
+	// aren't in any event
+	for _, search := range []string{"!?", "language:en", "fox", "wolf"} {
+		want := 0
+		if search == "fox" {
+			want = 1
+		}
+		got := len(storetest.Query(t, b, &filter.T{Search: search}))
+		if got != want {
+			t.Errorf("search '%s' found %d events, want %d", search, got, want)
+		}
+	}
+}
+
+// searchEvents stores events with the terms nostr and relay occurring
+// different numbers of times, and returns them.
+func searchEvents(t *testing.T, b *BadgerBackend) []*event.T {
+	evs := []*event.T{
+		storetest.NewEvent(1, kind.TextNote, 1000, "a nostr relay", nil),
+		storetest.NewEvent(2, kind.TextNote, 900, "Nostr, nostr relay", nil),
+		storetest.NewEvent(1, kind.TextNote, 1100, "nostr only", nil),
+		storetest.NewEvent(2, kind.Article, 1200, "relay for nostr", nil),
+		storetest.NewEvent(1, kind.TextNote, 800, "relay of nostr relays",
+			nil),
+		storetest.NewEvent(3, kind.TextNote, 1300, "relay relay nostr", nil),
+	}
+	for _, ev := range evs {
+		if err := b.SaveEvent(context.Bg(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return evs
+}
+
+func TestSearch(t *testing.T) {
+	b := testBackend(t)
+	evs := searchEvents(t, b)
+	for _, tc := range []struct {
+		name string
+		f    *filter.T
+		want []int
+	}{
+		// the terms are ANDed, and the events ranked by how often they
+		// occur, then by how recent they are
+		{"terms", &filter.T{Search: "nostr relay"}, []int{5, 1, 3, 0, 4}},
+		{"term", &filter.T{Search: "NOSTR"}, []int{1, 5, 3, 2, 0, 4}},
+		{"missing term", &filter.T{Search: "nostr fox"}, nil},
+		{"kinds", &filter.T{Search: "nostr relay",
+			Kinds: kinds.T{kind.Article}}, []int{3}},
+		{"authors", &filter.T{Search: "nostr relay",
+			Authors: []string{storetest.Pubkey(1)}}, []int{0, 4}},
+		{"since", &filter.T{Search: "nostr relay",
+			Since: timestamp.T(1000).Ptr()}, []int{5, 3, 0}},
+		{"until", &filter.T{Search: "nostr relay",
+			Until: timestamp.T(1000).Ptr()}, []int{1, 0, 4}},
+		{"limit", &filter.T{Search: "nostr relay", Limit: 2}, []int{5, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var want []*event.T
+			for _, i := range tc.want {
+				want = append(want, evs[i])
+			}
+			storetest.SameEvents(t, storetest.Query(t, b, tc.f), want)
+		})
+	}
+}
+
+func TestSearchTags(t *testing.T) {
+	b := testBackend(t)
+	b.SearchTags = []string{"t", "title"}
+	evs := []*event.T{
+		storetest.NewEvent(1, kind.TextNote, 1000, "hello",
+			tags.T{{"t", "nostr"}}),
+		storetest.NewEvent(1, kind.Article, 1100, "hello",
+			tags.T{{"title", "Nostr relays"}, {"d", "fox"}}),
+		// encrypted direct messages are not indexed
+		storetest.NewEvent(1, kind.EncryptedDirectMessage, 1200, "nostr",
+			nil),
+	}
+	for _, ev := range evs {
+		if err := b.SaveEvent(context.Bg(), ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storetest.SameEvents(t, storetest.Query(t, b,
+		&filter.T{Search: "nostr"}), []*event.T{evs[1], evs[0]})
+	storetest.SameEvents(t, storetest.Query(t, b,
+		&filter.T{Search: "fox"}), nil)
+}
+
+// searchKeys returns the number of keys in the search index.
+func searchKeys(t *testing.T, b *BadgerBackend) (n int) {
+	if err := b.View(func(txn *badger.Txn) (err error) {
+		prefix := []byte{indexSearchPrefix}
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			n++
+		}
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSearchDeleteReplace(t *testing.T) {
+	b := testBackend(t)
+	c := context.Bg()
+	evs := searchEvents(t, b)
+	for _, ev := range evs {
+		if err := b.DeleteEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := searchKeys(t, b); n != 0 {
+		t.Fatalf("%d search index keys left after deleting the events", n)
+	}
+	old := storetest.NewEvent(1, kind.ProfileMetadata, 1000, "alice", nil)
+	profile := storetest.NewEvent(1, kind.ProfileMetadata, 1100, "bob", nil)
+	for _, ev := range []*event.T{old, profile} {
+		if err := b.ReplaceEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storetest.SameEvents(t, storetest.Query(t, b,
+		&filter.T{Search: "alice"}), nil)
+	storetest.SameEvents(t, storetest.Query(t, b,
+		&filter.T{Search: "bob"}), []*event.T{profile})
+	if n := searchKeys(t, b); n != 1 {
+		t.Fatalf("%d search index keys after replacing, want 1", n)
+	}
+}
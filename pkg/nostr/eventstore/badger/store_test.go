@@ -0,0 +1,14 @@
+package badger
+
+import (
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) eventstore.Store {
+		return testBackend(t)
+	})
+}
@@ -0,0 +1,172 @@
+package badger
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// countKeys returns the number of keys with a prefix.
+func countKeys(t testing.TB, b *BadgerBackend, prefix []byte) (n int) {
+	if err := b.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			n++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func saveTagged(t testing.TB, b *BadgerBackend, i int, tt tags.T) *event.T {
+	ev := &event.T{
+		PubKey:    fmt.Sprintf("%064x", i),
+		CreatedAt: timestamp.T(1700000000 + i),
+		Kind:      1,
+		Tags:      tt,
+		Content:   fmt.Sprint(i),
+	}
+	ev.ID = ev.GetID()
+	if err := b.SaveEvent(context.Bg(), ev); err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestTagIndexNames(t *testing.T) {
+	b := testBackend(t)
+	hex32 := fmt.Sprintf("%064x", 12345)
+	e := saveTagged(t, b, 0, tags.T{{"e", hex32}, {"t", "nostr"}})
+	p := saveTagged(t, b, 1, tags.T{{"p", hex32}, {"r", "nostr"},
+		{"p", hex32}})
+	for name, want := range map[byte]int{'e': 1, 'p': 1} {
+		if n := countKeys(t, b, []byte{indexTag32Prefix, name}); n != want {
+			t.Fatalf("%d keys for %c tags, want %d", n, name, want)
+		}
+	}
+	for _, c := range []struct {
+		f    *filter.T
+		want *event.T
+	}{
+		{&filter.T{Tags: filter.TagMap{"#e": {hex32}}}, e},
+		{&filter.T{Tags: filter.TagMap{"#p": {hex32}}}, p},
+		{&filter.T{Tags: filter.TagMap{"t": {"nostr"}}}, e},
+		{&filter.T{Tags: filter.TagMap{"r": {"nostr"}}}, p},
+	} {
+		got := queryIDs(t, b, c.f)
+		if fmt.Sprint(got) != fmt.Sprint([]string{c.want.ID.String()}) {
+			t.Fatalf("query %s got %v", c.f, got)
+		}
+	}
+	if got := queryIDs(t, b, &filter.T{
+		Tags: filter.TagMap{"#t": {"nostr"}, "#r": {"nostr"}}}); len(got) != 0 {
+		t.Fatalf("query for both t and r got %v", got)
+	}
+}
+
+func TestLongTagValues(t *testing.T) {
+	b := testBackend(t)
+	long := strings.Repeat("x", 300)
+	ev := saveTagged(t, b, 0, tags.T{{"r", long}})
+	saveTagged(t, b, 1, tags.T{{"r", long[:200]}})
+	if n := countKeys(t, b, []byte{indexTagHashPrefix, 'r'}); n != 2 {
+		t.Fatalf("%d keys for long tags, want 2", n)
+	}
+	got := queryIDs(t, b, &filter.T{Tags: filter.TagMap{"#r": {long}}})
+	if fmt.Sprint(got) != fmt.Sprint([]string{ev.ID.String()}) {
+		t.Fatalf("query for a long tag value got %v", got)
+	}
+}
+
+func TestMigrateTagIndexes(t *testing.T) {
+	b := testBackend(t)
+	ev := saveTagged(t, b, 0, tags.T{{"t", "nostr"},
+		{"e", fmt.Sprintf("%064x", 1)}})
+	// replace the tag indexes with ones made the way the version before did
+	for _, prefix := range []byte{indexTagPrefix, indexTag32Prefix} {
+		if err := b.DropPrefix([]byte{prefix}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := append([]byte{indexTagPrefix}, "nostr"...)
+	old = append(old, 0, 0, 0, 0, 0, 0, 0, 1)
+	if err := b.Update(func(txn *badger.Txn) error {
+		return txn.Set(old, nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f := &filter.T{Tags: filter.TagMap{"#t": {"nostr"}}}
+	if got := queryIDs(t, b, f); len(got) != 0 {
+		t.Fatalf("found %v with the old tag index", got)
+	}
+	if err := migrateFrom(t, b, 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryIDs(t, b, f); fmt.Sprint(got) !=
+		fmt.Sprint([]string{ev.ID.String()}) {
+		t.Fatalf("found %v after the migration", got)
+	}
+	if err := b.View(func(txn *badger.Txn) (err error) {
+		_, err = txn.Get(old)
+		return
+	}); !errors.Is(err, badger.ErrKeyNotFound) {
+		t.Fatalf("old tag index key is still there: %v", err)
+	}
+	if n := countKeys(t, b, []byte{indexTag32Prefix, 'e'}); n != 1 {
+		t.Fatalf("%d keys for e tags after the migration, want 1", n)
+	}
+}
+
+// BenchmarkQueryTags queries events that refer to a small set of ids and
+// pubkeys with both e and p tags, and have a t tag with the same values as
+// their r tags, so every value is in the index under more than one name.
+func BenchmarkQueryTags(b *testing.B) {
+	db := testBackend(b)
+	r := rand.New(rand.NewSource(1))
+	values := make([]string, 20)
+	for i := range values {
+		values[i] = hexString(r)
+	}
+	words := []string{"nostr", "bitcoin", "relay", "zap", "music"}
+	for i := 0; i < 5000; i++ {
+		word := words[r.Intn(len(words))]
+		saveTagged(b, db, i, tags.T{
+			{"e", values[r.Intn(len(values))]},
+			{"p", values[r.Intn(len(values))]},
+			{"t", word},
+			{"r", word},
+		})
+	}
+	c := context.Bg()
+	for _, name := range []string{"#e", "#p", "#t"} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				value := values[i%len(values)]
+				if name == "#t" {
+					value = words[i%len(words)]
+				}
+				ch, err := db.QueryEvents(c, &filter.T{
+					Tags:  filter.TagMap{name: {value}},
+					Limit: 100,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for range ch {
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package badger
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Tombstones record the events that deletion events refer to, so that they
+// can't be stored again after they are deleted. An event id tombstone is keyed
+// by the id and the pubkey of the deletion, so it only blocks the event if the
+// deletion was by its author:
+//
+//	[tombstonePrefix]['e'][id][pubkey]
+//
+// An address tombstone blocks the replaceable events of an author with a kind
+// and d tag that were created at or before the time in its value:
+//
+//	[tombstonePrefix]['a'][kind][pubkey][d] = created_at
+
+func idTombstoneKey(id, pubkey []byte) []byte {
+	k := make([]byte, 0, 2+32+32)
+	k = append(k, tombstonePrefix, 'e')
+	k = append(k, id...)
+	return append(k, pubkey...)
+}
+
+func addrTombstoneKey(k uint16, pubkey []byte, d string) []byte {
+	key := make([]byte, 0, 2+2+32+len(d))
+	key = append(key, tombstonePrefix, 'a')
+	key = binary.BigEndian.AppendUint16(key, k)
+	key = append(key, pubkey...)
+	return append(key, d...)
+}
+
+// setTombstones records the events referred to by the e and a tags of a
+// deletion event. Addresses of other authors are ignored, as they can't be
+// deleted by it.
+func setTombstones(txn *badger.Txn, del *event.T) (err error) {
+	var pubkey []byte
+	if pubkey, err = hex.Dec(del.PubKey); err != nil {
+		return
+	}
+	for _, t := range del.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		switch t[0] {
+		case "e":
+			var id []byte
+			if id, _ = hex.Dec(t[1]); len(id) != 32 {
+				continue
+			}
+			if err = txn.Set(idTombstoneKey(id, pubkey), nil); err != nil {
+				return
+			}
+		case "a":
+			k, pkb, d := eventstore.GetAddrTagElements(t[1])
+			if string(pkb) != string(pubkey) {
+				continue
+			}
+			key := addrTombstoneKey(k, pubkey, d)
+			// keep the latest time if the address was deleted before
+			var deletedAt uint64
+			if deletedAt, err = getAddrTombstone(txn, key); err != nil {
+				return
+			}
+			if uint64(del.CreatedAt) <= deletedAt {
+				continue
+			}
+			if err = txn.Set(key, binary.BigEndian.AppendUint64(nil,
+				uint64(del.CreatedAt))); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// getAddrTombstone returns the created_at of the latest deletion of an
+// address, or zero if it wasn't deleted.
+func getAddrTombstone(txn *badger.Txn, key []byte) (deletedAt uint64,
+	err error) {
+
+	var item *badger.Item
+	if item, err = txn.Get(key); errors.Is(err, badger.ErrKeyNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return
+	}
+	err = item.Value(func(val []byte) error {
+		if len(val) == 8 {
+			deletedAt = binary.BigEndian.Uint64(val)
+		}
+		return nil
+	})
+	return
+}
+
+// isDeleted returns whether a deletion event by its author referred to an
+// event, by its id or, for replaceable events, by its address.
+func isDeleted(txn *badger.Txn, evt *event.T) (deleted bool, err error) {
+	var id, pubkey []byte
+	if id, err = hex.Dec(evt.ID.String()); err != nil {
+		return
+	}
+	if pubkey, err = hex.Dec(evt.PubKey); err != nil {
+		return
+	}
+	if _, err = txn.Get(idTombstoneKey(id, pubkey)); err == nil {
+		return true, nil
+	} else if !errors.Is(err, badger.ErrKeyNotFound) {
+		return
+	}
+	err = nil
+	d, ok := replaceableD(evt)
+	if !ok {
+		return
+	}
+	var deletedAt uint64
+	if deletedAt, err = getAddrTombstone(txn,
+		addrTombstoneKey(uint16(evt.Kind), pubkey, d)); err != nil {
+		return
+	}
+	return uint64(evt.CreatedAt) <= deletedAt, nil
+}
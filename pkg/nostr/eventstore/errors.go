@@ -3,3 +3,15 @@ package eventstore
 import "errors"
 
 var ErrDupEvent = errors.New("duplicate: event already exists")
+
+// ErrEventDeleted is returned when saving an event that a stored deletion
+// event refers to.
+var ErrEventDeleted = errors.New("blocked: event has been deleted")
+
+// ErrOutdatedEvent is returned when replacing an event that a newer version
+// of is stored.
+var ErrOutdatedEvent = errors.New("duplicate: a newer version of this event is stored")
+
+// ErrQuotaExceeded is returned when saving an event would take the events
+// stored of its pubkey over a quota.
+var ErrQuotaExceeded = errors.New("blocked: storage quota exceeded")
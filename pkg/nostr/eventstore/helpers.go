@@ -2,12 +2,46 @@ package eventstore
 
 import (
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
 	"mleku.online/git/slog"
 )
 
 var log = slog.GetStd()
 
-func isOlder(previous, next *event.T) bool {
+// IsOlder returns whether a version of a replaceable event is replaced by
+// another, which is when it was created earlier, or at the same time with a
+// higher id.
+func IsOlder(previous, next *event.T) bool {
 	return previous.CreatedAt < next.CreatedAt ||
 		(previous.CreatedAt == next.CreatedAt && previous.ID > next.ID)
 }
+
+// MatchFilter returns a copy of a filter for filter.T.Matches, without the
+// empty fields that filters decoded from JSON have, which stores treat as
+// unset. Tag names decoded from JSON keep their '#', which is removed so they
+// match the tags of events.
+func MatchFilter(f *filter.T) (m *filter.T) {
+	m = &filter.T{Since: f.Since, Until: f.Until}
+	if len(f.IDs) > 0 {
+		m.IDs = f.IDs
+	}
+	if len(f.Kinds) > 0 {
+		m.Kinds = f.Kinds
+	}
+	if len(f.Authors) > 0 {
+		m.Authors = f.Authors
+	}
+	for name, values := range f.Tags {
+		if len(values) == 0 {
+			continue
+		}
+		if m.Tags == nil {
+			m.Tags = make(filter.TagMap)
+		}
+		if len(name) == 2 && name[0] == '#' {
+			name = name[1:]
+		}
+		m.Tags[name] = values
+	}
+	return
+}
@@ -0,0 +1,177 @@
+// Package memory is an eventstore.Store that keeps the events in memory, for
+// tests, relays that don't need to keep their events and caches of events
+// fetched from relays.
+package memory
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+var _ eventstore.Store = (*Store)(nil)
+var _ eventstore.Replacer = (*Store)(nil)
+var _ eventstore.Pager = (*Store)(nil)
+
+// Store keeps events in memory, with an index of them by kind, by author and
+// by single letter tag, each in the order that queries return events in. It
+// is safe for concurrent use.
+type Store struct {
+	MaxLimit int
+	// MaxEvents is the most events that are kept, if it is zero there is no
+	// limit. When an event is saved over it the least recently saved or
+	// returned by a query is evicted.
+	MaxEvents int
+
+	mx      sync.Mutex
+	ids     map[eventid.T]*list.Element
+	lru     *list.List
+	all     events
+	kinds   map[kind.T]events
+	authors map[string]events
+	tags    map[string]events
+	// deletedIDs are the ids of the events deleted by their authors, with the
+	// pubkey of the deletion appended, and deletedAddrs the time of the
+	// latest deletion of each address
+	deletedIDs   map[string]struct{}
+	deletedAddrs map[string]timestamp.T
+}
+
+func (s *Store) Init() error {
+	if s.MaxLimit == 0 {
+		s.MaxLimit = 500
+	}
+	s.ids = make(map[eventid.T]*list.Element)
+	s.lru = list.New()
+	s.all = nil
+	s.kinds = make(map[kind.T]events)
+	s.authors = make(map[string]events)
+	s.tags = make(map[string]events)
+	s.deletedIDs = make(map[string]struct{})
+	s.deletedAddrs = make(map[string]timestamp.T)
+	return nil
+}
+
+func (s *Store) Close() {}
+
+// Len returns how many events are stored.
+func (s *Store) Len() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.all)
+}
+
+// events is a list of events in the order of eventstore.Less.
+type events []*event.T
+
+// search returns the position of an event in the list, or where it would be
+// inserted.
+func (evs events) search(ev *event.T) int {
+	return sort.Search(len(evs), func(i int) bool {
+		return !eventstore.Less(evs[i], ev)
+	})
+}
+
+func (evs events) insert(ev *event.T) events {
+	i := evs.search(ev)
+	evs = append(evs, nil)
+	copy(evs[i+1:], evs[i:])
+	evs[i] = ev
+	return evs
+}
+
+func (evs events) remove(ev *event.T) events {
+	i := evs.search(ev)
+	if i == len(evs) || evs[i].ID != ev.ID {
+		return evs
+	}
+	copy(evs[i:], evs[i+1:])
+	evs[len(evs)-1] = nil
+	return evs[:len(evs)-1]
+}
+
+// between returns the events created from since to until.
+func (evs events) between(since, until timestamp.T) events {
+	start := sort.Search(len(evs), func(i int) bool {
+		return evs[i].CreatedAt <= until
+	})
+	end := sort.Search(len(evs), func(i int) bool {
+		return evs[i].CreatedAt < since
+	})
+	if end < start {
+		return nil
+	}
+	return evs[start:end]
+}
+
+func insertInto[K comparable](m map[K]events, k K, ev *event.T) {
+	m[k] = m[k].insert(ev)
+}
+
+func removeFrom[K comparable](m map[K]events, k K, ev *event.T) {
+	if evs := m[k].remove(ev); len(evs) > 0 {
+		m[k] = evs
+	} else {
+		delete(m, k)
+	}
+}
+
+// tagKey returns the key of the tag index for a tag name and value.
+func tagKey(name, value string) string { return name + ":" + value }
+
+// tagKeys returns the keys of the tag index of an event. Like in the badger
+// store, only tags with a single letter name and a value are indexed.
+func tagKeys(ev *event.T) (keys []string) {
+	seen := make(map[string]struct{})
+	for _, t := range ev.Tags {
+		if len(t) < 2 || len(t[0]) != 1 || len(t[1]) == 0 {
+			continue
+		}
+		k := tagKey(t[0], t[1])
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		keys = append(keys, k)
+	}
+	return
+}
+
+// add stores an event in the indexes, evicting the least recently used events
+// if the store is full.
+func (s *Store) add(ev *event.T) {
+	s.ids[ev.ID] = s.lru.PushFront(ev)
+	s.all = s.all.insert(ev)
+	insertInto(s.kinds, ev.Kind, ev)
+	insertInto(s.authors, ev.PubKey, ev)
+	for _, k := range tagKeys(ev) {
+		insertInto(s.tags, k, ev)
+	}
+	for s.MaxEvents > 0 && len(s.all) > s.MaxEvents {
+		s.remove(s.lru.Back().Value.(*event.T))
+	}
+}
+
+// remove deletes an event from the indexes.
+func (s *Store) remove(ev *event.T) {
+	el, ok := s.ids[ev.ID]
+	if !ok {
+		return
+	}
+	// the index entries are made from the stored event
+	ev = el.Value.(*event.T)
+	s.lru.Remove(el)
+	delete(s.ids, ev.ID)
+	s.all = s.all.remove(ev)
+	removeFrom(s.kinds, ev.Kind, ev)
+	removeFrom(s.authors, ev.PubKey, ev)
+	for _, k := range tagKeys(ev) {
+		removeFrom(s.tags, k, ev)
+	}
+}
@@ -0,0 +1,189 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+func testStore(t *testing.T) *Store {
+	s := &Store{}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestQuery(t *testing.T) {
+	s := testStore(t)
+	s.MaxLimit = 7
+	c := context.Bg()
+	var all []*event.T
+	for i := 0; i < 20; i++ {
+		tt := tags.T{{"t", []string{"a", "b"}[i%2]},
+			{"p", storetest.Pubkey(i % 3)}}
+		ev := storetest.NewEvent(i%4, kind.T(1+i%2), timestamp.T(1000+i/3),
+			fmt.Sprintf("note %d", i), tt)
+		if err := s.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, ev)
+	}
+	if err := s.SaveEvent(c, all[0]); !errors.Is(err, eventstore.ErrDupEvent) {
+		t.Errorf("saving an event again returned %v", err)
+	}
+	sort.Slice(all, func(i, j int) bool { return eventstore.Less(all[i], all[j]) })
+	matching := func(f *filter.T) (evs []*event.T) {
+		m := eventstore.MatchFilter(f)
+		for _, ev := range all {
+			if m.Matches(ev) {
+				evs = append(evs, ev)
+			}
+		}
+		return
+	}
+	for _, f := range []*filter.T{
+		{Limit: 100},
+		{Kinds: kinds.T{2}, Limit: 100},
+		{Authors: []string{storetest.Pubkey(1), storetest.Pubkey(2)},
+			Kinds: kinds.T{1, 2}, Limit: 100},
+		{Tags: filter.TagMap{"#t": {"a", "b"}}, Limit: 100},
+		{Tags: filter.TagMap{"#p": {storetest.Pubkey(0)}, "#t": {"a"}},
+			Limit: 100},
+		{Since: timestamp.T(1002).Ptr(), Until: timestamp.T(1004).Ptr(),
+			Kinds: kinds.T{1}, Limit: 100},
+		{IDs: []string{all[3].ID.String(), all[1].ID.String(),
+			all[3].ID.String()}},
+	} {
+		want := matching(f)
+		if len(want) > s.MaxLimit {
+			want = want[:s.MaxLimit]
+		}
+		storetest.SameEvents(t, storetest.Query(t, s, f), want)
+		n, err := s.CountEvents(c, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(n) != len(matching(f)) {
+			t.Errorf("counted %d events for %s, want %d", n, f,
+				len(matching(f)))
+		}
+	}
+	var found []*event.T
+	for _, ev := range all {
+		if ev.Content == "note 13" {
+			found = append(found, ev)
+		}
+	}
+	storetest.SameEvents(t,
+		storetest.Query(t, s, &filter.T{Search: "NOTE 13"}), found)
+
+	// pages of the events resume after each other
+	var paged []*event.T
+	if err := eventstore.Paginate(c, eventstore.RelayWrapper{Store: s},
+		&filter.T{Limit: 3}, func(ev *event.T) error {
+			paged = append(paged, ev)
+			return nil
+		}); err != nil {
+		t.Fatal(err)
+	}
+	storetest.SameEvents(t, paged, all)
+}
+
+func TestReplace(t *testing.T) {
+	s := testStore(t)
+	c := context.Bg()
+	profile := storetest.NewEvent(1, kind.ProfileMetadata, 100, "", nil)
+	update := storetest.NewEvent(1, kind.ProfileMetadata, 200, "", nil)
+	for _, ev := range []*event.T{profile, update} {
+		if err := s.ReplaceEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.ReplaceEvent(c,
+		storetest.NewEvent(1, kind.ProfileMetadata, 150, "", nil))
+	if !errors.Is(err, eventstore.ErrOutdatedEvent) {
+		t.Errorf("replacing with an older version returned %v", err)
+	}
+	storetest.SameEvents(t, storetest.Query(t, s,
+		&filter.T{Authors: []string{storetest.Pubkey(1)}}), []*event.T{update})
+
+	// versions with another d tag are kept
+	article := func(d string, createdAt timestamp.T) *event.T {
+		return storetest.NewEvent(1, kind.T(30023), createdAt, "",
+			tags.T{{"d", d}})
+	}
+	first, other, second := article("a", 100), article("b", 150),
+		article("a", 200)
+	for _, ev := range []*event.T{first, other, second} {
+		if err = s.ReplaceEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storetest.SameEvents(t,
+		storetest.Query(t, s, &filter.T{Kinds: kinds.T{30023}}),
+		[]*event.T{second, other})
+
+	// deleted events, and older versions of deleted addresses, can't be
+	// stored again
+	note := storetest.NewEvent(1, kind.TextNote, 100, "", nil)
+	deletion := storetest.NewEvent(1, kind.Deletion, 300, "", tags.T{
+		{"e", note.ID.String()},
+		{"a", fmt.Sprintf("30023:%s:a", storetest.Pubkey(1))}})
+	if err = s.SaveEvent(c, deletion); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SaveEvent(c, note); !errors.Is(err, eventstore.ErrEventDeleted) {
+		t.Errorf("saving a deleted event returned %v", err)
+	}
+	if err = s.ReplaceEvent(c, article("a", 250)); !errors.Is(err,
+		eventstore.ErrEventDeleted) {
+		t.Errorf("replacing a deleted address returned %v", err)
+	}
+	if err = s.ReplaceEvent(c, article("a", 400)); err != nil {
+		t.Errorf("replacing a deleted address with a newer version "+
+			"returned %v", err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	s := testStore(t)
+	s.MaxEvents = 3
+	c := context.Bg()
+	var evs []*event.T
+	for i := 0; i < 4; i++ {
+		ev := storetest.NewEvent(i, kind.TextNote, timestamp.T(100+i), "", nil)
+		if err := s.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+		evs = append(evs, ev)
+		if i == 1 {
+			// returning the first event makes the second the least
+			// recently used
+			storetest.Query(t, s, &filter.T{IDs: []string{evs[0].ID.String()}})
+		}
+	}
+	storetest.SameEvents(t, storetest.Query(t, s, &filter.T{}),
+		[]*event.T{evs[3], evs[2], evs[0]})
+	if s.Len() != 3 {
+		t.Errorf("store has %d events, want 3", s.Len())
+	}
+	if err := s.DeleteEvent(c, evs[2]); err != nil {
+		t.Fatal(err)
+	}
+	storetest.SameEvents(t,
+		storetest.Query(t, s, &filter.T{Kinds: kinds.T{kind.TextNote}}),
+		[]*event.T{evs[3], evs[0]})
+}
@@ -0,0 +1,181 @@
+package memory
+
+import (
+	"math"
+	"sort"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip40"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/nip50"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+// QueryEvents returns the events that match the filter, newest first and, for
+// events created at the same time, by descending id, up to the limit of the
+// filter or the MaxLimit, like the badger store.
+func (s *Store) QueryEvents(c context.T, f *filter.T) (chan *event.T, error) {
+	return s.QueryEventsAfter(c, f, nil)
+}
+
+// QueryEventsAfter is QueryEvents for the events that come after a cursor, or
+// all of them if it is nil. The events are the ones the store holds, and must
+// not be modified. Search results are in the same order as other results, so
+// unlike in the badger store the cursor resumes them too.
+func (s *Store) QueryEventsAfter(c context.T, f *filter.T,
+	after *eventstore.Cursor) (chan *event.T, error) {
+
+	limit := s.MaxLimit
+	if f.Limit > 0 && f.Limit < limit {
+		limit = f.Limit
+	}
+	var results []*event.T
+	s.mx.Lock()
+	s.match(f, after, func(ev *event.T) bool {
+		results = append(results, ev)
+		// events returned by queries are used, so they are evicted last
+		s.lru.MoveToFront(s.ids[ev.ID])
+		return len(results) < limit
+	})
+	s.mx.Unlock()
+	ch := make(chan *event.T)
+	go func() {
+		defer close(ch)
+		for _, ev := range results {
+			select {
+			case <-c.Done():
+				return
+			case ch <- ev:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// CountEvents returns how many events match the filter, without a limit.
+func (s *Store) CountEvents(c context.T, f *filter.T) (n int64, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.match(f, nil, func(ev *event.T) bool {
+		n++
+		return true
+	})
+	return
+}
+
+// match calls fn with the events that match a filter, after a cursor if it
+// isn't nil, in the order of eventstore.Less until it returns false. Expired
+// events that haven't been deleted yet are left out.
+func (s *Store) match(f *filter.T, after *eventstore.Cursor,
+	fn func(ev *event.T) bool) {
+
+	m := eventstore.MatchFilter(f)
+	since, until := timestamp.T(0), timestamp.T(math.MaxInt64)
+	if m.Since != nil {
+		since = m.Since.T()
+	}
+	if m.Until != nil {
+		until = m.Until.T()
+	}
+	if after != nil && after.CreatedAt < until {
+		until = after.CreatedAt
+	}
+	var terms []string
+	if f.Search != "" {
+		if terms = nip50.QueryTerms(f.Search); len(terms) == 0 {
+			return
+		}
+	}
+	now := timestamp.Now()
+	for _, ev := range s.candidates(m, since, until) {
+		if !m.Matches(ev) || nip40.IsExpired(ev, now) ||
+			!nip50.Matches(terms, ev) {
+			continue
+		}
+		if after != nil && after.Passed(ev) {
+			continue
+		}
+		if !fn(ev) {
+			return
+		}
+	}
+}
+
+// candidates returns the events created from since to until in the index
+// with the fewest of them for the filter, which match it apart from the fields
+// that the index doesn't cover.
+func (s *Store) candidates(m *filter.T, since, until timestamp.T) events {
+	if m.IDs != nil {
+		lists := make([]events, 0, len(m.IDs))
+		for _, id := range m.IDs {
+			if el, ok := s.ids[eventid.T(id)]; ok {
+				lists = append(lists, events{el.Value.(*event.T)})
+			}
+		}
+		return merge(lists)
+	}
+	best := []events{s.all}
+	fewest := len(s.all)
+	consider := func(lists []events) {
+		var n int
+		for _, evs := range lists {
+			n += len(evs)
+		}
+		if n < fewest {
+			best, fewest = lists, n
+		}
+	}
+	if m.Kinds != nil {
+		var lists []events
+		for _, k := range m.Kinds {
+			lists = append(lists, s.kinds[k])
+		}
+		consider(lists)
+	}
+	if m.Authors != nil {
+		var lists []events
+		for _, pubkey := range m.Authors {
+			lists = append(lists, s.authors[pubkey])
+		}
+		consider(lists)
+	}
+	for name, values := range m.Tags {
+		if len(name) != 1 {
+			// only single letter tags are indexed
+			continue
+		}
+		var lists []events
+		for _, v := range values {
+			lists = append(lists, s.tags[tagKey(name, v)])
+		}
+		consider(lists)
+	}
+	for i, evs := range best {
+		best[i] = evs.between(since, until)
+	}
+	return merge(best)
+}
+
+// merge returns the events of the lists in one list, in order and without
+// the ones that are in more than one of them.
+func merge(lists []events) events {
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	var evs events
+	for _, l := range lists {
+		evs = append(evs, l...)
+	}
+	sort.Slice(evs, func(i, j int) bool { return eventstore.Less(evs[i], evs[j]) })
+	var merged events
+	for _, ev := range evs {
+		if len(merged) > 0 && ev.ID == merged[len(merged)-1].ID {
+			continue
+		}
+		merged = append(merged, ev)
+	}
+	return merged
+}
@@ -0,0 +1,144 @@
+package memory
+
+import (
+	"fmt"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+)
+
+// SaveEvent stores a copy of an event, unless it is already stored or was
+// deleted by its author.
+func (s *Store) SaveEvent(c context.T, evt *event.T) (err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err = s.check(evt); err != nil {
+		return
+	}
+	s.save(evt)
+	return
+}
+
+// DeleteEvent removes an event, if it is stored.
+func (s *Store) DeleteEvent(c context.T, evt *event.T) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.remove(evt)
+	return nil
+}
+
+// ReplaceEvent implements eventstore.Replacer. The store is locked while the
+// stored versions are deleted and the event stored.
+func (s *Store) ReplaceEvent(c context.T, evt *event.T) (err error) {
+	d, ok := replaceableD(evt)
+	if !ok {
+		return s.SaveEvent(c, evt)
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err = s.check(evt); err != nil {
+		return
+	}
+	var versions []*event.T
+	for _, v := range s.authors[evt.PubKey] {
+		if v.Kind != evt.Kind {
+			continue
+		}
+		if vd, _ := replaceableD(v); vd != d {
+			continue
+		}
+		if !eventstore.IsOlder(v, evt) {
+			return eventstore.ErrOutdatedEvent
+		}
+		versions = append(versions, v)
+	}
+	for _, v := range versions {
+		s.remove(v)
+	}
+	s.save(evt)
+	return
+}
+
+// check returns an error if an event can't be stored because it is already
+// stored or was deleted.
+func (s *Store) check(evt *event.T) error {
+	if _, ok := s.ids[evt.ID]; ok {
+		return eventstore.ErrDupEvent
+	}
+	if _, ok := s.deletedIDs[evt.ID.String()+evt.PubKey]; ok {
+		return eventstore.ErrEventDeleted
+	}
+	if d, ok := replaceableD(evt); ok {
+		deletedAt, ok := s.deletedAddrs[addrKey(evt.Kind, evt.PubKey, d)]
+		if ok && evt.CreatedAt <= deletedAt {
+			return eventstore.ErrEventDeleted
+		}
+	}
+	return nil
+}
+
+// save stores a copy of an event, and records the events that a deletion
+// event refers to so they can't be stored again, like the badger store does.
+// Addresses of other authors are ignored, as they can't be deleted by it.
+func (s *Store) save(evt *event.T) {
+	evt = clone(evt)
+	s.add(evt)
+	if evt.Kind != kind.Deletion {
+		return
+	}
+	for _, t := range evt.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		switch t[0] {
+		case "e":
+			s.deletedIDs[t[1]+evt.PubKey] = struct{}{}
+		case "a":
+			k, pkb, d := eventstore.GetAddrTagElements(t[1])
+			if hex.Enc(pkb) != evt.PubKey {
+				continue
+			}
+			key := addrKey(kind.T(k), evt.PubKey, d)
+			if evt.CreatedAt > s.deletedAddrs[key] {
+				s.deletedAddrs[key] = evt.CreatedAt
+			}
+		}
+	}
+}
+
+func addrKey(k kind.T, pubkey, d string) string {
+	return fmt.Sprintf("%d:%s:%s", k, pubkey, d)
+}
+
+// replaceableD returns the d tag that identifies the versions of a
+// replaceable event along with its pubkey and kind, which is empty for events
+// that are replaceable without parameters, and whether it is replaceable.
+func replaceableD(evt *event.T) (d string, ok bool) {
+	switch {
+	case evt.Kind.IsReplaceable():
+		return "", true
+	case evt.Kind.IsParameterizedReplaceable():
+		if t := evt.Tags.GetFirst([]string{"d", ""}); t != nil {
+			d = t.Value()
+		}
+		return d, true
+	}
+	return "", false
+}
+
+// clone returns a copy of an event that doesn't share its tags, so changes to
+// the event that was saved don't change the stored one.
+func clone(evt *event.T) *event.T {
+	c := *evt
+	if evt.Tags != nil {
+		c.Tags = make(tags.T, len(evt.Tags))
+		for i, t := range evt.Tags {
+			c.Tags[i] = t.Clone()
+		}
+	}
+	return &c
+}
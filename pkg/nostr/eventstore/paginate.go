@@ -0,0 +1,118 @@
+package eventstore
+
+import (
+	"sort"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/interfaces/subscriptionoption"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+// Cursor is a position in the order that queries return events in, which is
+// newest first and, for events created at the same time, by descending id.
+type Cursor struct {
+	CreatedAt timestamp.T
+	ID        eventid.T
+}
+
+// CursorOf returns the position of an event.
+func CursorOf(ev *event.T) *Cursor {
+	return &Cursor{CreatedAt: ev.CreatedAt, ID: ev.ID}
+}
+
+// Passed returns true if an event is at or before the cursor in the order, so
+// a query resuming after the cursor doesn't return it.
+func (cur *Cursor) Passed(ev *event.T) bool {
+	return ev.CreatedAt > cur.CreatedAt ||
+		(ev.CreatedAt == cur.CreatedAt && ev.ID >= cur.ID)
+}
+
+// Less returns true if a comes before b in the order queries return events in.
+func Less(a, b *event.T) bool {
+	return a.CreatedAt > b.CreatedAt ||
+		(a.CreatedAt == b.CreatedAt && a.ID > b.ID)
+}
+
+// After is a subscription option for RelayWrapper.QuerySync that resumes the
+// query after a cursor. Relays ignore it, as a filter can't carry it.
+type After Cursor
+
+func (_ After) IsSubscriptionOption() {}
+
+var _ subscriptionoption.I = After{}
+
+// Paginate calls fn with every event that matches the filter, newest first,
+// querying r for one page after another. Relays return the newest events up
+// to the limit of the filter or their own maximum, so each page is queried up
+// to the created_at of the last event of the page before, and the events of
+// that page are skipped.
+//
+// Stores that are Pagers resume exactly after the last event. Relays can only
+// be asked for events up to a time, so if more events than fit in a page were
+// created in the same second, the ones that didn't fit are skipped.
+func Paginate(c context.T, r RelayInterface, f *filter.T,
+	fn func(ev *event.T) error) (err error) {
+
+	pf := *f
+	var until *timestamp.T
+	if f.Until != nil {
+		u := f.Until.T()
+		until = &u
+	}
+	var last *Cursor
+	// seen are the ids of the events created at the same time as last
+	seen := make(map[eventid.T]struct{})
+	for {
+		if err = c.Err(); err != nil {
+			return
+		}
+		var opts []subscriptionoption.I
+		if until != nil {
+			pf.Until = until.Ptr()
+		}
+		if last != nil {
+			opts = append(opts, After(*last))
+		}
+		var evs []*event.T
+		if evs, err = r.QuerySync(c, &pf, opts...); err != nil {
+			return
+		}
+		sort.Slice(evs, func(i, j int) bool { return Less(evs[i], evs[j]) })
+		var n int
+		for _, ev := range evs {
+			if until != nil && ev.CreatedAt > *until {
+				continue
+			}
+			if last != nil && ev.CreatedAt == last.CreatedAt {
+				if _, ok := seen[ev.ID]; ok {
+					continue
+				}
+			} else {
+				seen = make(map[eventid.T]struct{})
+			}
+			if err = fn(ev); err != nil {
+				return
+			}
+			n++
+			seen[ev.ID] = struct{}{}
+			last = CursorOf(ev)
+		}
+		switch {
+		case n > 0:
+			until = &last.CreatedAt
+		case last == nil || last.CreatedAt == 0:
+			return
+		default:
+			// the page had only events that were already seen, so there are
+			// no older ones, or there are more events created at the time of
+			// the last one than fit in a page, and the rest can't be asked for
+			log.D.F("no more events at %d, paging on from the second before",
+				last.CreatedAt)
+			u := last.CreatedAt - 1
+			until, last = &u, nil
+		}
+	}
+}
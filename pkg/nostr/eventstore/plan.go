@@ -0,0 +1,63 @@
+package eventstore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Plan is how a store runs the query for a filter.
+type Plan struct {
+	// Index is the name of the index the query reads.
+	Index string `json:"index"`
+	// Ranges is the number of ranges of the index that are read, each with
+	// its own iterator.
+	Ranges int `json:"ranges"`
+	// Estimate is the estimated number of index entries that are read.
+	Estimate int `json:"estimate"`
+	// AtLeast is set if the estimate stopped counting, and there are more
+	// entries than the estimate.
+	AtLeast bool `json:"at_least,omitempty"`
+	// PostFilter is the filter that the events found in the index are checked
+	// against, for the fields that the index doesn't cover exactly. It is
+	// empty if every event found matches.
+	PostFilter string `json:"post_filter,omitempty"`
+	// Candidates is the indexes that were considered, including the one that
+	// was chosen.
+	Candidates []Candidate `json:"candidates,omitempty"`
+}
+
+// Candidate is an index that a query could read.
+type Candidate struct {
+	Index    string `json:"index"`
+	Ranges   int    `json:"ranges"`
+	Estimate int    `json:"estimate"`
+	AtLeast  bool   `json:"at_least,omitempty"`
+	// Rejected is why the index was not chosen, if it wasn't.
+	Rejected string `json:"rejected,omitempty"`
+}
+
+// String returns the plan as text for people to read.
+func (p *Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "index %s, %d ranges, %s entries\n", p.Index, p.Ranges,
+		estimate(p.Estimate, p.AtLeast))
+	if p.PostFilter != "" {
+		fmt.Fprintf(&b, "post filter %s\n", p.PostFilter)
+	}
+	for _, c := range p.Candidates {
+		fmt.Fprintf(&b, "  candidate %s, %d ranges, %s entries", c.Index,
+			c.Ranges, estimate(c.Estimate, c.AtLeast))
+		if c.Rejected != "" {
+			fmt.Fprintf(&b, ": %s", c.Rejected)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func estimate(n int, atLeast bool) string {
+	if atLeast {
+		return fmt.Sprintf("at least %d", n)
+	}
+	return fmt.Sprint(n)
+}
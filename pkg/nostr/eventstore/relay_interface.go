@@ -25,42 +25,24 @@ type RelayWrapper struct {
 var _ RelayInterface = (*RelayWrapper)(nil)
 
 func (w RelayWrapper) Publish(c context.T, evt *event.T) (err error) {
-	var ch chan *event.T
-	if 20000 <= evt.Kind && evt.Kind < 30000 {
+	var replace bool
+	switch {
+	case evt.Kind.IsEphemeral():
 		// do not store ephemeral events
 		return nil
-	} else if evt.Kind == 0 || evt.Kind == 3 || (10000 <= evt.Kind && evt.Kind < 20000) {
-		// replaceable event, delete before storing
-		ch, err = w.Store.QueryEvents(c, &filter.T{
-			Authors: []string{evt.PubKey},
-			Kinds:   kinds.T{evt.Kind},
-		})
-		if err != nil {
-			return fmt.Errorf("failed to query before replacing: %w", err)
-		}
-		if previous := <-ch; previous != nil && isOlder(previous, evt) {
-			if err := w.Store.DeleteEvent(c, previous); err != nil {
-				return fmt.Errorf("failed to delete event for replacing: %w", err)
-			}
-		}
-	} else if 30000 <= evt.Kind && evt.Kind < 40000 {
-		// parameterized replaceable event, delete before storing
-		d := evt.Tags.GetFirst([]string{"d", ""})
-		if d != nil {
-			ch, err = w.Store.QueryEvents(c, &filter.T{
-				Authors: []string{evt.PubKey},
-				Kinds:   kinds.T{evt.Kind},
-				Tags:    filter.TagMap{"d": []string{d.Value()}},
-			})
-			if err != nil {
-				return fmt.Errorf("failed to query before parameterized replacing: %w", err)
-			}
-			if previous := <-ch; previous != nil && isOlder(previous, evt) {
-				if err = w.Store.DeleteEvent(c, previous); log.Fail(err) {
-					return fmt.Errorf("failed to delete event for parameterized replacing: %w", err)
-				}
-			}
+	case evt.Kind.IsReplaceable():
+		replace = true
+	case evt.Kind.IsParameterizedReplaceable():
+		replace = evt.Tags.GetFirst([]string{"d", ""}) != nil
+	}
+	if replace {
+		err = Replace(c, w.Store, evt)
+		if err != nil && !errors.Is(err, ErrDupEvent) &&
+			!errors.Is(err, ErrOutdatedEvent) {
+
+			return fmt.Errorf("failed to replace: %w", err)
 		}
+		return nil
 	}
 	if err = w.SaveEvent(c, evt); err != nil && !errors.Is(err, ErrDupEvent) {
 		return fmt.Errorf("failed to save: %w", err)
@@ -68,10 +50,72 @@ func (w RelayWrapper) Publish(c context.T, evt *event.T) (err error) {
 	return nil
 }
 
+// Replace stores a replaceable or parameterized replaceable event and deletes
+// the older versions of it, with ReplaceEvent if the store is a Replacer.
+// Otherwise the versions are queried and deleted before the event is saved,
+// which concurrent replacements can leave more than one version stored by. If
+// a newer version is stored ErrOutdatedEvent is returned.
+func Replace(c context.T, s Store, evt *event.T) (err error) {
+	if r, ok := s.(Replacer); ok {
+		return r.ReplaceEvent(c, evt)
+	}
+	f := &filter.T{
+		Authors: []string{evt.PubKey},
+		Kinds:   kinds.T{evt.Kind},
+	}
+	if evt.Kind.IsParameterizedReplaceable() {
+		var d string
+		if t := evt.Tags.GetFirst([]string{"d", ""}); t != nil {
+			d = t.Value()
+		}
+		f.Tags = filter.TagMap{"d": []string{d}}
+	}
+	var ch chan *event.T
+	if ch, err = s.QueryEvents(c, f); err != nil {
+		return fmt.Errorf("failed to query before replacing: %w", err)
+	}
+	var older []*event.T
+	var outdated bool
+	for previous := range ch {
+		if IsOlder(previous, evt) {
+			older = append(older, previous)
+		} else {
+			outdated = true
+		}
+	}
+	if outdated {
+		return ErrOutdatedEvent
+	}
+	for _, previous := range older {
+		if err = s.DeleteEvent(c, previous); log.Fail(err) {
+			return fmt.Errorf("failed to delete event for replacing: %w", err)
+		}
+	}
+	return s.SaveEvent(c, evt)
+}
+
+// QuerySync returns the events that match the filter. With the After option it
+// returns the events that come after the cursor, exactly if the store is a
+// Pager, and otherwise by leaving out the ones that the store returns before
+// it.
 func (w RelayWrapper) QuerySync(c context.T, f *filter.T,
 	opts ...subscriptionoption.I) ([]*event.T, error) {
 
-	ch, err := w.Store.QueryEvents(c, f)
+	var after *Cursor
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case After:
+			cur := Cursor(o)
+			after = &cur
+		}
+	}
+	var ch chan *event.T
+	var err error
+	if p, ok := w.Store.(Pager); ok && after != nil {
+		ch, err = p.QueryEventsAfter(c, f, after)
+	} else {
+		ch, err = w.Store.QueryEvents(c, f)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to query: %w", err)
 	}
@@ -81,6 +125,9 @@ func (w RelayWrapper) QuerySync(c context.T, f *filter.T,
 	}
 	results := make([]*event.T, 0, n)
 	for evt := range ch {
+		if after != nil && after.Passed(evt) {
+			continue
+		}
 		results = append(results, evt)
 	}
 
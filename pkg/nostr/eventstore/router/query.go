@@ -0,0 +1,173 @@
+package router
+
+import (
+	"sort"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+)
+
+// counter is implemented by stores that count the events that match a filter.
+type counter interface {
+	CountEvents(c context.T, f *filter.T) (int64, error)
+}
+
+// split returns the stores that keep the events that can match a filter, each
+// with the filter for the kinds it keeps.
+func (r *Store) split(f *filter.T) (stores []eventstore.Store,
+	filters []*filter.T) {
+
+	if len(f.Kinds) == 0 {
+		stores = r.stores()
+		for range stores {
+			filters = append(filters, f)
+		}
+		return
+	}
+	for _, k := range f.Kinds {
+		s := r.storeFor(k)
+		if s == nil {
+			continue
+		}
+		i := 0
+		for i < len(stores) && stores[i] != s {
+			i++
+		}
+		if i == len(stores) {
+			fc := *f
+			fc.Kinds = nil
+			stores, filters = append(stores, s), append(filters, &fc)
+		}
+		filters[i].Kinds = append(filters[i].Kinds, k)
+	}
+	return
+}
+
+// QueryEvents returns the events of the stores that match the filter, newest
+// first and, for events created at the same time, by descending id, up to the
+// limit of the filter or the MaxLimit.
+func (r *Store) QueryEvents(c context.T, f *filter.T) (chan *event.T, error) {
+	return r.QueryEventsAfter(c, f, nil)
+}
+
+// QueryEventsAfter is QueryEvents for the events that come after a cursor, or
+// all of them if it is nil. Stores that are not Pagers are queried up to the
+// time of the cursor, so if more events than their limit were created then the
+// ones after the cursor can be left out.
+func (r *Store) QueryEventsAfter(c context.T, f *filter.T,
+	after *eventstore.Cursor) (chan *event.T, error) {
+
+	limit := r.MaxLimit
+	if f.Limit > 0 && f.Limit < limit {
+		limit = f.Limit
+	}
+	stores, filters := r.split(f)
+	// the stores are stopped if one of them fails or the results are cut
+	qc, cancel := context.Cancel(c)
+	chans := make([]chan *event.T, len(stores))
+	for i, s := range stores {
+		var err error
+		if chans[i], err = queryAfter(qc, s, filters[i], after); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	ch := make(chan *event.T)
+	go func() {
+		defer close(ch)
+		defer cancel()
+		results := make([][]*event.T, len(chans))
+		done := make(chan struct{})
+		for i := range chans {
+			go func(i int) {
+				for ev := range chans[i] {
+					results[i] = append(results[i], ev)
+				}
+				done <- struct{}{}
+			}(i)
+		}
+		for range chans {
+			<-done
+		}
+		for _, ev := range merge(results, after, limit) {
+			select {
+			case <-c.Done():
+				return
+			case ch <- ev:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// queryAfter queries a store for the events after a cursor, exactly if it is
+// a Pager and otherwise up to the time of the cursor.
+func queryAfter(c context.T, s eventstore.Store, f *filter.T,
+	after *eventstore.Cursor) (chan *event.T, error) {
+
+	if after == nil {
+		return s.QueryEvents(c, f)
+	}
+	if p, ok := s.(eventstore.Pager); ok {
+		return p.QueryEventsAfter(c, f, after)
+	}
+	if f.Until == nil || after.CreatedAt < f.Until.T() {
+		fc := *f
+		fc.Until = after.CreatedAt.Ptr()
+		f = &fc
+	}
+	return s.QueryEvents(c, f)
+}
+
+// merge returns the events of the results in order, once each and after the
+// cursor if it isn't nil, up to the limit.
+func merge(results [][]*event.T, after *eventstore.Cursor,
+	limit int) (merged []*event.T) {
+
+	var evs []*event.T
+	for _, r := range results {
+		evs = append(evs, r...)
+	}
+	sort.Slice(evs, func(i, j int) bool { return eventstore.Less(evs[i], evs[j]) })
+	for _, ev := range evs {
+		if len(merged) == limit {
+			break
+		}
+		if len(merged) > 0 && ev.ID == merged[len(merged)-1].ID {
+			continue
+		}
+		if after != nil && after.Passed(ev) {
+			continue
+		}
+		merged = append(merged, ev)
+	}
+	return
+}
+
+// CountEvents returns the sum of the counts of the stores that keep the
+// events that can match the filter. Stores that don't count events are
+// counted by the events their queries return, and deletion events that are
+// kept in more than one store are counted in each.
+func (r *Store) CountEvents(c context.T, f *filter.T) (n int64, err error) {
+	stores, filters := r.split(f)
+	for i, s := range stores {
+		if cs, ok := s.(counter); ok {
+			var count int64
+			if count, err = cs.CountEvents(c, filters[i]); err != nil {
+				return
+			}
+			n += count
+			continue
+		}
+		var ch chan *event.T
+		if ch, err = s.QueryEvents(c, filters[i]); err != nil {
+			return
+		}
+		for range ch {
+			n++
+		}
+	}
+	return
+}
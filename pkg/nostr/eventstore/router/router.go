@@ -0,0 +1,191 @@
+// Package router is an eventstore.Store that keeps events in other stores by
+// their kind, such as the small and widely requested kinds in a replicated
+// store and the rest in a local one, as described in doc/chaindata.md.
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+)
+
+var _ eventstore.Store = (*Store)(nil)
+var _ eventstore.Replacer = (*Store)(nil)
+var _ eventstore.Pager = (*Store)(nil)
+
+// ErrNoStore is returned when saving an event of a kind that no store keeps.
+var ErrNoStore = errors.New("blocked: events of this kind are not stored")
+
+// KindRange is the kinds from Min to Max, inclusive.
+type KindRange struct {
+	Min kind.T `json:"min"`
+	Max kind.T `json:"max"`
+}
+
+// Contains returns whether a kind is in the range.
+func (r KindRange) Contains(k kind.T) bool { return k >= r.Min && k <= r.Max }
+
+// Route keeps the events of the kinds in its ranges in a store.
+type Route struct {
+	Kinds []KindRange
+	Store eventstore.Store
+}
+
+// Store keeps each event in the store of the first route with its kind, or the
+// Default store if no route has it. Queries go to the stores that keep the
+// kinds of the filter, or to all of them if it has no kinds, and their results
+// are merged in the order of eventstore.Less.
+//
+// Deletion events are also kept in the stores of the events they refer to, by
+// the kinds of their a and k tags, or in every store if they have e tags
+// without k tags, so those stores keep the events from being stored again.
+type Store struct {
+	Routes []Route
+	// Default keeps the events of the kinds that no route has, if it is nil
+	// they are rejected with ErrNoStore.
+	Default  eventstore.Store
+	MaxLimit int
+}
+
+// Init initializes each of the stores.
+func (r *Store) Init() (err error) {
+	if r.MaxLimit == 0 {
+		r.MaxLimit = 500
+	}
+	for _, s := range r.stores() {
+		if err = s.Init(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Close closes each of the stores.
+func (r *Store) Close() {
+	for _, s := range r.stores() {
+		s.Close()
+	}
+}
+
+// stores returns each of the stores once, as routes can share a store.
+func (r *Store) stores() (stores []eventstore.Store) {
+	for _, rt := range r.Routes {
+		stores = appendStore(stores, rt.Store)
+	}
+	if r.Default != nil {
+		stores = appendStore(stores, r.Default)
+	}
+	return
+}
+
+// appendStore adds a store to a list if it isn't in it.
+func appendStore(stores []eventstore.Store,
+	s eventstore.Store) []eventstore.Store {
+
+	for _, have := range stores {
+		if have == s {
+			return stores
+		}
+	}
+	return append(stores, s)
+}
+
+// storeFor returns the store that keeps the events of a kind, or nil if none
+// does.
+func (r *Store) storeFor(k kind.T) eventstore.Store {
+	for _, rt := range r.Routes {
+		for _, kr := range rt.Kinds {
+			if kr.Contains(k) {
+				return rt.Store
+			}
+		}
+	}
+	return r.Default
+}
+
+// SaveEvent stores an event in the store that keeps its kind.
+func (r *Store) SaveEvent(c context.T, evt *event.T) (err error) {
+	s := r.storeFor(evt.Kind)
+	if s == nil {
+		return fmt.Errorf("%w, kind %d", ErrNoStore, evt.Kind)
+	}
+	if err = s.SaveEvent(c, evt); err != nil || evt.Kind != kind.Deletion {
+		return
+	}
+	for _, ds := range r.deletionStores(evt) {
+		if ds == s {
+			continue
+		}
+		if err = ds.SaveEvent(c, evt); err != nil &&
+			!errors.Is(err, eventstore.ErrDupEvent) {
+			return
+		}
+	}
+	return nil
+}
+
+// deletionStores returns the stores that keep the events a deletion event
+// refers to.
+func (r *Store) deletionStores(del *event.T) (stores []eventstore.Store) {
+	var ids, kinds bool
+	add := func(k kind.T) {
+		if s := r.storeFor(k); s != nil {
+			stores = appendStore(stores, s)
+		}
+	}
+	for _, t := range del.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		switch t[0] {
+		case "e":
+			ids = true
+		case "k":
+			if k, err := strconv.ParseUint(t[1], 10, 16); err == nil {
+				kinds = true
+				add(kind.T(k))
+			}
+		case "a":
+			if k, pkb, _ := eventstore.GetAddrTagElements(t[1]); len(pkb) == 32 {
+				add(kind.T(k))
+			}
+		}
+	}
+	if ids && !kinds {
+		// the kinds of the events are not known
+		return r.stores()
+	}
+	return
+}
+
+// DeleteEvent deletes an event from the store that keeps its kind. Deletion
+// events are deleted from every store, as they can be kept in more than one.
+func (r *Store) DeleteEvent(c context.T, evt *event.T) (err error) {
+	if evt.Kind == kind.Deletion {
+		for _, s := range r.stores() {
+			if err = s.DeleteEvent(c, evt); err != nil {
+				return
+			}
+		}
+		return
+	}
+	if s := r.storeFor(evt.Kind); s != nil {
+		return s.DeleteEvent(c, evt)
+	}
+	return
+}
+
+// ReplaceEvent implements eventstore.Replacer, with eventstore.Replace in the
+// store that keeps the kind of the event.
+func (r *Store) ReplaceEvent(c context.T, evt *event.T) (err error) {
+	s := r.storeFor(evt.Kind)
+	if s == nil {
+		return fmt.Errorf("%w, kind %d", ErrNoStore, evt.Kind)
+	}
+	return eventstore.Replace(c, s, evt)
+}
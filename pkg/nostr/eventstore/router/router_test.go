@@ -0,0 +1,109 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/memory"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore/storetest"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+)
+
+// testRouter returns a router that keeps the kinds from 0 to 3 in the first
+// store, reactions in the second and the rest in the third.
+func testRouter(t *testing.T) (r *Store, stores []*memory.Store) {
+	for i := 0; i < 3; i++ {
+		stores = append(stores, &memory.Store{})
+	}
+	r = &Store{
+		Routes: []Route{
+			{Kinds: []KindRange{{0, 3}}, Store: stores[0]},
+			{Kinds: []KindRange{{kind.Reaction, kind.Reaction}},
+				Store: stores[1]},
+		},
+		Default: stores[2],
+	}
+	if err := r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) eventstore.Store {
+		r, _ := testRouter(t)
+		return r
+	})
+}
+
+func TestRoutes(t *testing.T) {
+	r, stores := testRouter(t)
+	c := context.Bg()
+	profile := storetest.NewEvent(1, kind.ProfileMetadata, 100, "", nil)
+	note := storetest.NewEvent(1, kind.TextNote, 200, "", nil)
+	reaction := storetest.NewEvent(2, kind.Reaction, 300, "+",
+		tags.T{{"e", note.ID.String()}})
+	article := storetest.NewEvent(1, kind.T(30023), 400, "",
+		tags.T{{"d", "x"}})
+	for _, ev := range []*event.T{profile, note, reaction, article} {
+		if err := r.SaveEvent(c, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, want := range [][]*event.T{{note, profile}, {reaction},
+		{article}} {
+		storetest.SameEvents(t, storetest.Query(t, stores[i], &filter.T{}),
+			want)
+	}
+	// the results of the stores are merged and cut at the limit
+	storetest.SameEvents(t, storetest.Query(t, r, &filter.T{Limit: 3}),
+		[]*event.T{article, reaction, note})
+	storetest.SameEvents(t, storetest.Query(t, r,
+		&filter.T{Kinds: kinds.T{kind.Reaction, kind.ProfileMetadata}}),
+		[]*event.T{reaction, profile})
+	if n, err := r.CountEvents(c, &filter.T{Authors: []string{
+		storetest.Pubkey(1)}}); err != nil || n != 3 {
+		t.Errorf("counted %d events, error %v, want 3", n, err)
+	}
+
+	// deletions are kept by the stores of the events they refer to
+	deletion := storetest.NewEvent(2, kind.Deletion, 500, "", tags.T{
+		{"e", reaction.ID.String()}, {"k", fmt.Sprint(kind.Reaction)}})
+	if err := r.SaveEvent(c, deletion); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DeleteEvent(c, reaction); err != nil {
+		t.Fatal(err)
+	}
+	storetest.SameEvents(t, storetest.Query(t, stores[1], &filter.T{}),
+		[]*event.T{deletion})
+	err := r.SaveEvent(c, reaction)
+	if !errors.Is(err, eventstore.ErrEventDeleted) {
+		t.Errorf("saving a deleted event returned %v", err)
+	}
+	storetest.SameEvents(t, storetest.Query(t, r,
+		&filter.T{Kinds: kinds.T{kind.Deletion}}), []*event.T{deletion})
+	if err = r.DeleteEvent(c, deletion); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		storetest.SameEvents(t, storetest.Query(t, s,
+			&filter.T{Kinds: kinds.T{kind.Deletion}}), nil)
+	}
+
+	// without a default store the kinds of no route are rejected
+	r.Default = nil
+	err = r.SaveEvent(c, storetest.NewEvent(1, kind.T(30023), 600, "",
+		tags.T{{"d", "y"}}))
+	if !errors.Is(err, ErrNoStore) {
+		t.Errorf("saving an event of a kind with no store returned %v", err)
+	}
+}
@@ -24,3 +24,31 @@ type Store interface {
 	// SaveEvent is called once Relay.AcceptEvent reports true.
 	SaveEvent(context.T, *event.T) error
 }
+
+// Replacer is implemented by stores that can replace the previous versions of
+// a replaceable or parameterized replaceable event atomically, so concurrent
+// updates can't leave more than one version stored.
+type Replacer interface {
+	// ReplaceEvent stores an event and deletes the older versions with the
+	// same pubkey, kind and, for parameterized replaceable events, d tag. If a
+	// newer version is stored the event is not, and ErrOutdatedEvent is
+	// returned.
+	ReplaceEvent(context.T, *event.T) error
+}
+
+// Explainer is implemented by stores that can describe how they would run a
+// query, to find out why a filter is slow.
+type Explainer interface {
+	// Explain returns the plan for a filter without running the query.
+	Explain(context.T, *filter.T) (*Plan, error)
+}
+
+// Pager is implemented by stores that can resume a query after a cursor, so
+// the events that match a filter can be read in pages without missing or
+// repeating events created at the same time as the end of a page.
+type Pager interface {
+	// QueryEventsAfter is QueryEvents for the events that come after the
+	// cursor, in the order of Less.
+	QueryEventsAfter(c context.T, f *filter.T, after *Cursor) (chan *event.T,
+		error)
+}
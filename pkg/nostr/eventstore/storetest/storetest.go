@@ -0,0 +1,417 @@
+// Package storetest is a conformance test suite for eventstore.Store
+// implementations. A store runs it from its own tests:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) eventstore.Store {
+//			return newInitializedStore(t)
+//		})
+//	}
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+// Open returns a new empty store that is initialized and is closed when the
+// test finishes.
+type Open func(t *testing.T) eventstore.Store
+
+// counter is implemented by stores that count the events that match a filter,
+// which the suite checks against the events that queries return.
+type counter interface {
+	CountEvents(c context.T, f *filter.T) (int64, error)
+}
+
+// Run runs the conformance tests, each with a store returned by open. The
+// stores must return at least 200 events for filters without a limit.
+func Run(t *testing.T, open Open) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, open Open)
+	}{
+		{"order", testOrder},
+		{"limit", testLimit},
+		{"filters", testFilters},
+		{"duplicates", testDuplicates},
+		{"delete", testDelete},
+		{"replace", testReplace},
+		{"concurrent", testConcurrent},
+		{"cancel", testCancel},
+	} {
+		t.Run(tc.name, func(t *testing.T) { tc.fn(t, open) })
+	}
+}
+
+// Pubkey returns a pubkey for tests, which is i as hex.
+func Pubkey(i int) string { return fmt.Sprintf("%064x", i) }
+
+// NewEvent returns an event with its id set, for tests that don't check
+// signatures.
+func NewEvent(author int, k kind.T, createdAt timestamp.T, content string,
+	tt tags.T) *event.T {
+
+	ev := &event.T{PubKey: Pubkey(author), CreatedAt: createdAt, Kind: k,
+		Tags: tt, Content: content}
+	ev.ID = ev.GetID()
+	return ev
+}
+
+// fixture is a set of stored events, for working out which a query should
+// return.
+type fixture []*event.T
+
+// save stores the events of a fixture of n events, by 3 authors, of 2 kinds,
+// with t, p and e tags, and several created at the same time.
+func save(t *testing.T, s eventstore.Store, n int) (fx fixture) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		var target string
+		if len(fx) > 0 {
+			target = fx[i/2].ID.String()
+		}
+		tt := tags.T{{"t", []string{"a", "b", "c"}[i%3]},
+			{"p", Pubkey(i % 4)}}
+		if target != "" {
+			tt = append(tt, []string{"e", target})
+		}
+		ev := NewEvent(i%3, []kind.T{kind.TextNote, kind.Reaction}[i%2],
+			timestamp.T(1700000000+i/4), fmt.Sprint("event ", i), tt)
+		if err := s.SaveEvent(context.Bg(), ev); err != nil {
+			t.Fatal(err)
+		}
+		fx = append(fx, ev)
+	}
+	sort.Slice(fx, func(i, j int) bool { return eventstore.Less(fx[i], fx[j]) })
+	return
+}
+
+// matching returns the events of the fixture that match a filter, in the
+// order they are returned, up to the limit if it is set.
+func (fx fixture) matching(f *filter.T) (evs []*event.T) {
+	m := eventstore.MatchFilter(f)
+	for _, ev := range fx {
+		if m.Matches(ev) {
+			evs = append(evs, ev)
+		}
+	}
+	if f.Limit > 0 && len(evs) > f.Limit {
+		evs = evs[:f.Limit]
+	}
+	return
+}
+
+// Query returns the events that a store returns for a filter.
+func Query(t testing.TB, s eventstore.Store, f *filter.T) (evs []*event.T) {
+	t.Helper()
+	ch, err := s.QueryEvents(context.Bg(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ev := range ch {
+		evs = append(evs, ev)
+	}
+	return
+}
+
+// SameEvents fails the test if the events are not the wanted ones in the same
+// order.
+func SameEvents(t testing.TB, got, want []*event.T) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID {
+			t.Fatalf("event %d is %s, want %s", i, got[i].ID, want[i].ID)
+		}
+	}
+}
+
+func testOrder(t *testing.T, open Open) {
+	s := open(t)
+	fx := save(t, s, 40)
+	got := Query(t, s, &filter.T{})
+	if !sort.SliceIsSorted(got, func(i, j int) bool {
+		return eventstore.Less(got[i], got[j])
+	}) {
+		t.Error("events are not newest first, by descending id")
+	}
+	SameEvents(t, got, fx)
+}
+
+func testLimit(t *testing.T, open Open) {
+	s := open(t)
+	fx := save(t, s, 40)
+	// the limits cut the events created in the same second
+	for _, limit := range []int{1, 5, 6, 39, 40, 100} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			f := &filter.T{Limit: limit}
+			SameEvents(t, Query(t, s, f), fx.matching(f))
+		})
+	}
+}
+
+func testFilters(t *testing.T, open Open) {
+	s := open(t)
+	fx := save(t, s, 40)
+	first, last := fx[len(fx)-1].CreatedAt, fx[0].CreatedAt
+	for _, tc := range []struct {
+		name string
+		f    *filter.T
+	}{
+		{"ids", &filter.T{IDs: []string{fx[3].ID.String(), fx[17].ID.String(),
+			NewEvent(9, kind.TextNote, 0, "", nil).ID.String()}}},
+		{"kinds", &filter.T{Kinds: kinds.T{kind.Reaction}}},
+		{"all kinds", &filter.T{Kinds: kinds.T{kind.TextNote, kind.Reaction}}},
+		{"authors", &filter.T{Authors: []string{Pubkey(1)}}},
+		{"authors and kinds", &filter.T{Authors: []string{Pubkey(0), Pubkey(2)},
+			Kinds: kinds.T{kind.TextNote}}},
+		{"tag", &filter.T{Tags: filter.TagMap{"#t": {"a"}}}},
+		{"tag values", &filter.T{Tags: filter.TagMap{"#t": {"a", "c"}}}},
+		{"tags", &filter.T{Tags: filter.TagMap{"#t": {"b"},
+			"#p": {Pubkey(1), Pubkey(3)}}}},
+		{"event tag", &filter.T{Tags: filter.TagMap{
+			"#e": {fx[len(fx)-1].ID.String()}}}},
+		{"since", &filter.T{Since: (first + 5).Ptr()}},
+		{"until", &filter.T{Until: (last - 3).Ptr()}},
+		{"since and until", &filter.T{Since: (first + 2).Ptr(),
+			Until: (first + 4).Ptr()}},
+		{"second", &filter.T{Since: (first + 3).Ptr(),
+			Until: (first + 3).Ptr()}},
+		{"everything", &filter.T{Authors: []string{Pubkey(0), Pubkey(1)},
+			Kinds: kinds.T{kind.TextNote}, Tags: filter.TagMap{"#t": {"a", "b"}},
+			Since: (first + 1).Ptr(), Limit: 3}},
+		{"nothing", &filter.T{Kinds: kinds.T{kind.TextNote},
+			Tags: filter.TagMap{"#t": {"d"}}}},
+		// fields decoded from JSON as empty are unset
+		{"empty fields", &filter.T{Kinds: kinds.T{}, Authors: []string{},
+			Tags: filter.TagMap{"#t": {}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := fx.matching(tc.f)
+			SameEvents(t, Query(t, s, tc.f), want)
+			cs, ok := s.(counter)
+			if !ok {
+				return
+			}
+			f := *tc.f
+			f.Limit = 0
+			n, err := cs.CountEvents(context.Bg(), &f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want = fx.matching(&f); n != int64(len(want)) {
+				t.Errorf("counted %d events, want %d", n, len(want))
+			}
+		})
+	}
+}
+
+func testDuplicates(t *testing.T, open Open) {
+	s := open(t)
+	fx := save(t, s, 4)
+	err := s.SaveEvent(context.Bg(), fx[2])
+	if !errors.Is(err, eventstore.ErrDupEvent) {
+		t.Errorf("saving a stored event returned %v, want %v", err,
+			eventstore.ErrDupEvent)
+	}
+	SameEvents(t, Query(t, s, &filter.T{}), fx)
+}
+
+func testDelete(t *testing.T, open Open) {
+	s := open(t)
+	c := context.Bg()
+	fx := save(t, s, 10)
+	for _, ev := range []*event.T{fx[4], fx[4], NewEvent(9, kind.TextNote, 0,
+		"never stored", nil)} {
+		if err := s.DeleteEvent(c, ev); err != nil {
+			t.Fatalf("deleting %s returned %v", ev.ID, err)
+		}
+	}
+	rest := append(append(fixture{}, fx[:4]...), fx[5:]...)
+	SameEvents(t, Query(t, s, &filter.T{}), rest)
+	SameEvents(t, Query(t, s, &filter.T{IDs: []string{fx[4].ID.String()}}),
+		nil)
+	SameEvents(t, Query(t, s, &filter.T{Authors: []string{fx[4].PubKey}}),
+		rest.matching(&filter.T{Authors: []string{fx[4].PubKey}}))
+	// it can be stored again, as DeleteEvent doesn't record deletions
+	if err := s.SaveEvent(c, fx[4]); err != nil {
+		t.Fatal(err)
+	}
+	SameEvents(t, Query(t, s, &filter.T{}), fx)
+}
+
+// hideReplacer hides that a store is a Replacer, so RelayWrapper.Publish
+// replaces events by querying and deleting the older versions.
+type hideReplacer struct{ eventstore.Store }
+
+func testReplace(t *testing.T, open Open) {
+	for _, tc := range []struct {
+		name string
+		wrap func(s eventstore.Store) eventstore.Store
+	}{
+		{"store", func(s eventstore.Store) eventstore.Store { return s }},
+		{"query and delete", func(s eventstore.Store) eventstore.Store {
+			return hideReplacer{s}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := open(t)
+			w := eventstore.RelayWrapper{Store: tc.wrap(s)}
+			publish := func(evs ...*event.T) {
+				t.Helper()
+				for _, ev := range evs {
+					if err := w.Publish(context.Bg(), ev); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			profile := func(createdAt timestamp.T, content string) *event.T {
+				return NewEvent(1, kind.ProfileMetadata, createdAt, content,
+					nil)
+			}
+			v1, v2, old := profile(100, "1"), profile(200, "2"),
+				profile(50, "0")
+			publish(v1, v2, old)
+			SameEvents(t, Query(t, s, &filter.T{Authors: []string{Pubkey(1)}}),
+				[]*event.T{v2})
+			// of versions created at the same time the lowest id is kept
+			a, b := profile(300, "a"), profile(300, "b")
+			publish(a, b)
+			kept := a
+			if b.ID < a.ID {
+				kept = b
+			}
+			SameEvents(t, Query(t, s, &filter.T{Authors: []string{Pubkey(1)}}),
+				[]*event.T{kept})
+
+			// parameterized replaceable events are replaced by the ones with
+			// the same d tag
+			article := func(d string, createdAt timestamp.T) *event.T {
+				return NewEvent(1, kind.T(30023), createdAt, "",
+					tags.T{{"d", d}})
+			}
+			x1, y, x2 := article("x", 100), article("y", 150),
+				article("x", 200)
+			publish(x1, y, x2)
+			SameEvents(t, Query(t, s, &filter.T{Kinds: kinds.T{30023}}),
+				[]*event.T{x2, y})
+
+			// ephemeral events are not stored
+			publish(NewEvent(1, kind.T(20001), 100, "", nil))
+			SameEvents(t, Query(t, s, &filter.T{Kinds: kinds.T{20001}}), nil)
+		})
+	}
+}
+
+func testConcurrent(t *testing.T, open Open) {
+	s := open(t)
+	c := context.Bg()
+	const writers, each = 8, 20
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	var fx fixture
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				ev := NewEvent(w, kind.TextNote, timestamp.T(1000+i),
+					fmt.Sprint(w, i), nil)
+				if err := s.SaveEvent(c, ev); err != nil {
+					errs <- err
+					return
+				}
+				mx.Lock()
+				fx = append(fx, ev)
+				mx.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	sort.Slice(fx, func(i, j int) bool { return eventstore.Less(fx[i], fx[j]) })
+	SameEvents(t, Query(t, s, &filter.T{}), fx)
+
+	// replacing without a Replacer can leave more than one version if the
+	// replacements run at the same time
+	if _, ok := s.(eventstore.Replacer); !ok {
+		return
+	}
+	w := eventstore.RelayWrapper{Store: s}
+	versions := make([]*event.T, writers)
+	for i := range versions {
+		versions[i] = NewEvent(writers, kind.ProfileMetadata,
+			timestamp.T(100+i), fmt.Sprint(i), nil)
+	}
+	errs = make(chan error, writers)
+	for _, ev := range versions {
+		wg.Add(1)
+		go func(ev *event.T) {
+			defer wg.Done()
+			errs <- w.Publish(c, ev)
+		}(ev)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	SameEvents(t, Query(t, s, &filter.T{Kinds: kinds.T{kind.ProfileMetadata}}),
+		[]*event.T{versions[len(versions)-1]})
+}
+
+func testCancel(t *testing.T, open Open) {
+	s := open(t)
+	save(t, s, 40)
+	// the channel is closed when the query is canceled, whether or not the
+	// store stops early
+	drain := func(ch chan *event.T) {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case _, ok := <-ch:
+				if !ok {
+					return
+				}
+			case <-timeout:
+				t.Fatal("the channel was not closed after the query was " +
+					"canceled")
+			}
+		}
+	}
+	c, cancel := context.Cancel(context.Bg())
+	ch, err := s.QueryEvents(c, &filter.T{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+	cancel()
+	drain(ch)
+	// a query with a canceled context fails or returns a channel that is
+	// closed
+	if ch, err = s.QueryEvents(c, &filter.T{}); err == nil {
+		drain(ch)
+	}
+}
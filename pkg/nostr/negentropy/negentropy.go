@@ -0,0 +1,355 @@
+// Package negentropy implements the range-based set reconciliation protocol
+// of NIP-77, with which two parties can find the events that only one of them
+// has, with bandwidth proportional to the difference between their sets.
+package negentropy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+)
+
+const (
+	// ProtocolVersion is the version of the protocol messages.
+	ProtocolVersion byte = 0x61
+	// MinFrameSizeLimit is the smallest limit on the size of messages.
+	MinFrameSizeLimit = 4096
+	// FingerprintSize is the size of the fingerprints of ranges.
+	FingerprintSize = 16
+	// buckets is the number of ranges a range that differs is split into.
+	buckets = 16
+	// maxTimestamp is the timestamp of the bound that is after every item.
+	maxTimestamp = math.MaxUint64
+)
+
+// The modes of the ranges in a message.
+const (
+	modeSkip        = 0
+	modeFingerprint = 1
+	modeIDList      = 2
+)
+
+// ErrTooManyItems is returned when the set to reconcile is larger than is
+// allowed.
+var ErrTooManyItems = errors.New("too many events to reconcile")
+
+// ErrUnsupportedVersion is returned if the messages of the other side use a
+// different version of the protocol.
+var ErrUnsupportedVersion = errors.New("unsupported negentropy protocol version")
+
+// bound is the upper end of a range, made of a timestamp and the shortest
+// id prefix that separates it from the previous item.
+type bound struct {
+	timestamp uint64
+	prefix    []byte
+}
+
+// greaterThan returns true if an item is before the bound.
+func (b bound) greaterThan(it Item) bool {
+	if it.Timestamp != b.timestamp {
+		return it.Timestamp < b.timestamp
+	}
+	return bytes.Compare(it.ID[:], b.prefix) < 0
+}
+
+// T is one side of a reconciliation.
+type T struct {
+	storage          *Vector
+	frameSizeLimit   int
+	initiator        bool
+	lastTimestampIn  uint64
+	lastTimestampOut uint64
+}
+
+// New returns a reconciliation over the items of a sealed Vector. If the
+// frame size limit is not zero messages are kept below it, which takes more
+// round trips.
+func New(storage *Vector, frameSizeLimit int) (n *T, err error) {
+	if !storage.sealed {
+		return nil, errors.New("vector must be sealed")
+	}
+	if frameSizeLimit != 0 && frameSizeLimit < MinFrameSizeLimit {
+		return nil, fmt.Errorf("frame size limit must be at least %d",
+			MinFrameSizeLimit)
+	}
+	return &T{storage: storage, frameSizeLimit: frameSizeLimit}, nil
+}
+
+// Initiate returns the first message of a reconciliation, which makes this
+// side the initiator.
+func (n *T) Initiate() (msg []byte) {
+	n.initiator = true
+	n.lastTimestampOut = 0
+	msg = []byte{ProtocolVersion}
+	return n.splitRange(msg, 0, n.storage.Size(), bound{timestamp: maxTimestamp})
+}
+
+// Reconcile processes a message from the other side and returns the reply.
+//
+// For the initiator, the ids of the items only it has and the ids of the
+// items only the other side has are returned as hex. Once the reply is nil
+// the reconciliation is complete.
+func (n *T) Reconcile(query []byte) (reply []byte, have, need []string,
+	err error) {
+
+	n.lastTimestampIn, n.lastTimestampOut = 0, 0
+	r := &reader{b: query}
+	var version byte
+	if version, err = r.byte(); err != nil {
+		return
+	}
+	if version < 0x60 || version > 0x6f {
+		err = fmt.Errorf("invalid negentropy protocol version byte %x", version)
+		return
+	}
+	if version != ProtocolVersion {
+		if n.initiator {
+			err = ErrUnsupportedVersion
+			return
+		}
+		// tell the initiator which version we use
+		return []byte{ProtocolVersion}, nil, nil, nil
+	}
+	out := []byte{ProtocolVersion}
+	prevBound := bound{}
+	prevIndex := 0
+	skip := false
+	for len(r.b) > 0 {
+		var o []byte
+		// the state before this range, to go back to if its output does not
+		// fit in the frame
+		skipBefore, lastTimestampOut := skip, n.lastTimestampOut
+		// the index the output sent so far reaches
+		sent := -1
+		doSkip := func() {
+			if skip {
+				skip = false
+				o = n.encodeBound(o, prevBound)
+				o = appendVarint(o, modeSkip)
+			}
+		}
+		var currBound bound
+		if currBound, err = n.decodeBound(r); err != nil {
+			return
+		}
+		var mode uint64
+		if mode, err = r.varint(); err != nil {
+			return
+		}
+		lower := prevIndex
+		upper := n.storage.findLowerBound(prevIndex, n.storage.Size(),
+			currBound)
+		switch mode {
+		case modeSkip:
+			skip = true
+		case modeFingerprint:
+			var theirs []byte
+			if theirs, err = r.bytes(FingerprintSize); err != nil {
+				return
+			}
+			if !bytes.Equal(theirs, n.fingerprint(lower, upper)) {
+				doSkip()
+				o = n.splitRange(o, lower, upper, currBound)
+			} else {
+				skip = true
+			}
+		case modeIDList:
+			var num uint64
+			if num, err = r.varint(); err != nil {
+				return
+			}
+			// the count comes from the peer, so it is checked against the
+			// ids the message can hold before the map is sized for it
+			if num > uint64(len(r.b)/IDSize) {
+				err = fmt.Errorf("negentropy id list of %d ids is longer "+
+					"than the message", num)
+				return
+			}
+			theirs := make(map[[IDSize]byte]struct{}, num)
+			for i := uint64(0); i < num; i++ {
+				var id []byte
+				if id, err = r.bytes(IDSize); err != nil {
+					return
+				}
+				theirs[[IDSize]byte(id)] = struct{}{}
+			}
+			if n.initiator {
+				skip = true
+				for _, it := range n.storage.items[lower:upper] {
+					if _, ok := theirs[it.ID]; ok {
+						delete(theirs, it.ID)
+					} else {
+						have = append(have, hex.Enc(it.ID[:]))
+					}
+				}
+				for id := range theirs {
+					need = append(need, hex.Enc(id[:]))
+				}
+			} else {
+				doSkip()
+				var ids []byte
+				numIDs := 0
+				endBound := currBound
+				for i := lower; i < upper; i++ {
+					if n.exceedsFrameSizeLimit(len(out) + len(ids)) {
+						endBound = itemBound(n.storage.items[i])
+						upper = i
+						break
+					}
+					ids = append(ids, n.storage.items[i].ID[:]...)
+					numIDs++
+				}
+				o = n.encodeBound(o, endBound)
+				o = appendVarint(o, modeIDList)
+				o = appendVarint(o, uint64(numIDs))
+				o = append(o, ids...)
+				out = append(out, o...)
+				o = nil
+				sent = upper
+			}
+		default:
+			err = fmt.Errorf("unknown negentropy range mode %d", mode)
+			return
+		}
+		if n.exceedsFrameSizeLimit(len(out) + len(o)) {
+			// the rest of the ranges are sent as a fingerprint, which
+			// continues the reconciliation in the next round
+			if sent < 0 {
+				// the output of this range is dropped, so the fingerprint
+				// covers it too
+				n.lastTimestampOut = lastTimestampOut
+				if skipBefore {
+					out = n.encodeBound(out, prevBound)
+					out = appendVarint(out, modeSkip)
+				}
+				sent = lower
+			}
+			out = n.encodeBound(out, bound{timestamp: maxTimestamp})
+			out = appendVarint(out, modeFingerprint)
+			out = append(out, n.fingerprint(sent, n.storage.Size())...)
+			break
+		}
+		out = append(out, o...)
+		prevIndex = upper
+		prevBound = currBound
+	}
+	if n.initiator && len(out) == 1 {
+		return nil, have, need, nil
+	}
+	return out, have, need, nil
+}
+
+func (n *T) exceedsFrameSizeLimit(size int) bool {
+	return n.frameSizeLimit != 0 && size > n.frameSizeLimit-200
+}
+
+// splitRange appends the ranges that the items in [lower, upper) are split
+// into, which are a list of the ids if there are few, otherwise the
+// fingerprints of buckets of them.
+func (n *T) splitRange(o []byte, lower, upper int, upperBound bound) []byte {
+	num := upper - lower
+	if num < buckets*2 {
+		o = n.encodeBound(o, upperBound)
+		o = appendVarint(o, modeIDList)
+		o = appendVarint(o, uint64(num))
+		for _, it := range n.storage.items[lower:upper] {
+			o = append(o, it.ID[:]...)
+		}
+		return o
+	}
+	perBucket := num / buckets
+	withExtra := num % buckets
+	curr := lower
+	for i := 0; i < buckets; i++ {
+		size := perBucket
+		if i < withExtra {
+			size++
+		}
+		fp := n.fingerprint(curr, curr+size)
+		curr += size
+		next := upperBound
+		if curr != upper {
+			next = minimalBound(n.storage.items[curr-1], n.storage.items[curr])
+		}
+		o = n.encodeBound(o, next)
+		o = appendVarint(o, modeFingerprint)
+		o = append(o, fp...)
+	}
+	return o
+}
+
+// fingerprint returns the hash of the sum of the ids of the items in [lower,
+// upper) and their number.
+func (n *T) fingerprint(lower, upper int) []byte {
+	var sum [IDSize]byte
+	for _, it := range n.storage.items[lower:upper] {
+		// the ids are added as little endian 256 bit numbers
+		var carry uint16
+		for i := 0; i < IDSize; i++ {
+			s := uint16(sum[i]) + uint16(it.ID[i]) + carry
+			sum[i] = byte(s)
+			carry = s >> 8
+		}
+	}
+	h := sha256.Sum256(appendVarint(sum[:], uint64(upper-lower)))
+	return h[:FingerprintSize]
+}
+
+// itemBound returns the bound at an item.
+func itemBound(it Item) bound {
+	return bound{timestamp: it.Timestamp, prefix: it.ID[:]}
+}
+
+// minimalBound returns the shortest bound that is after prev and not after
+// curr.
+func minimalBound(prev, curr Item) bound {
+	if curr.Timestamp != prev.Timestamp {
+		return bound{timestamp: curr.Timestamp}
+	}
+	shared := 0
+	for shared < IDSize && curr.ID[shared] == prev.ID[shared] {
+		shared++
+	}
+	return bound{timestamp: curr.Timestamp, prefix: curr.ID[:shared+1]}
+}
+
+// encodeBound appends a bound, with its timestamp as the difference from the
+// previous one in the message.
+func (n *T) encodeBound(o []byte, b bound) []byte {
+	if b.timestamp == maxTimestamp {
+		n.lastTimestampOut = maxTimestamp
+		o = appendVarint(o, 0)
+	} else {
+		o = appendVarint(o, b.timestamp-n.lastTimestampOut+1)
+		n.lastTimestampOut = b.timestamp
+	}
+	o = appendVarint(o, uint64(len(b.prefix)))
+	return append(o, b.prefix...)
+}
+
+func (n *T) decodeBound(r *reader) (b bound, err error) {
+	var ts uint64
+	if ts, err = r.varint(); err != nil {
+		return
+	}
+	if ts == 0 || n.lastTimestampIn == maxTimestamp {
+		b.timestamp = maxTimestamp
+	} else {
+		b.timestamp = n.lastTimestampIn + ts - 1
+	}
+	n.lastTimestampIn = b.timestamp
+	var length uint64
+	if length, err = r.varint(); err != nil {
+		return
+	}
+	if length > IDSize {
+		err = fmt.Errorf("bound id prefix of %d bytes is too long", length)
+		return
+	}
+	b.prefix, err = r.bytes(int(length))
+	return
+}
@@ -0,0 +1,212 @@
+package negentropy
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+)
+
+func randomItem(r *rand.Rand) (it Item) {
+	// few distinct timestamps so that bounds need id prefixes
+	it.Timestamp = uint64(1700000000 + r.Intn(1000))
+	r.Read(it.ID[:])
+	return
+}
+
+// reconcile runs a reconciliation between two sets and returns the ids found
+// only in the first and only in the second, and the number of round trips.
+func reconcile(t *testing.T, a, b []Item, frameSizeLimit int) (have,
+	need []string, rounds int) {
+
+	va, vb := NewVector(), NewVector()
+	for _, it := range a {
+		if err := va.Insert(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, it := range b {
+		if err := vb.Insert(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	va.Seal()
+	vb.Seal()
+	na, err := New(va, frameSizeLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb, err := New(vb, frameSizeLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := na.Initiate()
+	for msg != nil {
+		rounds++
+		if frameSizeLimit != 0 && len(msg) > frameSizeLimit {
+			t.Fatalf("message of %d bytes exceeds the frame size limit",
+				len(msg))
+		}
+		var reply []byte
+		if reply, _, _, err = nb.Reconcile(msg); err != nil {
+			t.Fatal(err)
+		}
+		if frameSizeLimit != 0 && len(reply) > frameSizeLimit {
+			t.Fatalf("reply of %d bytes exceeds the frame size limit",
+				len(reply))
+		}
+		var h, n []string
+		if msg, h, n, err = na.Reconcile(reply); err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, h...)
+		need = append(need, n...)
+		if rounds > 1000 {
+			t.Fatal("reconciliation does not end")
+		}
+	}
+	sort.Strings(have)
+	sort.Strings(need)
+	return
+}
+
+// difference returns the hex ids of the items in a that are not in b.
+func difference(a, b []Item) (ids []string) {
+	in := make(map[Item]struct{}, len(b))
+	for _, it := range b {
+		in[it] = struct{}{}
+	}
+	for _, it := range a {
+		if _, ok := in[it]; !ok {
+			ids = append(ids, hex.Enc(it.ID[:]))
+		}
+	}
+	sort.Strings(ids)
+	return
+}
+
+func TestReconcile(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		common, onlyA, onlyB int
+		frameSizeLimit       int
+	}{
+		{0, 0, 0, 0},
+		{10, 0, 0, 0},
+		{0, 5, 7, 0},
+		{1000, 3, 4, 0},
+		{10000, 100, 50, 0},
+		{10000, 100, 50, MinFrameSizeLimit},
+		{5000, 2000, 2000, MinFrameSizeLimit},
+	} {
+		name := fmt.Sprintf("%d/%d/%d/%d", tc.common, tc.onlyA, tc.onlyB,
+			tc.frameSizeLimit)
+		t.Run(name, func(t *testing.T) {
+			var a, b []Item
+			for i := 0; i < tc.common; i++ {
+				it := randomItem(r)
+				a, b = append(a, it), append(b, it)
+			}
+			for i := 0; i < tc.onlyA; i++ {
+				a = append(a, randomItem(r))
+			}
+			for i := 0; i < tc.onlyB; i++ {
+				b = append(b, randomItem(r))
+			}
+			have, need, rounds := reconcile(t, a, b, tc.frameSizeLimit)
+			if fmt.Sprint(have) != fmt.Sprint(difference(a, b)) {
+				t.Errorf("have %d ids, want %d", len(have),
+					len(difference(a, b)))
+			}
+			if fmt.Sprint(need) != fmt.Sprint(difference(b, a)) {
+				t.Errorf("need %d ids, want %d", len(need),
+					len(difference(b, a)))
+			}
+			t.Logf("%d rounds", rounds)
+		})
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	v := NewVector()
+	v.Seal()
+	responder, _ := New(v, 0)
+	reply, _, _, err := responder.Reconcile([]byte{0x62})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 1 || reply[0] != ProtocolVersion {
+		t.Fatalf("reply to an unsupported version is %x", reply)
+	}
+	initiator, _ := New(v, 0)
+	initiator.Initiate()
+	if _, _, _, err = initiator.Reconcile([]byte{0x62}); err != ErrUnsupportedVersion {
+		t.Fatalf("initiator got error %v", err)
+	}
+}
+
+func TestIDListTooLong(t *testing.T) {
+	v := NewVector()
+	v.Seal()
+	// an id list that claims more ids than the message holds, which must be
+	// rejected before anything is allocated for them
+	for _, num := range []uint64{1 << 20, 1 << 60} {
+		msg := []byte{ProtocolVersion}
+		msg = appendVarint(msg, 0)
+		msg = appendVarint(msg, 0)
+		msg = appendVarint(msg, modeIDList)
+		msg = appendVarint(msg, num)
+		msg = append(msg, make([]byte, IDSize)...)
+		for _, initiator := range []bool{false, true} {
+			n, _ := New(v, 0)
+			if initiator {
+				n.Initiate()
+			}
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, _, _, err := n.Reconcile(msg)
+			runtime.ReadMemStats(&after)
+			if err == nil {
+				t.Errorf("an id list of %d ids was accepted, initiator %v",
+					num, initiator)
+			}
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+				t.Errorf("an id list of %d ids allocated %d bytes", num,
+					alloc)
+			}
+		}
+	}
+}
+
+func FuzzReconcile(f *testing.F) {
+	v := NewVector()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		if err := v.Insert(randomItem(r)); err != nil {
+			f.Fatal(err)
+		}
+	}
+	v.Seal()
+	initiator, _ := New(v, 0)
+	f.Add(initiator.Initiate())
+	f.Add([]byte{ProtocolVersion, 0, 0, modeIDList, 0xff, 0xff, 0xff, 0xff,
+		0x0f})
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		n, _ := New(v, 0)
+		// only errors are expected from messages that are not valid
+		_, _, _, _ = n.Reconcile(msg)
+	})
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 1 << 40,
+		maxTimestamp} {
+		r := &reader{b: appendVarint(nil, v)}
+		if got, err := r.varint(); err != nil || got != v || len(r.b) != 0 {
+			t.Errorf("varint %d decoded as %d, %v", v, got, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package negentropy
+
+import (
+	"errors"
+)
+
+var errTruncated = errors.New("negentropy message is truncated")
+
+// appendVarint appends an unsigned integer in base 128, most significant
+// digit first, with the high bit set on every byte but the last.
+func appendVarint(o []byte, v uint64) []byte {
+	var digits [10]byte
+	i := len(digits) - 1
+	digits[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		digits[i] = byte(v&0x7f) | 0x80
+	}
+	return append(o, digits[i:]...)
+}
+
+// reader decodes the fields of a message.
+type reader struct {
+	b []byte
+}
+
+func (r *reader) byte() (b byte, err error) {
+	if len(r.b) < 1 {
+		return 0, errTruncated
+	}
+	b, r.b = r.b[0], r.b[1:]
+	return
+}
+
+func (r *reader) bytes(n int) (b []byte, err error) {
+	if len(r.b) < n {
+		return nil, errTruncated
+	}
+	b, r.b = r.b[:n], r.b[n:]
+	return
+}
+
+func (r *reader) varint() (v uint64, err error) {
+	for i := 0; ; i++ {
+		if i == 10 {
+			return 0, errors.New("negentropy varint is too long")
+		}
+		var b byte
+		if b, err = r.byte(); err != nil {
+			return
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return
+		}
+	}
+}
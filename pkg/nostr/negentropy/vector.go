@@ -0,0 +1,95 @@
+package negentropy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+)
+
+// IDSize is the size of the ids of the items.
+const IDSize = 32
+
+// Item is an element of the set being reconciled, an event with its
+// created_at timestamp and id.
+type Item struct {
+	Timestamp uint64
+	ID        [IDSize]byte
+}
+
+// NewItem returns the item for an event with a hex id.
+func NewItem(timestamp uint64, id string) (it Item, err error) {
+	var b []byte
+	if b, err = hex.Dec(id); err != nil {
+		return
+	}
+	if len(b) != IDSize {
+		err = fmt.Errorf("invalid id '%s'", id)
+		return
+	}
+	it.Timestamp = timestamp
+	copy(it.ID[:], b)
+	return
+}
+
+// Compare orders items by timestamp, then by id.
+func (it Item) Compare(other Item) int {
+	switch {
+	case it.Timestamp < other.Timestamp:
+		return -1
+	case it.Timestamp > other.Timestamp:
+		return 1
+	}
+	return bytes.Compare(it.ID[:], other.ID[:])
+}
+
+// Vector is the storage of the items of one side of a reconciliation, which
+// is a sorted slice.
+type Vector struct {
+	items  []Item
+	sealed bool
+}
+
+// NewVector returns an empty Vector.
+func NewVector() *Vector { return &Vector{} }
+
+// Insert adds an item. Items can only be added before the Vector is sealed.
+func (v *Vector) Insert(it Item) (err error) {
+	if v.sealed {
+		return fmt.Errorf("vector is sealed")
+	}
+	v.items = append(v.items, it)
+	return
+}
+
+// Seal sorts the items and removes duplicates. After it is sealed the Vector
+// can be used for reconciliation.
+func (v *Vector) Seal() {
+	if v.sealed {
+		return
+	}
+	v.sealed = true
+	sort.Slice(v.items, func(i, j int) bool {
+		return v.items[i].Compare(v.items[j]) < 0
+	})
+	dedup := v.items[:0]
+	for i, it := range v.items {
+		if i > 0 && it == v.items[i-1] {
+			continue
+		}
+		dedup = append(dedup, it)
+	}
+	v.items = dedup
+}
+
+// Size returns the number of items.
+func (v *Vector) Size() int { return len(v.items) }
+
+// findLowerBound returns the index of the first item in [begin, end) that is
+// not less than the bound, or end if there is none.
+func (v *Vector) findLowerBound(begin, end int, b bound) int {
+	return begin + sort.Search(end-begin, func(i int) bool {
+		return !b.greaterThan(v.items[begin+i])
+	})
+}
@@ -1,6 +1,9 @@
 package nip11
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestAddSupportedNIP(t *testing.T) {
 	info := NewInfo(nil)
@@ -14,3 +17,32 @@ func TestAddSupportedNIP(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoveSupportedNIP(t *testing.T) {
+	info := NewInfo(nil)
+	info.AddNIPs(1, 13, 50)
+	info.RemoveNIPs(13, 42)
+	if info.HasNIP(13) || !info.HasNIP(1) || !info.HasNIP(50) {
+		t.Errorf("supported nips after removing 13 are %v", info.nips)
+	}
+}
+
+func TestMarshalSupportedNIPs(t *testing.T) {
+	info := NewInfo(&Info{Name: "relay"})
+	info.AddNIPs(50, 1, 11)
+	b, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Name string `json:"name"`
+		NIPs []int  `json:"supported_nips"`
+	}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Name != "relay" || len(doc.NIPs) != 3 || doc.NIPs[0] != 1 ||
+		doc.NIPs[1] != 11 || doc.NIPs[2] != 50 {
+		t.Errorf("encoded information is %s", b)
+	}
+}
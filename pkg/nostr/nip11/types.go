@@ -1,6 +1,8 @@
 package nip11
 
 import (
+	"encoding/json"
+	"sort"
 	"sync"
 
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kinds"
@@ -47,7 +49,6 @@ type Info struct {
 	Description    string   `json:"description"`
 	PubKey         string   `json:"pubkey"`
 	Contact        string   `json:"contact"`
-	nips           NIPs     `json:"supported_nips"`
 	Software       string   `json:"software"`
 	Version        string   `json:"version"`
 	Limitation     *Limits  `json:"limitation,omitempty"`
@@ -58,6 +59,8 @@ type Info struct {
 	PaymentsURL    string   `json:"payments_url,omitempty"`
 	Fees           *Fees    `json:"fees,omitempty"`
 	Icon           string   `json:"icon"`
+	// nips is encoded as supported_nips by MarshalJSON
+	nips NIPs
 	sync.Mutex
 }
 
@@ -88,9 +91,36 @@ func (inf *Info) AddNIPs(n ...int) {
 	inf.Unlock()
 }
 
+// RemoveNIPs removes NIPs from the supported NIPs, for features that are
+// turned off while the relay is running.
+func (inf *Info) RemoveNIPs(n ...int) {
+	inf.Lock()
+	for _, number := range n {
+		delete(inf.nips, number)
+	}
+	inf.Unlock()
+}
+
 func (inf *Info) HasNIP(n int) (ok bool) {
 	inf.Lock()
 	_, ok = inf.nips[n]
 	inf.Unlock()
 	return
 }
+
+// MarshalJSON encodes the information with the supported NIPs in ascending
+// order. The caller holds the lock if the information can be changed
+// concurrently. The supported NIPs are not decoded, as they are set by the
+// software serving the information rather than by its configuration.
+func (inf *Info) MarshalJSON() ([]byte, error) {
+	var nips []int
+	for n := range inf.nips {
+		nips = append(nips, n)
+	}
+	sort.Ints(nips)
+	type info Info
+	return json.Marshal(struct {
+		*info
+		NIPs []int `json:"supported_nips,omitempty"`
+	}{(*info)(inf), nips})
+}
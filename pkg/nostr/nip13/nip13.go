@@ -0,0 +1,162 @@
+// Package nip13 implements NIP-13 proof of work: counting the leading zero
+// bits of an event ID, verifying the target committed to in the nonce tag, and
+// mining a nonce that produces an ID of a given difficulty.
+package nip13
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"runtime"
+	"strconv"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"mleku.online/git/slog"
+)
+
+var log = slog.GetStd()
+
+// NonceTag is the key of the tag that carries the nonce and the committed
+// target difficulty.
+const NonceTag = "nonce"
+
+var (
+	ErrDifficultyTooLow = errors.New("nip13: insufficient difficulty")
+	ErrTargetTooLow     = errors.New("nip13: committed target is too low")
+	ErrGenerateTimeout  = errors.New("nip13: generating proof of work took too long")
+	ErrMissingPubKey    = errors.New("nip13: event must have a pubkey to be mined")
+)
+
+// Difficulty counts the number of leading zero bits in a hex encoded event ID.
+// Invalid hex characters end the count.
+func Difficulty(id string) (n int) {
+	for i := 0; i < len(id); i++ {
+		var nibble byte
+		switch c := id[i]; {
+		case c >= '0' && c <= '9':
+			nibble = c - '0'
+		case c >= 'a' && c <= 'f':
+			nibble = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			nibble = c - 'A' + 10
+		default:
+			return
+		}
+		if nibble != 0 {
+			return n + bits.LeadingZeros8(nibble) - 4
+		}
+		n += 4
+	}
+	return
+}
+
+// DifficultyBytes counts the number of leading zero bits in a raw event ID.
+func DifficultyBytes(id []byte) (n int) {
+	for _, b := range id {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return
+}
+
+// CommittedDifficulty returns the target difficulty committed to in the third
+// element of the nonce tag of an event, or zero if there is none.
+func CommittedDifficulty(ev *event.T) (target int) {
+	t := ev.Tags.GetFirst([]string{NonceTag, ""})
+	if t == nil || len(*t) < 3 || (*t)[0] != NonceTag {
+		return
+	}
+	var err error
+	if target, err = strconv.Atoi((*t)[2]); err != nil || target < 0 {
+		return 0
+	}
+	return
+}
+
+// Check returns ErrDifficultyTooLow if the hex encoded event ID has less than
+// minDifficulty leading zero bits.
+func Check(id string, minDifficulty int) (err error) {
+	if Difficulty(id) < minDifficulty {
+		return ErrDifficultyTooLow
+	}
+	return
+}
+
+// CheckEvent verifies that the event ID of an event has at least
+// minDifficulty leading zero bits, and that the event committed to a target
+// that is at least minDifficulty, so that events that reach the difficulty by
+// luck while mining for a lower target are not accepted.
+func CheckEvent(ev *event.T, minDifficulty int) (err error) {
+	if err = Check(ev.ID.String(), minDifficulty); err != nil {
+		return
+	}
+	if CommittedDifficulty(ev) < minDifficulty {
+		return ErrTargetTooLow
+	}
+	return
+}
+
+// Generate mines a nonce tag for an event so that its ID has at least target
+// leading zero bits, using all available CPU cores. The event must already
+// have its pubkey set, as it is part of the ID hash, and it must be signed
+// afterwards. On success the nonce tag and the ID of the event are set.
+//
+// If the context is canceled before the target is reached, ErrGenerateTimeout
+// is returned and the event is not modified.
+func Generate(c context.T, ev *event.T, target int) (err error) {
+	if ev.PubKey == "" {
+		return ErrMissingPubKey
+	}
+	if target < 0 || target > 256 {
+		return fmt.Errorf("nip13: invalid target difficulty %d", target)
+	}
+	c, cancel := context.Cancel(c)
+	defer cancel()
+	workers := runtime.NumCPU()
+	found := make(chan *event.T, workers)
+	committed := strconv.Itoa(target)
+	base, baseTags := *ev, ev.Tags.FilterOut([]string{NonceTag})
+	for w := 0; w < workers; w++ {
+		go func(start uint64) {
+			// each worker has its own copy of the event, with a nonce tag it
+			// can modify in place
+			e := base
+			e.Tags = make(tags.T, len(baseTags), len(baseTags)+1)
+			copy(e.Tags, baseTags)
+			e.Tags = append(e.Tags, tag.T{NonceTag, "", committed})
+			nonce := e.Tags[len(e.Tags)-1]
+			for i, n := 0, start; ; i, n = i+1, n+uint64(workers) {
+				if i%1024 == 0 {
+					select {
+					case <-c.Done():
+						return
+					default:
+					}
+				}
+				nonce[1] = strconv.FormatUint(n, 10)
+				id := e.GetIDBytes()
+				if DifficultyBytes(id) >= target {
+					e.ID = eventid.T(hex.Enc(id))
+					found <- &e
+					return
+				}
+			}
+		}(uint64(w))
+	}
+	select {
+	case res := <-found:
+		log.D.F("mined event %s with difficulty %d", res.ID,
+			Difficulty(res.ID.String()))
+		ev.Tags, ev.ID = res.Tags, res.ID
+	case <-c.Done():
+		err = ErrGenerateTimeout
+	}
+	return
+}
@@ -0,0 +1,83 @@
+package nip13
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+func TestDifficulty(t *testing.T) {
+	for _, tc := range []struct {
+		id   string
+		want int
+	}{
+		{"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 0},
+		{"7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 1},
+		{"0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 4},
+		{"00ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 8},
+		{"000000000e9d97a1ab09fc381030b346cdd7a142ad57e6df0b46dc9bef6c7e2d", 36},
+		{"0000000000000000000000000000000000000000000000000000000000000000", 256},
+	} {
+		if got := Difficulty(tc.id); got != tc.want {
+			t.Errorf("Difficulty(%s) = %d, want %d", tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestCommittedDifficulty(t *testing.T) {
+	ev := &event.T{Tags: tags.T{{"p", "abcd"}, {"nonce", "776797", "20"}}}
+	if got := CommittedDifficulty(ev); got != 20 {
+		t.Errorf("CommittedDifficulty = %d, want 20", got)
+	}
+	ev.Tags = tags.T{{"nonce", "776797"}}
+	if got := CommittedDifficulty(ev); got != 0 {
+		t.Errorf("CommittedDifficulty without target = %d, want 0", got)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	const target = 12
+	ev := &event.T{
+		PubKey:    "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		CreatedAt: timestamp.Now(),
+		Kind:      kind.TextNote,
+		Tags:      tags.T{tag.T{"t", "pow"}},
+		Content:   "proof of work",
+	}
+	c, cancel := context.Timeout(context.Bg(), 10*time.Second)
+	defer cancel()
+	if err := Generate(c, ev, target); err != nil {
+		t.Fatal(err)
+	}
+	if ev.ID != ev.GetID() {
+		t.Fatalf("mined id %s does not match event %s", ev.ID, ev.GetID())
+	}
+	if err := CheckEvent(ev, target); err != nil {
+		t.Fatalf("mined event failed check: %s", err)
+	}
+	if len(ev.Tags) != 2 {
+		t.Fatalf("expected 2 tags, got %v", ev.Tags)
+	}
+}
+
+func TestGenerateTimeout(t *testing.T) {
+	ev := &event.T{
+		PubKey:    "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",
+		CreatedAt: timestamp.Now(),
+		Kind:      kind.TextNote,
+	}
+	c, cancel := context.Timeout(context.Bg(), 100*time.Millisecond)
+	defer cancel()
+	if err := Generate(c, ev, 200); err != ErrGenerateTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if len(ev.Tags) != 0 || ev.ID != "" {
+		t.Fatalf("event was modified on timeout")
+	}
+}
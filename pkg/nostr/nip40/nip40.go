@@ -0,0 +1,33 @@
+// Package nip40 implements NIP-40 event expiration timestamps.
+package nip40
+
+import (
+	"strconv"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+// ExpirationTag is the key of the tag that carries the expiration timestamp.
+const ExpirationTag = "expiration"
+
+// Expiration returns the expiration timestamp of an event, and false if the
+// event has no valid expiration tag.
+func Expiration(ev *event.T) (ts timestamp.T, ok bool) {
+	t := ev.Tags.GetFirst([]string{ExpirationTag, ""})
+	if t == nil || (*t)[0] != ExpirationTag {
+		return
+	}
+	i, err := strconv.ParseInt(t.Value(), 10, 64)
+	if err != nil || i < 0 {
+		return
+	}
+	return timestamp.T(i), true
+}
+
+// IsExpired returns true if the event has an expiration tag with a time that is
+// not after now.
+func IsExpired(ev *event.T, now timestamp.T) bool {
+	ts, ok := Expiration(ev)
+	return ok && ts <= now
+}
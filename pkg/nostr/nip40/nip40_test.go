@@ -0,0 +1,30 @@
+package nip40
+
+import (
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+func TestIsExpired(t *testing.T) {
+	for _, tc := range []struct {
+		tags tags.T
+		now  timestamp.T
+		want bool
+	}{
+		{nil, 1000, false},
+		{tags.T{{"expiration", "1000"}}, 999, false},
+		{tags.T{{"expiration", "1000"}}, 1000, true},
+		{tags.T{{"p", "abcd"}, {"expiration", "1000"}}, 1001, true},
+		{tags.T{{"expiration", "soon"}}, 1001, false},
+		{tags.T{{"expiration"}}, 1001, false},
+	} {
+		ev := &event.T{Tags: tc.tags}
+		if got := IsExpired(ev, tc.now); got != tc.want {
+			t.Errorf("IsExpired(%v, %d) = %v, want %v", tc.tags, tc.now,
+				got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package nip50 implements the tokenizing of text for NIP-50 search.
+package nip50
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+)
+
+const (
+	// MinTermLength is the number of characters below which words are not
+	// search terms.
+	MinTermLength = 2
+	// MaxTermLength is the number of bytes search terms are truncated to.
+	MaxTermLength = 64
+)
+
+// Tokenize splits text into its search terms, which are the lower case runs
+// of letters and digits, with the number of times each one occurs.
+func Tokenize(text string) (terms map[string]int) {
+	terms = make(map[string]int)
+	for _, w := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(w) < MinTermLength {
+			continue
+		}
+		terms[truncate(strings.ToLower(w))]++
+	}
+	return
+}
+
+// truncate shortens a term to MaxTermLength bytes without splitting a
+// character.
+func truncate(s string) string {
+	if len(s) <= MaxTermLength {
+		return s
+	}
+	i := MaxTermLength
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i]
+}
+
+// QueryTerms returns the distinct search terms of the search field of a
+// filter. Extensions of the form key:value are not supported and are ignored.
+func QueryTerms(search string) (terms []string) {
+	seen := make(map[string]struct{})
+	for _, f := range strings.Fields(search) {
+		if k, v, ok := strings.Cut(f, ":"); ok && isExtension(k, v) {
+			continue
+		}
+		for t := range Tokenize(f) {
+			if _, ok := seen[t]; !ok {
+				seen[t] = struct{}{}
+				terms = append(terms, t)
+			}
+		}
+	}
+	return
+}
+
+// isExtension returns true if a word split at its first colon is an
+// extension, and not, for example, a URL.
+func isExtension(k, v string) bool {
+	if k == "" || v == "" || strings.HasPrefix(v, "/") {
+		return false
+	}
+	for _, r := range k {
+		if !unicode.IsLetter(r) && r != '_' && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Text returns the text of an event that is searched, which is the content and
+// the values of the tags with the given names. Encrypted direct messages have
+// none, as their content would only match by chance.
+func Text(ev *event.T, tagNames []string) string {
+	if ev.Kind == kind.EncryptedDirectMessage {
+		return ""
+	}
+	if len(tagNames) == 0 {
+		return ev.Content
+	}
+	text := []string{ev.Content}
+	for _, t := range ev.Tags {
+		if len(t) < 2 {
+			continue
+		}
+		for _, name := range tagNames {
+			if t[0] == name {
+				text = append(text, t[1])
+				break
+			}
+		}
+	}
+	return strings.Join(text, " ")
+}
+
+// Matches returns true if the text of an event, with the values of the tags
+// with the given names, contains all of the terms.
+func Matches(terms []string, ev *event.T, tagNames ...string) bool {
+	if len(terms) == 0 {
+		return true
+	}
+	words := Tokenize(Text(ev, tagNames))
+	for _, t := range terms {
+		if _, ok := words[t]; !ok {
+			return false
+		}
+	}
+	return true
+}
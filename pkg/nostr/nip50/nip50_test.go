@@ -0,0 +1,64 @@
+package nip50
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+)
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Hello, hello world! I'm #nostr-ing a 2nd time: ÜBER")
+	want := map[string]int{"hello": 2, "world": 1, "nostr": 1, "ing": 1,
+		"2nd": 1, "time": 1, "über": 1}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueryTerms(t *testing.T) {
+	for _, tc := range []struct {
+		search string
+		want   []string
+	}{
+		{"", nil},
+		{"nostr relay", []string{"nostr", "relay"}},
+		{"relay Relay language:en", []string{"relay"}},
+		{"https://example.com", []string{"com", "example", "https"}},
+	} {
+		got := QueryTerms(tc.search)
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("QueryTerms(%q) = %v, want %v", tc.search, got, tc.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	ev := &event.T{Kind: kind.TextNote, Content: "hello world",
+		Tags: tags.T{{"t", "nostr"}, {"subject", "relays"}, {"t"}}}
+	for _, tc := range []struct {
+		search   string
+		tagNames []string
+		want     bool
+	}{
+		{"hello world", nil, true},
+		{"hello nostr", nil, false},
+		{"hello nostr", []string{"t"}, true},
+		{"nostr relays", []string{"t"}, false},
+		{"nostr relays", []string{"t", "subject"}, true},
+	} {
+		if got := Matches(QueryTerms(tc.search), ev,
+			tc.tagNames...); got != tc.want {
+			t.Errorf("search %q with tags %v matched %v, want %v",
+				tc.search, tc.tagNames, got, tc.want)
+		}
+	}
+	dm := &event.T{Kind: kind.EncryptedDirectMessage, Content: "hello"}
+	if Matches([]string{"hello"}, dm) {
+		t.Error("encrypted direct message matched a search")
+	}
+}
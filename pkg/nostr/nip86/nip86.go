@@ -0,0 +1,114 @@
+// Package nip86 defines the JSON-RPC messages of the NIP-86 relay management
+// API.
+package nip86
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+)
+
+// ContentType is the content type of management API requests.
+const ContentType = "application/nostr+json+rpc"
+
+// The methods of the management API.
+const (
+	SupportedMethods            = "supportedmethods"
+	BanPubKey                   = "banpubkey"
+	ListBannedPubKeys           = "listbannedpubkeys"
+	AllowPubKey                 = "allowpubkey"
+	ListAllowedPubKeys          = "listallowedpubkeys"
+	ListEventsNeedingModeration = "listeventsneedingmoderation"
+	AllowEvent                  = "allowevent"
+	BanEvent                    = "banevent"
+	ListBannedEvents            = "listbannedevents"
+	ChangeRelayName             = "changerelayname"
+	ChangeRelayDescription      = "changerelaydescription"
+	ChangeRelayIcon             = "changerelayicon"
+	AllowKind                   = "allowkind"
+	DisallowKind                = "disallowkind"
+	ListAllowedKinds            = "listallowedkinds"
+	BlockIP                     = "blockip"
+	UnblockIP                   = "unblockip"
+	ListBlockedIPs              = "listblockedips"
+	// Explain is not part of NIP-86, it returns how the relay would query the
+	// events for a filter.
+	Explain = "explain"
+)
+
+// Request is a management API call.
+type Request struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// Response is the result of a management API call. Error is set if the call
+// failed.
+type Response struct {
+	Result any    `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PubKeyReason is an entry in the lists of banned and allowed public keys.
+type PubKeyReason struct {
+	PubKey string `json:"pubkey"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// IDReason is an entry in the lists of banned events and events needing
+// moderation.
+type IDReason struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// IPReason is an entry in the list of blocked IP addresses.
+type IPReason struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// String returns the parameter at index i as a string. Missing optional
+// parameters, such as reasons, are empty strings.
+func (r *Request) String(i int) (s string, err error) {
+	if i >= len(r.Params) {
+		return
+	}
+	if err = json.Unmarshal(r.Params[i], &s); err != nil {
+		err = fmt.Errorf("parameter %d of %s must be a string", i, r.Method)
+	}
+	return
+}
+
+// Int returns the parameter at index i as an integer, which may also be sent
+// as a string.
+func (r *Request) Int(i int) (n int, err error) {
+	if i >= len(r.Params) {
+		return 0, fmt.Errorf("%s requires %d parameters", r.Method, i+1)
+	}
+	if err = json.Unmarshal(r.Params[i], &n); err == nil {
+		return
+	}
+	var s string
+	if err = json.Unmarshal(r.Params[i], &s); err == nil {
+		if n, err = strconv.Atoi(s); err == nil {
+			return
+		}
+	}
+	return 0, fmt.Errorf("parameter %d of %s must be an integer", i, r.Method)
+}
+
+// Filter returns the parameter at index i as a filter.
+func (r *Request) Filter(i int) (f *filter.T, err error) {
+	if i >= len(r.Params) {
+		return nil, fmt.Errorf("%s requires %d parameters", r.Method, i+1)
+	}
+	f = &filter.T{}
+	if err = json.Unmarshal(r.Params[i], f); err != nil {
+		return nil, fmt.Errorf("parameter %d of %s must be a filter: %s", i,
+			r.Method, err)
+	}
+	return
+}
@@ -0,0 +1,201 @@
+// Package nip98 implements NIP-98 HTTP authentication, where a request carries
+// a signed event in its Authorization header that commits to the URL, method
+// and body of the request.
+package nip98
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/hex"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"github.com/minio/sha256-simd"
+)
+
+// Scheme is the prefix of the Authorization header value.
+const Scheme = "Nostr"
+
+// MaxSkew is how far the created_at of an auth event can be from the time
+// the request is received.
+const MaxSkew = time.Minute
+
+var (
+	ErrMissingHeader    = errors.New("nip98: missing authorization header")
+	ErrInvalidHeader    = errors.New("nip98: invalid authorization header")
+	ErrWrongKind        = errors.New("nip98: auth event has the wrong kind")
+	ErrExpired          = errors.New("nip98: auth event is too old or too new")
+	ErrURLMismatch      = errors.New("nip98: auth event is for another url")
+	ErrMethodMismatch   = errors.New("nip98: auth event is for another method")
+	ErrPayloadMismatch  = errors.New("nip98: auth event payload hash does not match")
+	ErrInvalidSignature = errors.New("nip98: auth event signature is invalid")
+	ErrReplayed         = errors.New("nip98: auth event has already been used")
+)
+
+// PayloadHash returns the hex encoded sha256 hash of a request body.
+func PayloadHash(body []byte) string {
+	h := sha256.Sum256(body)
+	return hex.Enc(h[:])
+}
+
+// CreateUnsignedAuthEvent creates an event for authenticating a request to
+// url with the given method. If the request has a body, its hash is included.
+func CreateUnsignedAuthEvent(pubkey, url, method string,
+	body []byte) *event.T {
+
+	t := tags.T{{"u", url}, {"method", method}}
+	if len(body) > 0 {
+		t = append(t, []string{"payload", PayloadHash(body)})
+	}
+	return &event.T{
+		PubKey:    pubkey,
+		CreatedAt: timestamp.Now(),
+		Kind:      kind.HTTPAuth,
+		Tags:      t,
+	}
+}
+
+// Header returns the value of the Authorization header for a signed auth
+// event.
+func Header(ev *event.T) (h string, err error) {
+	var b []byte
+	if b, err = json.Marshal(ev); err != nil {
+		return
+	}
+	return Scheme + " " + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// RequestURL returns the absolute URL a request was sent to, which is what
+// the auth event must commit to, from the URL of the service. The service URL
+// must come from the configuration or a trusted proxy, not from the headers of
+// the request, or an auth event signed for another service could be used.
+func RequestURL(serviceURL string, r *http.Request) string {
+	return strings.TrimSuffix(serviceURL, "/") + r.URL.RequestURI()
+}
+
+// ValidateRequest checks the auth event in the Authorization header of a
+// request to url with the given body, and returns the public key that signed
+// it.
+func ValidateRequest(r *http.Request, url string, body []byte) (pubkey string,
+	err error) {
+
+	var ev *event.T
+	if ev, err = validateRequest(r, url, body); err != nil {
+		return
+	}
+	return ev.PubKey, nil
+}
+
+func validateRequest(r *http.Request, url string, body []byte) (ev *event.T,
+	err error) {
+
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return nil, ErrMissingHeader
+	}
+	scheme, b64, ok := strings.Cut(h, " ")
+	if !ok || !strings.EqualFold(scheme, Scheme) {
+		return nil, ErrInvalidHeader
+	}
+	var b []byte
+	if b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(b64)); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	ev = &event.T{}
+	if err = json.Unmarshal(b, ev); err != nil {
+		return nil, ErrInvalidHeader
+	}
+	if err = ValidateEvent(ev, url, r.Method, body); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// ReplayCache remembers the auth events that have been accepted until they
+// are too old to be accepted again, so that each authenticates only one
+// request. The zero value is ready to use.
+type ReplayCache struct {
+	seen map[string]time.Time
+	sync.Mutex
+}
+
+// ValidateRequest checks the auth event of a request like ValidateRequest,
+// and also returns ErrReplayed if the event has already authenticated a
+// request.
+func (rc *ReplayCache) ValidateRequest(r *http.Request, url string,
+	body []byte) (pubkey string, err error) {
+
+	var ev *event.T
+	if ev, err = validateRequest(r, url, body); err != nil {
+		return
+	}
+	if err = rc.use(ev); err != nil {
+		return
+	}
+	return ev.PubKey, nil
+}
+
+// use records that a request was authenticated with an auth event, and
+// returns ErrReplayed if one already was. The id is computed rather than
+// taken from the event, as the signature is only checked against that.
+func (rc *ReplayCache) use(ev *event.T) (err error) {
+	now := time.Now()
+	rc.Lock()
+	defer rc.Unlock()
+	if rc.seen == nil {
+		rc.seen = make(map[string]time.Time)
+	}
+	for id, expiry := range rc.seen {
+		if now.After(expiry) {
+			delete(rc.seen, id)
+		}
+	}
+	id := ev.GetID().String()
+	if _, ok := rc.seen[id]; ok {
+		return ErrReplayed
+	}
+	rc.seen[id] = ev.CreatedAt.Time().Add(MaxSkew)
+	return
+}
+
+// ValidateEvent checks that an auth event is for a request to url with the
+// given method and body.
+func ValidateEvent(ev *event.T, url, method string, body []byte) (err error) {
+	if ev.Kind != kind.HTTPAuth {
+		return ErrWrongKind
+	}
+	now := time.Now()
+	if created := ev.CreatedAt.Time(); created.Before(now.Add(-MaxSkew)) ||
+		created.After(now.Add(MaxSkew)) {
+		return ErrExpired
+	}
+	if u := ev.Tags.GetFirst([]string{"u", ""}); u == nil ||
+		strings.TrimSuffix(u.Value(), "/") != strings.TrimSuffix(url, "/") {
+		return ErrURLMismatch
+	}
+	if m := ev.Tags.GetFirst([]string{"method", ""}); m == nil ||
+		!strings.EqualFold(m.Value(), method) {
+		return ErrMethodMismatch
+	}
+	if len(body) > 0 {
+		p := ev.Tags.GetFirst([]string{"payload", ""})
+		if p == nil || p.Value() != PayloadHash(body) {
+			return ErrPayloadMismatch
+		}
+	}
+	var ok bool
+	if ok, err = ev.CheckSignature(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	} else if !ok {
+		return ErrInvalidSignature
+	}
+	return
+}
@@ -0,0 +1,112 @@
+package nip98
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+func TestValidateRequest(t *testing.T) {
+	sec := keys.GeneratePrivateKey()
+	pub, err := keys.GetPublicKey(sec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const url = "http://relay.example.com/"
+	body := []byte(`{"method":"supportedmethods","params":[]}`)
+	// the request is always the same, the auth event is for the url, method
+	// and body of each case
+	for _, tc := range []struct {
+		name   string
+		url    string
+		method string
+		body   []byte
+		age    int64
+		want   error
+	}{
+		{"valid", url, "POST", body, 0, nil},
+		{"other url", "http://other.example.com/", "POST", body, 0,
+			ErrURLMismatch},
+		{"other method", url, "GET", body, 0, ErrMethodMismatch},
+		{"other body", url, "POST", []byte("{}"), 0, ErrPayloadMismatch},
+		{"expired", url, "POST", body, 3600, ErrExpired},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ev := CreateUnsignedAuthEvent(pub, tc.url, tc.method, tc.body)
+			ev.CreatedAt -= timestamp.T(tc.age)
+			if err := ev.Sign(sec); err != nil {
+				t.Fatal(err)
+			}
+			h, err := Header(ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("POST", url, bytes.NewReader(body))
+			r.Header.Set("Authorization", h)
+			got, err := ValidateRequest(r, RequestURL(url, r), body)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got error %v, want %v", err, tc.want)
+			}
+			if err == nil && got != pub {
+				t.Fatalf("got pubkey %s, want %s", got, pub)
+			}
+		})
+	}
+}
+
+func TestValidateRequestMissingHeader(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://relay.example.com/", nil)
+	if _, err := ValidateRequest(r, RequestURL("http://relay.example.com", r),
+		nil); !errors.Is(err, ErrMissingHeader) {
+		t.Fatalf("got error %v, want %v", err, ErrMissingHeader)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	sec := keys.GeneratePrivateKey()
+	pub, err := keys.GetPublicKey(sec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const url = "http://relay.example.com/"
+	ev := CreateUnsignedAuthEvent(pub, "http://other.example.com/", "POST",
+		nil)
+	if err = ev.Sign(sec); err != nil {
+		t.Fatal(err)
+	}
+	h, err := Header(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", url, nil)
+	r.Header.Set("Authorization", h)
+	// the url comes from the service, not the forwarded headers
+	r.Header.Set("X-Forwarded-Host", "other.example.com")
+	var rc ReplayCache
+	if _, err = rc.ValidateRequest(r, RequestURL(url, r),
+		nil); !errors.Is(err, ErrURLMismatch) {
+		t.Fatalf("got error %v, want %v", err, ErrURLMismatch)
+	}
+	const other = "http://other.example.com"
+	if _, err = rc.ValidateRequest(r, RequestURL(other, r), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rc.ValidateRequest(r, RequestURL(other, r),
+		nil); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("got error %v, want %v", err, ErrReplayed)
+	}
+	// changing the id field doesn't make it a different event
+	ev.ID = "0000000000000000000000000000000000000000000000000000000000000000"
+	if h, err = Header(ev); err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", h)
+	if _, err = rc.ValidateRequest(r, RequestURL(other, r),
+		nil); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("got error %v, want %v", err, ErrReplayed)
+	}
+}
@@ -0,0 +1,273 @@
+// Package nostrbinary is the compact binary encoding that events are stored
+// in.
+//
+// An encoded event starts with the version of the format, followed by a byte
+// of flags and the fields of the event:
+//
+//	version     1 byte, currently 0
+//	flags       1 byte, which of the id, pubkey and sig are raw bytes
+//	id          32 bytes, or a string if it isn't 64 lowercase hex characters
+//	pubkey      32 bytes, or a string if it isn't 64 lowercase hex characters
+//	sig         64 bytes, or a string if it isn't 128 lowercase hex characters
+//	created_at  zigzag varint
+//	kind        uvarint
+//	content     string
+//	tags        uvarint count, then for each tag a uvarint count of its items
+//	            followed by the items
+//
+// A string is a uvarint length followed by the bytes. A tag item is a uvarint
+// of its length shifted left by one, with the lowest bit set if the item is
+// lowercase hex and stored decoded, which halves the size of the event ids
+// and pubkeys that most tags refer to.
+//
+// Events stored before this format was used were encoded with gob, which
+// starts with the length of the first gob message, the definition of the event
+// type. For events that is always 0x55, so they can still be decoded until the
+// database migration rewrites them, and later versions of the format must not
+// collide with it. Data that starts with any other byte is not decoded.
+package nostrbinary
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tag"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+	"mleku.online/git/slog"
+)
+
+var log = slog.New(os.Stderr, "nostrbinary")
+
+// Version is the version of the format written by Marshal.
+const Version = 0
+
+// VersionGob is the first byte of events encoded with gob, which are decoded
+// as the version before the binary format.
+const VersionGob = 0x55
+
+// flags of the fields that are stored as raw bytes
+const (
+	rawID byte = 1 << iota
+	rawPubKey
+	rawSig
+)
+
+// ErrTruncated is returned when decoding an event that ends before its
+// fields do.
+var ErrTruncated = errors.New("binary event is truncated")
+
+// ErrTrailingData is returned when decoding an event that is followed by more
+// data.
+var ErrTrailingData = errors.New("binary event has trailing data")
+
+// ErrUnknownVersion is returned when decoding data that doesn't start with a
+// known version of the format.
+var ErrUnknownVersion = errors.New("unknown binary event version")
+
+// Marshal encodes an event in the binary format.
+func Marshal(evt *event.T) (b []byte, err error) {
+	size := 2 + 32 + 32 + 64 + 2*binary.MaxVarintLen64 + len(evt.Content) + 8
+	for _, t := range evt.Tags {
+		size += 2
+		for _, item := range t {
+			size += 2 + len(item)
+		}
+	}
+	b = make([]byte, 2, size)
+	b[0] = Version
+	var raw bool
+	if b, raw = appendHex(b, evt.ID.String(), 32); raw {
+		b[1] |= rawID
+	}
+	if b, raw = appendHex(b, evt.PubKey, 32); raw {
+		b[1] |= rawPubKey
+	}
+	if b, raw = appendHex(b, evt.Sig, 64); raw {
+		b[1] |= rawSig
+	}
+	b = binary.AppendVarint(b, int64(evt.CreatedAt))
+	b = binary.AppendUvarint(b, uint64(evt.Kind))
+	b = appendString(b, evt.Content)
+	b = binary.AppendUvarint(b, uint64(len(evt.Tags)))
+	for _, t := range evt.Tags {
+		b = binary.AppendUvarint(b, uint64(len(t)))
+		for _, item := range t {
+			if isHex(item) {
+				b = binary.AppendUvarint(b, uint64(len(item)/2)<<1|1)
+				b = appendDecoded(b, item)
+			} else {
+				b = binary.AppendUvarint(b, uint64(len(item))<<1)
+				b = append(b, item...)
+			}
+		}
+	}
+	return
+}
+
+// appendHex appends a hex string as raw bytes and returns true if it is the
+// expected number of bytes, or otherwise appends it as a string.
+func appendHex(b []byte, s string, size int) ([]byte, bool) {
+	if len(s) == size*2 && isHex(s) {
+		return appendDecoded(b, s), true
+	}
+	return appendString(b, s), false
+}
+
+// appendDecoded appends the bytes of a string that isHex.
+func appendDecoded(b []byte, s string) []byte {
+	n := len(b)
+	b = append(b, make([]byte, len(s)/2)...)
+	_, _ = hex.Decode(b[n:], []byte(s))
+	return b
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// isHex returns whether a string is a non-empty even number of lowercase hex
+// characters, which decoded and encoded again is the same string.
+func isHex(s string) bool {
+	if len(s) == 0 || len(s)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Unmarshal decodes an event from the binary format, or from gob if it was
+// stored before the binary format was used.
+func Unmarshal(data []byte) (evt *event.T, err error) {
+	if len(data) == 0 {
+		return nil, ErrTruncated
+	}
+	switch data[0] {
+	case Version:
+	case VersionGob:
+		return unmarshalGob(data)
+	default:
+		return nil, fmt.Errorf("%w %#x", ErrUnknownVersion, data[0])
+	}
+	r := &reader{data: data[1:]}
+	flags := r.byte()
+	evt = &event.T{}
+	evt.ID = eventid.T(r.hex(32, flags&rawID != 0))
+	evt.PubKey = r.hex(32, flags&rawPubKey != 0)
+	evt.Sig = r.hex(64, flags&rawSig != 0)
+	evt.CreatedAt = timestamp.T(r.varint())
+	evt.Kind = kind.T(r.uvarint())
+	evt.Content = r.string()
+	if n := r.count(); n > 0 {
+		evt.Tags = make(tags.T, n)
+		for i := range evt.Tags {
+			t := make(tag.T, r.count())
+			for j := range t {
+				t[j] = r.item()
+			}
+			evt.Tags[i] = t
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) > 0 {
+		return nil, ErrTrailingData
+	}
+	return
+}
+
+// reader decodes the fields of a binary event, returning zero values after an
+// error.
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) next(n uint64) (b []byte) {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = ErrTruncated
+		return nil
+	}
+	b, r.data = r.data[:n], r.data[n:]
+	return
+}
+
+func (r *reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = ErrTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = ErrTruncated
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads a number of tags or tag items. Each of them is at least a byte,
+// so a count of more than the remaining bytes is corrupt.
+func (r *reader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		if r.err == nil {
+			r.err = ErrTruncated
+		}
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) string() string { return string(r.next(r.uvarint())) }
+
+// hex reads a field that is raw bytes of a size, or a string if raw isn't
+// set.
+func (r *reader) hex(size uint64, raw bool) string {
+	if !raw {
+		return r.string()
+	}
+	return hex.EncodeToString(r.next(size))
+}
+
+func (r *reader) item() string {
+	h := r.uvarint()
+	if h&1 == 1 {
+		return hex.EncodeToString(r.next(h >> 1))
+	}
+	return string(r.next(h >> 1))
+}
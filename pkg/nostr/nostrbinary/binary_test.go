@@ -0,0 +1,242 @@
+package nostrbinary
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventid"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/tags"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/timestamp"
+)
+
+var testEvents = []*event.T{
+	{
+		ID:        "4296bfa40427b9cb3e078da9c12de7af57e238caf77ace9b517ecd99ad7f38d8",
+		PubKey:    "046284c5d3cc859f58b1ff58d2bdbf22eb6f41a633e97f503a569cc1fe886322",
+		CreatedAt: 1688555517,
+		Kind:      kind.TextNote,
+		Content:   "ブンブンピーブピー",
+		Sig:       "40426c3677dd61132558e58ec2e0d306a7581a73e7cbcd8fcf447b0da1580b782c12461d4105939faa4caf95864354dba25fe5b10aa794ccc7f68adb2d12bb01",
+	},
+	{
+		ID:        "abd1d0c9300b7745bfada6147ceb5b4d9d09ab23925e55c53b835347fdd0cb17",
+		PubKey:    "634bd19e5c87db216555c814bf88e66ace175805291a6be90b15ac3b2247da9b",
+		CreatedAt: 1688554980,
+		Kind:      kind.TextNote,
+		Tags: tags.T{
+			{"e", "4296bfa40427b9cb3e078da9c12de7af57e238caf77ace9b517ecd99ad7f38d8", "wss://relay.example.com", "reply"},
+			{"p", "046284c5d3cc859f58b1ff58d2bdbf22eb6f41a633e97f503a569cc1fe886322"},
+			{"a", "30023:046284c5d3cc859f58b1ff58d2bdbf22eb6f41a633e97f503a569cc1fe886322:article"},
+			{"t", "nostr"},
+			{"expiration", "1700000000"},
+			{"empty", ""},
+			{},
+		},
+		Content: "Threadsには旅立たないかなー。",
+		Sig:     "4f0243d5380a1757d78a772bb27386d2c2b54926b514f4568e717ed9cfe6d87f8d299a9b34d6bbd90241deabde17a3bf514f3195b4f4c4183429387bdc6f179d",
+	},
+	// fields that aren't valid hex are kept as they are
+	{
+		ID:        "ABD1D0C9300B7745BFADA6147CEB5B4D9D09AB23925E55C53B835347FDD0CB17",
+		PubKey:    "not a pubkey",
+		CreatedAt: -1,
+		Kind:      kind.T(65535),
+		Tags:      tags.T{{"p", "ABCDEF"}, {"x", "abc"}},
+	},
+	{},
+}
+
+// equal returns whether two events have the same fields, with no tags and an
+// empty list of tags being the same.
+func equal(a, b *event.T) bool {
+	if a.ID != b.ID || a.PubKey != b.PubKey || a.Sig != b.Sig ||
+		a.CreatedAt != b.CreatedAt || a.Kind != b.Kind ||
+		a.Content != b.Content || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	for i := range a.Tags {
+		if len(a.Tags[i]) != len(b.Tags[i]) {
+			return false
+		}
+		for j := range a.Tags[i] {
+			if a.Tags[i][j] != b.Tags[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func roundTrip(t *testing.T, evt *event.T) {
+	b, err := Marshal(evt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsLegacy(b) {
+		t.Fatal("encoded event is taken for gob")
+	}
+	var dec *event.T
+	if dec, err = Unmarshal(b); err != nil {
+		t.Fatalf("%s decoding %x", err, b)
+	}
+	if !equal(evt, dec) {
+		t.Fatalf("decoded\n%v\nwant\n%v", dec, evt)
+	}
+	// every shorter encoding is truncated
+	for i := 0; i < len(b); i++ {
+		if _, err = Unmarshal(b[:i]); err == nil {
+			t.Fatalf("decoded an event truncated to %d of %d bytes", i,
+				len(b))
+		}
+	}
+	if _, err = Unmarshal(append(b, 0)); !errors.Is(err, ErrTrailingData) {
+		t.Fatalf("got error %v decoding an event with trailing data", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, evt := range testEvents {
+		roundTrip(t, evt)
+	}
+}
+
+func TestSize(t *testing.T) {
+	evt := testEvents[1]
+	b, _ := Marshal(evt)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(evt); err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= buf.Len() {
+		t.Fatalf("encoded event is %d bytes, gob is %d", len(b), buf.Len())
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	for _, evt := range testEvents {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(evt); err != nil {
+			t.Fatal(err)
+		}
+		if !IsLegacy(buf.Bytes()) {
+			t.Fatal("gob encoded event is not taken for gob")
+		}
+		dec, err := Unmarshal(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equal(evt, dec) {
+			t.Fatalf("decoded\n%v\nwant\n%v", dec, evt)
+		}
+		b := append(buf.Bytes(), 0)
+		if _, err = Unmarshal(b); !errors.Is(err, ErrTrailingData) {
+			t.Fatalf("got error %v decoding gob with trailing data", err)
+		}
+	}
+}
+
+func TestUnknownVersion(t *testing.T) {
+	b, _ := Marshal(testEvents[0])
+	for _, v := range []byte{1, 0x54, 0x56, 0xff} {
+		b[0] = v
+		if IsLegacy(b) {
+			t.Errorf("version %#x is taken for gob", v)
+		}
+		if _, err := Unmarshal(b); !errors.Is(err, ErrUnknownVersion) {
+			t.Errorf("got error %v decoding version %#x", err, v)
+		}
+	}
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, evt := range testEvents {
+		var t1, t2 string
+		if len(evt.Tags) > 1 {
+			t1, t2 = evt.Tags[0][1], evt.Tags[1][0]
+		}
+		f.Add(evt.ID.String(), evt.PubKey, evt.Sig, int64(evt.CreatedAt),
+			uint16(evt.Kind), evt.Content, t1, t2)
+	}
+	f.Fuzz(func(t *testing.T, id, pubkey, sig string, createdAt int64,
+		k uint16, content, t1, t2 string) {
+
+		roundTrip(t, &event.T{
+			ID:        eventid.T(id),
+			PubKey:    pubkey,
+			Sig:       sig,
+			CreatedAt: timestamp.T(createdAt),
+			Kind:      kind.T(k),
+			Content:   content,
+			Tags:      tags.T{{t1, t2}, {t2}, {"e", t1, t2}},
+		})
+	})
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, evt := range testEvents {
+		b, _ := Marshal(evt)
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if IsLegacy(b) {
+			return
+		}
+		evt, err := Unmarshal(b)
+		if err != nil {
+			return
+		}
+		// whatever decodes must encode to something that decodes the same
+		roundTrip(t, evt)
+	})
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	b.Run("gob", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, evt := range testEvents {
+				var buf bytes.Buffer
+				_ = gob.NewEncoder(&buf).Encode(evt)
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, evt := range testEvents {
+				_, _ = Marshal(evt)
+			}
+		}
+	})
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	var gobs, bins [][]byte
+	for _, evt := range testEvents {
+		var buf bytes.Buffer
+		_ = gob.NewEncoder(&buf).Encode(evt)
+		gobs = append(gobs, buf.Bytes())
+		bin, _ := Marshal(evt)
+		bins = append(bins, bin)
+	}
+	b.Run("gob", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, g := range gobs {
+				if _, err := unmarshalGob(g); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, bin := range bins {
+				if _, err := Unmarshal(bin); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
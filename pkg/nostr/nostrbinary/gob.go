@@ -0,0 +1,27 @@
+package nostrbinary
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+)
+
+// IsLegacy returns whether an encoded event is in the gob encoding used
+// before the binary format, which the database migration rewrites.
+func IsLegacy(data []byte) bool {
+	return len(data) > 0 && data[0] == VersionGob
+}
+
+func unmarshalGob(data []byte) (evt *event.T, err error) {
+	buf := bytes.NewBuffer(data)
+	dec := gob.NewDecoder(buf)
+	evt = &event.T{}
+	if err = dec.Decode(evt); log.Fail(err) {
+		return nil, err
+	}
+	if buf.Len() > 0 {
+		return nil, ErrTrailingData
+	}
+	return
+}
@@ -1,11 +1,11 @@
 package pool
 
 import (
+	"errors"
 	"fmt"
 	"hash/maphash"
 	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
@@ -39,8 +39,14 @@ func (h WithAuthHandler) Apply(pool *Simple) {
 
 var _ Option = (WithAuthHandler)(nil)
 
-func PointerHasher(_ maphash.Seed, k string) uint64 {
-	return uint64(uintptr(unsafe.Pointer(&k)))
+// PointerHasher hashes a relay url for a map created with
+// xsync.NewTypedMapOf.
+//
+// Deprecated: it used to hash the address of its argument, which is a new
+// copy on every call, so relays were not found again by their url. Use
+// xsync.NewMapOf, which hashes string keys by their contents, as Simple does.
+func PointerHasher(seed maphash.Seed, k string) uint64 {
+	return maphash.String(seed, k)
 }
 
 var namedMutexPool = make([]sync.Mutex, MAX_LOCKS)
@@ -67,7 +73,7 @@ func NewSimplePool(c context.T, opts ...Option) (p *Simple) {
 	c, cancel := context.Cancel(c)
 
 	p = &Simple{
-		Relays:  xsync.NewTypedMapOf[string, *relay.T](PointerHasher),
+		Relays:  xsync.NewMapOf[*relay.T](),
 		Context: c,
 		cancel:  cancel,
 	}
@@ -116,14 +122,23 @@ func (p *Simple) SubManyNonUnique(c context.T, urls []string, filters filters.T,
 func (p *Simple) subMany(c context.T, urls []string, filters filters.T, unique bool) chan IncomingEvent {
 	events := make(chan IncomingEvent)
 	seenAlready := xsync.NewMapOf[bool]()
+	wg := sync.WaitGroup{}
+	wg.Add(len(urls))
+
+	go func() {
+		// this will happen when all subscriptions are closed, or fail to
+		// connect
+		wg.Wait()
+		close(events)
+	}()
 
-	pending := xsync.NewCounter()
-	initial := len(urls)
-	pending.Add(int64(initial))
 	for _, url := range urls {
 		go func(nm string) {
+			defer wg.Done()
+
 			rl, err := p.EnsureRelay(nm)
 			if err != nil {
+				log.D.F("error connecting to %s: %s", nm, err)
 				return
 			}
 
@@ -132,24 +147,29 @@ func (p *Simple) subMany(c context.T, urls []string, filters filters.T, unique b
 				return
 			}
 
-			for evt := range sub.Events {
-				stop := false
-				if unique {
-					_, stop = seenAlready.LoadOrStore(evt.ID.String(), true)
-				}
-				if !stop {
-					select {
-					case events <- IncomingEvent{Event: evt, Relay: rl}:
-					case <-c.Done():
+			for {
+				select {
+				case reason := <-sub.ClosedReason:
+					log.D.F("{%s} subscription closed: %s", nm, reason)
+					sub.Unsub()
+					return
+				case evt, more := <-sub.Events:
+					if !more {
 						return
 					}
+					stop := false
+					if unique {
+						_, stop = seenAlready.LoadOrStore(evt.ID.String(), true)
+					}
+					if !stop {
+						select {
+						case events <- IncomingEvent{Event: evt, Relay: rl}:
+						case <-c.Done():
+							return
+						}
+					}
 				}
 			}
-
-			pending.Dec()
-			if pending.Value() == 0 {
-				close(events)
-			}
 		}(normalize.URL(url))
 	}
 
@@ -205,6 +225,9 @@ func (p *Simple) subManyEose(c context.T, urls []string, f filters.T, unique boo
 					return
 				case <-sub.EndOfStoredEvents:
 					return
+				case reason := <-sub.ClosedReason:
+					log.D.F("{%s} subscription closed: %s", nm, reason)
+					return
 				case evt, more := <-sub.Events:
 					if !more {
 						return
@@ -229,6 +252,52 @@ func (p *Simple) subManyEose(c context.T, urls []string, f filters.T, unique boo
 	return events
 }
 
+// PaginateMany walks the history of the events that match the filter on each
+// of the relays, one page at a time, and returns each event once. The channel
+// is closed when all the relays have been walked or the context is canceled.
+func (p *Simple) PaginateMany(c context.T, urls []string,
+	f *filter.T) chan IncomingEvent {
+
+	events := make(chan IncomingEvent)
+	seenAlready := xsync.NewMapOf[bool]()
+	wg := sync.WaitGroup{}
+	wg.Add(len(urls))
+
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	for _, url := range urls {
+		go func(nm string) {
+			defer wg.Done()
+
+			rl, err := p.EnsureRelay(nm)
+			if err != nil {
+				log.D.F("error connecting to %s: %s", nm, err)
+				return
+			}
+
+			err = rl.Paginate(c, f, func(evt *event.T) error {
+				if _, seen := seenAlready.LoadOrStore(evt.ID.String(), true); seen {
+					return nil
+				}
+				select {
+				case events <- IncomingEvent{Event: evt, Relay: rl}:
+					return nil
+				case <-c.Done():
+					return c.Err()
+				}
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.D.F("{%s} paginating stopped: %s", nm, err)
+			}
+		}(normalize.URL(url))
+	}
+
+	return events
+}
+
 // QuerySingle returns the first event returned by the first relay, cancels everything else.
 func (p *Simple) QuerySingle(c context.T, urls []string, f *filter.T, unique bool) *IncomingEvent {
 	c, cancel := context.Cancel(c)
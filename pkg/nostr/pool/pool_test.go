@@ -0,0 +1,78 @@
+package pool
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
+	"golang.org/x/net/websocket"
+)
+
+func TestPointerHasher(t *testing.T) {
+	seed := maphash.MakeSeed()
+	url := "wss://relay.example.com"
+	// a copy of the url in other memory has the same hash
+	if PointerHasher(seed, url) != PointerHasher(seed, strings.Clone(url)) {
+		t.Fatal("equal urls have different hashes")
+	}
+}
+
+// closingRelay serves a relay that answers a REQ by closing the
+// subscription.
+func closingRelay() *httptest.Server {
+	return httptest.NewServer(&websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			for {
+				var raw []json.RawMessage
+				if err := websocket.JSON.Receive(conn, &raw); err != nil {
+					return
+				}
+				var typ, id string
+				json.Unmarshal(raw[0], &typ)
+				if typ != "REQ" {
+					continue
+				}
+				json.Unmarshal(raw[1], &id)
+				websocket.JSON.Send(conn, []any{"CLOSED", id, "error: test"})
+			}
+		},
+	})
+}
+
+func TestSubManyClosed(t *testing.T) {
+	srv := closingRelay()
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	// nothing listens on port 1, so connecting to it fails
+	urls := []string{url, "ws://127.0.0.1:1"}
+	for name, sub := range map[string]func(*Simple) chan IncomingEvent{
+		"SubMany": func(p *Simple) chan IncomingEvent {
+			return p.SubMany(context.Bg(), urls, filters.T{{}}, true)
+		},
+		"SubManyEose": func(p *Simple) chan IncomingEvent {
+			return p.SubManyEose(context.Bg(), urls, filters.T{{}}, true)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := NewSimplePool(context.Bg())
+			// the channel is closed once the relay closed the subscription
+			// and the other relay failed to connect
+			events := sub(p)
+			select {
+			case ie, more := <-events:
+				if more {
+					t.Fatalf("got event %s", ie.Event.ID)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("channel was not closed")
+			}
+		})
+	}
+}
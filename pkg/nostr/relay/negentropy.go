@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Hubmakerlabs/replicatr/pkg/context"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/negenvelope"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/interfaces/enveloper"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/negentropy"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/subscriptionid"
+)
+
+// NegentropyFrameSizeLimit is the size limit of the negentropy messages sent
+// to relays, which keeps the hex encoded messages well within the message size
+// limits of common relays.
+const NegentropyFrameSizeLimit = 60000
+
+// Reconcile runs a NIP-77 negentropy reconciliation between the events on the
+// relay that match a filter and a local set of items, and returns the ids of
+// the events only the local set has and the ids of the events only the relay
+// has.
+//
+// If the context has no deadline, the reconciliation is given two minutes.
+func (r *T) Reconcile(c context.T, f *filter.T,
+	items []negentropy.Item) (have, need []string, err error) {
+
+	if _, ok := c.Deadline(); !ok {
+		var cancel context.F
+		c, cancel = context.Timeout(c, 2*time.Minute)
+		defer cancel()
+	}
+	v := negentropy.NewVector()
+	for _, it := range items {
+		if err = v.Insert(it); err != nil {
+			return
+		}
+	}
+	v.Seal()
+	var n *negentropy.T
+	if n, err = negentropy.New(v, NegentropyFrameSizeLimit); err != nil {
+		return
+	}
+	id := subscriptionid.T("neg:" +
+		strconv.Itoa(int(subscriptionIDCounter.Add(1))))
+	replies := make(chan enveloper.I, 1)
+	r.negentropySessions.Store(id.String(), replies)
+	defer r.negentropySessions.Delete(id.String())
+	var env enveloper.I = &negenvelope.Open{ID: id, Filter: f,
+		Message: n.Initiate()}
+	for {
+		log.T.F("{%s} sending %s", r.URL(), env)
+		if err = <-r.Write(env.Bytes()); err != nil {
+			return
+		}
+		var reply enveloper.I
+		select {
+		case reply = <-replies:
+		case <-c.Done():
+			// tell the relay to drop the reconciliation
+			<-r.Write((&negenvelope.Close{ID: id}).Bytes())
+			return nil, nil, c.Err()
+		case <-r.connectionContext.Done():
+			return nil, nil, errors.New("connection closed")
+		}
+		var msg []byte
+		switch rep := reply.(type) {
+		case *negenvelope.Err:
+			return nil, nil, fmt.Errorf("reconciliation failed: %s",
+				rep.Reason)
+		case *negenvelope.Msg:
+			msg = rep.Message
+		}
+		var h, nd []string
+		if msg, h, nd, err = n.Reconcile(msg); err != nil {
+			<-r.Write((&negenvelope.Close{ID: id}).Bytes())
+			return
+		}
+		have = append(have, h...)
+		need = append(need, nd...)
+		if msg == nil {
+			<-r.Write((&negenvelope.Close{ID: id}).Bytes())
+			return
+		}
+		env = &negenvelope.Msg{ID: id, Message: msg}
+	}
+}
+
+// dispatchNegentropy passes a reply to the reconciliation it is for.
+func (r *T) dispatchNegentropy(id string, env enveloper.I) {
+	replies, ok := r.negentropySessions.Load(id)
+	if !ok {
+		log.D.F("{%s} no reconciliation with id '%s'", r.URL(), id)
+		return
+	}
+	select {
+	case replies <- env:
+	default:
+		log.D.F("{%s} unexpected negentropy message for '%s'", r.URL(), id)
+	}
+}
@@ -16,9 +16,11 @@ import (
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/countenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/eoseenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/eventenvelope"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/negenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/noticeenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/envelopes/okenvelope"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/eventstore"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/interfaces/enveloper"
@@ -57,6 +59,7 @@ type T struct {
 	challenge                     string      // NIP-42 challenge, we only keep the last
 	notices                       chan string // NIP-01 NOTICEs
 	okCallbacks                   *xsync.MapOf[string, func(bool, string)]
+	negentropySessions            *xsync.MapOf[string, chan enveloper.I]
 	writeQueue                    chan writeRequest
 	subscriptionChannelCloseQueue chan *subscription.T
 
@@ -84,6 +87,7 @@ func NewRelay(c context.T, url string, opts ...Option) *T {
 		connectionContextCancel:       cancel,
 		Subscriptions:                 xsync.NewMapOf[*subscription.T](),
 		okCallbacks:                   xsync.NewMapOf[func(bool, string)](),
+		negentropySessions:            xsync.NewMapOf[chan enveloper.I](),
 		writeQueue:                    make(chan writeRequest),
 		subscriptionChannelCloseQueue: make(chan *subscription.T),
 	}
@@ -282,7 +286,7 @@ func (r *T) MessageReadLoop(conn *connection.C) {
 				s.DispatchEvent(env.Event)
 			}
 		case *eoseenvelope.T:
-			if s, ok := r.Subscriptions.Load(env.String()); ok {
+			if s, ok := r.Subscriptions.Load(env.T.String()); ok {
 				s.DispatchEose()
 			}
 		case *closedenvelope.T:
@@ -295,6 +299,10 @@ func (r *T) MessageReadLoop(conn *connection.C) {
 
 				s.CountResult <- env.Count
 			}
+		case *negenvelope.Msg:
+			r.dispatchNegentropy(env.ID.String(), env)
+		case *negenvelope.Err:
+			r.dispatchNegentropy(env.ID.String(), env)
 		case *okenvelope.T:
 			if okCallback, exist := r.okCallbacks.Load(env.ID.String()); exist {
 				okCallback(env.OK, env.Reason)
@@ -486,6 +494,16 @@ func (r *T) QuerySync(c context.T, f *filter.T,
 	}
 }
 
+// Paginate calls fn with every event that matches the filter, newest first,
+// querying the relay for one page after another, so it gets more events than
+// the relay returns for one query. The limit of the filter is the size of the
+// pages. See eventstore.Paginate for the events that can be missed.
+func (r *T) Paginate(c context.T, f *filter.T,
+	fn func(ev *event.T) error) error {
+
+	return eventstore.Paginate(c, r, f, fn)
+}
+
 func (r *T) Count(c context.T, filters filters.T,
 	opts ...subscriptionoption.I) (int64, error) {
 
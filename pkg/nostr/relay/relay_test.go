@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -14,6 +15,7 @@ import (
 	"github.com/Hubmakerlabs/replicatr/pkg/context"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/event"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filter"
+	"github.com/Hubmakerlabs/replicatr/pkg/nostr/filters"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/keys"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/kind"
 	"github.com/Hubmakerlabs/replicatr/pkg/nostr/normalize"
@@ -179,6 +181,115 @@ func TestConnectWithOrigin(t *testing.T) {
 	}
 }
 
+func TestPaginate(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	// two events are created in each second
+	var evs []*event.T
+	for i := 0; i < 11; i++ {
+		ev := &event.T{
+			Kind:      kind.TextNote,
+			Content:   fmt.Sprint(i),
+			CreatedAt: timestamp.T(1672068534 + i/2),
+			PubKey:    pub,
+		}
+		if err := ev.Sign(priv); err != nil {
+			t.Fatalf("ev.Sign: %v", err)
+		}
+		evs = append(evs, ev)
+	}
+
+	// fake relay server that returns pages of 3 events, newest first, in no
+	// particular order for the ones created in the same second
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ string
+			json.Unmarshal(raw[0], &typ)
+			if typ != "REQ" {
+				continue
+			}
+			id, ff := parseSubscriptionMessage(t, raw)
+			var page []*event.T
+			for i := len(evs) - 1; i >= 0 && len(page) < 3; i-- {
+				if ff[0].Until == nil || evs[i].CreatedAt <= ff[0].Until.T() {
+					page = append(page, evs[i])
+				}
+			}
+			for _, ev := range page {
+				websocket.JSON.Send(conn, []any{"EVENT", id, ev})
+			}
+			websocket.JSON.Send(conn, []any{"EOSE", id})
+		}
+	})
+	defer ws.Close()
+
+	rl := MustConnect(ws.URL)
+	seen := make(map[string]bool)
+	var last *event.T
+	err := rl.Paginate(context.Bg(), &filter.T{}, func(ev *event.T) error {
+		if seen[ev.ID.String()] {
+			t.Errorf("event %s returned twice", ev.Content)
+		}
+		if last != nil && ev.CreatedAt > last.CreatedAt {
+			t.Errorf("event %s returned after an older one", ev.Content)
+		}
+		seen[ev.ID.String()], last = true, ev
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Paginate: %v", err)
+	}
+	if len(seen) != len(evs) {
+		t.Errorf("got %d events, want %d", len(seen), len(evs))
+	}
+}
+
+func TestSubscribeEOSE(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	ev := &event.T{Kind: kind.TextNote, Content: "stored",
+		CreatedAt: timestamp.Now(), PubKey: pub}
+	if err := ev.Sign(priv); err != nil {
+		t.Fatalf("ev.Sign: %v", err)
+	}
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			return
+		}
+		id, _ := parseSubscriptionMessage(t, raw)
+		websocket.JSON.Send(conn, []any{"EVENT", id, ev})
+		websocket.JSON.Send(conn, []any{"EOSE", id})
+		discardingHandler(conn)
+	})
+	defer ws.Close()
+
+	rl := MustConnect(ws.URL)
+	defer rl.Close()
+	sub, err := rl.Subscribe(context.Bg(), filters.T{{}})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer sub.Unsub()
+	// the EOSE is dispatched to the subscription by its id
+	timeout := time.After(5 * time.Second)
+	select {
+	case got := <-sub.Events:
+		if got.ID != ev.ID {
+			t.Errorf("got event %s, want %s", got.ID, ev.ID)
+		}
+	case <-timeout:
+		t.Fatal("event was not received")
+	}
+	select {
+	case <-sub.EndOfStoredEvents:
+	case <-timeout:
+		t.Fatal("EOSE was not dispatched to the subscription")
+	}
+}
+
 func discardingHandler(conn *websocket.Conn) {
 	io.ReadAll(conn) // discard all input
 }
@@ -26,7 +26,9 @@ type System struct {
 	RelayListRelays  []string
 	FollowListRelays []string
 	MetadataRelays   []string
-	Store            eventstore.Store
+	// Store keeps the events that are fetched, a memory.Store with MaxEvents
+	// set makes it a cache of the most recently used ones.
+	Store eventstore.Store
 }
 
 func (s *System) StoreRelay() eventstore.RelayInterface {